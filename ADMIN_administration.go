@@ -9,13 +9,9 @@ filename.go by Allen J. Mills
 
 import (
 	"fmt"
-	"github.com/Esseh/retrievable"
 	"github.com/julienschmidt/httprouter"
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/datastore"
 	"net/http"
 	"strings"
-	"time"
 )
 
 // Call: /admin
@@ -34,7 +30,7 @@ func ADMIN_AdministrationConsole(res http.ResponseWriter, req *http.Request, par
 	}
 	u, _ := GetUserFromSession(res, req)
 
-	ServeTemplateWithParams(res, "adminConsole.html", u.Name)
+	ServeTemplateWithParams(res, "adminConsole.html", u)
 }
 
 // Call: /admin/changeUsrPerm
@@ -58,22 +54,9 @@ func ADMIN_POST_ELEVATEUSER(res http.ResponseWriter, req *http.Request, params h
 
 	uEmail := strings.ToLower(req.FormValue("UEmail"))
 
-	actualPermLevel := func(incomingPerm string) int {
-		switch incomingPerm {
-		default:
-			return ReadPermissions
-		case "Admin":
-			return AdminPermissions
-		case "Write":
-			return WritePermissions
-		case "Edit":
-			return EditPermissions
-		case "Read":
-			return ReadPermissions
-		}
-	}(req.FormValue("NewPermLevel"))
+	actualPermLevel, _ := PermissionFromString(req.FormValue("NewPermLevel")) // Unknown levels are Read.
 
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 
 	uid, loginErr := GetUIDFromLogin(ctx, uEmail)
 	if loginErr != nil {
@@ -81,20 +64,21 @@ func ADMIN_POST_ELEVATEUSER(res http.ResponseWriter, req *http.Request, params h
 		return
 	}
 
-	u := &User{}
-	getErr := retrievable.GetEntity(ctx, uid, u)
+	u, getErr := GetUserFromDatastore(ctx, uid)
 	if getErr != nil {
 		fmt.Fprint(res, `{"Status":"Failure","Reason":"User cannot be retrived: `+getErr.Error()+`","Code":500}`)
 		return
 	}
 
+	before := *u
 	u.Permission = actualPermLevel
 
-	_, putErr := retrievable.PlaceEntity(ctx, uid, u)
+	putErr := PlaceUserInDatastore(ctx, u)
 	if putErr != nil {
 		fmt.Fprint(res, `{"Status":"Failure","Reason":"User cannot be stored: `+putErr.Error()+`","Code":500}`)
 		return
 	}
+	RecordAudit(res, req, AuditPermission, "User", uid, before, u)
 
 	fmt.Fprint(res, `{"Status":"Success","Reason":"","Code":0}`)
 }
@@ -119,7 +103,7 @@ func ADMIN_GET_USERPERM(res http.ResponseWriter, req *http.Request, params httpr
 
 	uEmail := strings.ToLower(req.FormValue("UEmail"))
 
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 
 	uid, loginErr := GetUIDFromLogin(ctx, uEmail)
 	if loginErr != nil {
@@ -127,8 +111,7 @@ func ADMIN_GET_USERPERM(res http.ResponseWriter, req *http.Request, params httpr
 		return
 	}
 
-	u := &User{}
-	getErr := retrievable.GetEntity(ctx, uid, u)
+	u, getErr := GetUserFromDatastore(ctx, uid)
 	if getErr != nil {
 		fmt.Fprint(res, `{"Status":"Failure","Reason":"User cannot be retrived: `+getErr.Error()+`","Code":500}`)
 		return
@@ -157,12 +140,16 @@ func ADMIN_POST_DELETEUSER(res http.ResponseWriter, req *http.Request, params ht
 
 	uEmail := strings.ToLower(req.FormValue("UEmail"))
 
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
+	uid, _ := GetUIDFromLogin(ctx, uEmail)
+	before, _ := GetUserFromDatastore(ctx, uid)
+
 	delErr := DeleteUserAndLogin(ctx, uEmail)
 	if delErr != nil {
 		fmt.Fprint(res, `{"Status":"Failure","Reason":"`, delErr.Error(), `","Code":500}`)
-
+		return
 	}
+	RecordAudit(res, req, AuditDelete, "User", uid, before, nil)
 
 	fmt.Fprint(res, `{"Status":"Success","Reason":"","Code":0}`)
 }
@@ -191,20 +178,16 @@ func ADMIN_POST_RetriveUserEmails(res http.ResponseWriter, req *http.Request, pa
 		return
 	}
 
-	q := datastore.NewQuery(UsersTable)
+	q := NewEntityQuery(UsersTable)
 	collectedEmails := make([]string, 0)
 
-	ctx := appengine.NewContext(req)
-	for t := q.Run(ctx); ; { // standard query run.
-		var tval User
-		_, qErr := t.Next(&tval)
-
-		if qErr == datastore.Done {
-			break
-		} else if qErr != nil {
-			fmt.Fprint(res, `{"Status":"Failure","Reason":"`, qErr.Error(), `","Code":500}`)
-			return
-		}
+	ctx := NewContext(req)
+	users := make([]User, 0)
+	if _, qErr := Stores.Entities.GetAll(ctx, q, &users); qErr != nil {
+		fmt.Fprint(res, `{"Status":"Failure","Reason":"`, qErr.Error(), `","Code":500}`)
+		return
+	}
+	for _, tval := range users {
 		if strings.Contains(strings.ToLower(tval.Name), usr) {
 			collectedEmails = append(collectedEmails, tval.Email)
 		}
@@ -239,31 +222,16 @@ func ADMIN_POST_INVITEUUID(res http.ResponseWriter, req *http.Request, params ht
 		return
 	}
 
-	actualPermLevel := func(incomingPerm string) int {
-		switch incomingPerm {
-		default:
-			return ReadPermissions
-		case "Admin":
-			return AdminPermissions
-		case "Write":
-			return WritePermissions
-		case "Edit":
-			return EditPermissions
-		case "Read":
-			return ReadPermissions
-		}
-	}(req.FormValue("Perm"))
+	actualPermLevel, _ := PermissionFromString(req.FormValue("Perm")) // Unknown levels are Read.
 
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 
 	uuid := NewUUID()
 	newU := &User{}
 	newU.Name = req.FormValue("UName")
 	newU.Permission = actualPermLevel
 
-	registerLimit := time.Hour * time.Duration(72)
-
-	putErr := retrievable.PlaceInMemcache(ctx, uuid, newU, registerLimit)
+	putErr := PlaceInCache(ctx, uuid, newU, Settings.Register.InviteLifetime.Duration)
 	if putErr != nil {
 		fmt.Fprint(res, `{"Status":"Failure","Reason":"User cannot be stored: `+putErr.Error()+`","Code":500}`)
 		return
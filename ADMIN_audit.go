@@ -0,0 +1,332 @@
+package main
+
+/*
+ADMIN_audit.go by Allen J. Mills
+    mm.d.yy
+
+    An append-only record of every change to content and users.
+    Each entry keeps who made the change, what was changed, and the
+    values of the fields that changed, before and after. Entries are
+    never updated or deleted by the application.
+
+    Creates keep every field in After, deletes keep every field in
+    Before. Deleting a structure removes its children too; the entry
+    is made for the structure asked for, with the number of other
+    records removed in Cascade.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/net/context"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBadAuditDate = errors.New("Audit: Dates must be RFC3339 or YYYY-MM-DD.") // ErrBadAuditDate is returned when a From or To filter cannot be parsed.
+)
+
+const (
+	AuditTable = "AuditLog"
+
+	// Audit actions.
+	AuditCreate     = "create"
+	AuditUpdate     = "update"
+	AuditDelete     = "delete"
+	AuditPermission = "permission"
+	AuditGrant      = "grant"   // A role given on the catalog or book
+	AuditShare      = "share"   // A share link made for the book
+	AuditRevoke     = "revoke"  // A role or share link taken away
+	AuditRestore    = "restore" // Put back from the trash
+	AuditPurge      = "purge"   // Removed from the trash for good
+
+	auditDefaultLimit = 100
+	auditMaxLimit     = 1000
+)
+
+// Type: AuditEntry
+// One change, made by Actor at Time, to the EntityKind at EntityID.
+// Before and After are JSON objects of the changed fields.
+type AuditEntry struct {
+	Time       time.Time
+	ActorID    int64
+	Actor      string // Email of the acting user, empty for automatic trash purges
+	TokenID    int64  // API token used, 0 for browser sessions
+	Action     string
+	EntityKind string
+	EntityID   int64
+	Before     string `datastore:",noindex"`
+	After      string `datastore:",noindex"`
+	Cascade    int    // Other records removed along with a deleted structure
+	ID         int64  `datastore:"-" json:",string"`
+}
+
+// Method: Kind
+// Implements Entity interface
+func (a *AuditEntry) Kind() string {
+	return AuditTable
+}
+
+// Internal Function
+// Description:
+// Flattens v into its JSON fields. nil gives an empty map.
+func auditFields(v interface{}) map[string]interface{} {
+	fields := make(map[string]interface{})
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil()) {
+		return fields
+	}
+	b, _ := json.Marshal(v)
+	json.Unmarshal(b, &fields)
+	delete(fields, "ID") // ID is the entry's EntityID
+	return fields
+}
+
+// Internal Function
+// Description:
+// Compares the fields of before and after.
+//
+// Returns:
+//      before(string) - JSON object of changed fields as they were, "{}" if none.
+//      after(string) - JSON object of changed fields as they are now, "{}" if none.
+func auditDiff(before, after interface{}) (string, string) {
+	bf, af := auditFields(before), auditFields(after)
+	for k, v := range bf {
+		if w, ok := af[k]; ok && reflect.DeepEqual(v, w) {
+			delete(bf, k)
+			delete(af, k)
+		}
+	}
+	bj, _ := json.Marshal(bf)
+	aj, _ := json.Marshal(af)
+	return string(bj), string(aj)
+}
+
+// Internal Function
+// Description:
+// Appends an audit entry for a change made by the user of req.
+// before is ignored for creations and after is nil for deletions.
+// A change that fails to be audited is not undone.
+//
+// Returns:
+//      failure?(error) - Any storage error.
+func RecordAudit(res http.ResponseWriter, req *http.Request, action, kind string, id int64, before, after interface{}) error {
+	return RecordAuditCascade(res, req, action, kind, id, before, after, 0)
+}
+
+// Internal Function
+// Description:
+// RecordAudit, also noting how many other records a deletion removed.
+//
+// Returns:
+//      failure?(error) - Any storage error.
+func RecordAuditCascade(res http.ResponseWriter, req *http.Request, action, kind string, id int64, before, after interface{}, cascade int) error {
+	entry := &AuditEntry{
+		Time:       time.Now(),
+		Action:     action,
+		EntityKind: kind,
+		EntityID:   id,
+		Cascade:    cascade,
+	}
+	if u, authErr := GetUserFromRequest(res, req); authErr == nil {
+		entry.ActorID = u.ID
+		entry.Actor = u.Email
+		if u.Token != nil {
+			entry.TokenID = u.Token.ID
+		}
+	}
+	if action == AuditCreate {
+		before = nil
+	}
+	entry.Before, entry.After = auditDiff(before, after)
+
+	return appendAudit(NewContext(req), entry)
+}
+
+// Internal Function
+// Description:
+// Stores a new audit entry. Entries made outside a request have no actor.
+//
+// Returns:
+//      failure?(error) - Any storage error.
+func appendAudit(ctx context.Context, entry *AuditEntry) error {
+	if entry.Before == "" {
+		entry.Before = "{}"
+	}
+	if entry.After == "" {
+		entry.After = "{}"
+	}
+	_, putErr := PlaceInDatastore(ctx, 0, entry)
+	return putErr
+}
+
+// Internal Function
+// Description:
+// Chooses create or update for a write to id, zero meaning a new entity.
+func auditWriteAction(id int) string {
+	if id == 0 {
+		return AuditCreate
+	}
+	return AuditUpdate
+}
+
+// Type: AuditFilter
+// Conditions for GetAuditEntries. Zero values match everything.
+type AuditFilter struct {
+	Actor      string
+	EntityKind string
+	EntityID   int64
+	From, To   time.Time // From is inclusive, To is exclusive
+	Limit      int
+}
+
+// Internal Function
+// Description:
+// Gets the audit entries matching f, newest first. Every condition is a
+// filter of the query, which has an index for each combination of them,
+// see index.yaml, so at most f.Limit entries are read.
+//
+// Returns:
+//      entries([]AuditEntry) - Matching entries, at most f.Limit.
+//      failure?(error) - Any storage error.
+func GetAuditEntries(ctx context.Context, f AuditFilter) ([]AuditEntry, error) {
+	q := NewEntityQuery(AuditTable)
+	if f.Actor != "" {
+		q = q.Filter("Actor =", f.Actor)
+	}
+	if f.EntityKind != "" {
+		q = q.Filter("EntityKind =", f.EntityKind)
+	}
+	if f.EntityID != 0 {
+		q = q.Filter("EntityID =", f.EntityID)
+	}
+	if !f.From.IsZero() {
+		q = q.Filter("Time >=", f.From)
+	}
+	if !f.To.IsZero() {
+		q = q.Filter("Time <", f.To)
+	}
+	q = q.Order("-Time").Limit(f.Limit)
+
+	entries := make([]AuditEntry, 0)
+	keys, getErr := Stores.Entities.GetAll(ctx, q, &entries)
+	if getErr != nil {
+		return []AuditEntry{}, getErr
+	}
+	for i := range entries {
+		entries[i].ID = keys[i].IntID
+	}
+	return entries, nil
+}
+
+// Internal Function
+// Description:
+// Parses a From or To filter. A bare date starts at midnight UTC; for
+// To it is taken as the whole day, so the day is included.
+//
+// Returns:
+//      when(time.Time) - Zero if s is empty.
+//      failure?(error) - ErrBadAuditDate
+func parseAuditDate(s string, endOfDay bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, ErrBadAuditDate
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// ------------------------------------
+// Handlers
+/////
+
+// Call: /admin/audit
+// Description:
+// The audit log page. Must be an Administrator to access.
+//
+// Method: GET
+// Results: HTML
+// Mandatory Options:
+// Optional Options:
+func ADMIN_AuditPage(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if validPerm, permErr := HasPermission(res, req, AdminPermissions); !validPerm {
+		// User Must be at least Admin.
+		http.Error(res, permErr.Error(), http.StatusUnauthorized)
+		return
+	}
+	u, _ := GetUserFromSession(res, req)
+
+	ServeTemplateWithParams(res, "audit.html", u)
+}
+
+// Call: /admin/audit.json
+// Description:
+// This call lists audit entries, newest first.
+// Option:UEmail is the acting user, Option:Kind and Option:ID the changed entity.
+// Option:From and Option:To are RFC3339 times or YYYY-MM-DD dates, To included.
+// Option:Limit defaults to 100 and is at most 1000.
+//
+// Method: GET
+// Results: JSON
+// Mandatory Options:
+// Optional Options: UEmail, Kind, ID, From, To, Limit
+// Codes:
+//      0 - Success, All actions completed
+//    400 - Failure, Bad option value
+//    500 - Failure, Internal Services Error
+func ADMIN_GET_AUDIT(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if validPerm, permErr := HasPermission(res, req, AdminPermissions); !validPerm {
+		// User Must be at least Admin.
+		http.Error(res, permErr.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	f := AuditFilter{
+		Actor:      strings.ToLower(strings.TrimSpace(req.FormValue("UEmail"))),
+		EntityKind: strings.TrimSpace(req.FormValue("Kind")),
+		Limit:      auditDefaultLimit,
+	}
+	if req.FormValue("ID") != "" {
+		id, parseErr := strconv.ParseInt(req.FormValue("ID"), 10, 64)
+		if parseErr != nil {
+			ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Invalid ID", Code: 400}, nil)
+			return
+		}
+		f.EntityID = id
+	}
+	if req.FormValue("Limit") != "" {
+		limit, parseErr := strconv.Atoi(req.FormValue("Limit"))
+		if parseErr != nil || limit <= 0 || limit > auditMaxLimit {
+			ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Limit must be between 1 and " + strconv.Itoa(auditMaxLimit), Code: 400}, nil)
+			return
+		}
+		f.Limit = limit
+	}
+
+	var fromErr, toErr error
+	f.From, fromErr = parseAuditDate(req.FormValue("From"), false)
+	f.To, toErr = parseAuditDate(req.FormValue("To"), true)
+	if fromErr != nil || toErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: ErrBadAuditDate.Error(), Code: 400}, nil)
+		return
+	}
+
+	entries, getErr := GetAuditEntries(NewContext(req), f)
+	if getErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: getErr.Error(), Code: 500}, nil)
+		return
+	}
+	ServeJsonOfStruct(res, JsonOptions{Status: "Success"}, entries)
+}
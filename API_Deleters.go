@@ -3,15 +3,21 @@
 // Source Project: https://github.com/johnRedden/TextbookProject
 //
 // This package holds all api handlers with regards to structure that perform deletion operations.
-// Permission requirement for these api calls: Admin
+// Deleted structures are moved to the trash with their children and images, see STRUCT_trash.go.
+// Every delete must echo back the Confirm token given by /api/delete/preview.json for the
+// same structure; the token expires, and stops matching if anything below the structure changes.
+// Permission requirement for these api calls: Admin, globally or through an Owner
+// grant on the book or catalog being changed (see USER_Grants.go).
 // For more information, please visit: https://github.com/johnRedden/TextbookProject/wiki
 //
 // This module shares a collective set of error codes described below:
 //    Code: Message
-//      0 - Success: All actions completed.
+//      0 - Success: All actions completed. trash holds the id of the trash entry.
 //    400 - Failure: Mandatory parameter missing; check reason for missing/invalid parameter.
+//    409 - Failure: Confirm token missing, expired, or out of date; preview the delete again.
 //    418 - Failure: Authentication Error; check login status and permission level.
 //    500 - Failure: Internal Services Error; check reason for more information.
+//          Nothing was deleted; rollback lists any changes that were made and undone.
 //
 package main
 
@@ -23,18 +29,17 @@ API_Deleters.go by Allen J. Mills
 */
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/datastore"
+	"golang.org/x/net/context"
 	"net/http"
+	"sort"
 	"strconv"
-)
-
-var (
-	// Local Permission Variable: delete
-	// This variable holds the minimum required permission level to use this module.
-	api_Delete_Permission = AdminPermissions
+	"strings"
+	"time"
 )
 
 // -------------------------------------------------------------------
@@ -45,16 +50,17 @@ var (
 
 // Call: /api/delete/catalog
 // Description:
-// This call will delete a catalog and all child structures.
-// ID should be a well-formed non-nil string of an existing catalog name.
+// This call will move a catalog and all child structures to the trash.
+// ID should be a well-formatted integer of an existing catalog id.
+// Confirm is the Token of /api/delete/preview.json for this ID.
 //
 // Method: POST
 // Results: JSON
-// Mandatory Options: ID
+// Mandatory Options: ID, Confirm
 // Optional Options:
 // Codes: See Above.
 func API_DeleteCatalog(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	if validPerm, permErr := HasPermission(res, req, api_Delete_Permission); !validPerm {
+	if validPerm, permErr := HasPermission(res, req, Settings.Permissions.APIDelete, ScopeOf("Catalog", req.FormValue("ID"))); !validPerm {
 		// User Must be at least Admin.
 		fmt.Fprint(res, `{"result":"failure","reason":"Invalid Authorization: `+permErr.Error()+`","code":418}`)
 		return
@@ -66,61 +72,24 @@ func API_DeleteCatalog(res http.ResponseWriter, req *http.Request, params httpro
 		return
 	}
 
-	// Initalize Variables
-	ctx := appengine.NewContext(req)
-	keyCollection := make([]*datastore.Key, 0)
-	fileCollection := make([]string, 0)
-
-	// Add Parent(Catalog) to collection
-	keyCollection = append(keyCollection, MakeCatalogKey(ctx, catalogID))
-
-	for _, bk := range Get_Child_Key_From_Parent(ctx, catalogID, "Books") {
-		keyCollection = append(keyCollection, bk)
-
-		for _, chK := range Get_Child_Key_From_Parent(ctx, bk.IntID(), "Chapters") {
-			keyCollection = append(keyCollection, chK)
-
-			for _, sk := range Get_Child_Key_From_Parent(ctx, chK.IntID(), "Sections") {
-				keyCollection = append(keyCollection, sk)
-
-				for _, ok := range Get_Child_Key_From_Parent(ctx, sk.IntID(), "Objectives") {
-					keyCollection = append(keyCollection, ok)
-					fileCollection = append(fileCollection, GetFilesFromGCS_WithPrefix(ctx, fmt.Sprint(ok.IntID()))...)
-
-					for _, ek := range Get_Child_Key_From_Parent(ctx, ok.IntID(), "Exercises") {
-						keyCollection = append(keyCollection, ek)
-						fileCollection = append(fileCollection, GetFilesFromGCS_WithPrefix(ctx, fmt.Sprint(ek.IntID()))...)
-					}
-				}
-			}
-		}
-	}
-
-	if err := datastore.DeleteMulti(ctx, keyCollection); err != nil {
-		fmt.Fprint(res, `{"result":"failure","reason":"Internal Error: Datastore Failure","code":500}`)
-		return
-	}
-
-	if err := RemoveFilesFromGCS(ctx, fileCollection); err != nil {
-		fmt.Fprint(res, `{"result":"failure","reason":"Internal Error: Cloudstore Failure","code":500}`)
-		return
-	}
-
-	fmt.Fprint(res, `{"result":"success","reason":"","code":0}`)
+	ctx := NewContext(req)
+	before, _ := GetCatalogFromDatastore(ctx, catalogID)
+	deleteToTrash(res, req, CollectSubtree(ctx, Scope{"Catalog", catalogID}), before.Title, before)
 }
 
 // Call: /api/delete/book
 // Description:
-// This call will delete a book and all child structures.
+// This call will move a book and all child structures to the trash.
 // ID should be a well-formatted integer of an existing book id.
+// Confirm is the Token of /api/delete/preview.json for this ID.
 //
 // Method: POST
 // Results: JSON
-// Mandatory Options: ID
+// Mandatory Options: ID, Confirm
 // Optional Options:
 // Codes: See Above.
 func API_DeleteBook(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	if validPerm, permErr := HasPermission(res, req, api_Delete_Permission); !validPerm {
+	if validPerm, permErr := HasPermission(res, req, Settings.Permissions.APIDelete, ScopeOf("Book", req.FormValue("ID"))); !validPerm {
 		// User Must be at least Admin.
 		fmt.Fprint(res, `{"result":"failure","reason":"Invalid Authorization: `+permErr.Error()+`","code":418}`)
 		return
@@ -132,240 +101,304 @@ func API_DeleteBook(res http.ResponseWriter, req *http.Request, params httproute
 		return
 	}
 
-	// Initalize Variables
-	ctx := appengine.NewContext(req)
-	keyCollection := make([]*datastore.Key, 0)
-	fileCollection := make([]string, 0)
-
-	// Add Parent(Book) to collection
-	keyCollection = append(keyCollection, MakeBookKey(ctx, bookID))
-
-	for _, chK := range Get_Child_Key_From_Parent(ctx, bookID, "Chapters") {
-		keyCollection = append(keyCollection, chK)
-
-		for _, sk := range Get_Child_Key_From_Parent(ctx, chK.IntID(), "Sections") {
-			keyCollection = append(keyCollection, sk)
-
-			for _, ok := range Get_Child_Key_From_Parent(ctx, sk.IntID(), "Objectives") {
-				keyCollection = append(keyCollection, ok)
-				fileCollection = append(fileCollection, GetFilesFromGCS_WithPrefix(ctx, fmt.Sprint(ok.IntID()))...)
-
-				for _, ek := range Get_Child_Key_From_Parent(ctx, ok.IntID(), "Exercises") {
-					keyCollection = append(keyCollection, ek)
-					fileCollection = append(fileCollection, GetFilesFromGCS_WithPrefix(ctx, fmt.Sprint(ek.IntID()))...)
-				}
-			}
-		}
-	}
-
-	if err := datastore.DeleteMulti(ctx, keyCollection); err != nil {
-		fmt.Fprint(res, `{"result":"failure","reason":"Internal Error: Datastore Failure","code":500}`)
-		return
-	}
-
-	if err := RemoveFilesFromGCS(ctx, fileCollection); err != nil {
-		fmt.Fprint(res, `{"result":"failure","reason":"Internal Error: Cloudstore Failure","code":500}`)
-		return
-	}
-
-	fmt.Fprint(res, `{"result":"success","reason":"","code":0}`)
+	ctx := NewContext(req)
+	before, _ := GetBookFromDatastore(ctx, bookID)
+	deleteToTrash(res, req, CollectSubtree(ctx, Scope{"Book", bookID}), before.Title, before)
 }
 
 // Call: /api/delete/chapter
 // Description:
-// This call will delete a chapter and all child structures.
+// This call will move a chapter and all child structures to the trash.
 // ID should be a well-formatted integer of an existing chapter id.
+// Confirm is the Token of /api/delete/preview.json for this ID.
 //
 // Method: POST
 // Results: JSON
-// Mandatory Options: ID
+// Mandatory Options: ID, Confirm
 // Optional Options:
 // Codes: See Above.
 func API_DeleteChapter(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	if validPerm, permErr := HasPermission(res, req, api_Delete_Permission); !validPerm {
+	if validPerm, permErr := HasPermission(res, req, Settings.Permissions.APIDelete, ScopeOf("Chapter", req.FormValue("ID"))); !validPerm {
 		// User Must be at least Admin.
 		fmt.Fprint(res, `{"result":"failure","reason":"Invalid Authorization: `+permErr.Error()+`","code":418}`)
 		return
 	}
 
-	chaptID, convErr := strconv.ParseInt(req.FormValue("ID"), 10, 64)
-	if convErr != nil || chaptID == 0 {
+	chapterID, convErr := strconv.ParseInt(req.FormValue("ID"), 10, 64)
+	if convErr != nil || chapterID == 0 {
 		fmt.Fprint(res, `{"result":"failure","reason":"Invalid ID","code":400}`)
 		return
 	}
 
-	// Initalize Variables
-	ctx := appengine.NewContext(req)
-	keyCollection := make([]*datastore.Key, 0)
-	fileCollection := make([]string, 0)
-
-	// Add Parent(Chapter) to collection
-	keyCollection = append(keyCollection, MakeChapterKey(ctx, chaptID))
-
-	for _, sk := range Get_Child_Key_From_Parent(ctx, chaptID, "Sections") {
-		keyCollection = append(keyCollection, sk)
-
-		for _, ok := range Get_Child_Key_From_Parent(ctx, sk.IntID(), "Objectives") {
-			keyCollection = append(keyCollection, ok)
-			fileCollection = append(fileCollection, GetFilesFromGCS_WithPrefix(ctx, fmt.Sprint(ok.IntID()))...)
-
-			for _, ek := range Get_Child_Key_From_Parent(ctx, ok.IntID(), "Exercises") {
-				keyCollection = append(keyCollection, ek)
-				fileCollection = append(fileCollection, GetFilesFromGCS_WithPrefix(ctx, fmt.Sprint(ek.IntID()))...)
-			}
-		}
-	}
-
-	if err := datastore.DeleteMulti(ctx, keyCollection); err != nil {
-		fmt.Fprint(res, `{"result":"failure","reason":"Internal Error: Datastore Failure","code":500}`)
-		return
-	}
-
-	if err := RemoveFilesFromGCS(ctx, fileCollection); err != nil {
-		fmt.Fprint(res, `{"result":"failure","reason":"Internal Error: Cloudstore Failure","code":500}`)
-		return
-	}
-
-	fmt.Fprint(res, `{"result":"success","reason":"","code":0}`)
+	ctx := NewContext(req)
+	before, _ := GetChapterFromDatastore(ctx, chapterID)
+	deleteToTrash(res, req, CollectSubtree(ctx, Scope{"Chapter", chapterID}), before.Title, before)
 }
 
 // Call: /api/delete/section
 // Description:
-// This call will delete a section and all child structures.
+// This call will move a section and all child structures to the trash.
 // ID should be a well-formatted integer of an existing section id.
+// Confirm is the Token of /api/delete/preview.json for this ID.
 //
 // Method: POST
 // Results: JSON
-// Mandatory Options: ID
+// Mandatory Options: ID, Confirm
 // Optional Options:
 // Codes: See Above.
 func API_DeleteSection(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	if validPerm, permErr := HasPermission(res, req, api_Delete_Permission); !validPerm {
+	if validPerm, permErr := HasPermission(res, req, Settings.Permissions.APIDelete, ScopeOf("Section", req.FormValue("ID"))); !validPerm {
 		// User Must be at least Admin.
 		fmt.Fprint(res, `{"result":"failure","reason":"Invalid Authorization: `+permErr.Error()+`","code":418}`)
 		return
 	}
 
-	sectID, convErr := strconv.ParseInt(req.FormValue("ID"), 10, 64)
-	if convErr != nil || sectID == 0 {
+	sectionID, convErr := strconv.ParseInt(req.FormValue("ID"), 10, 64)
+	if convErr != nil || sectionID == 0 {
 		fmt.Fprint(res, `{"result":"failure","reason":"Invalid ID","code":400}`)
 		return
 	}
 
-	// Initalize Variables
-	ctx := appengine.NewContext(req)
-	keyCollection := make([]*datastore.Key, 0)
-	fileCollection := make([]string, 0)
-
-	// Add Parent(Section) to collection
-	keyCollection = append(keyCollection, MakeSectionKey(ctx, sectID))
-
-	for _, ok := range Get_Child_Key_From_Parent(ctx, sectID, "Objectives") {
-		keyCollection = append(keyCollection, ok)
-		fileCollection = append(fileCollection, GetFilesFromGCS_WithPrefix(ctx, fmt.Sprint(ok.IntID()))...)
-
-		for _, ek := range Get_Child_Key_From_Parent(ctx, ok.IntID(), "Exercises") {
-			keyCollection = append(keyCollection, ek)
-			fileCollection = append(fileCollection, GetFilesFromGCS_WithPrefix(ctx, fmt.Sprint(ek.IntID()))...)
-		}
-	}
+	ctx := NewContext(req)
+	before, _ := GetSectionFromDatastore(ctx, sectionID)
+	deleteToTrash(res, req, CollectSubtree(ctx, Scope{"Section", sectionID}), before.Title, before)
+}
 
-	if err := datastore.DeleteMulti(ctx, keyCollection); err != nil {
-		fmt.Fprint(res, `{"result":"failure","reason":"Internal Error: Datastore Failure","code":500}`)
+// Call: /api/delete/objective
+// Description:
+// This call will move an objective and all child structures to the trash.
+// ID should be a well-formatted integer of an existing objective id.
+// Confirm is the Token of /api/delete/preview.json for this ID.
+//
+// Method: POST
+// Results: JSON
+// Mandatory Options: ID, Confirm
+// Optional Options:
+// Codes: See Above.
+func API_DeleteObjective(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if validPerm, permErr := HasPermission(res, req, Settings.Permissions.APIDelete, ScopeOf("Objective", req.FormValue("ID"))); !validPerm {
+		// User Must be at least Admin.
+		fmt.Fprint(res, `{"result":"failure","reason":"Invalid Authorization: `+permErr.Error()+`","code":418}`)
 		return
 	}
 
-	if err := RemoveFilesFromGCS(ctx, fileCollection); err != nil {
-		fmt.Fprint(res, `{"result":"failure","reason":"Internal Error: Cloudstore Failure","code":500}`)
+	objectiveID, convErr := strconv.ParseInt(req.FormValue("ID"), 10, 64)
+	if convErr != nil || objectiveID == 0 {
+		fmt.Fprint(res, `{"result":"failure","reason":"Invalid ID","code":400}`)
 		return
 	}
 
-	fmt.Fprint(res, `{"result":"success","reason":"","code":0}`)
+	ctx := NewContext(req)
+	before, _ := GetObjectiveFromDatastore(ctx, objectiveID)
+	deleteToTrash(res, req, CollectSubtree(ctx, Scope{"Objective", objectiveID}), before.Title, before)
 }
 
-// Call: /api/delete/objective
+// Call: /api/delete/exercise
 // Description:
-// This call will delete an objective and all child structures.
-// ID should be a well-formatted integer of an existing objective id.
+// This call will move an Exercise and all child structures to the trash.
+// ID should be a well-formatted integer of an existing Exercise id.
+// Confirm is the Token of /api/delete/preview.json for this ID.
 //
 // Method: POST
 // Results: JSON
-// Mandatory Options: ID
+// Mandatory Options: ID, Confirm
 // Optional Options:
 // Codes: See Above.
-func API_DeleteObjective(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	if validPerm, permErr := HasPermission(res, req, api_Delete_Permission); !validPerm {
+func API_DeleteExercise(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if validPerm, permErr := HasPermission(res, req, Settings.Permissions.APIDelete, ScopeOf("Exercise", req.FormValue("ID"))); !validPerm {
 		// User Must be at least Admin.
 		fmt.Fprint(res, `{"result":"failure","reason":"Invalid Authorization: `+permErr.Error()+`","code":418}`)
 		return
 	}
 
-	objID, convErr := strconv.ParseInt(req.FormValue("ID"), 10, 64)
-	if convErr != nil || objID == 0 {
+	exerciseID, convErr := strconv.ParseInt(req.FormValue("ID"), 10, 64)
+	if convErr != nil || exerciseID == 0 {
 		fmt.Fprint(res, `{"result":"failure","reason":"Invalid ID","code":400}`)
 		return
 	}
 
-	// Initalize Variables
-	ctx := appengine.NewContext(req)
-	keyCollection := make([]*datastore.Key, 0)
-	fileCollection := make([]string, 0)
-
-	// Add Parent(Objective) to collection
-	keyCollection = append(keyCollection, MakeObjectiveKey(ctx, objID))
-	fileCollection = append(fileCollection, GetFilesFromGCS_WithPrefix(ctx, fmt.Sprint(objID))...)
+	ctx := NewContext(req)
+	before, _ := GetExerciseFromDatastore(ctx, exerciseID)
+	deleteToTrash(res, req, CollectSubtree(ctx, Scope{"Exercise", exerciseID}), before.Instruction, before)
+}
 
-	for _, ek := range Get_Child_Key_From_Parent(ctx, objID, "Exercises") {
-		keyCollection = append(keyCollection, ek)
-		fileCollection = append(fileCollection, GetFilesFromGCS_WithPrefix(ctx, fmt.Sprint(ek.IntID()))...)
+// Call: /api/delete/preview.json
+// Description:
+// This call reports what deleting a structure would remove, without removing anything.
+// Kind is one of Catalog, Book, Chapter, Section, Objective or Exercise.
+// Counts is the number of records of each datastore kind, Files the images.
+// Token must be sent as Confirm to the matching /api/delete call before Expires.
+//
+// Method: GET
+// Results: JSON
+// Mandatory Options: Kind, ID
+// Optional Options:
+// Codes:
+//      0 - Success, All actions completed
+//    400 - Failure, Unknown Kind or invalid ID
+//    418 - Failure, Authorization error
+func API_DeletePreview(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	kind := req.FormValue("Kind")
+	table, isStructure := structureTables[kind]
+	if !isStructure {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Unknown Kind", Code: 400}, nil)
+		return
+	}
+	if validPerm, permErr := HasPermission(res, req, Settings.Permissions.APIDelete, ScopeOf(kind, req.FormValue("ID"))); !validPerm {
+		// User Must be at least Admin.
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Invalid Authorization: " + permErr.Error(), Code: 418}, nil)
+		return
 	}
 
-	if err := datastore.DeleteMulti(ctx, keyCollection); err != nil {
-		fmt.Fprint(res, `{"result":"failure","reason":"Internal Error: Datastore Failure","code":500}`)
+	id, convErr := strconv.ParseInt(req.FormValue("ID"), 10, 64)
+	if convErr != nil || id == 0 {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Invalid ID", Code: 400}, nil)
 		return
 	}
 
-	if err := RemoveFilesFromGCS(ctx, fileCollection); err != nil {
-		fmt.Fprint(res, `{"result":"failure","reason":"Internal Error: Cloudstore Failure","code":500}`)
+	ctx := NewContext(req)
+	root := newTrashable(table)
+	if getErr := Stores.Entities.Get(ctx, NewEntityKey(table, id), root); getErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Invalid ID: " + getErr.Error(), Code: 400}, nil)
 		return
 	}
+	var named struct{ Title, Instruction string }
+	b, _ := json.Marshal(root)
+	json.Unmarshal(b, &named)
+	if named.Title == "" {
+		named.Title = named.Instruction
+	}
 
-	fmt.Fprint(res, `{"result":"success","reason":"","code":0}`)
+	t := CollectSubtree(ctx, Scope{kind, id})
+	expires := time.Now().Add(confirmLifetime)
+	ServeJsonOfStruct(res, JsonOptions{Status: "Success"}, struct {
+		Kind    string
+		ID      int64 `json:",string"`
+		Title   string
+		Counts  map[string]int
+		Files   []string
+		Token   string
+		Expires time.Time
+	}{kind, id, named.Title, t.Counts(), t.Files, confirmToken(res, req, t.change(), expires), expires})
 }
 
-// Call: /api/delete/exercise
+// ------------------------------------
+// Subtrees
+/////
+
+// The structure kind found below each kind.
+var childKinds = map[string]string{
+	"Catalog":   "Book",
+	"Book":      "Chapter",
+	"Chapter":   "Section",
+	"Section":   "Objective",
+	"Objective": "Exercise",
+}
+
+// Type: Subtree
+// Everything removed together with one structure.
+type Subtree struct {
+	Root  Scope
+	Keys  []EntityKey // The root first, then grants, share links, and every child structure
+	Files []string    // Images of the objectives and exercises
+}
+
+// Internal Function
 // Description:
-// This call will delete an Exercise and all child structures.
-// ID should be a well-formatted integer of an existing Exercise id.
+// Walks every structure below root, collecting what a delete removes.
 //
-// Method: POST
-// Results: JSON
-// Mandatory Options: ID
-// Optional Options:
-// Codes: See Above.
-func API_DeleteExercise(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	if validPerm, permErr := HasPermission(res, req, api_Delete_Permission); !validPerm {
-		// User Must be at least Admin.
-		fmt.Fprint(res, `{"result":"failure","reason":"Invalid Authorization: `+permErr.Error()+`","code":418}`)
-		return
+// Returns:
+//      subtree(*Subtree) - Keys and files of root and its children.
+func CollectSubtree(ctx context.Context, root Scope) *Subtree {
+	t := &Subtree{Root: root, Keys: make([]EntityKey, 0), Files: make([]string, 0)}
+	t.add(ctx, root.Kind, root.ID)
+	return t
+}
+
+func (t *Subtree) add(ctx context.Context, kind string, id int64) {
+	t.Keys = append(t.Keys, NewEntityKey(structureTables[kind], id))
+
+	switch kind {
+	case "Catalog":
+		t.Keys = append(t.Keys, GetGrantKeysForTargets(ctx, Scope{kind, id})...)
+	case "Book":
+		t.Keys = append(t.Keys, GetGrantKeysForTargets(ctx, Scope{kind, id})...)
+		t.Keys = append(t.Keys, GetShareLinkKeysForBook(ctx, id)...)
+	case "Objective", "Exercise":
+		t.Files = append(t.Files, GetImagesOf(ctx, fmt.Sprint(id))...)
 	}
 
-	exerID, convErr := strconv.ParseInt(req.FormValue("ID"), 10, 64)
-	if convErr != nil {
-		fmt.Fprint(res, `{"result":"failure","reason":"Invalid ID","code":400}`)
+	if child, hasChildren := childKinds[kind]; hasChildren {
+		for _, ck := range Get_Child_Key_From_Parent(ctx, id, structureTables[child]) {
+			t.add(ctx, child, ck.IntID)
+		}
+	}
+}
+
+// Method: Counts
+// The number of records of each datastore kind in t, including kinds below the root with none.
+func (t *Subtree) Counts() map[string]int {
+	counts := make(map[string]int)
+	for kind, hasChild := t.Root.Kind, true; hasChild; kind, hasChild = childKinds[kind] {
+		counts[structureTables[kind]] = 0
+	}
+	for _, k := range t.Keys {
+		counts[k.Kind]++
+	}
+	return counts
+}
+
+// Method: digest
+// A hash of every key and file in t, in sorted order.
+func (t *Subtree) digest() string {
+	parts := make([]string, 0, len(t.Keys)+len(t.Files))
+	for _, k := range t.Keys {
+		parts = append(parts, fmt.Sprint(k.Kind, "/", k.IntID, "/", k.StringID))
+	}
+	for _, f := range t.Files {
+		parts = append(parts, "file/"+f)
+	}
+	sort.Strings(parts)
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// ------------------------------------
+// Confirmation
+/////
+
+// Method: change
+// What a Confirm token to delete t is made over: the root and t's digest,
+// so the token is refused for any other structure or once t has changed.
+func (t *Subtree) change() string {
+	return fmt.Sprint("delete:", t.Root.Kind, ":", t.Root.ID, ":", t.digest())
+}
+
+// Internal Function
+// Description:
+// Moves t to the trash for the user of req and writes the API response.
+// title names the trash entry; before is the root as it was, for the audit log.
+func deleteToTrash(res http.ResponseWriter, req *http.Request, t *Subtree, title string, before interface{}) {
+	if confirmErr := checkConfirmToken(res, req, t.change()); confirmErr != nil {
+		fmt.Fprint(res, `{"result":"failure","reason":"`+confirmErr.Error()+`","code":409}`)
 		return
 	}
 
-	// Remove this exercise from datastore.
-	ctx := appengine.NewContext(req)
-	remvErr := DeleteFromDatastore(ctx, exerID, &Exercise{})
-	if remvErr != nil {
-		fmt.Fprint(res, `{"result":"failure","reason":"Internal Error","code":500}`)
+	deletedBy := ""
+	if u, authErr := GetUserFromRequest(res, req); authErr == nil {
+		deletedBy = u.Email
 	}
 
-	// Clear this exercises images, if any.
-	imagesToDelete := GetFilesFromGCS_WithPrefix(ctx, req.FormValue("ID"))
-	RemoveFilesFromGCS(ctx, imagesToDelete)
+	bin, trashErr := MoveToTrash(NewContext(req), t, title, deletedBy)
+	if rb, rolledBack := trashErr.(*Rollback); rolledBack {
+		report, _ := json.Marshal(rb)
+		fmt.Fprint(res, `{"result":"failure","reason":"Internal Error: Delete rolled back","code":500,"rollback":`+string(report)+`}`)
+		return
+	} else if trashErr != nil {
+		fmt.Fprint(res, `{"result":"failure","reason":"Internal Error: `+trashErr.Error()+`","code":500}`)
+		return
+	}
+	RecordAuditCascade(res, req, AuditDelete, t.Root.Kind, t.Root.ID, before, nil, len(t.Keys)-1)
 
-	fmt.Fprint(res, `{"result":"success","reason":"","code":0}`)
+	fmt.Fprint(res, `{"result":"success","reason":"","code":0,"trash":"`, bin.ID, `"}`)
 }
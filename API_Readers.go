@@ -3,7 +3,8 @@
 // Source Project: https://github.com/johnRedden/TextbookProject
 //
 // This package holds all api handlers with regards to structure that perform read operations.
-// No requirement currently exists in respect to permissions.
+// Results honor book visibility: private books, and everything in them, are
+// left out or reported as not found for readers who may not see them (see USER_Visibility.go).
 // For more information, please visit: https://github.com/johnRedden/TextbookProject/wiki
 //
 package main
@@ -19,8 +20,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/datastore"
+	"golang.org/x/net/context"
 	"net/http"
 	"strconv"
 )
@@ -41,20 +41,17 @@ import (
 // Codes:
 //      None, Data is either served or an http.Error is returned.
 func API_GetCatalogs(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	ctx := appengine.NewContext(req)
-	q := datastore.NewQuery("Catalogs")
+	ctx := NewContext(req)
+	q := NewEntityQuery("Catalogs")
 	q = q.Order("Title")
 	cataloglist := make([]Catalog, 0)
-	for t := q.Run(ctx); ; {
-		var x Catalog
-		k, qErr := t.Next(&x)
-		if qErr == datastore.Done {
-			break
-		} else if qErr != nil {
-			http.Error(res, qErr.Error(), http.StatusInternalServerError)
-		}
-		x.ID = k.IntID()
-		cataloglist = append(cataloglist, x)
+	keys, qErr := Stores.Entities.GetAll(ctx, q, &cataloglist)
+	if qErr != nil {
+		http.Error(res, qErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i, k := range keys {
+		cataloglist[i].ID = k.IntID
 	}
 	ServeTemplateWithParams(res, "Catalogs.json", cataloglist)
 }
@@ -70,8 +67,8 @@ func API_GetCatalogs(res http.ResponseWriter, req *http.Request, params httprout
 // Codes:
 //      None, Data is either served or an http.Error is returned.
 func API_GetBooks(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	ctx := appengine.NewContext(req)
-	q := datastore.NewQuery("Books")
+	ctx := NewContext(req)
+	q := NewEntityQuery("Books")
 	q = q.Order("Title")
 
 	queryCatID := req.FormValue("Catalog")
@@ -82,18 +79,20 @@ func API_GetBooks(res http.ResponseWriter, req *http.Request, params httprouter.
 	}
 
 	booklist := make([]Book, 0)
-	for t := q.Run(ctx); ; {
-		var x Book
-		k, qErr := t.Next(&x)
-		if qErr == datastore.Done {
-			break
-		} else if qErr != nil {
-			http.Error(res, qErr.Error(), http.StatusInternalServerError)
+	keys, qErr := Stores.Entities.GetAll(ctx, q, &booklist)
+	if qErr != nil {
+		http.Error(res, qErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	rc := NewReadChecker(res, req)
+	visible := booklist[:0]
+	for i, k := range keys {
+		booklist[i].ID = k.IntID
+		if rc.Listed(booklist[i]) {
+			visible = append(visible, booklist[i])
 		}
-		x.ID = k.IntID()
-		booklist = append(booklist, x)
 	}
-	ServeTemplateWithParams(res, "Books.json", booklist)
+	ServeTemplateWithParams(res, "Books.json", visible)
 }
 
 // Call: /api/chapters.json
@@ -107,8 +106,8 @@ func API_GetBooks(res http.ResponseWriter, req *http.Request, params httprouter.
 // Codes:
 //      None, Data is either served or an http.Error is returned.
 func API_GetChapters(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	ctx := appengine.NewContext(req)
-	q := datastore.NewQuery("Chapters")
+	ctx := NewContext(req)
+	q := NewEntityQuery("Chapters")
 
 	queryBookID := req.FormValue("BookID")
 	if queryBookID != "" { // Ensure that a BookID was indeed sent.
@@ -121,19 +120,21 @@ func API_GetChapters(res http.ResponseWriter, req *http.Request, params httprout
 	q = q.Order("Title")
 
 	chapterList := make([]Chapter, 0)
-	for t := q.Run(ctx); ; {
-		var x Chapter
-		k, qErr := t.Next(&x)
-		if qErr == datastore.Done {
-			break
-		} else if qErr != nil {
-			http.Error(res, qErr.Error(), http.StatusInternalServerError)
+	keys, qErr := Stores.Entities.GetAll(ctx, q, &chapterList)
+	if qErr != nil {
+		http.Error(res, qErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	rc := NewReadChecker(res, req)
+	visible := chapterList[:0]
+	for i, k := range keys {
+		chapterList[i].ID = k.IntID
+		if rc.CanRead(Scope{"Book", chapterList[i].Parent}) {
+			visible = append(visible, chapterList[i])
 		}
-		x.ID = k.IntID()
-		chapterList = append(chapterList, x)
 	}
 
-	ServeTemplateWithParams(res, "Chapters.json", chapterList)
+	ServeTemplateWithParams(res, "Chapters.json", visible)
 }
 
 // Call: /api/sections.json
@@ -147,8 +148,8 @@ func API_GetChapters(res http.ResponseWriter, req *http.Request, params httprout
 // Codes:
 //      None, Data is either served or an http.Error is returned.
 func API_GetSections(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	ctx := appengine.NewContext(req)
-	q := datastore.NewQuery("Sections")
+	ctx := NewContext(req)
+	q := NewEntityQuery("Sections")
 
 	queryChapterID := req.FormValue("ChapterID")
 	if queryChapterID != "" { // Ensure that a ChapterID was indeed sent.
@@ -160,19 +161,21 @@ func API_GetSections(res http.ResponseWriter, req *http.Request, params httprout
 	q = q.Order("Order").Order("Title")
 
 	sectionList := make([]Section, 0)
-	for t := q.Run(ctx); ; {
-		var x Section
-		k, qErr := t.Next(&x)
-		if qErr == datastore.Done {
-			break
-		} else if qErr != nil {
-			http.Error(res, qErr.Error(), http.StatusInternalServerError)
+	keys, qErr := Stores.Entities.GetAll(ctx, q, &sectionList)
+	if qErr != nil {
+		http.Error(res, qErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	rc := NewReadChecker(res, req)
+	visible := sectionList[:0]
+	for i, k := range keys {
+		sectionList[i].ID = k.IntID
+		if rc.CanRead(Scope{"Chapter", sectionList[i].Parent}) {
+			visible = append(visible, sectionList[i])
 		}
-		x.ID = k.IntID()
-		sectionList = append(sectionList, x)
 	}
 
-	ServeTemplateWithParams(res, "Sections.json", sectionList)
+	ServeTemplateWithParams(res, "Sections.json", visible)
 }
 
 // Call: /api/sections.json
@@ -186,8 +189,8 @@ func API_GetSections(res http.ResponseWriter, req *http.Request, params httprout
 // Codes:
 //      None, Data is either served or an http.Error is returned.
 func API_GetObjectives(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	ctx := appengine.NewContext(req)
-	q := datastore.NewQuery("Objectives")
+	ctx := NewContext(req)
+	q := NewEntityQuery("Objectives")
 
 	querySectionID := req.FormValue("SectionID")
 	if querySectionID != "" { // Ensure that a BookID was indeed sent.
@@ -199,19 +202,21 @@ func API_GetObjectives(res http.ResponseWriter, req *http.Request, params httpro
 	q = q.Order("Order").Order("Title")
 
 	objectiveList := make([]Objective, 0)
-	for t := q.Run(ctx); ; {
-		var x Objective
-		k, qErr := t.Next(&x)
-		if qErr == datastore.Done {
-			break
-		} else if qErr != nil {
-			http.Error(res, qErr.Error(), http.StatusInternalServerError)
+	keys, qErr := Stores.Entities.GetAll(ctx, q, &objectiveList)
+	if qErr != nil {
+		http.Error(res, qErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	rc := NewReadChecker(res, req)
+	visible := objectiveList[:0]
+	for i, k := range keys {
+		objectiveList[i].ID = k.IntID
+		if rc.CanRead(Scope{"Section", objectiveList[i].Parent}) {
+			visible = append(visible, objectiveList[i])
 		}
-		x.ID = k.IntID()
-		objectiveList = append(objectiveList, x)
 	}
 
-	ServeTemplateWithParams(res, "Objectives.json", objectiveList)
+	ServeTemplateWithParams(res, "Objectives.json", visible)
 }
 
 // Call: /api/exercises.json
@@ -227,34 +232,57 @@ func API_GetObjectives(res http.ResponseWriter, req *http.Request, params httpro
 // Codes:
 //      None, Data is either served or an http.Error is returned.
 func API_GetExercises(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	ctx := appengine.NewContext(req)
-	q := datastore.NewQuery("Exercises")
-
+	var objectiveID *int64
 	if req.FormValue("ObjectiveID") != "" {
 		i, numErr := strconv.Atoi(req.FormValue("ObjectiveID"))
 		HandleError(res, numErr)
-		q = q.Filter("Parent =", int64(i))
+		id := int64(i)
+		objectiveID = &id
 	}
 
-	if req.FormValue("IKind") != "" {
-		q = q.Filter("Instruction =", req.FormValue("IKind"))
+	exerciselist, qErr := GetExercises(NewContext(req), objectiveID, req.FormValue("IKind"))
+	if qErr != nil {
+		http.Error(res, qErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	rc := NewReadChecker(res, req)
+	visible := exerciselist[:0]
+	for _, e := range exerciselist {
+		if rc.CanRead(Scope{"Objective", e.Parent}) {
+			visible = append(visible, e)
+		}
 	}
+	ServeTemplateWithParams(res, "Exercises.json", visible)
+}
 
+// Internal Function
+// Description:
+// Gets the exercises of the objective objectiveID, or of every objective
+// when it is nil, of instruction kind ikind when that is given, ordered
+// by Order and then Instruction. Visibility is not checked.
+//
+// Returns:
+//      exercises([]Exercise) - The exercises, with their ids.
+//      failure?(error) - Any storage error.
+func GetExercises(ctx context.Context, objectiveID *int64, ikind string) ([]Exercise, error) {
+	q := NewEntityQuery("Exercises")
+	if objectiveID != nil {
+		q = q.Filter("Parent =", *objectiveID)
+	}
+	if ikind != "" {
+		q = q.Filter("Instruction =", ikind)
+	}
 	q = q.Order("Order").Order("Instruction")
 
 	exerciselist := make([]Exercise, 0)
-	for t := q.Run(ctx); ; {
-		var x Exercise
-		k, qErr := t.Next(&x)
-		if qErr == datastore.Done {
-			break
-		} else if qErr != nil {
-			http.Error(res, qErr.Error(), http.StatusInternalServerError)
-		}
-		x.ID = k.IntID()
-		exerciselist = append(exerciselist, x)
+	keys, qErr := Stores.Entities.GetAll(ctx, q, &exerciselist)
+	if qErr != nil {
+		return nil, qErr
 	}
-	ServeTemplateWithParams(res, "Exercises.json", exerciselist)
+	for i, k := range keys {
+		exerciselist[i].ID = k.IntID
+	}
+	return exerciselist, nil
 }
 
 // Call: /api/toc.xml
@@ -284,14 +312,14 @@ func API_getTOC(res http.ResponseWriter, req *http.Request, params httprouter.Pa
 	/// - - - -
 	// Gather Book information, ensure that book exists.
 	////////
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 
 	BookTitle, BookCatalog, BookID_Out := func(req *http.Request, id int64) (string, int64, int64) { // get book data
 		book_to_output, _ := GetBookFromDatastore(ctx, id)
 		return book_to_output.Title, book_to_output.Parent, book_to_output.ID
 	}(req, BookID_In)
 
-	if BookID_In != BookID_Out {
+	if BookID_In != BookID_Out || CheckReadable(res, req, Scope{"Book", BookID_In}) != nil {
 		fmt.Fprint(res, `<?xml version="1.0" encoding="UTF-8" ?><error><status>Failure</status><message>Book Not Found!</message></error>`)
 		// ServeTemplateWithParams(res, req, "printme.html", "ERROR! Incoming id not found!")
 		return
@@ -399,7 +427,16 @@ func API_GetParent(res http.ResponseWriter, req *http.Request, params httprouter
 		screen.BookID = id
 	}
 
-	ctx := appengine.NewContext(req)
+	if readErr := CheckReadable(res, req, Scope{params.ByName("KIND"), id}); readErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{
+			Code:   http.StatusNotFound,
+			Status: "Failure",
+			Reason: readErr.Error(),
+		}, nil)
+		return
+	}
+
+	ctx := NewContext(req)
 
 	// DO OBJECTIVE
 	if screen.ObjectiveID != 0 {
@@ -491,7 +528,7 @@ func API_GetCatalog(res http.ResponseWriter, req *http.Request, params httproute
 		fmt.Fprint(res, `<?xml version="1.0" encoding="UTF-8" ?><error><status>Failure</status><message>Invalid ID</message></error>`)
 		return
 	}
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 	Catalog_to_Output, geterr := GetCatalogFromDatastore(ctx, int64(CatalogID))
 	if geterr != nil {
 		fmt.Fprint(res, `<?xml version="1.0" encoding="UTF-8" ?><error><status>Failure</status><message>ID Not Found!</message></error>`)
@@ -523,8 +560,11 @@ func API_GetBook(res http.ResponseWriter, req *http.Request, params httprouter.P
 		fmt.Fprint(res, `<?xml version="1.0" encoding="UTF-8" ?><error><status>Failure</status><message>Invalid ID</message></error>`)
 		return
 	}
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 	Book_to_Output, geterr := GetBookFromDatastore(ctx, BookID)
+	if geterr == nil {
+		geterr = CheckReadable(res, req, Scope{"Book", BookID})
+	}
 	if geterr != nil {
 		fmt.Fprint(res, `<?xml version="1.0" encoding="UTF-8" ?><error><status>Failure</status><message>ID Not Found!</message></error>`)
 		return
@@ -557,8 +597,11 @@ func API_GetChapter(res http.ResponseWriter, req *http.Request, params httproute
 		fmt.Fprint(res, `<?xml version="1.0" encoding="UTF-8" ?><error><status>Failure</status><message>Invalid ID</message></error>`)
 		return
 	}
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 	Chapter_to_Output, geterr := GetChapterFromDatastore(ctx, ChapterID)
+	if geterr == nil {
+		geterr = CheckReadable(res, req, Scope{"Chapter", ChapterID})
+	}
 	if geterr != nil {
 		fmt.Fprint(res, `<?xml version="1.0" encoding="UTF-8" ?><error><status>Failure</status><message>ID Not Found!</message></error>`)
 		return
@@ -590,8 +633,11 @@ func API_GetSection(res http.ResponseWriter, req *http.Request, params httproute
 		fmt.Fprint(res, `<?xml version="1.0" encoding="UTF-8" ?><error><status>Failure</status><message>Invalid ID</message></error>`)
 		return
 	}
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 	Section_to_Output, geterr := GetSectionFromDatastore(ctx, SectionID)
+	if geterr == nil {
+		geterr = CheckReadable(res, req, Scope{"Section", SectionID})
+	}
 	if geterr != nil {
 		fmt.Fprint(res, `<?xml version="1.0" encoding="UTF-8" ?><error><status>Failure</status><message>ID Not Found!</message></error>`)
 		return
@@ -624,9 +670,12 @@ func API_GetObjectiveHTML(res http.ResponseWriter, req *http.Request, params htt
 		return
 	}
 
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 	objectiveToScreen, getErr := GetObjectiveFromDatastore(ctx, int64(ObjectiveID))
 	//HandleError(res, getErr)
+	if getErr == nil {
+		getErr = CheckReadable(res, req, Scope{"Objective", int64(ObjectiveID)})
+	}
 	if getErr != nil {
 		fmt.Fprint(res, `<section><p>Request has failed: No objective with given ID.</p></section>`)
 		return
@@ -653,8 +702,11 @@ func API_GetExercise(res http.ResponseWriter, req *http.Request, params httprout
 		fmt.Fprint(res, `<?xml version="1.0" encoding="UTF-8" ?><error><status>Failure</status><message>Invalid ID</message></error>`)
 		return
 	}
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 	Exercise_to_Output, geterr := GetExerciseFromDatastore(ctx, int64(ExerciseID))
+	if geterr == nil {
+		geterr = CheckReadable(res, req, Scope{"Exercise", int64(ExerciseID)})
+	}
 	if geterr != nil {
 		fmt.Fprint(res, `<?xml version="1.0" encoding="UTF-8" ?><error><status>Failure</status><message>ID Not Found!</message></error>`)
 		return
@@ -3,7 +3,8 @@
 // Source Project: https://github.com/johnRedden/TextbookProject
 //
 // This package holds all api handlers with regards to structure that perform write operations.
-// Permission requirement for these api calls: Writer
+// Permission requirement for these api calls: Writer, globally or through a grant
+// on the book or catalog being changed (see USER_Grants.go).
 // For more information, please visit: https://github.com/johnRedden/TextbookProject/wiki
 //
 // This module shares a collective set of error codes described below:
@@ -24,18 +25,11 @@ API_Writers.go by Allen J. Mills
 import (
 	"fmt"
 	"github.com/julienschmidt/httprouter"
-	"google.golang.org/appengine"
 	"html/template"
 	"net/http"
 	"strconv"
 )
 
-var (
-	// Local Permission Variable: make
-	// This variable holds the minimum required permission level to use this module.
-	api_Make_Permission = WritePermissions
-)
-
 // -------------------------------------------------------------------
 // Creation Data calls, No-Wait
 // API calls for singular objects.
@@ -52,7 +46,7 @@ var (
 // Optional Options: Company, Version, Description
 // Codes: See Above.
 func API_MakeCatalog(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	if validPerm, permErr := HasPermission(res, req, api_Make_Permission); !validPerm {
+	if validPerm, permErr := HasPermission(res, req, Settings.Permissions.APIMake, ScopeOf("Catalog", req.FormValue("ID"))); !validPerm {
 		// User Must be at least Writer.
 		fmt.Fprint(res, `{"result":"failure","reason":"Invalid Authorization: `+permErr.Error()+`","code":418}`)
 		return
@@ -60,13 +54,14 @@ func API_MakeCatalog(res http.ResponseWriter, req *http.Request, params httprout
 
 	catID, _ := strconv.Atoi(req.FormValue("ID"))
 
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 	catalogForDatastore, getErr := GetCatalogFromDatastore(ctx, int64(catID))
 	if getErr != nil {
 		fmt.Fprint(res, `{"result":"failure","reason":"Retrivial Error: `+getErr.Error()+`","code":500}`)
 		return
 	}
 	// HandleError(res, getErr) // If this catalog already exists. We should go get that information to update it.
+	before := catalogForDatastore
 
 	if req.FormValue("CatalogName") != "" { // if you're giving me a title, we're good
 		catalogForDatastore.Title = req.FormValue("CatalogName")
@@ -97,20 +92,22 @@ func API_MakeCatalog(res http.ResponseWriter, req *http.Request, params httprout
 		return
 	}
 	// HandleError(res, putErr)
-	fmt.Fprint(res, `{"result":"success","reason":"","code":0,"object":{"Title":"`, catalogForDatastore.Title, `","ID":"`, rk.IntID(), `"}}`)
+	RecordAudit(res, req, auditWriteAction(catID), "Catalog", rk, before, &catalogForDatastore)
+	fmt.Fprint(res, `{"result":"success","reason":"","code":0,"object":{"Title":"`, catalogForDatastore.Title, `","ID":"`, rk, `"}}`)
 }
 
 // Call: /api/create/book
 // Description:
 // This call will create or update book information. If Mandatory:ID is given, all parameters are set as update mode, otherwise Mandatory:CatalogName, Mandatory:BookName must be given. Option:Version should be a well-formatted float.
+// Option:Visibility is public, unlisted, or private; new books without it get Books.DefaultVisibility from the settings.
 //
 // Method: POST
 // Results: JSON
 // Mandatory Options: {CatalogID, BookName} OR {ID}
-// Optional Options: Author, Version, Tags, Description
+// Optional Options: Author, Version, Tags, Description, Visibility
 // Codes: See Above.
 func API_MakeBook(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	if validPerm, permErr := HasPermission(res, req, api_Make_Permission); !validPerm {
+	if validPerm, permErr := HasPermission(res, req, Settings.Permissions.APIMake, ScopeOf("Book", req.FormValue("ID")), ScopeOf("Catalog", req.FormValue("CatalogID"))); !validPerm {
 		// User Must be at least Writer.
 		fmt.Fprint(res, `{"result":"failure","reason":"Invalid Authorization: `+permErr.Error()+`","code":418}`)
 		return
@@ -118,9 +115,10 @@ func API_MakeBook(res http.ResponseWriter, req *http.Request, params httprouter.
 
 	bookID, _ := strconv.Atoi(req.FormValue("ID"))
 
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 	bookForDatastore, getErr := GetBookFromDatastore(ctx, int64(bookID))
 	HandleError(res, getErr)
+	before := bookForDatastore
 
 	if catKey, parseErr := strconv.ParseInt(req.FormValue("CatalogID"), 10, 64); parseErr == nil && catKey != int64(0) { // if you're giving me a catalog, we're good
 		bookForDatastore.Parent = catKey
@@ -151,14 +149,29 @@ func API_MakeBook(res http.ResponseWriter, req *http.Request, params httprouter.
 		bookForDatastore.Tags = req.FormValue("Tags")
 	}
 
+	if req.FormValue("Visibility") != "" {
+		vis, visErr := ParseVisibility(req.FormValue("Visibility"))
+		if visErr != nil {
+			fmt.Fprint(res, `{"result":"failure","reason":"`+visErr.Error()+`","code":400}`)
+			return
+		}
+		bookForDatastore.Visibility = vis
+	} else if bookID == 0 { // new books start with the configured visibility
+		bookForDatastore.Visibility = Settings.Books.DefaultVisibility
+	}
+
 	if req.FormValue("Description") != "" {
 		bookForDatastore.Description = template.HTML(req.FormValue("Description"))
 	}
 
 	rk, putErr := PlaceInDatastore(ctx, bookForDatastore.ID, &bookForDatastore)
 	HandleError(res, putErr)
+	if putErr == nil {
+		RecordAudit(res, req, auditWriteAction(bookID), "Book", rk, before, &bookForDatastore)
+		SaveRevision(res, req, "Book", rk, before, &bookForDatastore)
+	}
 
-	fmt.Fprint(res, `{"result":"success","reason":"","code":0,"object":{"Title":"`, bookForDatastore.Title, `","ID":"`, rk.IntID(), `"}}`)
+	fmt.Fprint(res, `{"result":"success","reason":"","code":0,"object":{"Title":"`, bookForDatastore.Title, `","ID":"`, rk, `"}}`)
 }
 
 // Call: /api/create/chapter
@@ -171,7 +184,7 @@ func API_MakeBook(res http.ResponseWriter, req *http.Request, params httprouter.
 // Optional Options: Version, Description
 // Codes: See Above.
 func API_MakeChapter(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	if validPerm, permErr := HasPermission(res, req, api_Make_Permission); !validPerm {
+	if validPerm, permErr := HasPermission(res, req, Settings.Permissions.APIMake, ScopeOf("Chapter", req.FormValue("ID")), ScopeOf("Book", req.FormValue("BookID"))); !validPerm {
 		// User Must be at least Writer.
 		fmt.Fprint(res, `{"result":"failure","reason":"Invalid Authorization: `+permErr.Error()+`","code":418}`)
 		return
@@ -179,9 +192,10 @@ func API_MakeChapter(res http.ResponseWriter, req *http.Request, params httprout
 
 	chapterID, _ := strconv.Atoi(req.FormValue("ID"))
 
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 	chapterForDatastore, getErr := GetChapterFromDatastore(ctx, int64(chapterID))
 	HandleError(res, getErr)
+	before := chapterForDatastore
 
 	bookID, numErr2 := strconv.Atoi(req.FormValue("BookID"))
 	if numErr2 == nil { // if you're giving me a catalog, we're good
@@ -215,8 +229,12 @@ func API_MakeChapter(res http.ResponseWriter, req *http.Request, params httprout
 
 	rk, putErr := PlaceInDatastore(ctx, chapterForDatastore.ID, &chapterForDatastore)
 	HandleError(res, putErr)
+	if putErr == nil {
+		RecordAudit(res, req, auditWriteAction(chapterID), "Chapter", rk, before, &chapterForDatastore)
+		SaveRevision(res, req, "Chapter", rk, before, &chapterForDatastore)
+	}
 
-	fmt.Fprint(res, `{"result":"success","reason":"","code":0,"object":{"Title":"`, chapterForDatastore.Title, `","ID":"`, rk.IntID(), `"}}`)
+	fmt.Fprint(res, `{"result":"success","reason":"","code":0,"object":{"Title":"`, chapterForDatastore.Title, `","ID":"`, rk, `"}}`)
 }
 
 // Call: /api/create/section
@@ -229,7 +247,7 @@ func API_MakeChapter(res http.ResponseWriter, req *http.Request, params httprout
 // Optional Options: Version, Description
 // Codes: See Above.
 func API_MakeSection(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	if validPerm, permErr := HasPermission(res, req, api_Make_Permission); !validPerm {
+	if validPerm, permErr := HasPermission(res, req, Settings.Permissions.APIMake, ScopeOf("Section", req.FormValue("ID")), ScopeOf("Chapter", req.FormValue("ChapterID"))); !validPerm {
 		// User Must be at least Writer.
 		fmt.Fprint(res, `{"result":"failure","reason":"Invalid Authorization: `+permErr.Error()+`","code":418}`)
 		return
@@ -237,9 +255,10 @@ func API_MakeSection(res http.ResponseWriter, req *http.Request, params httprout
 
 	sectionID, _ := strconv.Atoi(req.FormValue("ID"))
 
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 	sectionForDatastore, getErr := GetSectionFromDatastore(ctx, int64(sectionID))
 	HandleError(res, getErr)
+	before := sectionForDatastore
 
 	chapterID, numErr2 := strconv.Atoi(req.FormValue("ChapterID"))
 	if numErr2 == nil { // if your giving me a catalog, we're good
@@ -273,8 +292,12 @@ func API_MakeSection(res http.ResponseWriter, req *http.Request, params httprout
 
 	rk, putErr := PlaceInDatastore(ctx, sectionForDatastore.ID, &sectionForDatastore)
 	HandleError(res, putErr)
+	if putErr == nil {
+		RecordAudit(res, req, auditWriteAction(sectionID), "Section", rk, before, &sectionForDatastore)
+		SaveRevision(res, req, "Section", rk, before, &sectionForDatastore)
+	}
 
-	fmt.Fprint(res, `{"result":"success","reason":"","code":0,"object":{"Title":"`, sectionForDatastore.Title, `","ID":"`, rk.IntID(), `"}}`)
+	fmt.Fprint(res, `{"result":"success","reason":"","code":0,"object":{"Title":"`, sectionForDatastore.Title, `","ID":"`, rk, `"}}`)
 }
 
 // Call: /api/create/objective
@@ -287,16 +310,17 @@ func API_MakeSection(res http.ResponseWriter, req *http.Request, params httprout
 // Optional Options: Version, Content, KeyTakeaways, Author
 // Codes: See Above.
 func API_MakeObjective(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	if validPerm, permErr := HasPermission(res, req, api_Make_Permission); !validPerm {
+	if validPerm, permErr := HasPermission(res, req, Settings.Permissions.APIMake, ScopeOf("Objective", req.FormValue("ID")), ScopeOf("Section", req.FormValue("SectionID"))); !validPerm {
 		// User Must be at least Writer.
 		fmt.Fprint(res, `{"result":"failure","reason":"Invalid Authorization: `+permErr.Error()+`","code":418}`)
 		return
 	}
 
 	ObjectiveID, _ := strconv.Atoi(req.FormValue("ID"))
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 	objectiveForDatastore, getErr := GetObjectiveFromDatastore(ctx, int64(ObjectiveID))
 	HandleError(res, getErr)
+	before := objectiveForDatastore
 
 	sectionID, numErr2 := strconv.Atoi(req.FormValue("SectionID"))
 	if numErr2 == nil { // if you're giving me a section, we're good
@@ -338,8 +362,12 @@ func API_MakeObjective(res http.ResponseWriter, req *http.Request, params httpro
 
 	rk, putErr := PlaceInDatastore(ctx, objectiveForDatastore.ID, &objectiveForDatastore)
 	HandleError(res, putErr)
+	if putErr == nil {
+		RecordAudit(res, req, auditWriteAction(ObjectiveID), "Objective", rk, before, &objectiveForDatastore)
+		SaveRevision(res, req, "Objective", rk, before, &objectiveForDatastore)
+	}
 
-	fmt.Fprint(res, `{"result":"success","reason":"","code":0,"object":{"Title":"`, objectiveForDatastore.Title, `","ID":"`, rk.IntID(), `"}}`)
+	fmt.Fprint(res, `{"result":"success","reason":"","code":0,"object":{"Title":"`, objectiveForDatastore.Title, `","ID":"`, rk, `"}}`)
 }
 
 // Call: /api/create/exercise
@@ -352,7 +380,7 @@ func API_MakeObjective(res http.ResponseWriter, req *http.Request, params httpro
 // Optional Options: Instruction, Question, Solution
 // Codes: See Above.
 func API_MakeExercise(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	if validPerm, permErr := HasPermission(res, req, api_Make_Permission); !validPerm {
+	if validPerm, permErr := HasPermission(res, req, Settings.Permissions.APIMake, ScopeOf("Exercise", req.FormValue("ID")), ScopeOf("Objective", req.FormValue("ObjectiveID"))); !validPerm {
 		// User Must be at least Writer.
 		fmt.Fprint(res, `{"result":"failure","reason":"Invalid Authorization: `+permErr.Error()+`","code":418}`)
 		return
@@ -360,9 +388,10 @@ func API_MakeExercise(res http.ResponseWriter, req *http.Request, params httprou
 
 	exerID, _ := strconv.Atoi(req.FormValue("ID"))
 
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 	exerciseForDatastore, getErr := GetExerciseFromDatastore(ctx, int64(exerID))
 	HandleError(res, getErr)
+	before := exerciseForDatastore
 
 	objectiveID, numErr2 := strconv.Atoi(req.FormValue("ObjectiveID"))
 	if numErr2 == nil { // if you're giving me a section, we're good
@@ -393,6 +422,10 @@ func API_MakeExercise(res http.ResponseWriter, req *http.Request, params httprou
 
 	rk, putErr := PlaceInDatastore(ctx, exerciseForDatastore.ID, &exerciseForDatastore)
 	HandleError(res, putErr)
+	if putErr == nil {
+		RecordAudit(res, req, auditWriteAction(exerID), "Exercise", rk, before, &exerciseForDatastore)
+		SaveRevision(res, req, "Exercise", rk, before, &exerciseForDatastore)
+	}
 
-	fmt.Fprint(res, `{"result":"success","reason":"","code":0,"object":{"Title":"","ID":"`, rk.IntID(), `"}}`)
+	fmt.Fprint(res, `{"result":"success","reason":"","code":0,"object":{"Title":"","ID":"`, rk, `"}}`)
 }
@@ -0,0 +1,114 @@
+package main
+
+/*
+AUTH_csrf.go by Allen J. Mills
+    mm.d.yy
+
+    Cross site request forgery protection.
+    Each session has a token, an HMAC of the session id, that pages
+    embed and send back with every state changing request:
+        header X-CSRF-Token (set for all jQuery ajax by ens-contentSystem.js)
+        or form/query value csrf_token (plain forms and CKEditor uploads)
+    Requests that authenticate with an Authorization header never use
+    our cookies, so another site cannot forge them and they are exempt.
+*/
+
+import (
+	"crypto/hmac"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrInvalidCSRF          = errors.New("CSRF: Missing or invalid request token. Reload the page and try again.") // ErrInvalidCSRF is returned when a cookie authenticated request fails its token check.
+	ErrInvalidAuthorization = errors.New("Authorization: Unsupported or invalid Authorization header.")            // ErrInvalidAuthorization is returned when an Authorization header cannot be used.
+)
+
+const (
+	CSRFHeaderName = "X-CSRF-Token" // Header checked for the token.
+	CSRFFieldName  = "csrf_token"   // Form or query value checked when the header is absent.
+)
+
+// Internal Function
+// Description:
+// The CSRF token belonging to session s.
+func CSRFTokenFor(s *Session) string {
+	return signValue(getSessionKey(), "csrf:"+s.ID)
+}
+
+// Internal Function
+// Description:
+// Reports whether req changes state and so must be protected.
+func isUnsafeMethod(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return false
+	}
+	return true
+}
+
+// Internal Function
+// Description:
+// Reports whether req authenticates through its Authorization header
+// instead of our session cookie.
+func usesHeaderAuth(req *http.Request) bool {
+	return req.Header.Get("Authorization") != ""
+}
+
+// Internal Function
+// Description:
+// Checks the token sent with req against the session's token.
+//
+// Returns:
+//      failure?(error) - ErrInvalidCSRF when the token is missing or wrong.
+func CheckCSRF(req *http.Request, token string) error {
+	sent := req.Header.Get(CSRFHeaderName)
+	if sent == "" {
+		sent = req.FormValue(CSRFFieldName)
+	}
+	if sent == "" || token == "" || !hmac.Equal([]byte(sent), []byte(token)) {
+		return ErrInvalidCSRF
+	}
+	return nil
+}
+
+// Internal Function
+// Description:
+// Finds the user making req. Cookie sessions must pass the CSRF check on
+// unsafe methods; Authorization header requests skip the cookie entirely.
+//
+// Returns:
+//      user(*User) - The authenticated user, with CSRFToken set for sessions.
+//      failure?(error) - Session, CSRF, or authorization errors.
+func GetUserFromRequest(res http.ResponseWriter, req *http.Request) (*User, error) {
+	if usesHeaderAuth(req) {
+		return GetUserFromAuthorization(req)
+	}
+
+	u, sessErr := GetUserFromSession(res, req)
+	if sessErr != nil {
+		return u, sessErr
+	}
+	if isUnsafeMethod(req) {
+		if csrfErr := CheckCSRF(req, u.CSRFToken); csrfErr != nil {
+			return &User{}, csrfErr
+		}
+	}
+	return u, nil
+}
+
+// Internal Function
+// Description:
+// Authenticates req from its Authorization header.
+// The only accepted scheme is "Bearer <API token>", see AUTH_tokens.go.
+func GetUserFromAuthorization(req *http.Request) (*User, error) {
+	scheme, token := "", ""
+	if fields := strings.Fields(req.Header.Get("Authorization")); len(fields) == 2 {
+		scheme, token = fields[0], fields[1]
+	}
+	if !strings.EqualFold(scheme, "Bearer") {
+		return &User{}, ErrInvalidAuthorization
+	}
+	return GetUserFromAPIToken(NewContext(req), token)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCSRFCheck(t *testing.T) {
+	ctx, u := setupSessionTest(t)
+	c, s := loginForTest(t, ctx, u)
+	other := MakeUser("Other User", "other@example.com")
+	if putErr := PlaceUserInDatastore(ctx, &other); putErr != nil {
+		t.Fatal(putErr)
+	}
+	_, otherSession := loginForTest(t, ctx, &other)
+
+	cases := []struct {
+		name   string
+		method string
+		form   url.Values
+		header string
+		want   error
+	}{
+		{"safe method without token", "GET", nil, "", nil},
+		{"unsafe method without token", "POST", url.Values{}, "", ErrInvalidCSRF},
+		{"token of another session", "POST", url.Values{CSRFFieldName: {CSRFTokenFor(otherSession)}}, "", ErrInvalidCSRF},
+		{"header of another session", "DELETE", nil, CSRFTokenFor(otherSession), ErrInvalidCSRF},
+		{"own token in the form", "POST", url.Values{CSRFFieldName: {CSRFTokenFor(s)}}, "", nil},
+		{"own token in the header", "DELETE", nil, CSRFTokenFor(s), nil},
+	}
+	for _, tc := range cases {
+		req := sessionRequest(tc.method, c, tc.form)
+		if tc.header != "" {
+			req.Header.Set(CSRFHeaderName, tc.header)
+		}
+		got, err := GetUserFromRequest(httptest.NewRecorder(), req)
+		if err != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+		if err == nil && got.ID != u.ID {
+			t.Errorf("%s: got user %d, want %d", tc.name, got.ID, u.ID)
+		}
+	}
+}
+
+func TestCSRFBearerExempt(t *testing.T) {
+	ctx, u := setupSessionTest(t)
+	token, _, createErr := CreateAPIToken(ctx, u, "test", WritePermissions, 0)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+
+	req := sessionRequest("POST", nil, url.Values{})
+	req.Header.Set("Authorization", "Bearer "+token)
+	got, err := GetUserFromRequest(httptest.NewRecorder(), req)
+	if err != nil || got.ID != u.ID {
+		t.Errorf("bearer POST without a CSRF token gave %+v, %v", got, err)
+	}
+
+	req = sessionRequest("POST", nil, url.Values{})
+	req.Header.Set("Authorization", "Bearer "+token+"x")
+	if _, err := GetUserFromRequest(httptest.NewRecorder(), req); err == nil {
+		t.Error("wrong bearer token was accepted")
+	}
+}
@@ -11,29 +11,21 @@ AUTH_authentication.go by Allen J. Mills
 
 import (
 	"fmt"
-	"github.com/Esseh/retrievable"
 	"github.com/julienschmidt/httprouter"
 	"github.com/nu7hatch/gouuid"
-	"golang.org/x/net/context"
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/user"
 	"net/http"
 	"strings"
-	"time"
-)
-
-var (
-	RegisterUUIDTime = time.Minute * time.Duration(3) // Three minutes until cookie deletes itself.
 )
 
 // Internal Function, Outbound Service
 // Description:
-// This will create a google login url to have a user login using their gmail. It will then redirect back to an internal url of our choosing.
+// This will create a login url from the active identity provider (on App Engine, a google login
+// using their gmail). It will then redirect back to an internal url of our choosing.
 //
 // Returns:
-//      url(string) - Google login url with redirect.
-func GetOAuthURL(ctx context.Context, redirect string) string {
-	login, _ := user.LoginURLFederated(ctx, redirect, "")
+//      url(string) - Login url with redirect.
+func GetOAuthURL(req *http.Request, redirect string) string {
+	login, _ := Identities.LoginURL(req, redirect)
 	return login
 }
 
@@ -49,7 +41,7 @@ func NewUUID() string {
 
 // Call: /logout
 // Description:
-// Deletes the user's local session data.
+// Deletes the user's session, both the server record and local cookie.
 // Will attempt to redirect the user to page at option:redirect if exists.
 //
 // Method: GET
@@ -57,7 +49,7 @@ func NewUUID() string {
 // Mandatory Options:
 // Optional Options: redirect
 func AUTH_Logout_GET(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	DeleteSession(res)
+	DeleteSession(res, req)
 	// ctx := appengine.NewContext(req)
 	// lgo, _ := user.LogoutURL(ctx, "/"+req.FormValue("redirect"))
 	http.Redirect(res, req, "/", http.StatusSeeOther)
@@ -79,15 +71,15 @@ func AUTH_Logout_GET(res http.ResponseWriter, req *http.Request, params httprout
 // Mandatory Options:
 // Optional Options: redirect
 func AUTH_Register_GET(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 	screen := User{}
 	// Step 1: UUID
 	registerUUID, cErr := FromCookie(req, "UUID")
 	if cErr != nil { // No uuid, we'll make one
 		registerUUID = NewUUID()
-		ToCookie(res, "UUID", registerUUID, RegisterUUIDTime)
+		ToCookie(res, "UUID", registerUUID, Settings.Register.UUIDTime.Duration)
 	} else {
-		getErr := retrievable.GetFromMemcache(ctx, registerUUID, &screen)
+		getErr := GetFromCache(ctx, registerUUID, &screen)
 		if ErrorPage(res, "UUID Error!", getErr) {
 			return
 		}
@@ -96,16 +88,16 @@ func AUTH_Register_GET(res http.ResponseWriter, req *http.Request, params httpro
 	if authed, _ := FromCookie(req, "AUTHED"); authed != "yes" {
 		// if req.FormValue("Oauth") != "yes" { // has oauth occured?
 		// First time oauth. Go out to google.
-		ToCookie(res, "AUTHED", "yes", RegisterUUIDTime)
-		retrievable.PlaceInMemcache(ctx, registerUUID, screen, 0)
-		lgn, _ := user.LoginURLFederated(ctx, "/register?Oauth=yes&redirect="+req.FormValue("redirect"), "")
+		ToCookie(res, "AUTHED", "yes", Settings.Register.UUIDTime.Duration)
+		PlaceInCache(ctx, registerUUID, screen, 0)
+		lgn := GetOAuthURL(req, "/register?Oauth=yes&redirect="+req.FormValue("redirect"))
 		http.Redirect(res, req, lgn, http.StatusFound)
 		return
 	}
 
 	DeleteCookie(res, "AUTHED")
 
-	u := user.Current(ctx)
+	u := Identities.Current(req)
 	if u == nil {
 		ErrorPage(res, "OAuth Error!", ErrNotLoggedIn)
 		return
@@ -115,7 +107,7 @@ func AUTH_Register_GET(res http.ResponseWriter, req *http.Request, params httpro
 		screen.Permission = AdminPermissions
 	}
 	// Output and get Name
-	retrievable.PlaceInMemcache(ctx, registerUUID, screen, 0)
+	PlaceInCache(ctx, registerUUID, screen, 0)
 	ServeTemplateWithParams(res, "register.html", screen)
 	return
 }
@@ -135,7 +127,7 @@ func AUTH_Register_GET_USINGUUID(res http.ResponseWriter, req *http.Request, par
 // Mandatory Options:
 // Optional Options: redirect
 func AUTH_Register_POST(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 
 	ruuid, cErr := FromCookie(req, "UUID")
 	if ErrorPage(res, "UUID Error: Cannot find UUID cookie.", cErr) {
@@ -143,7 +135,7 @@ func AUTH_Register_POST(res http.ResponseWriter, req *http.Request, params httpr
 	}
 
 	uNew := &User{}
-	getErr := retrievable.GetFromMemcache(ctx, ruuid, uNew)
+	getErr := GetFromCache(ctx, ruuid, uNew)
 	if ErrorPage(res, "UUID Error: Cannot find UUID memcache value.", getErr) {
 		return
 	}
@@ -168,7 +160,8 @@ func AUTH_Register_POST(res http.ResponseWriter, req *http.Request, params httpr
 		return b
 	}(uNew.Permission, lvl)
 
-	_, putErr := retrievable.PlaceEntity(ctx, int64(0), uNew)
+	uNew.ID = 0
+	putErr := PlaceUserInDatastore(ctx, uNew)
 	if ErrorPage(res, "User Creation Error", putErr) {
 		return
 	}
@@ -177,7 +170,9 @@ func AUTH_Register_POST(res http.ResponseWriter, req *http.Request, params httpr
 	if ErrorPage(res, "Login Creation Error!", createErr) {
 		return
 	}
-	http.SetCookie(res, MakeSessionCookie(uNew))
+	if ErrorPage(res, "Session Creation Error!", SetSession(ctx, res, req, uNew)) {
+		return
+	}
 	DeleteCookie(res, "UUID")
 	http.Redirect(res, req, "/"+req.FormValue("redirect"), http.StatusSeeOther)
 }
@@ -206,16 +201,16 @@ func AUTH_Register_POST(res http.ResponseWriter, req *http.Request, params httpr
 func AUTH_Login_GET(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
 	// User has requested a login procedure.
 
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 
 	if authed, _ := FromCookie(req, "AUTHED"); authed != "yes" {
-		ToCookie(res, "AUTHED", "yes", RegisterUUIDTime)
-		lgn, _ := user.LoginURLFederated(ctx, "/login?Oauth=yes&redirect="+req.FormValue("redirect"), "")
+		ToCookie(res, "AUTHED", "yes", Settings.Register.UUIDTime.Duration)
+		lgn := GetOAuthURL(req, "/login?Oauth=yes&redirect="+req.FormValue("redirect"))
 		http.Redirect(res, req, lgn, http.StatusFound)
 		return
 	}
 
-	ou := user.Current(ctx)
+	ou := Identities.Current(req)
 	if ou == nil {
 		DeleteCookie(res, "AUTHED") // spoofed AUTHED cookie. Delete this one and give an error page.
 		ErrorPage(res, "Invalid Login State: OAuth", ErrNotLoggedIn)
@@ -229,13 +224,14 @@ func AUTH_Login_GET(res http.ResponseWriter, req *http.Request, params httproute
 
 	DeleteCookie(res, "AUTHED") // We've gone past the point of needing the auth cookie. go fourth.
 
-	u := &User{}
-	getuErr := retrievable.GetEntity(ctx, uid, u)
+	u, getuErr := GetUserFromDatastore(ctx, uid)
 	if ErrorPage(res, "No Such User", getuErr) {
 		return
 	}
 
-	http.SetCookie(res, MakeSessionCookie(u))
+	if ErrorPage(res, "Session Creation Error!", SetSession(ctx, res, req, u)) {
+		return
+	}
 	http.Redirect(res, req, "/"+req.FormValue("redirect"), http.StatusFound)
 }
 
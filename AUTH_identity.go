@@ -0,0 +1,164 @@
+package main
+
+/*
+AUTH_identity.go by Allen J. Mills
+    mm.d.yy
+
+    Identity providers answer "who is this person?" before we
+    have a session for them. On App Engine that is the users API,
+    when running standalone it is a trusted header set by an
+    authenticating reverse proxy in front of us. The header is only
+    believed on connections from the proxy's own addresses, listed in
+    Identity.TrustedProxies, so clients that reach the server directly
+    cannot log in as anyone they like.
+*/
+
+import (
+	"errors"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/user"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrUnknownIdentity = errors.New("Identity: Unknown identity provider.")                           // ErrUnknownIdentity is returned when selecting a provider that does not exist.
+	ErrTrustedProxy    = errors.New("Identity: Trusted proxies must be IP addresses or CIDR ranges.") // ErrTrustedProxy is returned when Identity.TrustedProxies cannot be read.
+)
+
+// Type: Identity
+// A person authenticated by the active IdentityProvider.
+type Identity struct {
+	Email string
+	Admin bool
+}
+
+// Type: IdentityProvider
+// Source of outside authentication used by login and registration.
+type IdentityProvider interface {
+	// LoginURL gives the url that authenticates the user and then returns them to redirect.
+	LoginURL(req *http.Request, redirect string) (string, error)
+	// Current gives the authenticated person for req, or nil if there is none.
+	Current(req *http.Request) *Identity
+}
+
+// Identities is the active identity provider.
+var Identities IdentityProvider = AppEngineIdentity{}
+
+// Type: AppEngineIdentity
+// Google accounts through the App Engine users API.
+type AppEngineIdentity struct{}
+
+func (AppEngineIdentity) LoginURL(req *http.Request, redirect string) (string, error) {
+	return user.LoginURLFederated(appengine.NewContext(req), redirect, "")
+}
+
+func (AppEngineIdentity) Current(req *http.Request) *Identity {
+	u := user.Current(appengine.NewContext(req))
+	if u == nil {
+		return nil
+	}
+	return &Identity{Email: u.Email, Admin: u.Admin}
+}
+
+// Type: HeaderIdentity
+// Trusts an email address placed on every request by a reverse proxy
+// (oauth2-proxy, IAP, and the like). The header is ignored on requests
+// that do not come straight from one of Proxies, since anyone else
+// could forge it.
+type HeaderIdentity struct {
+	Header  string       // Request header holding the email, e.g. X-Forwarded-Email
+	Admins  []string     // Emails given administrator permissions on registration
+	Proxies []*net.IPNet // Addresses the header is believed from
+}
+
+// The proxy has already authenticated the user, so login goes straight back.
+func (h HeaderIdentity) LoginURL(req *http.Request, redirect string) (string, error) {
+	return redirect, nil
+}
+
+func (h HeaderIdentity) Current(req *http.Request) *Identity {
+	email := strings.TrimSpace(req.Header.Get(h.Header))
+	if email == "" || !h.trusted(req.RemoteAddr) {
+		return nil
+	}
+	id := &Identity{Email: email}
+	for _, admin := range h.Admins {
+		if strings.EqualFold(admin, email) {
+			id.Admin = true
+		}
+	}
+	return id
+}
+
+// Method: trusted
+// Whether remoteAddr, the host:port of a connection, is one of h.Proxies.
+func (h HeaderIdentity) trusted(remoteAddr string) bool {
+	host, _, splitErr := net.SplitHostPort(remoteAddr)
+	if splitErr != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range h.Proxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Internal Function
+// Description:
+// Reads trusted proxy addresses, each an IP address or a CIDR range.
+//
+// Returns:
+//      proxies([]*net.IPNet) - One range per entry; an address is a range of one.
+//      failure?(error) - ErrTrustedProxy if an entry is neither.
+func ParseTrustedProxies(list []string) ([]*net.IPNet, error) {
+	proxies := make([]*net.IPNet, 0, len(list))
+	for _, entry := range list {
+		if _, network, cidrErr := net.ParseCIDR(entry); cidrErr == nil {
+			proxies = append(proxies, network)
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, ErrTrustedProxy
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return proxies, nil
+}
+
+// Internal Function
+// Description:
+// Builds the identity provider named by cfg.Identity.Provider.
+//
+// Providers:
+//      appengine - App Engine users API
+//      header - trusted reverse proxy header, see HeaderIdentity
+//
+// Returns:
+//      provider(IdentityProvider) - Ready to use provider.
+//      failure?(error) - ErrUnknownIdentity if the name is not known, ErrTrustedProxy for bad proxies.
+func OpenIdentityProvider(cfg Config) (IdentityProvider, error) {
+	switch cfg.Identity.Provider {
+	case "appengine":
+		return AppEngineIdentity{}, nil
+	case "header":
+		proxies, proxyErr := ParseTrustedProxies(cfg.Identity.TrustedProxies)
+		if proxyErr != nil {
+			return nil, proxyErr
+		}
+		return HeaderIdentity{Header: cfg.Identity.Header, Admins: cfg.Identity.Admins, Proxies: proxies}, nil
+	}
+	return nil, ErrUnknownIdentity
+}
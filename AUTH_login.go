@@ -8,9 +8,7 @@ filename.go by Allen J. Mills
 */
 import (
 	"errors"
-	"github.com/Esseh/retrievable"
 	"golang.org/x/net/context"
-	"google.golang.org/appengine/datastore"
 )
 
 var (
@@ -21,31 +19,38 @@ type UserLogin struct {
 	UID int64
 }
 
-func (ul *UserLogin) Key(ctx context.Context, id interface{}) *datastore.Key {
-	return datastore.NewKey(ctx, "Logins", id.(string), 0, nil)
+func (ul *UserLogin) Kind() string {
+	return "Logins"
 }
 
 func CreateLogin(ctx context.Context, u *User) error {
-	_, lgnErr := retrievable.PlaceInDatastore(ctx, u.Email, &UserLogin{u.ID})
+	_, lgnErr := Stores.Entities.Put(ctx, NewEntityKey("Logins", u.Email), &UserLogin{u.ID})
 	return lgnErr
 }
 
 func GetUIDFromLogin(ctx context.Context, email string) (int64, error) {
 	ul := &UserLogin{}
-	getErr := retrievable.GetFromDatastore(ctx, email, ul)
+	getErr := Stores.Entities.Get(ctx, NewEntityKey("Logins", email), ul)
 	return ul.UID, getErr
 }
 
 func DeleteUserAndLogin(ctx context.Context, email string) error {
 	ul := &UserLogin{}
-	getErr := retrievable.GetFromDatastore(ctx, email, ul)
+	getErr := Stores.Entities.Get(ctx, NewEntityKey("Logins", email), ul)
 	if getErr != nil {
 		return getErr
 	}
 
-	toDelete := make([]*datastore.Key, 0)
-	toDelete = append(toDelete, ul.Key(ctx, email))
-	toDelete = append(toDelete, (&User{}).Key(ctx, ul.UID))
+	if tokenErr := DeleteAPITokensForUser(ctx, ul.UID); tokenErr != nil {
+		return tokenErr
+	}
+	if grantErr := DeleteGrantsForUser(ctx, ul.UID); grantErr != nil {
+		return grantErr
+	}
+
+	toDelete := make([]EntityKey, 0)
+	toDelete = append(toDelete, NewEntityKey(ul.Kind(), email))
+	toDelete = append(toDelete, NewEntityKey(UsersTable, ul.UID))
 
-	return datastore.DeleteMulti(ctx, toDelete)
+	return Stores.Entities.Delete(ctx, toDelete)
 }
@@ -6,67 +6,343 @@ package main
 AUTH_session.go by Allen J. Mills
     mm.d.yy
 
-    Description
+    Sessions are stored server side in the CacheStore and referenced
+    from the browser by a random, HMAC signed session id. The cookie
+    carries no user information of its own.
 */
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
-	"github.com/Esseh/retrievable"
-	"google.golang.org/appengine"
+	"golang.org/x/net/context"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 var (
 	ErrNotLoggedIn    = errors.New("Session: No Logged In User")   // ErrNotLoggedIn is thrown when a session cannot find user information.
 	ErrTimedOut       = errors.New("Session: User has timed out.") // ErrTimedOut is thrown when a session is missing a validation cookie or memcache
 	ErrInvalidSession = errors.New("Session: Invalid session information.")
+
+	ErrConfirmMissing  = errors.New("Confirm: Confirm is missing. Preview the change first.")                // ErrConfirmMissing is returned when a change has no Confirm token.
+	ErrConfirmExpired  = errors.New("Confirm: Confirm has expired. Preview the change again.")               // ErrConfirmExpired is returned for tokens older than confirmLifetime.
+	ErrConfirmMismatch = errors.New("Confirm: Confirm does not match what would be changed. Preview again.") // ErrConfirmMismatch is returned when the token is for another change or user.
 )
 
-func SetSesson(res http.ResponseWriter, u *User) {
-	http.SetCookie(res, &http.Cookie{
-		Name:  "Session",
-		Value: fmt.Sprint(u.ID),
-		Path:  "/",
+const (
+	// SessionCookieName is the name of the browser cookie holding the signed session id.
+	SessionCookieName = "Session"
+
+	confirmLifetime = 10 * time.Minute // How long a preview's Confirm token can be used.
+)
+
+// Type: Session
+// Server side record of a logged in user.
+type Session struct {
+	ID      string `json:"-"`
+	UID     int64
+	Issued  time.Time
+	Expires time.Time
+}
+
+// Method: Expired
+// Reports whether this session is past its expiration time.
+func (s *Session) Expired(now time.Time) bool {
+	return !now.Before(s.Expires)
+}
+
+// Method: NeedsRenewal
+// Sessions are renewed once less than half of their lifetime remains.
+func (s *Session) NeedsRenewal(now time.Time) bool {
+	return s.Expires.Sub(now) < Settings.Session.Lifetime.Duration/2
+}
+
+//// --------------------------
+// Session Storage
+// Sessions are kept in the active CacheStore, each living
+// until its own expiration.
+////
+
+func putSession(ctx context.Context, s *Session) error {
+	return PlaceInCache(ctx, "Session:"+s.ID, s, s.Expires.Sub(time.Now()))
+}
+
+func getSession(ctx context.Context, id string) (*Session, error) {
+	s := &Session{}
+	if err := GetFromCache(ctx, "Session:"+id, s); err != nil {
+		return nil, ErrTimedOut
+	}
+	s.ID = id
+	return s, nil
+}
+
+func deleteSession(ctx context.Context, id string) error {
+	return Stores.Cache.CacheDelete(ctx, "Session:"+id)
+}
+
+//// --------------------------
+// Session Tokens
+// The cookie value is "<id>.<signature>" where signature is an
+// HMAC-SHA256 of the id using Settings.Session.Secret.
+////
+
+var (
+	sessionKeyOnce sync.Once
+	sessionKey     []byte
+)
+
+// Internal Function
+// Description:
+// Returns the key used to sign session ids and confirm tokens. When no
+// Session.Secret is configured, which Validate only allows for the memory
+// backend, a random key is made that only lives as long as this instance.
+func getSessionKey() []byte {
+	sessionKeyOnce.Do(func() {
+		if Settings.Session.Secret != "" {
+			sessionKey = []byte(Settings.Session.Secret)
+			return
+		}
+		sessionKey = make([]byte, 32)
+		rand.Read(sessionKey)
 	})
+	return sessionKey
+}
+
+// Internal Function
+// Description:
+// Makes a random, url safe identifier of n bytes of entropy.
+func randomToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Internal Function
+// Description:
+// Signs value with key, returning the url safe signature.
+func signValue(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Internal Function
+// Description:
+// Produces the cookie value for a session id.
+func signSessionID(id string) string {
+	return id + "." + signValue(getSessionKey(), id)
+}
+
+// Internal Function
+// Description:
+// Checks the signature on a cookie value and returns the session id it holds.
+//
+// Returns:
+//      id(string) - Verified session id
+//      failure?(error) - ErrInvalidSession if the value was tampered with.
+func verifySessionValue(value string) (string, error) {
+	dot := strings.LastIndex(value, ".")
+	if dot <= 0 {
+		return "", ErrInvalidSession
+	}
+	id, sig := value[:dot], value[dot+1:]
+	if !hmac.Equal([]byte(sig), []byte(signValue(getSessionKey(), id))) {
+		return "", ErrInvalidSession
+	}
+	return id, nil
 }
 
-func MakeSessionCookie(u *User) *http.Cookie {
+//// --------------------------
+// Session Lifecycle
+// Creation, lookup, renewal, and removal of sessions.
+////
+
+// Internal Function
+// Description:
+// Creates a new session for user u and returns the cookie that references it.
+//
+// Returns:
+//      cookie(*http.Cookie) - Session cookie to hand to the browser that sent req.
+//      failure?(error) - If the session could not be stored.
+func MakeSessionCookie(ctx context.Context, req *http.Request, u *User) (*http.Cookie, error) {
+	now := time.Now()
+	s := &Session{
+		ID:      randomToken(32),
+		UID:     u.ID,
+		Issued:  now,
+		Expires: now.Add(Settings.Session.Lifetime.Duration),
+	}
+	if err := putSession(ctx, s); err != nil {
+		return nil, err
+	}
+	return sessionCookie(s, req), nil
+}
+
+// Internal Function
+// Description:
+// Creates a new session for user u and places it onto the response.
+//
+// Returns:
+//      failure?(error) - If the session could not be stored.
+func SetSession(ctx context.Context, res http.ResponseWriter, req *http.Request, u *User) error {
+	c, err := MakeSessionCookie(ctx, req, u)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(res, c)
+	return nil
+}
+
+// Internal Function
+// Description:
+// Whether cookies set on req are Secure: it came over TLS, or
+// Session.SecureCookie says the site is only served over https, as it
+// is behind a proxy that ends TLS.
+func secureCookie(req *http.Request) bool {
+	return req.TLS != nil || Settings.Session.SecureCookie
+}
+
+func sessionCookie(s *Session, req *http.Request) *http.Cookie {
 	return &http.Cookie{
-		Name:  "Session",
-		Value: fmt.Sprint(u.ID),
-		Path:  "/",
+		Name:     SessionCookieName,
+		Value:    signSessionID(s.ID),
+		Path:     "/",
+		Expires:  s.Expires,
+		HttpOnly: true,
+		Secure:   secureCookie(req),
+		SameSite: http.SameSiteLaxMode,
 	}
 }
 
-func DeleteSession(res http.ResponseWriter) {
+// Internal Function
+// Description:
+// Invalidates the current session, if any, and clears the browser cookie.
+func DeleteSession(res http.ResponseWriter, req *http.Request) {
+	if c, cerr := req.Cookie(SessionCookieName); cerr == nil {
+		if id, verr := verifySessionValue(c.Value); verr == nil {
+			deleteSession(NewContext(req), id)
+		}
+	}
 	http.SetCookie(res, &http.Cookie{
-		Name:   "Session",
-		Value:  "",
-		Path:   "/",
-		MaxAge: -1,
+		Name:     SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   secureCookie(req),
+		SameSite: http.SameSiteLaxMode,
 	})
 }
 
-func GetUserFromSession(res http.ResponseWriter, req *http.Request) (*User, error) {
-	ctx := appengine.NewContext(req)
-
-	c, cerr := req.Cookie("Session")
+// Internal Function
+// Description:
+// Retrieves the session referenced by the request cookie. Sessions
+// that are past half of their lifetime are renewed.
+//
+// Returns:
+//      session(*Session) - The active session.
+//      failure?(error) - ErrNotLoggedIn, ErrInvalidSession, or ErrTimedOut.
+func GetSession(res http.ResponseWriter, req *http.Request) (*Session, error) {
+	c, cerr := req.Cookie(SessionCookieName)
 	if cerr != nil {
-		return &User{}, ErrNotLoggedIn
+		return nil, ErrNotLoggedIn
+	}
+
+	id, verr := verifySessionValue(c.Value)
+	if verr != nil {
+		return nil, verr
+	}
+
+	ctx := NewContext(req)
+	s, getErr := getSession(ctx, id)
+	if getErr != nil {
+		return nil, ErrTimedOut
+	}
+	s.ID = id
+
+	now := time.Now()
+	if s.Expired(now) {
+		deleteSession(ctx, id)
+		return nil, ErrTimedOut
 	}
 
-	uid, convErr := strconv.ParseInt(c.Value, 10, 64)
-	if convErr != nil || uid == 0 {
-		return &User{}, ErrInvalidSession
+	if s.NeedsRenewal(now) {
+		s.Expires = now.Add(Settings.Session.Lifetime.Duration)
+		if putErr := putSession(ctx, s); putErr == nil {
+			http.SetCookie(res, sessionCookie(s, req))
+		}
 	}
+	return s, nil
+}
 
-	u := &User{}
-	rerr := retrievable.GetEntity(ctx, uid, u)
-	if rerr != nil {
-		return &User{}, rerr
+func GetUserFromSession(res http.ResponseWriter, req *http.Request) (*User, error) {
+	s, sessErr := GetSession(res, req)
+	if sessErr != nil {
+		if sessErr != ErrNotLoggedIn {
+			DeleteSession(res, req)
+		}
+		return &User{}, sessErr
 	}
 
+	u, getErr := GetUserFromDatastore(NewContext(req), s.UID)
+	if getErr != nil {
+		return u, getErr
+	}
+	u.CSRFToken = CSRFTokenFor(s)
 	return u, nil
 }
+
+//// --------------------------
+// Confirm Tokens
+// A preview of a change gives a token, which must be sent back as
+// Confirm to make the change. Tokens are signed with the session key.
+////
+
+// Internal Function
+// Description:
+// Makes the Confirm token for the user of req to make change, valid until
+// expires. change must describe everything the preview showed, so the token
+// is refused for any other change, user, or once what it shows has changed.
+//
+// Returns:
+//      token(string) - "<expiry unix seconds>.<signature>"
+func confirmToken(res http.ResponseWriter, req *http.Request, change string, expires time.Time) string {
+	var uid int64
+	if u, authErr := GetUserFromRequest(res, req); authErr == nil {
+		uid = u.ID
+	}
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	return expiry + "." + signValue(getSessionKey(), fmt.Sprint(uid, ":", expiry, ":", change))
+}
+
+// Internal Function
+// Description:
+// Checks the Confirm option of req against a fresh token for change.
+//
+// Returns:
+//      failure?(error) - ErrConfirmMissing, ErrConfirmExpired, ErrConfirmMismatch
+func checkConfirmToken(res http.ResponseWriter, req *http.Request, change string) error {
+	confirm := req.FormValue("Confirm")
+	dot := strings.Index(confirm, ".")
+	if dot <= 0 {
+		return ErrConfirmMissing
+	}
+	expiry, parseErr := strconv.ParseInt(confirm[:dot], 10, 64)
+	if parseErr != nil {
+		return ErrConfirmMismatch
+	}
+	if time.Now().Unix() > expiry {
+		return ErrConfirmExpired
+	}
+	if !hmac.Equal([]byte(confirm), []byte(confirmToken(res, req, change, time.Unix(expiry, 0)))) {
+		return ErrConfirmMismatch
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"golang.org/x/net/context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Internal Function
+// Description:
+// Starts a test with empty memory storage and one stored Writer.
+func setupSessionTest(t *testing.T) (context.Context, *User) {
+	Stores = NewMemoryBackend()
+	Settings = DefaultSettings()
+	ctx := context.Background()
+	u := MakeUser("Test User", "test@example.com")
+	u.Permission = WritePermissions
+	if putErr := PlaceUserInDatastore(ctx, &u); putErr != nil {
+		t.Fatal(putErr)
+	}
+	return ctx, &u
+}
+
+// Internal Function
+// Description:
+// Makes a request carrying cookie c and, when given, the form values in form.
+func sessionRequest(method string, c *http.Cookie, form url.Values) *http.Request {
+	req := httptest.NewRequest(method, "/", strings.NewReader(form.Encode()))
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if c != nil {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+// Internal Function
+// Description:
+// Logs u in, returning the session cookie and the stored session.
+func loginForTest(t *testing.T, ctx context.Context, u *User) (*http.Cookie, *Session) {
+	c, makeErr := MakeSessionCookie(ctx, sessionRequest("GET", nil, nil), u)
+	if makeErr != nil {
+		t.Fatal(makeErr)
+	}
+	id, verifyErr := verifySessionValue(c.Value)
+	if verifyErr != nil {
+		t.Fatal(verifyErr)
+	}
+	s, getErr := getSession(ctx, id)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	return c, s
+}
+
+func TestSessionCookieTampering(t *testing.T) {
+	ctx, u := setupSessionTest(t)
+	c, s := loginForTest(t, ctx, u)
+
+	if id, err := verifySessionValue(c.Value); err != nil || id != s.ID {
+		t.Fatalf("own cookie gave %q, %v", id, err)
+	}
+	dot := strings.LastIndex(c.Value, ".")
+	other := randomToken(32)
+	for _, value := range []string{
+		"",
+		s.ID,
+		"." + c.Value[dot+1:],
+		other + c.Value[dot:],
+		c.Value[:dot] + "." + signValue([]byte("another key"), s.ID),
+		c.Value + "x",
+	} {
+		if _, err := verifySessionValue(value); err != ErrInvalidSession {
+			t.Errorf("%q gave %v, want ErrInvalidSession", value, err)
+		}
+		tampered := &http.Cookie{Name: SessionCookieName, Value: value}
+		if _, err := GetSession(httptest.NewRecorder(), sessionRequest("GET", tampered, nil)); err == nil {
+			t.Errorf("%q opened a session", value)
+		}
+	}
+}
+
+func TestSessionExpiryAndRenewal(t *testing.T) {
+	ctx, u := setupSessionTest(t)
+	lifetime := Settings.Session.Lifetime.Duration
+
+	c, s := loginForTest(t, ctx, u)
+	res := httptest.NewRecorder()
+	if got, err := GetSession(res, sessionRequest("GET", c, nil)); err != nil || got.UID != u.ID {
+		t.Fatalf("fresh session gave %+v, %v", got, err)
+	}
+	if len(res.Result().Cookies()) != 0 {
+		t.Error("fresh session was renewed")
+	}
+
+	s.Expires = time.Now().Add(lifetime / 4)
+	if putErr := putSession(ctx, s); putErr != nil {
+		t.Fatal(putErr)
+	}
+	res = httptest.NewRecorder()
+	if _, err := GetSession(res, sessionRequest("GET", c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	renewed, _ := getSession(ctx, s.ID)
+	if renewed == nil || renewed.Expires.Before(time.Now().Add(lifetime-time.Minute)) {
+		t.Errorf("old session not renewed: %+v", renewed)
+	}
+	if cookies := res.Result().Cookies(); len(cookies) != 1 || cookies[0].Value != c.Value || !cookies[0].HttpOnly {
+		t.Errorf("renewal cookie is %v", cookies)
+	}
+
+	s.Expires = time.Now().Add(-time.Second)
+	if putErr := putSession(ctx, s); putErr != nil {
+		t.Fatal(putErr)
+	}
+	if _, err := GetSession(httptest.NewRecorder(), sessionRequest("GET", c, nil)); err != ErrTimedOut {
+		t.Errorf("expired session gave %v, want ErrTimedOut", err)
+	}
+	if _, err := getSession(ctx, s.ID); err == nil {
+		t.Error("expired session was kept")
+	}
+}
+
+func TestDeleteSession(t *testing.T) {
+	ctx, u := setupSessionTest(t)
+	c, s := loginForTest(t, ctx, u)
+
+	res := httptest.NewRecorder()
+	DeleteSession(res, sessionRequest("POST", c, nil))
+	if _, err := getSession(ctx, s.ID); err == nil {
+		t.Error("session record survived logout")
+	}
+	if _, err := GetSession(httptest.NewRecorder(), sessionRequest("GET", c, nil)); err != ErrTimedOut {
+		t.Errorf("old cookie gave %v, want ErrTimedOut", err)
+	}
+	cookies := res.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != "" || cookies[0].MaxAge >= 0 {
+		t.Errorf("logout cookie is %v", cookies)
+	}
+}
+
+func TestConfirmToken(t *testing.T) {
+	ctx, u := setupSessionTest(t)
+	other := MakeUser("Other User", "other@example.com")
+	other.Permission = WritePermissions
+	if putErr := PlaceUserInDatastore(ctx, &other); putErr != nil {
+		t.Fatal(putErr)
+	}
+	c, s := loginForTest(t, ctx, u)
+	otherCookie, _ := loginForTest(t, ctx, &other)
+
+	preview := sessionRequest("GET", c, nil)
+	token := confirmToken(httptest.NewRecorder(), preview, "delete book 1", time.Now().Add(confirmLifetime))
+	confirm := func(cookie *http.Cookie, csrf, token, change string) error {
+		form := url.Values{"Confirm": {token}, CSRFFieldName: {csrf}}
+		return checkConfirmToken(httptest.NewRecorder(), sessionRequest("POST", cookie, form), change)
+	}
+
+	if err := confirm(c, CSRFTokenFor(s), token, "delete book 1"); err != nil {
+		t.Errorf("own token refused: %v", err)
+	}
+	if err := confirm(c, CSRFTokenFor(s), token, "delete book 2"); err != ErrConfirmMismatch {
+		t.Errorf("token for another change gave %v", err)
+	}
+	otherID, _ := verifySessionValue(otherCookie.Value)
+	if err := confirm(otherCookie, CSRFTokenFor(&Session{ID: otherID}), token, "delete book 1"); err != ErrConfirmMismatch {
+		t.Errorf("token of another user gave %v", err)
+	}
+	if err := confirm(c, CSRFTokenFor(s), "", "delete book 1"); err != ErrConfirmMissing {
+		t.Errorf("no token gave %v", err)
+	}
+	stale := confirmToken(httptest.NewRecorder(), preview, "delete book 1", time.Now().Add(-time.Minute))
+	if err := confirm(c, CSRFTokenFor(s), stale, "delete book 1"); err != ErrConfirmExpired {
+		t.Errorf("expired token gave %v", err)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+/*
+AUTH_share.go by Allen J. Mills
+    mm.d.yy
+
+    Share links let reviewers outside the organisation read one
+    private book without an account. A link looks like
+        https://<host>/share/sh_<id>_<secret>
+    Opening it stores the token in a cookie for that book only, then
+    redirects to the book's table of contents. Like API tokens, only
+    a hash of the secret is stored and every link expires.
+*/
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/net/context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidShareLink = errors.New("Share: Invalid, revoked, or expired share link.") // ErrInvalidShareLink is returned for any share link that cannot be used.
+)
+
+const (
+	ShareLinksTable   = "ShareLinks"
+	shareLinkPrefix   = "sh"
+	shareCookiePrefix = "textbook-share-" // followed by the book id
+)
+
+// Type: ShareLink
+// Read access to book BookID for anyone holding the link, until Expires.
+type ShareLink struct {
+	BookID    int64
+	Note      string // Who or what the link was made for
+	Hash      string `json:",omitempty"` // hex SHA-256 of the secret, cleared before output
+	CreatedBy string
+	Created   time.Time
+	Expires   time.Time
+	Revoked   bool
+	ID        int64 `datastore:"-" json:",string"`
+}
+
+// Method: Kind
+// Implements Entity interface
+func (l *ShareLink) Kind() string {
+	return ShareLinksTable
+}
+
+// Method: Usable
+// Reports whether the link may be used at time now.
+func (l *ShareLink) Usable(now time.Time) bool {
+	return !l.Revoked && now.Before(l.Expires)
+}
+
+// Internal Function
+// Description:
+// Splits a share token into its id and secret.
+//
+// Returns:
+//      id(int64) - ShareLink entity id
+//      secret(string) - Link secret
+//      failure?(error) - ErrInvalidShareLink if the token is malformed.
+func parseShareToken(token string) (int64, string, error) {
+	parts := strings.SplitN(token, "_", 3)
+	if len(parts) != 3 || parts[0] != shareLinkPrefix || parts[2] == "" {
+		return 0, "", ErrInvalidShareLink
+	}
+	id, parseErr := strconv.ParseInt(parts[1], 10, 64)
+	if parseErr != nil || id == 0 {
+		return 0, "", ErrInvalidShareLink
+	}
+	return id, parts[2], nil
+}
+
+// Internal Function
+// Description:
+// Creates a share link for book bookID lasting expiresIn.
+//
+// Returns:
+//      token(string) - Token to put in the link. It cannot be recovered later.
+//      record(*ShareLink) - Stored link record.
+//      failure?(error) - Any storage error.
+func CreateShareLink(ctx context.Context, bookID int64, note, createdBy string, expiresIn time.Duration) (string, *ShareLink, error) {
+	now := time.Now()
+	secret := randomToken(32)
+	l := &ShareLink{
+		BookID:    bookID,
+		Note:      note,
+		Hash:      hashTokenSecret(secret),
+		CreatedBy: createdBy,
+		Created:   now,
+		Expires:   now.Add(expiresIn),
+	}
+
+	id, putErr := PlaceInDatastore(ctx, 0, l)
+	if putErr != nil {
+		return "", nil, putErr
+	}
+	l.ID = id
+	return fmt.Sprintf("%s_%d_%s", shareLinkPrefix, id, secret), l, nil
+}
+
+// Internal Function
+// Description:
+// Checks a share token.
+//
+// Returns:
+//      record(*ShareLink) - The link the token belongs to.
+//      failure?(error) - ErrInvalidShareLink for any unusable token.
+func GetShareLink(ctx context.Context, token string) (*ShareLink, error) {
+	id, secret, parseErr := parseShareToken(token)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+
+	l := &ShareLink{}
+	if getErr := GetFromDatastore(ctx, id, l); getErr != nil {
+		return nil, ErrInvalidShareLink
+	}
+	if subtle.ConstantTimeCompare([]byte(l.Hash), []byte(hashTokenSecret(secret))) != 1 || !l.Usable(time.Now()) {
+		return nil, ErrInvalidShareLink
+	}
+	l.ID = id
+	return l, nil
+}
+
+// Internal Function
+// Description:
+// Reports whether req carries a usable share link for book bookID.
+func HasShareAccess(ctx context.Context, req *http.Request, bookID int64) bool {
+	token, cookieErr := FromCookie(req, shareCookiePrefix+fmt.Sprint(bookID))
+	if cookieErr != nil {
+		return false
+	}
+	l, linkErr := GetShareLink(ctx, token)
+	return linkErr == nil && l.BookID == bookID
+}
+
+// Internal Function
+// Description:
+// Gets every share link for book bookID, newest first.
+func GetShareLinksForBook(ctx context.Context, bookID int64) ([]ShareLink, error) {
+	links := make([]ShareLink, 0)
+	keys, getErr := Stores.Entities.GetAll(ctx, NewEntityQuery(ShareLinksTable).Filter("BookID =", bookID), &links)
+	if getErr != nil {
+		return links, getErr
+	}
+	for i, k := range keys {
+		links[i].ID = k.IntID
+		links[i].Hash = ""
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Created.After(links[j].Created) })
+	return links, nil
+}
+
+// Internal Function
+// Description:
+// Collects the keys of every share link for book bookID, so they can be
+// deleted together with the book.
+func GetShareLinkKeysForBook(ctx context.Context, bookID int64) []EntityKey {
+	keys, getErr := Stores.Entities.GetAll(ctx, NewEntityQuery(ShareLinksTable).Filter("BookID =", bookID), nil)
+	if getErr != nil {
+		return []EntityKey{}
+	}
+	return keys
+}
+
+// ------------------------------------
+// Handlers
+/////
+
+// Call: /share/:TOKEN
+// Description:
+// Opens a share link. The token is kept in a cookie for its book
+// and the reader is sent to the book's table of contents.
+//
+// Method: GET
+// Results: HTTP Redirect
+// Mandatory Options: TOKEN
+// Optional Options:
+func AUTH_OpenShareLink(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	token := params.ByName("TOKEN")
+	l, linkErr := GetShareLink(NewContext(req), token)
+	if ErrorPage(res, "This share link cannot be used.", linkErr) {
+		return
+	}
+
+	http.SetCookie(res, &http.Cookie{
+		Name:     shareCookiePrefix + fmt.Sprint(l.BookID),
+		Value:    token,
+		Path:     "/",
+		Expires:  l.Expires,
+		HttpOnly: true,
+		Secure:   secureCookie(req),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(res, req, fmt.Sprint("/toc/", l.BookID), http.StatusSeeOther)
+}
+
+// Call: /api/shares.json
+// Description:
+// Lists the share links of a book. Secrets are never included.
+//
+// Method: GET
+// Results: JSON
+// Mandatory Options: BookID
+// Optional Options:
+// Codes:
+//      0 - Success, All actions completed
+//    400 - Failure, Bad BookID
+//    418 - Invalid Authorization; Check your login status and permission level.
+//    500 - Failure, Internal Services Error
+func API_GetShareLinks(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	book := ScopeOf("Book", req.FormValue("BookID"))
+	if book.ID == 0 {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Invalid BookID", Code: 400}, nil)
+		return
+	}
+	if validPerm, permErr := HasPermission(res, req, Settings.Permissions.APIMake, book); !validPerm {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Invalid Authorization: " + permErr.Error(), Code: 418}, nil)
+		return
+	}
+
+	links, getErr := GetShareLinksForBook(NewContext(req), book.ID)
+	if getErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: getErr.Error(), Code: 500}, nil)
+		return
+	}
+	ServeJsonOfStruct(res, JsonOptions{Status: "Success"}, links)
+}
+
+// Call: /api/create/share
+// Description:
+// Creates a share link for a book and returns its url once.
+// Option:ExpiresIn is a duration such as 72h, no longer than the configured
+// Books.ShareLifetime, which is also the default.
+//
+// Method: POST
+// Results: JSON
+// Mandatory Options: BookID
+// Optional Options: ExpiresIn, Note
+// Codes:
+//      0 - Success, Results holds URL and the stored record
+//    400 - Failure, Bad option value
+//    418 - Invalid Authorization; Check your login status and permission level.
+//    500 - Failure, Internal Services Error
+func API_MakeShareLink(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	book := ScopeOf("Book", req.FormValue("BookID"))
+	if book.ID == 0 {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Invalid BookID", Code: 400}, nil)
+		return
+	}
+	if validPerm, permErr := HasPermission(res, req, Settings.Permissions.APIMake, book); !validPerm {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Invalid Authorization: " + permErr.Error(), Code: 418}, nil)
+		return
+	}
+	u, _ := GetUserFromRequest(res, req)
+
+	expiresIn := Settings.Books.ShareLifetime.Duration
+	if req.FormValue("ExpiresIn") != "" {
+		d, durErr := time.ParseDuration(req.FormValue("ExpiresIn"))
+		if durErr != nil || d <= 0 || d > Settings.Books.ShareLifetime.Duration {
+			ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "ExpiresIn must be a positive duration no longer than " + Settings.Books.ShareLifetime.String(), Code: 400}, nil)
+			return
+		}
+		expiresIn = d
+	}
+
+	ctx := NewContext(req)
+	if getErr := GetFromDatastore(ctx, book.ID, &Book{}); getErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Invalid BookID", Code: 400}, nil)
+		return
+	}
+
+	token, record, makeErr := CreateShareLink(ctx, book.ID, strings.TrimSpace(req.FormValue("Note")), u.Email, expiresIn)
+	if makeErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: makeErr.Error(), Code: 500}, nil)
+		return
+	}
+
+	record.Hash = ""
+	RecordAudit(res, req, AuditShare, "Book", book.ID, nil, record)
+	scheme := "https"
+	if req.TLS == nil && req.Header.Get("X-Forwarded-Proto") != "https" {
+		scheme = "http"
+	}
+	ServeJsonOfStruct(res, JsonOptions{Status: "Success"}, struct {
+		URL    string
+		Record *ShareLink
+	}{scheme + "://" + req.Host + "/share/" + token, record})
+}
+
+// Call: /api/revoke/share
+// Description:
+// Revokes a share link. Readers already using it lose access on their next request.
+//
+// Method: POST
+// Results: JSON
+// Mandatory Options: ID
+// Optional Options:
+// Codes:
+//      0 - Success, All actions completed
+//    400 - Failure, Bad ID
+//    404 - Failure, No such link
+//    418 - Invalid Authorization; Check your login status and permission level.
+//    500 - Failure, Internal Services Error
+func API_RevokeShareLink(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	id, parseErr := strconv.ParseInt(req.FormValue("ID"), 10, 64)
+	if parseErr != nil || id == 0 {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Invalid ID", Code: 400}, nil)
+		return
+	}
+
+	ctx := NewContext(req)
+	l := &ShareLink{}
+	if getErr := GetFromDatastore(ctx, id, l); getErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "No such link", Code: 404}, nil)
+		return
+	}
+	if validPerm, permErr := HasPermission(res, req, Settings.Permissions.APIMake, Scope{"Book", l.BookID}); !validPerm {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Invalid Authorization: " + permErr.Error(), Code: 418}, nil)
+		return
+	}
+
+	before := *l
+	l.Revoked = true
+	if _, putErr := PlaceInDatastore(ctx, id, l); putErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: putErr.Error(), Code: 500}, nil)
+		return
+	}
+	before.Hash, l.Hash = "", ""
+	before.ID, l.ID = id, id
+	RecordAudit(res, req, AuditRevoke, "Book", l.BookID, before, l)
+	ServeJsonOfStruct(res, JsonOptions{Status: "Success"}, nil)
+}
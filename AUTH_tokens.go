@@ -0,0 +1,360 @@
+package main
+
+/*
+AUTH_tokens.go by Allen J. Mills
+    mm.d.yy
+
+    Personal API tokens for scripts and other non-browser clients.
+    A token is sent as "Authorization: Bearer tb_<id>_<secret>".
+    Only a SHA-256 hash of the secret is stored, so the full token
+    is shown once, when it is created.
+
+    A token acts as its owner, limited to its scope: the effective
+    permission is the lower of the scope and the owner's current level.
+*/
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/net/context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("Token: Invalid, revoked, or expired API token.")   // ErrInvalidToken is returned for any bearer token that cannot be used.
+	ErrTokenScope   = errors.New("Token: Scope is above your own permission level.") // ErrTokenScope is returned when asking for a scope the user does not hold.
+)
+
+const (
+	APITokensTable = "APITokens"
+	apiTokenPrefix = "tb"
+
+	// apiTokenTouchInterval limits how often LastUsed is written back.
+	apiTokenTouchInterval = time.Minute * time.Duration(10)
+)
+
+// Type: APIToken
+// A personal access token belonging to user UID.
+type APIToken struct {
+	UID      int64
+	Name     string
+	Hash     string `json:",omitempty"` // hex SHA-256 of the secret, cleared before output
+	Scope    int    // Highest permission level the token may use
+	Created  time.Time
+	Expires  time.Time // Zero for tokens that never expire
+	LastUsed time.Time
+	Revoked  bool
+	ID       int64 `datastore:"-" json:",string"`
+}
+
+// Method: Kind
+// Implements Entity interface
+func (t *APIToken) Kind() string {
+	return APITokensTable
+}
+
+// Method: Usable
+// Reports whether the token may authenticate at time now.
+func (t *APIToken) Usable(now time.Time) bool {
+	return !t.Revoked && (t.Expires.IsZero() || now.Before(t.Expires))
+}
+
+// Internal Function
+// Description:
+// Hashes a token secret for storage.
+func hashTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Internal Function
+// Description:
+// Splits a token into its id and secret.
+//
+// Returns:
+//      id(int64) - Token entity id
+//      secret(string) - Token secret
+//      failure?(error) - ErrInvalidToken if the token is malformed.
+func parseAPIToken(token string) (int64, string, error) {
+	parts := strings.SplitN(token, "_", 3)
+	if len(parts) != 3 || parts[0] != apiTokenPrefix || parts[2] == "" {
+		return 0, "", ErrInvalidToken
+	}
+	id, parseErr := strconv.ParseInt(parts[1], 10, 64)
+	if parseErr != nil || id == 0 {
+		return 0, "", ErrInvalidToken
+	}
+	return id, parts[2], nil
+}
+
+// Internal Function
+// Description:
+// Creates a new token for u. expiresIn of zero makes a token that never expires.
+//
+// Returns:
+//      token(string) - Full token to hand to the user. It cannot be recovered later.
+//      record(*APIToken) - Stored token record.
+//      failure?(error) - ErrTokenScope, or any storage error.
+func CreateAPIToken(ctx context.Context, u *User, name string, scope int, expiresIn time.Duration) (string, *APIToken, error) {
+	if scope > u.Permission {
+		return "", nil, ErrTokenScope
+	}
+
+	now := time.Now()
+	secret := randomToken(32)
+	t := &APIToken{
+		UID:     u.ID,
+		Name:    name,
+		Hash:    hashTokenSecret(secret),
+		Scope:   scope,
+		Created: now,
+	}
+	if expiresIn > 0 {
+		t.Expires = now.Add(expiresIn)
+	}
+
+	id, putErr := PlaceInDatastore(ctx, 0, t)
+	if putErr != nil {
+		return "", nil, putErr
+	}
+	t.ID = id
+	return fmt.Sprintf("%s_%d_%s", apiTokenPrefix, id, secret), t, nil
+}
+
+// Internal Function
+// Description:
+// Gets every token belonging to user uid, newest first.
+func GetAPITokensForUser(ctx context.Context, uid int64) ([]APIToken, error) {
+	tokens := make([]APIToken, 0)
+	keys, getErr := Stores.Entities.GetAll(ctx, NewEntityQuery(APITokensTable).Filter("UID =", uid), &tokens)
+	if getErr != nil {
+		return tokens, getErr
+	}
+	for i, k := range keys {
+		tokens[i].ID = k.IntID
+		tokens[i].Hash = ""
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created.After(tokens[j].Created) })
+	return tokens, nil
+}
+
+// Internal Function
+// Description:
+// Removes every token belonging to user uid. Used when a user is deleted.
+func DeleteAPITokensForUser(ctx context.Context, uid int64) error {
+	keys, getErr := Stores.Entities.GetAll(ctx, NewEntityQuery(APITokensTable).Filter("UID =", uid), nil)
+	if getErr != nil || len(keys) == 0 {
+		return getErr
+	}
+	return Stores.Entities.Delete(ctx, keys)
+}
+
+// Internal Function
+// Description:
+// Authenticates a bearer token. The returned user's Permission is
+// lowered to the token's scope, and Token is set so grants are capped too.
+//
+// Returns:
+//      user(*User) - Token owner with effective permission.
+//      failure?(error) - ErrInvalidToken for any unusable token.
+func GetUserFromAPIToken(ctx context.Context, token string) (*User, error) {
+	id, secret, parseErr := parseAPIToken(token)
+	if parseErr != nil {
+		return &User{}, parseErr
+	}
+
+	t := &APIToken{}
+	if getErr := GetFromDatastore(ctx, id, t); getErr != nil {
+		return &User{}, ErrInvalidToken
+	}
+	now := time.Now()
+	if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hashTokenSecret(secret))) != 1 || !t.Usable(now) {
+		return &User{}, ErrInvalidToken
+	}
+
+	u, getErr := GetUserFromDatastore(ctx, t.UID)
+	if getErr != nil {
+		return &User{}, ErrInvalidToken
+	}
+	if t.Scope < u.Permission {
+		u.Permission = t.Scope
+	}
+	u.Token = t
+
+	if now.Sub(t.LastUsed) > apiTokenTouchInterval {
+		t.LastUsed = now
+		PlaceInDatastore(ctx, id, t)
+	}
+	return u, nil
+}
+
+// ------------------------------------
+// Handlers
+/////
+
+// Call: /user/tokens
+// Description:
+// Page for the logged in user to create, view, and revoke their API tokens.
+//
+// Method: GET
+// Results: HTML
+// Mandatory Options:
+// Optional Options:
+func AUTH_TokensPage(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	pu, sessErr := GetUserFromSession(res, req)
+	if ErrorPage(res, "Please log in to manage API tokens.", sessErr) {
+		return
+	}
+	ServeTemplateWithParams(res, "tokens.html", pu)
+}
+
+// Call: /api/tokens.json
+// Description:
+// Lists the caller's API tokens. Secrets are never included.
+//
+// Method: GET
+// Results: JSON
+// Mandatory Options:
+// Optional Options:
+// Codes:
+//      0 - Success, All actions completed
+//    418 - Invalid Authorization; Check your login status.
+//    500 - Failure, Internal Services Error
+func API_GetTokens(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	u, authErr := GetUserFromRequest(res, req)
+	if authErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Invalid Authorization: " + authErr.Error(), Code: 418}, nil)
+		return
+	}
+
+	tokens, getErr := GetAPITokensForUser(NewContext(req), u.ID)
+	if getErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: getErr.Error(), Code: 500}, nil)
+		return
+	}
+	ServeJsonOfStruct(res, JsonOptions{Status: "Success"}, tokens)
+}
+
+// Call: /api/create/token
+// Description:
+// Creates an API token for the logged in user and returns it once.
+// Tokens cannot be created by other tokens; a browser session is required.
+//
+// Option:Scope is Read, Edit, Write, or Admin and may not exceed your own level. Defaults to Read.
+// Option:ExpiresIn is a duration such as 720h. Empty for a token that never expires.
+//
+// Method: POST
+// Results: JSON
+// Mandatory Options: Name
+// Optional Options: Scope, ExpiresIn
+// Codes:
+//      0 - Success, Results holds Token and the stored record
+//    400 - Failure, Bad option value
+//    418 - Invalid Authorization; Check your login status and permission level.
+//    500 - Failure, Internal Services Error
+func API_MakeToken(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if usesHeaderAuth(req) {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Invalid Authorization: Tokens must be created from a logged in session.", Code: 418}, nil)
+		return
+	}
+	u, authErr := GetUserFromRequest(res, req)
+	if authErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Invalid Authorization: " + authErr.Error(), Code: 418}, nil)
+		return
+	}
+
+	name := strings.TrimSpace(req.FormValue("Name"))
+	if name == "" {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Empty Token Name", Code: 400}, nil)
+		return
+	}
+
+	scope := ReadPermissions
+	if req.FormValue("Scope") != "" {
+		lvl, scopeErr := PermissionFromString(req.FormValue("Scope"))
+		if scopeErr != nil {
+			ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: scopeErr.Error(), Code: 400}, nil)
+			return
+		}
+		scope = lvl
+	}
+
+	var expiresIn time.Duration
+	if req.FormValue("ExpiresIn") != "" {
+		d, durErr := time.ParseDuration(req.FormValue("ExpiresIn"))
+		if durErr != nil || d <= 0 {
+			ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "ExpiresIn must be a positive duration such as 720h", Code: 400}, nil)
+			return
+		}
+		expiresIn = d
+	}
+
+	token, record, makeErr := CreateAPIToken(NewContext(req), u, name, scope, expiresIn)
+	if makeErr == ErrTokenScope {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: makeErr.Error(), Code: 400}, nil)
+		return
+	} else if makeErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: makeErr.Error(), Code: 500}, nil)
+		return
+	}
+
+	record.Hash = ""
+	RecordAudit(res, req, AuditCreate, "APIToken", record.ID, nil, record)
+	ServeJsonOfStruct(res, JsonOptions{Status: "Success"}, struct {
+		Token  string
+		Record *APIToken
+	}{token, record})
+}
+
+// Call: /api/revoke/token
+// Description:
+// Revokes one of the caller's tokens. Admins may revoke any token.
+// Revoked tokens stay listed so their use can still be traced.
+//
+// Method: POST
+// Results: JSON
+// Mandatory Options: ID
+// Optional Options:
+// Codes:
+//      0 - Success, All actions completed
+//    400 - Failure, Bad ID
+//    404 - Failure, No such token
+//    418 - Invalid Authorization; Check your login status and permission level.
+//    500 - Failure, Internal Services Error
+func API_RevokeToken(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	u, authErr := GetUserFromRequest(res, req)
+	if authErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Invalid Authorization: " + authErr.Error(), Code: 418}, nil)
+		return
+	}
+
+	id, parseErr := strconv.ParseInt(req.FormValue("ID"), 10, 64)
+	if parseErr != nil || id == 0 {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Invalid ID", Code: 400}, nil)
+		return
+	}
+
+	ctx := NewContext(req)
+	t := &APIToken{}
+	if getErr := GetFromDatastore(ctx, id, t); getErr != nil || (t.UID != u.ID && u.Permission < AdminPermissions) {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "No such token", Code: 404}, nil)
+		return
+	}
+
+	before := *t
+	t.Revoked = true
+	if _, putErr := PlaceInDatastore(ctx, id, t); putErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: putErr.Error(), Code: 500}, nil)
+		return
+	}
+	RecordAudit(res, req, AuditRevoke, "APIToken", id, &before, t)
+	ServeJsonOfStruct(res, JsonOptions{Status: "Success"}, nil)
+}
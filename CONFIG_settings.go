@@ -0,0 +1,395 @@
+// Configuration
+// This package loads and validates the runtime settings.
+package main
+
+/*
+CONFIG_settings.go by Allen J. Mills
+    mm.d.yy
+
+    Settings start from the defaults in Globals.go, are overlaid by
+    a JSON file (config.json, or the path in TEXTBOOK_CONFIG), and
+    finally by environment variables. The result is validated once at
+    startup and then read by handlers through Settings.
+
+    Example config.json:
+        {
+            "Storage": {"Backend": "file", "DataDir": "./data"},
+            "Images": {"Types": {"png": "image/png", "webp": "image/webp"}},
+            "Permissions": {"ImageDelete": "Write"},
+            "Register": {"InviteLifetime": "168h"}
+        }
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidSettings = errors.New("Config: Invalid settings.") // ErrInvalidSettings prefixes every validation failure.
+)
+
+const minSessionSecret = 32 // Shortest Session.Secret, in bytes, that Validate accepts.
+
+// Settings is the active configuration. It always holds a valid
+// configuration: the defaults until LoadSettings replaces them.
+var Settings = DefaultSettings()
+
+// Type: Config
+// Every setting that can change without a rebuild.
+// The env tags name the environment variable that overrides a field.
+type Config struct {
+	Server struct {
+		Addr            string   `env:"TEXTBOOK_ADDR"`             // Listen address, standalone only.
+		ShutdownTimeout Duration `env:"TEXTBOOK_SHUTDOWN_TIMEOUT"` // Time active requests get to finish, standalone only.
+	}
+	Storage struct {
+		Backend   string `env:"TEXTBOOK_BACKEND"`    // appengine, memory, or file
+		DataDir   string `env:"TEXTBOOK_DATA_DIR"`   // Root directory for the file backend.
+		GCSBucket string `env:"TEXTBOOK_GCS_BUCKET"` // Image bucket for the appengine backend.
+	}
+	Identity struct {
+		Provider       string   `env:"TEXTBOOK_IDENTITY"`        // appengine or header
+		Header         string   `env:"TEXTBOOK_IDENTITY_HEADER"` // Header holding the email, for the header provider.
+		Admins         []string `env:"TEXTBOOK_ADMINS"`          // Emails given admin permissions on registration, for the header provider.
+		TrustedProxies []string `env:"TEXTBOOK_TRUSTED_PROXIES"` // Addresses or CIDR ranges of the proxies allowed to set Header.
+	}
+	Session struct {
+		Secret       string   `env:"SESSION_SECRET"`            // Signs session cookies.
+		Lifetime     Duration `env:"TEXTBOOK_SESSION_LIFETIME"` // Session length without activity.
+		SecureCookie bool     `env:"TEXTBOOK_SECURE_COOKIES"`   // Mark cookies Secure on plain http requests too, for sites behind a TLS proxy.
+	}
+	Register struct {
+		UUIDTime       Duration `env:"TEXTBOOK_REGISTER_TIMEOUT"` // Time a user has to finish login or registration.
+		InviteLifetime Duration `env:"TEXTBOOK_INVITE_LIFETIME"`  // Time an admin made invite stays usable.
+	}
+	Images struct {
+		Types map[string]string `env:"TEXTBOOK_IMAGE_TYPES"` // Allowed extension to MIME type, e.g. png=image/png,gif=image/gif
+	}
+	Books struct {
+		DefaultVisibility string   `env:"TEXTBOOK_BOOK_VISIBILITY"` // Visibility of new books: public, unlisted, or private.
+		ShareLifetime     Duration `env:"TEXTBOOK_SHARE_LIFETIME"`  // Longest a share link may stay valid.
+	}
+	Uploads struct {
+		MaxBytes         int64 `env:"TEXTBOOK_UPLOAD_MAX_BYTES"`          // Largest book upload request.
+		MaxFileBytes     int64 `env:"TEXTBOOK_UPLOAD_MAX_FILE_BYTES"`     // Largest file inside an uploaded archive, once unpacked.
+		MaxUnpackedBytes int64 `env:"TEXTBOOK_UPLOAD_MAX_UNPACKED_BYTES"` // Largest total of the files of an uploaded archive, once unpacked.
+		MaxFiles         int   `env:"TEXTBOOK_UPLOAD_MAX_FILES"`          // Most entries an uploaded archive may hold.
+	}
+	Trash struct {
+		Retention     Duration `env:"TEXTBOOK_TRASH_RETENTION"`      // Time deleted structures are kept before being purged, 0 keeps them until purged by hand.
+		PurgeInterval Duration `env:"TEXTBOOK_TRASH_PURGE_INTERVAL"` // Time between purges of old trash, standalone only.
+	}
+	Permissions struct {
+		APIMake     PermissionLevel `env:"TEXTBOOK_PERM_API_MAKE"`     // Create and edit structures.
+		APIDelete   PermissionLevel `env:"TEXTBOOK_PERM_API_DELETE"`   // Delete structures.
+		ImageMake   PermissionLevel `env:"TEXTBOOK_PERM_IMAGE_MAKE"`   // Upload images.
+		ImageDelete PermissionLevel `env:"TEXTBOOK_PERM_IMAGE_DELETE"` // Delete images.
+	}
+}
+
+// Type: Duration
+// A time.Duration written as a string in config files, e.g. "72h".
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) parse(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// Type: PermissionLevel
+// A permission level written by name in config files: Read, Edit, Write, or Admin.
+type PermissionLevel int
+
+func (p PermissionLevel) MarshalJSON() ([]byte, error) {
+	return json.Marshal(PermissionName(int(p)))
+}
+
+func (p *PermissionLevel) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return p.parse(s)
+}
+
+func (p *PermissionLevel) parse(s string) error {
+	lvl, err := PermissionFromString(s)
+	if err != nil {
+		return err
+	}
+	*p = PermissionLevel(lvl)
+	return nil
+}
+
+//// --------------------------
+// Loading
+////
+
+// Internal Function
+// Description:
+// Builds the configuration from defaults, the config file at path, and the
+// environment, then validates it. A missing file at the default path is not
+// an error; a missing file that was asked for by name is.
+//
+// Returns:
+//      config(Config) - Validated configuration.
+//      failure?(error) - Unreadable file, bad values, or failed validation.
+func ReadSettings(path string) (Config, error) {
+	cfg := DefaultSettings()
+
+	required := path != ""
+	if env := os.Getenv("TEXTBOOK_CONFIG"); env != "" && !required {
+		path, required = env, true
+	}
+	if path == "" {
+		path = "config.json"
+	}
+
+	data, readErr := ioutil.ReadFile(path)
+	if readErr == nil {
+		// Image types given in the file replace the defaults rather than adding to them.
+		defaultTypes := cfg.Images.Types
+		cfg.Images.Types = nil
+		if jsonErr := json.Unmarshal(data, &cfg); jsonErr != nil {
+			return cfg, fmt.Errorf("Config: %s: %v", path, jsonErr)
+		}
+		if cfg.Images.Types == nil {
+			cfg.Images.Types = defaultTypes
+		}
+	} else if required || !os.IsNotExist(readErr) {
+		return cfg, fmt.Errorf("Config: %v", readErr)
+	}
+
+	if envErr := applyEnv(reflect.ValueOf(&cfg).Elem()); envErr != nil {
+		return cfg, envErr
+	}
+	return cfg, cfg.Validate()
+}
+
+// Internal Function
+// Description:
+// Reads the configuration and makes it active: Settings, Stores, and Identities
+// are all replaced. Call once at startup before serving requests.
+//
+// Returns:
+//      failure?(error) - Any problem reading, validating, or applying the settings.
+func LoadSettings(path string) error {
+	cfg, err := ReadSettings(path)
+	if err != nil {
+		return err
+	}
+	return ApplySettings(cfg)
+}
+
+// Internal Function
+// Description:
+// Makes cfg the active configuration, opening its storage backend and identity provider.
+func ApplySettings(cfg Config) error {
+	stores, storeErr := OpenStorageBackend(cfg)
+	if storeErr != nil {
+		return fmt.Errorf("Config: storage backend %q: %v", cfg.Storage.Backend, storeErr)
+	}
+	provider, idErr := OpenIdentityProvider(cfg)
+	if idErr != nil {
+		return fmt.Errorf("Config: identity provider %q: %v", cfg.Identity.Provider, idErr)
+	}
+
+	Settings = cfg
+	Stores = stores
+	Identities = provider
+	return nil
+}
+
+// Internal Function
+// Description:
+// Overrides fields of v from the environment variables named in their env tags.
+func applyEnv(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, fv := t.Field(i), v.Field(i)
+		name := field.Tag.Get("env")
+		if name == "" {
+			if fv.Kind() == reflect.Struct {
+				if err := applyEnv(fv); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setFromString(fv, value); err != nil {
+			return fmt.Errorf("Config: %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Internal Function
+// Description:
+// Sets a single setting from its environment variable form.
+// Lists are comma separated, maps are comma separated key=value pairs.
+func setFromString(fv reflect.Value, value string) error {
+	switch p := fv.Addr().Interface().(type) {
+	case *string:
+		*p = value
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*p = n
+	case *int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		*p = n
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*p = b
+	case *Duration:
+		return p.parse(value)
+	case *PermissionLevel:
+		return p.parse(value)
+	case *[]string:
+		*p = splitList(value)
+	case *map[string]string:
+		m := make(map[string]string)
+		for _, pair := range splitList(value) {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("expected key=value, got %q", pair)
+			}
+			m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+		*p = m
+	default:
+		return fmt.Errorf("unsupported setting type %s", fv.Type())
+	}
+	return nil
+}
+
+// Internal Function
+// Description:
+// Splits a comma separated list, dropping empty entries.
+func splitList(s string) []string {
+	list := make([]string, 0)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+//// --------------------------
+// Validation
+////
+
+// Method: Validate
+// Checks every setting, reporting all problems at once.
+func (cfg *Config) Validate() error {
+	problems := make([]string, 0)
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(cfg.Server.Addr != "", "Server.Addr is empty")
+	check(cfg.Server.ShutdownTimeout.Duration >= 0, "Server.ShutdownTimeout is negative")
+
+	switch cfg.Storage.Backend {
+	case "appengine":
+		check(cfg.Storage.GCSBucket != "", "Storage.GCSBucket is required by the appengine backend")
+	case "file":
+		check(cfg.Storage.DataDir != "", "Storage.DataDir is required by the file backend")
+	case "memory":
+	default:
+		check(false, "Storage.Backend %q is not one of appengine, memory, file", cfg.Storage.Backend)
+	}
+
+	switch cfg.Identity.Provider {
+	case "appengine":
+	case "header":
+		check(cfg.Identity.Header != "", "Identity.Header is required by the header provider")
+		check(len(cfg.Identity.TrustedProxies) > 0, "Identity.TrustedProxies is required by the header provider, list the addresses of the authenticating proxy")
+		_, proxyErr := ParseTrustedProxies(cfg.Identity.TrustedProxies)
+		check(proxyErr == nil, "Identity.TrustedProxies %q must be IP addresses or CIDR ranges", cfg.Identity.TrustedProxies)
+	default:
+		check(false, "Identity.Provider %q is not one of appengine, header", cfg.Identity.Provider)
+	}
+
+	// A random key only signs for the instance that made it, which is
+	// only enough when nothing outlives the instance.
+	if cfg.Storage.Backend != "memory" || cfg.Identity.Provider == "header" || cfg.Session.Secret != "" {
+		check(len(cfg.Session.Secret) >= minSessionSecret, "Session.Secret must be at least %d bytes, set SESSION_SECRET to a long random value", minSessionSecret)
+	}
+	check(cfg.Session.Lifetime.Duration > 0, "Session.Lifetime must be positive")
+	check(cfg.Register.UUIDTime.Duration > 0, "Register.UUIDTime must be positive")
+	check(cfg.Register.InviteLifetime.Duration > 0, "Register.InviteLifetime must be positive")
+
+	check(len(cfg.Images.Types) > 0, "Images.Types allows no file types")
+	for ext, ctype := range cfg.Images.Types {
+		check(ext != "" && ext == strings.ToLower(ext) && !strings.ContainsAny(ext, "./"), "Images.Types extension %q must be lower case without dots", ext)
+		check(strings.HasPrefix(ctype, "image/"), "Images.Types %q has non image content type %q", ext, ctype)
+	}
+
+	_, visErr := ParseVisibility(cfg.Books.DefaultVisibility)
+	check(visErr == nil, "Books.DefaultVisibility %q is not one of public, unlisted, private", cfg.Books.DefaultVisibility)
+	check(cfg.Books.ShareLifetime.Duration > 0, "Books.ShareLifetime must be positive")
+
+	check(cfg.Uploads.MaxBytes > 0, "Uploads.MaxBytes must be positive")
+	check(cfg.Uploads.MaxFileBytes > 0, "Uploads.MaxFileBytes must be positive")
+	check(cfg.Uploads.MaxUnpackedBytes >= cfg.Uploads.MaxFileBytes, "Uploads.MaxUnpackedBytes must be at least Uploads.MaxFileBytes")
+	check(cfg.Uploads.MaxFiles > 0, "Uploads.MaxFiles must be positive")
+
+	check(cfg.Trash.Retention.Duration >= 0, "Trash.Retention is negative")
+	check(cfg.Trash.PurgeInterval.Duration > 0, "Trash.PurgeInterval must be positive")
+
+	for name, lvl := range map[string]PermissionLevel{
+		"APIMake":     cfg.Permissions.APIMake,
+		"APIDelete":   cfg.Permissions.APIDelete,
+		"ImageMake":   cfg.Permissions.ImageMake,
+		"ImageDelete": cfg.Permissions.ImageDelete,
+	} {
+		check(lvl >= ReadPermissions && lvl <= AdminPermissions, "Permissions.%s is out of range", name)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%v\n    %s", ErrInvalidSettings, strings.Join(problems, "\n    "))
+	}
+	return nil
+}
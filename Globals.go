@@ -4,22 +4,72 @@ package main
 Globals.go by Allen J. Mills
     mm.d.yy
 
-    This file is meant to be used as an exchangable .settings
-    file for datastore. Any variables expected to be regularly
-    changed out could/should be placed here.
+    This file holds the default value of every setting. Deployments
+    change these through config.json or environment variables,
+    see CONFIG_settings.go, so no rebuild is needed.
 */
 
-const GCS_BucketID = "edueditorimages"
+import (
+	"os"
+	"time"
+)
 
-// const GCS_BucketID = "liquid-journal-88820_bucket1"
+// Internal Function
+// Description:
+// The configuration used when nothing is overridden.
+// defaultBackend and defaultIdentity come from the entrypoint
+// being built, main_appengine.go or main_standalone.go.
+func DefaultSettings() Config {
+	cfg := Config{}
 
-var Allowed_Filetypes = []string{"png", "jpg", "jpeg", "gif"} // Ensure that all types here are also supported as image/jpeg for MIME types.
+	cfg.Server.Addr = ":8080"
+	if port := os.Getenv("PORT"); port != "" {
+		cfg.Server.Addr = ":" + port
+	}
+	cfg.Server.ShutdownTimeout = Duration{time.Second * time.Duration(30)}
 
-var Content_Types = map[string]string{
-	"png":  "image/png",
-	"jpg":  "image/jpeg",
-	"jpeg": "image/jpeg",
-	"gif":  "image/gif",
-}
+	cfg.Storage.Backend = defaultBackend
+	cfg.Storage.DataDir = "data"
+	cfg.Storage.GCSBucket = "edueditorimages"
+	// cfg.Storage.GCSBucket = "liquid-journal-88820_bucket1"
+
+	cfg.Identity.Provider = defaultIdentity
+	cfg.Identity.Header = "X-Forwarded-Email"
+	cfg.Identity.Admins = []string{}
+	// The header is only believed from a proxy on this machine unless more are listed.
+	cfg.Identity.TrustedProxies = []string{"127.0.0.1", "::1"}
+
+	// Session.Secret must be set per deployment, usually through SESSION_SECRET
+	// (app.yaml: env_variables). Only the memory backend may leave it empty, and
+	// then its one instance makes its own random key at startup.
+	cfg.Session.Secret = ""
+	cfg.Session.Lifetime = Duration{time.Hour * time.Duration(12)} // Active sessions are renewed once half of this has passed.
+	cfg.Session.SecureCookie = false                               // Cookies are Secure on TLS requests either way.
+
+	cfg.Register.UUIDTime = Duration{time.Minute * time.Duration(3)}      // Three minutes until cookie deletes itself.
+	cfg.Register.InviteLifetime = Duration{time.Hour * time.Duration(72)} // Three days to accept an invite.
+
+	cfg.Images.Types = map[string]string{
+		"png":  "image/png",
+		"jpg":  "image/jpeg",
+		"jpeg": "image/jpeg",
+		"gif":  "image/gif",
+	}
 
-// Place any other variables that could regularly be changed out here.
+	cfg.Books.DefaultVisibility = VisibilityPublic
+	cfg.Books.ShareLifetime = Duration{time.Hour * time.Duration(24*30)} // Share links last at most thirty days.
+
+	cfg.Uploads.MaxBytes = 32 << 20         // A book upload may be 32 MB,
+	cfg.Uploads.MaxFileBytes = 16 << 20     // any file in it 16 MB once unpacked,
+	cfg.Uploads.MaxUnpackedBytes = 64 << 20 // and all of them 64 MB together.
+	cfg.Uploads.MaxFiles = 2000
+
+	cfg.Trash.Retention = Duration{time.Hour * time.Duration(24*30)} // Deleted structures are kept for thirty days.
+	cfg.Trash.PurgeInterval = Duration{time.Hour}
+
+	cfg.Permissions.APIMake = WritePermissions
+	cfg.Permissions.APIDelete = AdminPermissions
+	cfg.Permissions.ImageMake = WritePermissions
+	cfg.Permissions.ImageDelete = AdminPermissions
+	return cfg
+}
@@ -9,21 +9,19 @@ Images.go by Allen J. Mills
 
 import (
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
 	"golang.org/x/net/context"
-	"google.golang.org/appengine"
-	"google.golang.org/cloud/storage"
 	"io"
 	"mime/multipart"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
 var (
-	// Permission Requirements for Image
-	image_Make_Permission   = WritePermissions
-	image_Delete_Permission = AdminPermissions
+	ErrInvalidImageOwner = errors.New("Image: oid must be global or an objective or exercise id.") // ErrInvalidImageOwner is returned when images are asked for under any other oid.
 )
 
 // ------------------------------------
@@ -41,16 +39,30 @@ var (
 // Mandatory Options:
 // Optional Options: oid
 // Codes:
+//      400 : oid is not global or an id.
 //      418 : Invalid Authorization; Check your login status and permission level.
 func IMAGE_PostUploadForm(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	if validPerm, permErr := HasPermission(res, req, image_Make_Permission); !validPerm {
+	prefix, oidErr := imagePrefix(req.FormValue("oid"))
+	if oidErr != nil {
+		fmt.Fprint(res, `{"result":"failure","reason":"`+oidErr.Error()+`","code":400}`)
+		return
+	}
+	if validPerm, permErr := HasPermission(res, req, Settings.Permissions.ImageMake, imageScope(req, prefix)); !validPerm {
 		// User Must be at least Writer.
 		fmt.Fprint(res, `{"result":"failure","reason":"Invalid Authorization: `+permErr.Error()+`","code":418}`)
 		return
 	}
-	// ACTION: Give the user an internal permissions key?
+	pu, _ := GetUserFromSession(res, req)
+
+	screenOutput := struct {
+		OID       string
+		CSRFToken string
+	}{
+		req.FormValue("oid"),
+		pu.CSRFToken,
+	}
 
-	ServeTemplateWithParams(res, "simpleImageUploader.html", req.FormValue("oid"))
+	ServeTemplateWithParams(res, "simpleImageUploader.html", screenOutput)
 }
 
 // Call: /image/browser
@@ -68,18 +80,19 @@ func IMAGE_PostUploadForm(res http.ResponseWriter, req *http.Request, params htt
 // Mandatory Options:
 // Optional Options: oid, CKEditorFuncNum
 func IMAGE_BrowserForm(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 
 	// ACTION: Give the user an internal permissions key?
 
-	prefixQuery := storage.Query{}
-	if req.FormValue("oid") == "" {
-		prefixQuery.Prefix = "global"
-	} else {
-		prefixQuery.Prefix = req.FormValue("oid")
+	prefix, oidErr := imagePrefix(req.FormValue("oid"))
+	if ErrorPage(res, "Images Not Found", oidErr) {
+		return
+	}
+	if ErrorPage(res, "Images Not Found", CheckReadable(res, req, imageScope(req, prefix))) {
+		return
 	}
 
-	imgl, _ := getFileFromGCS(ctx, &prefixQuery) // get a list of files out of the CS
+	imgl := GetImagesOf(ctx, prefix) // get a list of files out of the CS
 
 	imageBrowser := struct { // make a struct on the fly for the page
 		CKEditorFuncNum string
@@ -113,7 +126,12 @@ func IMAGE_BrowserForm(res http.ResponseWriter, req *http.Request, params httpro
 // Mandatory Options: upload
 // Optional Options: oid, CKEditorFuncNum
 func IMAGE_API_CKEDITOR_PlaceImageIntoCS(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	if validPerm, permErr := HasPermission(res, req, image_Make_Permission); !validPerm {
+	prefix, oidErr := imagePrefix(req.FormValue("oid"))
+	if oidErr != nil {
+		fmt.Fprint(res, `<!DOCTYPE html><html><body><script type="text/javascript">window.parent.CKEDITOR.tools.callFunction('`+req.FormValue("CKEditorFuncNum")+`',"","`+oidErr.Error()+`");//window.close();</script></body></html>`)
+		return
+	}
+	if validPerm, permErr := HasPermission(res, req, Settings.Permissions.ImageMake, imageScope(req, prefix)); !validPerm {
 		// User Must be at least Writer.
 		fmt.Fprint(res, `<!DOCTYPE html><html><body><script type="text/javascript">window.parent.CKEDITOR.tools.callFunction('`+req.FormValue("CKEditorFuncNum")+`',"","`+permErr.Error()+`");//window.close();</script></body></html>`)
 		return
@@ -126,17 +144,13 @@ func IMAGE_API_CKEDITOR_PlaceImageIntoCS(res http.ResponseWriter, req *http.Requ
 	}
 	defer multipartFile.Close()
 
-	prefix := req.FormValue("oid")
-	if prefix == "" {
-		prefix = "global"
-	}
-
 	fileName, prepareError := IMAGE_API_SendToCloudStorage(req, multipartFile, multipartHeader, prefix) // send the image out to the cloudstore.
 	if prepareError != nil {
 		fmt.Fprint(res, `<!DOCTYPE html><html><body><script type="text/javascript">window.parent.CKEDITOR.tools.callFunction('`+req.FormValue("CKEditorFuncNum")+`',"","`+prepareError.Error()+`");//window.close();</script></body></html>`)
 		return
 	}
 
+	recordImageAudit(res, req, AuditCreate, fileName)
 	// image successfully sent, let CK know the final url.
 	fmt.Fprint(res, `<!DOCTYPE html><html><body><script type="text/javascript">window.parent.CKEDITOR.tools.callFunction('`+req.FormValue("CKEditorFuncNum")+`', "`+"/image?id="+fileName+`","");//window.close();</script></body></html>`)
 	return
@@ -161,7 +175,12 @@ func IMAGE_API_CKEDITOR_PlaceImageIntoCS(res http.ResponseWriter, req *http.Requ
 //      Success, redirect to image/uploader with status of success
 //      Failure, redirect to image/uploader with status of failure
 func IMAGE_API_PlaceImageIntoCS(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	if validPerm, _ := HasPermission(res, req, image_Make_Permission); !validPerm {
+	prefix, oidErr := imagePrefix(req.FormValue("oid"))
+	if oidErr != nil {
+		http.Redirect(res, req, "/image/uploader?status=failure", http.StatusSeeOther)
+		return
+	}
+	if validPerm, _ := HasPermission(res, req, Settings.Permissions.ImageMake, imageScope(req, prefix)); !validPerm {
 		// User Must be at least Writer.
 		http.Redirect(res, req, "/image/uploader?status=failure&message=invalid_login", http.StatusSeeOther)
 		return
@@ -174,16 +193,12 @@ func IMAGE_API_PlaceImageIntoCS(res http.ResponseWriter, req *http.Request, para
 	}
 	defer multipartFile.Close()
 
-	prefix := req.FormValue("oid")
-	if prefix == "" {
-		prefix = "global"
-	}
-
-	_, prepareError := IMAGE_API_SendToCloudStorage(req, multipartFile, multipartHeader, prefix)
+	fileName, prepareError := IMAGE_API_SendToCloudStorage(req, multipartFile, multipartHeader, prefix)
 	if prepareError != nil { // send to CS and same as above.
 		http.Redirect(res, req, "/image/uploader?status=failure", http.StatusSeeOther)
 		return
 	}
+	recordImageAudit(res, req, AuditCreate, fileName)
 	// success, let user know that their image is waiting.
 	http.Redirect(res, req, "/image/uploader?status=success", http.StatusSeeOther)
 }
@@ -206,20 +221,24 @@ func IMAGE_API_GetImageFromCS(res http.ResponseWriter, req *http.Request, params
 		return
 	}
 
-	ctx := appengine.NewContext(req) // quickly get a handle into CS
-	client, clientErr := storage.NewClient(ctx)
-	HandleError(res, clientErr)
-	defer client.Close()
+	if strings.HasPrefix(id, trashPrefix) || !NewReadChecker(res, req).CanRead(imageScope(req, imageOwner(id))) { // images in private books, or in the trash, are private too.
+		http.Error(res, ErrNoSuchBlob.Error(), http.StatusNotFound)
+		return
+	}
 
-	obj := client.Bucket(GCS_BucketID).Object(id) // pull the object from cs
+	ctx := NewContext(req)
+	rdr, getErr := Stores.Blobs.GetBlob(ctx, id) // pull the object from storage
+	if getErr == ErrNoSuchBlob {
+		http.Error(res, getErr.Error(), http.StatusNotFound)
+		return
+	} else if getErr != nil {
+		http.Error(res, getErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rdr.Close()
 
 	// We'll just copy the image data onto the response, letting the browser know that we're sending an image.
-	ctype, ok := Content_Types[stringedExt(id)]
-	if !ok {
-		ctype = "image/png"
-	}
-	res.Header().Set("Content-Type", ctype+"; charset=utf-8")
-	rdr, _ := obj.NewReader(ctx)
+	res.Header().Set("Content-Type", imageContentType(id)+"; charset=utf-8")
 	io.Copy(res, rdr)
 }
 
@@ -244,19 +263,20 @@ func IMAGE_API_RemoveImageFromCS(res http.ResponseWriter, req *http.Request, par
 		return
 	}
 
-	if validPerm, permErr := HasPermission(res, req, image_Delete_Permission); !validPerm {
+	if validPerm, permErr := HasPermission(res, req, Settings.Permissions.ImageDelete); !validPerm {
 		// User Must be at least Admin.
 		fmt.Fprint(res, `{"result":"failure","reason":"Invalid Authorization: `+permErr.Error()+`","code":418}`)
 		return
 	}
 
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 	csRemoveErr := removeFileFromGCS(ctx, id)
 
 	if csRemoveErr != nil {
 		fmt.Fprint(res, `{"result":"failure","reason":"Internal Error:`+csRemoveErr.Error()+`","code":500}`)
 		return
 	}
+	recordImageAudit(res, req, AuditDelete, id)
 	fmt.Fprint(res, `{"result":"success","reason":"","code":0}`)
 }
 
@@ -264,6 +284,26 @@ func IMAGE_API_RemoveImageFromCS(res http.ResponseWriter, req *http.Request, par
 // API - Parse/Prepare Image
 /////
 
+// Type: imageAudit
+// An image as the audit log records it.
+type imageAudit struct {
+	Name string
+}
+
+// Internal Function
+// Description:
+// Adds the upload or deletion of image name to the audit log, for the
+// user of req. Images are recorded under the id of the objective or
+// exercise they belong to, 0 for global images.
+func recordImageAudit(res http.ResponseWriter, req *http.Request, action, name string) {
+	owner, _ := strconv.ParseInt(imageOwner(name), 10, 64)
+	if action == AuditDelete {
+		RecordAudit(res, req, action, "Image", owner, &imageAudit{name}, nil)
+		return
+	}
+	RecordAudit(res, req, action, "Image", owner, nil, &imageAudit{name})
+}
+
 // Internal Function
 // Description:
 // This function will prepare and send file to GCS then return the key.
@@ -272,16 +312,89 @@ func IMAGE_API_RemoveImageFromCS(res http.ResponseWriter, req *http.Request, par
 //      key(string) - name of GCS key. Item is now in GCS
 //      failure?(error) - If any errors occur they exist here.
 func IMAGE_API_SendToCloudStorage(req *http.Request, mpf multipart.File, hdr *multipart.FileHeader, prefix string) (string, error) {
-	ext, extErr := filterExtension(req, hdr) // ensure that file's extension is an image
+	uploadName, nameErr := imageUploadName(hdr.Filename, mpf, prefix)
+	if nameErr != nil {
+		return "", nameErr
+	}
+
+	ctx := NewContext(req)
+	return uploadName, addFileToGCS(ctx, uploadName, mpf) // upload the file and name. if there is an error, our parent will catch it.}
+}
+
+// Internal Function
+// Description:
+// Names an image for cloud storage: prefix, the SHA of its contents, and
+// the extension of filename, which must be allowed by this server. src is
+// read to the end and then put back at its start.
+//
+// Returns:
+//      key(string) - name of GCS key the image should be stored at.
+//      failure?(error) - Error if filetype is not allowed.
+func imageUploadName(filename string, src io.ReadSeeker, prefix string) (string, error) {
+	ext, extErr := filterExtension(filename) // ensure that file's extension is an image
 	if extErr != nil {                       // if it is not, exit, returning error
 		return "", extErr
 	}
 
-	uploadName := prefix + makeSHA(mpf) + "." + ext // build new filename based on the image data instead. this will keep us from making multiple files of the same data.
-	mpf.Seek(0, 0)                                  // makeSHA moved the reader, move it back.
+	uploadName := prefix + makeSHA(src) + "." + ext // build new filename based on the image data instead. this will keep us from making multiple files of the same data.
+	src.Seek(0, 0)                                  // makeSHA moved the reader, move it back.
+	return uploadName, nil
+}
 
-	ctx := appengine.NewContext(req)
-	return uploadName, addFileToGCS(ctx, uploadName, mpf) // upload the file and name. if there is an error, our parent will catch it.}
+// Internal Function
+// Description:
+// Images are stored under the id of the objective or exercise whose
+// editor uploaded them. This finds which one oid is, so grants on its
+// book or catalog apply. "global" and empty oids have no scope.
+//
+// Returns:
+//      scope(Scope) - Objective or Exercise scope, zero if none.
+func imageScope(req *http.Request, oid string) Scope {
+	s := ScopeOf("Objective", oid)
+	if s.ID == 0 {
+		return s
+	}
+	if getErr := GetFromDatastore(NewContext(req), s.ID, &Objective{}); getErr == ErrNoSuchEntity {
+		s.Kind = "Exercise"
+	}
+	return s
+}
+
+// Internal Function
+// Description:
+// The prefix images of oid are stored under: "global" for an empty oid,
+// else oid itself when it is "global" or an id. Anything else could name
+// other files, such as those in the trash.
+//
+// Returns:
+//      prefix(string) - "global" or the id.
+//      failure?(error) - ErrInvalidImageOwner for any other oid.
+func imagePrefix(oid string) (string, error) {
+	if oid == "" || oid == "global" {
+		return "global", nil
+	}
+	if id, parseErr := strconv.ParseInt(oid, 10, 64); parseErr != nil || id <= 0 || strconv.FormatInt(id, 10) != oid {
+		return "", ErrInvalidImageOwner
+	}
+	return oid, nil
+}
+
+// Internal Function
+// Description:
+// The oid an image was uploaded under. Names are built by
+// IMAGE_API_SendToCloudStorage as oid + sha1 hex + "." + extension.
+//
+// Returns:
+//      oid(string) - Objective/exercise id, "global", or empty if the name is not ours.
+func imageOwner(name string) string {
+	base := name
+	if dot := strings.LastIndex(base, "."); dot >= 0 {
+		base = base[:dot]
+	}
+	if len(base) < sha1.Size*2 {
+		return ""
+	}
+	return base[:len(base)-sha1.Size*2]
 }
 
 // Internal Function
@@ -291,7 +404,7 @@ func IMAGE_API_SendToCloudStorage(req *http.Request, mpf multipart.File, hdr *mu
 //
 // Returns:
 //      key(string) - SHA of contents.
-func makeSHA(src multipart.File) string {
+func makeSHA(src io.Reader) string {
 	h := sha1.New()
 	io.Copy(h, src)
 	return fmt.Sprintf("%x", h.Sum(nil))
@@ -305,14 +418,12 @@ func makeSHA(src multipart.File) string {
 // Returns:
 //      extension(string) - Extension of file.
 //      failure?(error) - Error if filetype is not allowed.
-func filterExtension(req *http.Request, hdr *multipart.FileHeader) (string, error) {
-	ext := hdr.Filename[strings.LastIndex(hdr.Filename, ".")+1:] // parse through the fileheader for its extension.
-	ext = strings.ToLower(ext)                                   // uppercase, lowercase. all the same here.
+func filterExtension(filename string) (string, error) {
+	ext := filename[strings.LastIndex(filename, ".")+1:] // parse through the filename for its extension.
+	ext = strings.ToLower(ext)                           // uppercase, lowercase. all the same here.
 
-	for _, allowedExt := range Allowed_Filetypes { // for all allowed filetypes
-		if allowedExt == ext { // found it? Excellent!
-			return ext, nil
-		}
+	if _, allowed := Settings.Images.Types[ext]; allowed { // found it? Excellent!
+		return ext, nil
 	}
 	// It was not a part of the allowed extensions, return an error.
 	return ext, fmt.Errorf("Filetype %s is not allowed by server.", ext)
@@ -323,9 +434,19 @@ func stringedExt(filename string) string {
 	return strings.ToLower(ext)
 }
 
+// Internal Function
+// Description:
+// Returns the content type of an image by its extension, defaulting to png.
+func imageContentType(filename string) string {
+	if ctype, ok := Settings.Images.Types[stringedExt(filename)]; ok {
+		return ctype
+	}
+	return "image/png"
+}
+
 // ------------------------------------
 // API - Internal Cloud Storage functions
-// Local Only!
+// Local Only! These work against whichever BlobStore is active.
 /////
 
 // Internal Function
@@ -335,27 +456,7 @@ func stringedExt(filename string) string {
 // Returns:
 //      failure?(error) - Error if storage fails.
 func addFileToGCS(ctx context.Context, filename string, freader io.Reader) error {
-	client, clientErr := storage.NewClient(ctx)
-	if clientErr != nil {
-		return clientErr
-	}
-	defer client.Close()
-
-	csWriter := client.Bucket(GCS_BucketID).Object(filename).NewWriter(ctx)
-
-	// Cloud Storage Writer - Permissions
-	csWriter.ACL = []storage.ACLRule{
-		{storage.AllUsers, storage.RoleReader},
-	}
-
-	if ctype, ok := Content_Types[stringedExt(filename)]; ok {
-		csWriter.ContentType = ctype
-	} else {
-		csWriter.ContentType = "image/png"
-	}
-
-	io.Copy(csWriter, freader)
-	return csWriter.Close()
+	return Stores.Blobs.PutBlob(ctx, filename, imageContentType(filename), freader)
 }
 
 // Internal Function
@@ -365,12 +466,7 @@ func addFileToGCS(ctx context.Context, filename string, freader io.Reader) error
 // Returns:
 //      failure?(error) - Error if deletion fails.
 func removeFileFromGCS(ctx context.Context, filename string) error {
-	client, clientErr := storage.NewClient(ctx)
-	if clientErr != nil {
-		return clientErr
-	}
-	defer client.Close()
-	return client.Bucket(GCS_BucketID).Object(filename).Delete(ctx)
+	return Stores.Blobs.DeleteBlob(ctx, filename)
 }
 
 // Internal Function
@@ -380,17 +476,8 @@ func removeFileFromGCS(ctx context.Context, filename string) error {
 // Returns:
 //      failure?(error) - Error if deletion fails.
 func RemoveFilesFromGCS(ctx context.Context, files []string) error {
-	if len(files) < 1 {
-		return nil
-	}
-	client, clientErr := storage.NewClient(ctx)
-	if clientErr != nil {
-		return clientErr
-	}
-	defer client.Close()
-	bucket := client.Bucket(GCS_BucketID)
 	for _, f := range files {
-		if err := bucket.Object(f).Delete(ctx); err != nil {
+		if err := Stores.Blobs.DeleteBlob(ctx, f); err != nil {
 			return err
 		}
 	}
@@ -399,34 +486,33 @@ func RemoveFilesFromGCS(ctx context.Context, files []string) error {
 
 // Internal Function
 // Description:
-// This function will retrive filenames from GCS per a storage Query
+// This function will retrive filenames from GCS that begin with prefix
 //
 // Returns:
 //      files []string - list of filenames.
 //      failure?(error) - Error if storage fails.
-func getFileFromGCS(ctx context.Context, q *storage.Query) ([]string, error) {
-	results := make([]string, 0)
-
-	client, clientErr := storage.NewClient(ctx)
-	if clientErr != nil {
-		return results, clientErr
-	}
-	defer client.Close()
-
-	objectList, errList := client.Bucket(GCS_BucketID).List(ctx, q)
-	if errList != nil {
-		return results, errList
-	}
-
-	for _, elem := range objectList.Results {
-		results = append(results, elem.Name)
-	}
-	return results, nil
+func getFileFromGCS(ctx context.Context, prefix string) ([]string, error) {
+	return Stores.Blobs.ListBlobs(ctx, prefix)
 }
 
 func GetFilesFromGCS_WithPrefix(ctx context.Context, prefix string) []string {
-	q := storage.Query{}
-	q.Prefix = prefix
-	r, _ := getFileFromGCS(ctx, &q)
+	r, _ := getFileFromGCS(ctx, prefix)
 	return r
 }
+
+// Internal Function
+// Description:
+// The images stored under oid, "global" or an id. Listing by prefix alone
+// would also give those of ids that oid begins, 45 for 4.
+//
+// Returns:
+//      files []string - list of filenames.
+func GetImagesOf(ctx context.Context, oid string) []string {
+	images := make([]string, 0)
+	for _, name := range GetFilesFromGCS_WithPrefix(ctx, oid) {
+		if imageOwner(name) == oid {
+			images = append(images, name)
+		}
+	}
+	return images
+}
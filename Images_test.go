@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"golang.org/x/net/context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestImagePrefix(t *testing.T) {
+	for oid, want := range map[string]string{"": "global", "global": "global", "45": "45"} {
+		if got, err := imagePrefix(oid); err != nil || got != want {
+			t.Errorf("%q gave %q, %v, want %q", oid, got, err, want)
+		}
+	}
+	for _, oid := range []string{"trash/1/", trashPrefix, "0", "-4", "+4", "04", "4/", "4 ", "global/", "Global", "x"} {
+		if got, err := imagePrefix(oid); err != ErrInvalidImageOwner {
+			t.Errorf("%q gave %q, %v, want ErrInvalidImageOwner", oid, got, err)
+		}
+	}
+}
+
+func TestGetImagesOf(t *testing.T) {
+	Stores = NewMemoryBackend()
+	ctx := context.Background()
+	sha := strings.Repeat("a", 40)
+	for _, name := range []string{"4" + sha + ".png", "45" + sha + ".png", "global" + sha + ".png", trashPrefix + "1/4" + sha + ".png"} {
+		if putErr := Stores.Blobs.PutBlob(ctx, name, "image/png", bytes.NewReader([]byte("png"))); putErr != nil {
+			t.Fatal(putErr)
+		}
+	}
+	for oid, want := range map[string][]string{"4": {"4" + sha + ".png"}, "45": {"45" + sha + ".png"}, "global": {"global" + sha + ".png"}, "5": {}} {
+		if got := GetImagesOf(ctx, oid); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s lists %q, want %q", oid, got, want)
+		}
+	}
+}
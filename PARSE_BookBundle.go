@@ -0,0 +1,509 @@
+package main
+
+/*
+PARSE_BookBundle.go by Allen J. Mills
+    mm.d.yy
+
+    Books bundled with their images in a zip file, to move a book to
+    another deployment. Images are stored under the id of the objective
+    or exercise they were uploaded for, and content refers to them as
+    /image?id=<name>, so their names change when the book is imported
+    and its structures get new ids. A bundle holds:
+        book.html       The book, as /export/<book id> writes it
+        images/<name>   Every image the book refers to
+    On import each image is stored as an upload is, named by its
+    contents under the new id of its objective or exercise, and every
+    reference to it in the book is rewritten. The book and its images
+    are stored all together or not at all. An archive may hold a tree
+    of Markdown files instead of book.html, see PARSE_BookMarkdown.go.
+*/
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUploadTooLarge  = errors.New("Import: The upload is larger than allowed.")         // ErrUploadTooLarge is returned when an upload is over Uploads.MaxBytes.
+	ErrArchiveTooLarge = errors.New("Import: The archive unpacks to more than allowed.")  // ErrArchiveTooLarge is returned when a file or all files of an archive unpack past the Uploads limits.
+	ErrArchiveTooMany  = errors.New("Import: The archive holds more files than allowed.") // ErrArchiveTooMany is returned when an archive has more than Uploads.MaxFiles entries.
+)
+
+const (
+	bundleDocument = "book.html" // The book inside a bundle
+	bundleImages   = "images/"   // The folder of images inside a bundle
+)
+
+// References to images in content, as the editors and the image browser write them.
+var imageReference = regexp.MustCompile(`/(?:image|api/getImage)\?id=([A-Za-z0-9._-]+)`)
+
+// Type: bookBundle
+// A book document and the images that came with it.
+type bookBundle struct {
+	Document []byte
+	Sources  map[string][]byte // Of a Markdown tree, by path under its folder; nil for a document
+	Parts    map[string][]byte // Of a Word document, by path in its zip; nil for other uploads
+	Images   map[string][]byte // By name; nil when the upload was a document, not a bundle
+}
+
+// Type: bookSource
+// A file of a bundle that may refer to images.
+type bookSource struct {
+	Name string // Empty for the document of a bundle
+	Data []byte
+}
+
+// Internal Function
+// Description:
+// Limits the body of a book upload to Uploads.MaxBytes. Called before
+// anything reads the form, so an oversized request fails to parse.
+func limitUpload(res http.ResponseWriter, req *http.Request) {
+	req.Body = http.MaxBytesReader(res, req.Body, Settings.Uploads.MaxBytes)
+}
+
+// Internal Function
+// Description:
+// Reads an uploaded file, up to Uploads.MaxBytes.
+//
+// Returns:
+//      file([]byte) - The whole file.
+//      failure?(error) - ErrUploadTooLarge, or any read error.
+func readUpload(r io.Reader) ([]byte, error) {
+	file, readErr := ioutil.ReadAll(io.LimitReader(r, Settings.Uploads.MaxBytes+1))
+	if readErr != nil {
+		return nil, readErr
+	}
+	if int64(len(file)) > Settings.Uploads.MaxBytes {
+		return nil, ErrUploadTooLarge
+	}
+	return file, nil
+}
+
+// Type: archiveReader
+// Collects the files of an archive within the Uploads limits.
+type archiveReader struct {
+	files    map[string][]byte
+	entries  int
+	unpacked int64
+}
+
+// Internal Function
+// Description:
+// Counts an entry of the archive, file or not.
+//
+// Returns:
+//      failure?(error) - ErrArchiveTooMany past Uploads.MaxFiles entries.
+func (a *archiveReader) count() error {
+	if a.entries++; a.entries > Settings.Uploads.MaxFiles {
+		return ErrArchiveTooMany
+	}
+	return nil
+}
+
+// Internal Function
+// Description:
+// Reads one file of the archive, no more than the limits leave room for.
+//
+// Returns:
+//      failure?(error) - ErrArchiveTooLarge if it unpacks past a limit, or any read error.
+func (a *archiveReader) add(name string, r io.Reader) error {
+	room := Settings.Uploads.MaxFileBytes
+	if left := Settings.Uploads.MaxUnpackedBytes - a.unpacked; left < room {
+		room = left
+	}
+	data, readErr := ioutil.ReadAll(io.LimitReader(r, room+1))
+	if readErr != nil {
+		return readErr
+	}
+	if int64(len(data)) > room {
+		return ErrArchiveTooLarge
+	}
+	a.unpacked += int64(len(data))
+	a.files[strings.TrimPrefix(path.Clean("/"+name), "/")] = data
+	return nil
+}
+
+// Internal Function
+// Description:
+// Reads the files of an uploaded zip, or of a tar archive, gzipped or not.
+//
+// Returns:
+//      files(map[string][]byte) - By path, without folders. nil if the file is no archive.
+//      failure?(error) - If the archive cannot be read.
+func readUploadArchive(file []byte) (map[string][]byte, error) {
+	a := &archiveReader{files: make(map[string][]byte)}
+	if bytes.HasPrefix(file, []byte("PK\x03\x04")) {
+		zr, zipErr := zip.NewReader(bytes.NewReader(file), int64(len(file)))
+		if zipErr != nil {
+			return nil, zipErr
+		}
+		if len(zr.File) > Settings.Uploads.MaxFiles {
+			return nil, ErrArchiveTooMany
+		}
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			// The size is only what the zip claims; add still stops reading at the limit.
+			if f.UncompressedSize64 > uint64(Settings.Uploads.MaxFileBytes) {
+				return nil, ErrArchiveTooLarge
+			}
+			rc, openErr := f.Open()
+			if openErr != nil {
+				return nil, openErr
+			}
+			addErr := a.add(f.Name, rc)
+			rc.Close()
+			if addErr != nil {
+				return nil, addErr
+			}
+		}
+		return a.files, nil
+	}
+
+	// A gzipped tarball is unpacked as it is read, never all at once.
+	var archive io.Reader = bytes.NewReader(file)
+	if bytes.HasPrefix(file, []byte("\x1f\x8b")) {
+		gz, gzipErr := gzip.NewReader(archive)
+		if gzipErr != nil {
+			return nil, gzipErr
+		}
+		unzipped := bufio.NewReaderSize(gz, 512)
+		if head, _ := unzipped.Peek(262); len(head) < 262 || string(head[257:262]) != "ustar" {
+			return nil, errors.New("The gzipped file is not a tar archive")
+		}
+		archive = unzipped
+	} else if len(file) < 262 || string(file[257:262]) != "ustar" {
+		return nil, nil
+	}
+	tr := tar.NewReader(archive)
+	for {
+		h, nextErr := tr.Next()
+		if nextErr == io.EOF {
+			return a.files, nil
+		}
+		if nextErr != nil {
+			return nil, nextErr
+		}
+		if countErr := a.count(); countErr != nil {
+			return nil, countErr
+		}
+		if !h.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		if h.Size > Settings.Uploads.MaxFileBytes {
+			return nil, ErrArchiveTooLarge
+		}
+		if addErr := a.add(h.Name, tr); addErr != nil {
+			return nil, addErr
+		}
+	}
+}
+
+// Internal Function
+// Description:
+// Reads an uploaded book file: a book document, a zip bundle, an
+// archive of a Markdown tree, or a Word document.
+//
+// Returns:
+//      bundle(*bookBundle) - The document, Markdown files or Word parts, and the images of an archive.
+//      failure?(error) - If the file is an archive that cannot be read.
+func readBookUpload(file []byte) (*bookBundle, error) {
+	files, archiveErr := readUploadArchive(file)
+	if archiveErr != nil {
+		return nil, archiveErr
+	}
+	if files == nil {
+		return &bookBundle{Document: file}, nil
+	}
+
+	if _, isDocx := docxMainPart(files); isDocx {
+		return &bookBundle{Parts: files, Images: make(map[string][]byte)}, nil
+	}
+
+	b := &bookBundle{Images: make(map[string][]byte)}
+	root := ""
+	if _, hasDocument := files[bundleDocument]; !hasDocument {
+		if tree, isTree := markdownRoot(files); isTree {
+			root, b.Sources = tree, make(map[string][]byte)
+		}
+	}
+	for name, data := range files {
+		switch {
+		case !strings.HasPrefix(name, root):
+		case strings.HasPrefix(name, root+bundleImages):
+			b.Images[strings.TrimPrefix(name, root+bundleImages)] = data
+		case b.Sources != nil:
+			b.Sources[strings.TrimPrefix(name, root)] = data
+		case name == bundleDocument:
+			b.Document = data
+		}
+	}
+	return b, nil
+}
+
+// Method: sources
+// The files of b that may refer to images: its document, or the
+// Markdown files of its tree by name.
+func (b *bookBundle) sources() []bookSource {
+	if b.Sources == nil {
+		return []bookSource{{"", b.Document}}
+	}
+	names := make([]string, 0, len(b.Sources))
+	for name := range b.Sources {
+		if strings.HasSuffix(name, markdownFileType) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	sources := make([]bookSource, 0, len(names))
+	for _, name := range names {
+		sources = append(sources, bookSource{name, b.Sources[name]})
+	}
+	return sources
+}
+
+// Method: check
+// Finds problems with the images of a bundle: references to images it does
+// not hold, and images of a type this server does not take.
+func (b *bookBundle) check() []ImportDiagnostic {
+	diagnostics := make([]ImportDiagnostic, 0)
+	if b.Images == nil {
+		return diagnostics
+	}
+	if b.Document == nil && b.Sources == nil {
+		return append(diagnostics, ImportDiagnostic{Line: 1, Column: 1, Severity: ImportError, Message: "The bundle has no book", Expected: bundleDocument + " or " + markdownBook, Found: "neither"})
+	}
+
+	seen := make(map[string]bool)
+	for _, source := range b.sources() {
+		for _, m := range imageReference.FindAllSubmatchIndex(source.Data, -1) {
+			name := string(source.Data[m[2]:m[3]])
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			at := importPosition{Line: 1, Column: 1, File: source.Name}
+			at.advance(source.Data[:m[0]])
+			if _, held := b.Images[name]; !held {
+				diagnostics = append(diagnostics, ImportDiagnostic{File: at.File, Line: at.Line, Column: at.Column, Severity: ImportWarning, Message: "Image " + name + " is not in the bundle, references to it are kept as they are", Expected: bundleImages + name})
+			} else if _, extErr := filterExtension(name); extErr != nil {
+				diagnostics = append(diagnostics, ImportDiagnostic{File: at.File, Line: at.Line, Column: at.Column, Severity: ImportError, Message: extErr.Error(), Found: bundleImages + name})
+			}
+		}
+	}
+	return diagnostics
+}
+
+// Internal Function
+// Description:
+// Reads an uploaded book document, bundle, Markdown tree or Word
+// document into a tree, checking all of it.
+//
+// Returns:
+//      book(*importNode) - See parseBookHTML.
+//      bundle(*bookBundle) - The upload, with its images if it was an archive or Word document.
+//      diagnostics([]ImportDiagnostic) - Every problem found, in file order.
+//      failure?(error) - Any read error.
+func parseBookUpload(r io.Reader) (*importNode, *bookBundle, []ImportDiagnostic, error) {
+	file, readErr := readUpload(r)
+	if readErr != nil {
+		return nil, nil, nil, readErr
+	}
+	bundle, bundleErr := readBookUpload(file)
+	if bundleErr != nil {
+		return nil, nil, nil, bundleErr
+	}
+	if bundle.Parts != nil {
+		book, diagnostics := parseDocxBook(bundle.Parts, bundle.Images)
+		return book, bundle, diagnostics, nil
+	}
+	if bundle.Sources != nil {
+		book, diagnostics := parseMarkdownBook(bundle.Sources)
+		diagnostics = append(diagnostics, bundle.check()...)
+		sortImportDiagnostics(diagnostics)
+		return book, bundle, diagnostics, nil
+	}
+	book, diagnostics, parseErr := parseBookHTML(bytes.NewReader(bundle.Document))
+	if parseErr != nil {
+		return nil, bundle, diagnostics, parseErr
+	}
+	diagnostics = append(diagnostics, bundle.check()...)
+	sortImportDiagnostics(diagnostics)
+	return book, bundle, diagnostics, nil
+}
+
+// Internal Function
+// Description:
+// Gets the text and HTML fields of n that refer to images.
+func imageReferenceFields(n *importNode) []reflect.Value {
+	fields := make([]reflect.Value, 0)
+	v := reflect.ValueOf(n.Entity).Elem()
+	for _, name := range importFields[n.Kind] {
+		if f := v.FieldByName(name); f.Kind() == reflect.String && imageReference.MatchString(f.String()) {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// Internal Function
+// Description:
+// Rewrites the references to images in fields to the names in renamed.
+func rewriteImageReferences(fields []reflect.Value, renamed map[string]string) {
+	for _, f := range fields {
+		rewritten := imageReference.ReplaceAllStringFunc(f.String(), func(ref string) string {
+			old := imageReference.FindStringSubmatch(ref)[1]
+			if name, isRenamed := renamed[old]; isRenamed {
+				return strings.TrimSuffix(ref, old) + name
+			}
+			return ref
+		})
+		f.SetString(rewritten)
+	}
+}
+
+// Internal Function
+// Description:
+// Stages storing the images of b that book refers to into batch, which
+// must already place the structures of book. An image goes under the new
+// id of the objective or exercise it was stored under when that is in the
+// book, else under the first one that refers to it, else under "global".
+// Each structure referring to images is then placed again, with its
+// references rewritten to the new names.
+//
+// Returns:
+//      images(int) - The number of images staged.
+func stageBundleImages(batch *Batch, book *importNode, b *bookBundle) int {
+	nodes := make([]*importNode, 0)
+	owners := make(map[string]*int64) // New ids of objectives and exercises, by their id in the file
+	var walk func(n *importNode)
+	walk = func(n *importNode) {
+		nodes = append(nodes, n)
+		if (n.Kind == "objective" || n.Kind == "exercise") && n.ID != 0 {
+			owners[strconv.FormatInt(n.ID, 10)] = mergeID(n.Entity)
+		}
+		for _, c := range n.Children {
+			walk(c)
+		}
+	}
+	walk(book)
+
+	renamed := make(map[string]string)
+	staged := 0
+	for _, n := range nodes {
+		for _, f := range imageReferenceFields(n) {
+			for _, m := range imageReference.FindAllStringSubmatch(f.String(), -1) {
+				name, data := m[1], b.Images[m[1]]
+				if _, taken := renamed[name]; taken || data == nil {
+					continue
+				}
+				owner := owners[imageOwner(name)]
+				if owner == nil && (n.Kind == "objective" || n.Kind == "exercise") {
+					owner = mergeID(n.Entity)
+				}
+				renamed[name] = name
+				staged++
+
+				existed := false
+				batch.Do("store image "+name, func(ctx context.Context) error {
+					prefix := "global"
+					if owner != nil {
+						prefix = strconv.FormatInt(*owner, 10)
+					}
+					uploadName, nameErr := imageUploadName(name, bytes.NewReader(data), prefix)
+					if nameErr != nil {
+						return nameErr
+					}
+					if rdr, getErr := Stores.Blobs.GetBlob(ctx, uploadName); getErr == nil {
+						rdr.Close()
+						existed = true
+					}
+					renamed[name] = uploadName
+					return addFileToGCS(ctx, uploadName, bytes.NewReader(data))
+				}, func(ctx context.Context) error {
+					if existed {
+						return nil
+					}
+					return removeFileFromGCS(ctx, renamed[name])
+				})
+			}
+		}
+	}
+
+	for _, n := range nodes {
+		if fields := imageReferenceFields(n); len(fields) > 0 {
+			batch.Place(mergeID(n.Entity), n.Entity, func() { rewriteImageReferences(fields, renamed) })
+		}
+	}
+	return staged
+}
+
+// Internal Function
+// Description:
+// Sorts diagnostics into file order. Those of a Markdown tree keep the
+// order their files were first reported in.
+func sortImportDiagnostics(diagnostics []ImportDiagnostic) {
+	files := make(map[string]int)
+	for _, d := range diagnostics {
+		if _, ranked := files[d.File]; !ranked {
+			files[d.File] = len(files)
+		}
+	}
+	sort.SliceStable(diagnostics, func(i, j int) bool {
+		a, b := diagnostics[i], diagnostics[j]
+		if files[a.File] != files[b.File] {
+			return files[a.File] < files[b.File]
+		}
+		return a.Line < b.Line || (a.Line == b.Line && a.Column < b.Column)
+	})
+}
+
+// Call: /bundle/:ID
+// Description:
+//  Book Export as a zip bundle: book.html, as /export/:ID writes it,
+//  and images/<name> for every image the book refers to that can be read.
+//
+// Method: GET
+// Results: ZIP
+// Mandatory Options: ID
+// Optional Options:
+func exportBookBundle(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	i, parseErr := strconv.Atoi(params.ByName("ID"))
+	if parseErr != nil || i == 0 {
+		http.Error(res, "Invalid ID", http.StatusExpectationFailed)
+		return
+	}
+
+	if readErr := CheckReadable(res, req, Scope{"Book", int64(i)}); readErr != nil {
+		http.Error(res, readErr.Error(), http.StatusNotFound)
+		return
+	}
+
+	book, loadErr := loadBookExport(NewContext(req), int64(i))
+	if loadErr != nil {
+		http.Error(res, loadErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	images := book.readableImages(res, req) // missing images are left out, the importer warns of them.
+	serveDownload(res, "application/zip", fmt.Sprint("book-", i, ".zip"), func(w io.Writer) error {
+		return writeZipPackage(zip.NewWriter(w), []zipTemplate{{bundleDocument, "BookExport.gohtml", book}}, bundleImages, images)
+	})
+}
@@ -0,0 +1,162 @@
+package main
+
+/*
+PARSE_BookCartridge.go by Allen J. Mills
+    mm.d.yy
+
+    Books as IMS Common Cartridge 1.1 packages, which Canvas, Moodle and
+    most other learning management systems import as a course.
+    /export/<book id>?format=imscc writes:
+        imsmanifest.xml                     Organization of chapters, sections
+                                            and objectives, and the resources
+        web_resources/objective-<id>.html   Web content: an objective with its
+                                            key takeaways
+        web_resources/images/<name>         Every image the book refers to
+        exercises-<id>/assessment.xml       The exercises of objective <id>, as
+                                            QTI 1.2 essay items
+    Each objective with exercises is followed by an assessment of them in
+    the organization. Exercises have no choices to mark, so they are
+    essay items, with their solution and answer as feedback. Content is
+    written as in an EPUB, see PARSE_BookEpub.go. The documents are in
+    templates/BookCartridge.gohtml.
+*/
+
+import (
+	"archive/zip"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"net/http"
+)
+
+const (
+	cartridgeMimetype = "application/vnd.ims.imsccv1p1" // Type served for a cartridge
+	cartridgeImages   = "images/"                       // Images of pages, beside them in web_resources
+	cartridgeFilebase = "$IMS-CC-FILEBASE$/images/"     // Images of assessments, from web_resources
+)
+
+// Type: cartridge
+// A book with what its cartridge holds besides it.
+type cartridge struct {
+	*bookExport
+	Identifier  string
+	Images      []string // Names of the images held
+	Assessments []cartridgeAssessment
+
+	images map[string][]byte
+}
+
+// Type: cartridgeAssessment
+// The exercises of an objective.
+type cartridgeAssessment struct {
+	ID    int64 // Of the objective
+	Title string
+	Items []cartridgeItem
+}
+
+// Type: cartridgeItem
+// An exercise as an assessment item, its HTML ready to write.
+type cartridgeItem struct {
+	ID       int64
+	Title    string
+	Question string
+	Feedback string
+}
+
+// Internal Function
+// Description:
+// Makes exercise e an assessment item: its instruction and question are
+// the question, and its solution and answer the feedback.
+func newCartridgeItem(e Exercise) cartridgeItem {
+	item := cartridgeItem{ID: e.ID, Title: e.Instruction, Question: string(e.Question)}
+	if item.Title == "" {
+		item.Title = fmt.Sprint("Exercise ", e.Order)
+	}
+	if e.Instruction != "" {
+		item.Question = "<p>" + html.EscapeString(e.Instruction) + "</p>" + item.Question
+	}
+	if e.Solution != "" {
+		item.Feedback += "<h4>Solution</h4>" + string(e.Solution)
+	}
+	if e.Answer != "" {
+		item.Feedback += "<h4>Answer</h4>" + string(e.Answer)
+	}
+	return item
+}
+
+// Internal Function
+// Description:
+// Gathers book bookID into a cartridge: its images that the reader of
+// req may see and that are stored, its content rewritten to refer to
+// them, and its exercises as assessments.
+//
+// Returns:
+//      cartridge(*cartridge) - The cartridge, ready to write.
+//      failure?(error) - Any storage error.
+func newCartridge(res http.ResponseWriter, req *http.Request, bookID int64) (*cartridge, error) {
+	book, loadErr := loadBookExport(NewContext(req), bookID)
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	c := &cartridge{
+		bookExport: book,
+		Identifier: fmt.Sprint("book-", bookID, "-cartridge"),
+		images:     book.readableImages(res, req),
+	}
+	c.Images = imageNames(c.images)
+
+	book.eachHTML(func(kind string, field *template.HTML) {
+		imageDir := cartridgeImages
+		if kind == "Exercise" {
+			imageDir = cartridgeFilebase
+		}
+		*field = template.HTML(portableXHTML(string(*field), c.images, imageDir))
+	})
+
+	for _, ch := range book.Chapters {
+		for _, s := range ch.Sections {
+			for _, o := range s.Objectives {
+				if len(o.Exercises) == 0 {
+					continue
+				}
+				a := cartridgeAssessment{ID: o.ID, Title: o.Title}
+				for _, e := range o.Exercises {
+					a.Items = append(a.Items, newCartridgeItem(e))
+				}
+				c.Assessments = append(c.Assessments, a)
+			}
+		}
+	}
+	return c, nil
+}
+
+// Method: write
+// Writes the cartridge as a zip to w.
+func (c *cartridge) write(w io.Writer) error {
+	files := []zipTemplate{{"imsmanifest.xml", "CartridgeManifest", c}}
+	for _, ch := range c.Chapters {
+		for _, s := range ch.Sections {
+			for _, o := range s.Objectives {
+				files = append(files, zipTemplate{fmt.Sprint("web_resources/objective-", o.ID, ".html"), "CartridgePage", o})
+			}
+		}
+	}
+	for _, a := range c.Assessments {
+		files = append(files, zipTemplate{fmt.Sprint("exercises-", a.ID, "/assessment.xml"), "CartridgeAssessment", a})
+	}
+	return writeZipPackage(zip.NewWriter(w), files, "web_resources/"+cartridgeImages, c.images)
+}
+
+// Internal Function
+// Description:
+// Writes book bookID to res as a Common Cartridge. The reader must
+// already be allowed to read the book.
+func exportBookCartridge(res http.ResponseWriter, req *http.Request, bookID int64) {
+	c, packErr := newCartridge(res, req, bookID)
+	if packErr != nil {
+		http.Error(res, packErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveDownload(res, cartridgeMimetype, fmt.Sprint("book-", bookID, ".imscc"), c.write)
+}
@@ -0,0 +1,1732 @@
+package main
+
+/*
+PARSE_BookDocx.go by Allen J. Mills
+    mm.d.yy
+
+    Books as Word documents, for copy editors who review in Word.
+    /export/<book id>?format=docx writes an Office Open XML package:
+        [Content_Types].xml             Types of the parts
+        _rels/.rels                     Points Word at the document
+        docProps/core.xml               Title, author and keywords
+        word/document.xml               The book
+        word/_rels/document.xml.rels    Images and links of the document
+        word/styles.xml                 Its styles
+        word/numbering.xml              Bullets and numbers of its lists
+        word/media/image<n>.<ext>       Every image the book refers to
+    Chapter, section and objective titles are Heading 1, 2 and 3, so
+    they show in Word's navigation pane. Headings in content are Heading
+    4 and below. Each objective is followed by its key takeaways and its
+    exercises, in the Key Takeaways and Exercise styles, which are shaded
+    blocks that editors may restyle as they please.
+
+    Content is HTML written by the editors. Its paragraphs, headings,
+    lists, tables, quotes, preformatted text, links and emphasis are
+    written as Word's own. Other elements keep their text, and images
+    that cannot be read, or that Word cannot show, are replaced by their
+    alt text. The parts that do not depend on content are in
+    templates/BookDocx.gohtml.
+
+    /import/book also reads Word documents, to start a book from an
+    author's manuscript. Heading 1, 2 and 3 start a chapter, section and
+    objective, and the paragraphs between them become descriptions and
+    content, as sanitized HTML. The styles the exporter writes are read
+    back as they were written, so an exported book imports again. Images
+    are read from word/media into the upload's images, and stored under
+    the new id of the objective or exercise they are in.
+*/
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"html/template"
+	"image"
+	_ "image/gif"  // Sizes of images
+	_ "image/jpeg" // Sizes of images
+	_ "image/png"  // Sizes of images
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	docxMimetype  = "application/vnd.openxmlformats-officedocument.wordprocessingml.document" // Type served for a document
+	docxTextWidth = 9360                                                                      // Width of the text of a page, in twentieths of a point
+	docxTwips     = 15                                                                        // Twentieths of a point in a pixel
+	docxEMU       = 9525                                                                      // English Metric Units in a pixel
+	docxFirstRel  = 3                                                                         // The first relationship id left after styles and numbering
+	docxImageRel  = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/image"
+	docxLinkRel   = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/hyperlink"
+)
+
+// Image types Word shows, by extension.
+var docxImageTypes = map[string]string{
+	"png":  "image/png",
+	"jpg":  "image/jpeg",
+	"jpeg": "image/jpeg",
+	"gif":  "image/gif",
+	"bmp":  "image/bmp",
+	"tif":  "image/tiff",
+	"tiff": "image/tiff",
+}
+
+// Schemes of links that are kept as links.
+var docxLinkSchemes = map[string]bool{"http": true, "https": true, "mailto": true, "ftp": true}
+
+var docxSpaces = regexp.MustCompile(`[ \t\n\f\r]+`)
+
+// Type: docxPackage
+// A book with what its document refers to: relationships to images and
+// links, lists, and the image files held.
+type docxPackage struct {
+	*bookExport
+	Created    string
+	Relations  []docxRelation
+	Lists      []docxList
+	Extensions []docxExtension
+
+	images   map[string][]byte // By name, the images the reader may see
+	media    map[string][]byte // By path in word/, the images held
+	embedded map[string]string // Relationship ids, by image name
+	links    map[string]string // Relationship ids, by link target
+	base     *url.URL          // The server, for links inside it
+	drawings int
+}
+
+// Type: docxRelation
+// A relationship of the document to an image or a link.
+type docxRelation struct {
+	ID, Type, Target string
+	External         bool
+}
+
+// Type: docxList
+// A list of content. Each has a numbering of its own, so numbered
+// lists start again.
+type docxList struct {
+	ID      int
+	Ordered bool
+	Level   int // Of the list inside others, from 0
+	Start   int
+}
+
+// Type: docxLevel
+// A level of the bullets or numbers of lists.
+type docxLevel struct {
+	Level        int
+	Format, Text string
+	Indent       int
+}
+
+// Type: docxExtension
+// An image file extension, and its type.
+type docxExtension struct {
+	Extension, Type string
+}
+
+// Internal Function
+// Description:
+// The text of a paragraph of style in the document template.
+func docxHeading(style, text string) struct{ Style, Text string } {
+	return struct{ Style, Text string }{style, xmlCharacters(text)}
+}
+
+// Internal Function
+// Description:
+// The nine levels of bullets, or of numbers when ordered.
+func docxLevels(ordered bool) []docxLevel {
+	levels := make([]docxLevel, 9)
+	for l := range levels {
+		levels[l] = docxLevel{Level: l, Format: "bullet", Text: []string{"•", "◦", "▪"}[l%3], Indent: 720 * (l + 1)}
+		if ordered {
+			levels[l].Format = []string{"decimal", "lowerLetter", "lowerRoman"}[l%3]
+			levels[l].Text = fmt.Sprintf("%%%d.", l+1)
+		}
+	}
+	return levels
+}
+
+// Method: BulletLevels
+// The levels of lists with bullets.
+func (p *docxPackage) BulletLevels() []docxLevel {
+	return docxLevels(false)
+}
+
+// Method: NumberLevels
+// The levels of numbered lists.
+func (p *docxPackage) NumberLevels() []docxLevel {
+	return docxLevels(true)
+}
+
+// Method: relate
+// Adds a relationship of the document, and returns its id.
+func (p *docxPackage) relate(kind, target string, external bool) string {
+	id := fmt.Sprint("rId", docxFirstRel+len(p.Relations))
+	p.Relations = append(p.Relations, docxRelation{id, kind, target, external})
+	return id
+}
+
+// Method: embed
+// The relationship id of image name, held as a file of the document.
+func (p *docxPackage) embed(name string) string {
+	if id, held := p.embedded[name]; held {
+		return id
+	}
+	ext := stringedExt(name)
+	file := fmt.Sprintf("media/image%d.%s", len(p.embedded)+1, ext)
+	p.media[file] = p.images[name]
+	p.embedded[name] = p.relate(docxImageRel, file, false)
+	return p.embedded[name]
+}
+
+// Method: link
+// The relationship id of a link to href, with links inside this server
+// made whole. Empty for links that do not leave the page, or that Word
+// should not follow.
+func (p *docxPackage) link(href string) string {
+	u, parseErr := url.Parse(strings.TrimSpace(href))
+	if parseErr != nil || (u.Scheme == "" && u.Host == "" && u.Path == "") {
+		return ""
+	}
+	target := p.base.ResolveReference(u)
+	if !docxLinkSchemes[target.Scheme] {
+		return ""
+	}
+	if id, related := p.links[target.String()]; related {
+		return id
+	}
+	p.links[target.String()] = p.relate(docxLinkRel, target.String(), true)
+	return p.links[target.String()]
+}
+
+// Method: list
+// Adds a list, and returns its numbering id.
+func (p *docxPackage) list(ordered bool, level, start int) int {
+	p.Lists = append(p.Lists, docxList{len(p.Lists) + 1, ordered, level, start})
+	return len(p.Lists)
+}
+
+// Method: wordML
+// Writes HTML content as the paragraphs and tables of a document, in
+// paragraph style, Normal if it is empty.
+func (p *docxPackage) wordML(content template.HTML, style string) template.HTML {
+	body := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, parseErr := html.ParseFragment(strings.NewReader(string(content)), body)
+	if parseErr != nil {
+		nodes = []*html.Node{{Type: html.TextNode, Data: string(content)}}
+	}
+	var out bytes.Buffer
+	w := &docxWriter{p: p, out: &out, width: docxTextWidth, space: true}
+	for _, n := range nodes {
+		w.node(n, docxParagraph{Style: style}, docxRun{})
+	}
+	w.flush()
+	return template.HTML(out.String())
+}
+
+/////---------------------------------
+// HTML to WordprocessingML
+////
+
+// Type: docxParagraph
+// How a paragraph is written: its style, and the list item it is in.
+type docxParagraph struct {
+	Style string
+	Item  *docxItem
+}
+
+// Type: docxItem
+// An item of a list. Its first paragraph has the bullet or number, and
+// the rest are indented to match.
+type docxItem struct {
+	List, Level int
+	numbered    bool
+}
+
+// Type: docxRun
+// How text is written.
+type docxRun struct {
+	Style                           string // Character style
+	Bold, Italic, Underline, Strike bool
+	VertAlign                       string
+	Link                            string // Relationship id
+	Pre                             bool   // White space is kept
+}
+
+// Type: docxWriter
+// The state of writing content: the paragraph being written, and where
+// finished paragraphs and tables go.
+type docxWriter struct {
+	p         *docxPackage
+	out       *bytes.Buffer
+	width     int           // Of the text, in twentieths of a point
+	runs      bytes.Buffer  // Of the paragraph being written
+	para      docxParagraph // Of the paragraph being written
+	space     bool          // Whether the paragraph is empty or ends in white space
+	tableLast bool          // Whether a table was the last thing written
+}
+
+// Method: node
+// Writes n and everything inside it, in paragraph para with text as run.
+func (w *docxWriter) node(n *html.Node, para docxParagraph, run docxRun) {
+	switch n.Type {
+	case html.TextNode:
+		text := n.Data
+		if run.Pre && n.NextSibling == nil && n.Parent != nil && n.Parent.DataAtom == atom.Pre {
+			text = strings.TrimSuffix(text, "\n")
+		}
+		w.text(text, para, run)
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Br:
+		w.write(para, run, "<w:br/>")
+		w.space = true
+		return
+	case atom.Img:
+		w.image(n, para, run)
+		return
+	case atom.Ul, atom.Ol:
+		w.list(n, para, run)
+		return
+	case atom.Table:
+		w.table(n, para, run)
+		return
+	case atom.Hr:
+		w.flush()
+		w.paragraph(docxParagraph{Style: "HorizontalRule"}, "")
+		return
+	case atom.B, atom.Strong:
+		run.Bold = true
+	case atom.I, atom.Em, atom.Cite, atom.Dfn, atom.Var:
+		run.Italic = true
+	case atom.U, atom.Ins:
+		run.Underline = true
+	case atom.S, atom.Strike, atom.Del:
+		run.Strike = true
+	case atom.Sub:
+		run.VertAlign = "subscript"
+	case atom.Sup:
+		run.VertAlign = "superscript"
+	case atom.Code, atom.Kbd, atom.Samp, atom.Tt:
+		if run.Link == "" {
+			run.Style = "CodeChar"
+		}
+	case atom.A:
+		href, _ := markdownAttribute(n, "href")
+		if link := w.p.link(href); link != "" {
+			run.Link, run.Style = link, "Hyperlink"
+		}
+	case atom.Pre:
+		para.Style, run.Pre = "Code", true
+	case atom.Blockquote:
+		para.Style = "Quote"
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		level := int(n.Data[1]-'0') + 3
+		if level > 6 {
+			level = 6
+		}
+		para.Style = fmt.Sprint("Heading", level)
+	default:
+		if epubDropped[n.DataAtom] {
+			return
+		}
+	}
+
+	block := markdownBlockTags[n.Data]
+	if block {
+		w.flush()
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.node(c, para, run)
+	}
+	if block {
+		w.flush()
+	}
+}
+
+// Method: text
+// Writes text, its white space collapsed as a browser would, unless run keeps it.
+func (w *docxWriter) text(text string, para docxParagraph, run docxRun) {
+	text = xmlCharacters(text)
+	if !run.Pre {
+		text = docxSpaces.ReplaceAllString(text, " ")
+		if w.space {
+			text = strings.TrimLeft(text, " ")
+		}
+		if text == "" {
+			return
+		}
+		w.write(para, run, docxText(text))
+		w.space = strings.HasSuffix(text, " ")
+		return
+	}
+
+	var inner bytes.Buffer
+	for i, line := range strings.Split(text, "\n") {
+		if i > 0 {
+			inner.WriteString("<w:br/>")
+		}
+		for j, part := range strings.Split(line, "\t") {
+			if j > 0 {
+				inner.WriteString("<w:tab/>")
+			}
+			if part != "" {
+				inner.WriteString(docxText(part))
+			}
+		}
+	}
+	if inner.Len() > 0 {
+		w.write(para, run, inner.String())
+		w.space = false
+	}
+}
+
+// Internal Function
+// Description:
+// A w:t element holding text.
+func docxText(text string) string {
+	return `<w:t xml:space="preserve">` + html.EscapeString(text) + `</w:t>`
+}
+
+// Method: write
+// Adds a run holding inner to the paragraph being written, as para.
+func (w *docxWriter) write(para docxParagraph, run docxRun, inner string) {
+	w.para = para
+	var props bytes.Buffer
+	if run.Style != "" {
+		fmt.Fprintf(&props, `<w:rStyle w:val="%s"/>`, run.Style)
+	}
+	for _, p := range []struct {
+		set  bool
+		prop string
+	}{{run.Bold, "<w:b/>"}, {run.Italic, "<w:i/>"}, {run.Strike, "<w:strike/>"}, {run.Underline, `<w:u w:val="single"/>`}} {
+		if p.set {
+			props.WriteString(p.prop)
+		}
+	}
+	if run.VertAlign != "" {
+		fmt.Fprintf(&props, `<w:vertAlign w:val="%s"/>`, run.VertAlign)
+	}
+
+	r := "<w:r>" + inner + "</w:r>"
+	if props.Len() > 0 {
+		r = "<w:r><w:rPr>" + props.String() + "</w:rPr>" + inner + "</w:r>"
+	}
+	if run.Link != "" {
+		r = `<w:hyperlink r:id="` + run.Link + `">` + r + "</w:hyperlink>"
+	}
+	w.runs.WriteString(r)
+}
+
+// Method: flush
+// Ends the paragraph being written, if it has anything in it.
+func (w *docxWriter) flush() {
+	if w.runs.Len() == 0 {
+		return
+	}
+	w.paragraph(w.para, w.runs.String())
+	w.runs.Reset()
+	w.space = true
+}
+
+// Method: paragraph
+// Writes a paragraph of runs, as para.
+func (w *docxWriter) paragraph(para docxParagraph, runs string) {
+	var props bytes.Buffer
+	if para.Style != "" {
+		fmt.Fprintf(&props, `<w:pStyle w:val="%s"/>`, para.Style)
+	}
+	if item := para.Item; item != nil && !item.numbered {
+		fmt.Fprintf(&props, `<w:numPr><w:ilvl w:val="%d"/><w:numId w:val="%d"/></w:numPr>`, item.Level, item.List)
+		item.numbered = true
+	} else if item != nil {
+		fmt.Fprintf(&props, `<w:ind w:left="%d"/>`, 720*(item.Level+1))
+	}
+
+	w.out.WriteString("<w:p>")
+	if props.Len() > 0 {
+		w.out.WriteString("<w:pPr>" + props.String() + "</w:pPr>")
+	}
+	w.out.WriteString(runs + "</w:p>\n")
+	w.tableLast = false
+}
+
+// Method: list
+// Writes a list element, each item a paragraph with its bullet or number.
+func (w *docxWriter) list(n *html.Node, para docxParagraph, run docxRun) {
+	w.flush()
+	level := 0
+	if para.Item != nil && para.Item.Level < 8 {
+		level = para.Item.Level + 1
+	} else if para.Item != nil {
+		level = 8
+	}
+	start := 1
+	if attr, _ := markdownAttribute(n, "start"); attr != "" {
+		if s, convErr := strconv.Atoi(attr); convErr == nil {
+			start = s
+		}
+	}
+	id := w.p.list(n.DataAtom == atom.Ol, level, start)
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || c.DataAtom != atom.Li {
+			w.node(c, para, run)
+			continue
+		}
+		item := para
+		item.Item = &docxItem{List: id, Level: level}
+		for cc := c.FirstChild; cc != nil; cc = cc.NextSibling {
+			w.node(cc, item, run)
+		}
+		w.flush()
+		if !item.Item.numbered {
+			w.paragraph(item, "") // An empty item still has its bullet.
+		}
+	}
+}
+
+// Method: table
+// Writes a table element as a table with its grid, and its caption
+// before it. Cells spanning columns are kept; cells spanning rows are
+// not, their rows are written as given.
+func (w *docxWriter) table(n *html.Node, para docxParagraph, run docxRun) {
+	w.flush()
+	type row struct {
+		cells  []*html.Node
+		header bool
+	}
+	rows := make([]row, 0)
+	addRow := func(tr *html.Node, header bool) {
+		r := row{header: header}
+		for c := tr.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode && (c.DataAtom == atom.Td || c.DataAtom == atom.Th) {
+				r.cells = append(r.cells, c)
+			}
+		}
+		rows = append(rows, r)
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		switch {
+		case c.Type != html.ElementNode:
+		case c.DataAtom == atom.Caption:
+			w.node(c, docxParagraph{Style: "Caption"}, run)
+			w.flush()
+		case c.DataAtom == atom.Tr:
+			addRow(c, false)
+		case c.DataAtom == atom.Thead || c.DataAtom == atom.Tbody || c.DataAtom == atom.Tfoot:
+			for tr := c.FirstChild; tr != nil; tr = tr.NextSibling {
+				if tr.Type == html.ElementNode && tr.DataAtom == atom.Tr {
+					addRow(tr, c.DataAtom == atom.Thead)
+				}
+			}
+		}
+	}
+
+	span := func(cell *html.Node) int {
+		attr, _ := markdownAttribute(cell, "colspan")
+		if s, convErr := strconv.Atoi(attr); convErr == nil && s > 1 {
+			return s
+		}
+		return 1
+	}
+	columns := 0
+	for _, r := range rows {
+		width := 0
+		for _, cell := range r.cells {
+			width += span(cell)
+		}
+		if width > columns {
+			columns = width
+		}
+	}
+	if columns == 0 {
+		return
+	}
+
+	column := w.width / columns
+	w.out.WriteString(`<w:tbl><w:tblPr><w:tblStyle w:val="TableGrid"/><w:tblW w:w="0" w:type="auto"/></w:tblPr><w:tblGrid>`)
+	w.out.WriteString(strings.Repeat(fmt.Sprintf(`<w:gridCol w:w="%d"/>`, column), columns) + "</w:tblGrid>\n")
+	for _, r := range rows {
+		w.out.WriteString("<w:tr>")
+		if r.header {
+			w.out.WriteString("<w:trPr><w:tblHeader/></w:trPr>")
+		}
+		width := 0
+		for _, cell := range r.cells {
+			s := span(cell)
+			width += s
+			fmt.Fprintf(w.out, `<w:tc><w:tcPr><w:tcW w:w="%d" w:type="dxa"/>`, column*s)
+			if s > 1 {
+				fmt.Fprintf(w.out, `<w:gridSpan w:val="%d"/>`, s)
+			}
+			w.out.WriteString("</w:tcPr>")
+
+			var content bytes.Buffer
+			cw := &docxWriter{p: w.p, out: &content, width: column * s, space: true}
+			cellRun := run
+			cellRun.Bold = run.Bold || cell.DataAtom == atom.Th
+			for c := cell.FirstChild; c != nil; c = c.NextSibling {
+				cw.node(c, docxParagraph{Style: para.Style}, cellRun)
+			}
+			cw.flush()
+			if content.Len() == 0 || cw.tableLast {
+				content.WriteString("<w:p/>") // Cells end with a paragraph.
+			}
+			w.out.WriteString(content.String() + "</w:tc>")
+		}
+		if width < columns {
+			w.out.WriteString(strings.Repeat("<w:tc><w:p/></w:tc>", columns-width))
+		}
+		w.out.WriteString("</w:tr>\n")
+	}
+	w.out.WriteString("</w:tbl>\n")
+	w.tableLast = true
+}
+
+// Method: image
+// Writes an img element as a picture in line with the text, no wider
+// than the text, or its alt text if the document cannot hold it.
+func (w *docxWriter) image(n *html.Node, para docxParagraph, run docxRun) {
+	alt, _ := markdownAttribute(n, "alt")
+	src, _ := markdownAttribute(n, "src")
+	m := imageReference.FindStringSubmatch(src)
+	if m == nil || w.p.images[m[1]] == nil || docxImageTypes[stringedExt(m[1])] == "" {
+		w.text(alt, para, run)
+		return
+	}
+	name := m[1]
+	rel := w.p.embed(name)
+
+	width, height := 0, 0
+	if config, _, decodeErr := image.DecodeConfig(bytes.NewReader(w.p.images[name])); decodeErr == nil {
+		width, height = config.Width, config.Height
+	}
+	attrWidth, _ := markdownAttribute(n, "width")
+	attrHeight, _ := markdownAttribute(n, "height")
+	if wa, convErr := strconv.Atoi(attrWidth); convErr == nil && wa > 0 {
+		if height > 0 && width > 0 {
+			height = height * wa / width
+		}
+		width = wa
+	}
+	if ha, convErr := strconv.Atoi(attrHeight); convErr == nil && ha > 0 {
+		height = ha
+	}
+	if width <= 0 || height <= 0 {
+		width, height = 320, 240 // Sizes Word cannot read from the file, editors will resize.
+	}
+	if widest := w.width / docxTwips; width > widest {
+		height, width = height*widest/width, widest
+	}
+
+	w.p.drawings++
+	cx, cy := width*docxEMU, height*docxEMU
+	descr := html.EscapeString(xmlCharacters(alt))
+	w.write(para, docxRun{Link: run.Link}, fmt.Sprintf(`<w:drawing><wp:inline distT="0" distB="0" distL="0" distR="0"><wp:extent cx="%d" cy="%d"/><wp:docPr id="%d" name="Picture %d" descr="%s"/>`+
+		`<a:graphic><a:graphicData uri="http://schemas.openxmlformats.org/drawingml/2006/picture"><pic:pic><pic:nvPicPr><pic:cNvPr id="%d" name="%s"/><pic:cNvPicPr/></pic:nvPicPr>`+
+		`<pic:blipFill><a:blip r:embed="%s"/><a:stretch><a:fillRect/></a:stretch></pic:blipFill>`+
+		`<pic:spPr><a:xfrm><a:off x="0" y="0"/><a:ext cx="%d" cy="%d"/></a:xfrm><a:prstGeom prst="rect"><a:avLst/></a:prstGeom></pic:spPr></pic:pic></a:graphicData></a:graphic></wp:inline></w:drawing>`,
+		cx, cy, w.p.drawings, w.p.drawings, descr, w.p.drawings, html.EscapeString(name), rel, cx, cy))
+	w.space = false
+}
+
+/////---------------------------------
+// Exporter
+////
+
+// Internal Function
+// Description:
+// Gathers book bookID into a Word document: its images that the reader
+// of req may see and that are stored, and its content written as the
+// document's own. Links inside this server use https when cookies of
+// req would be Secure.
+//
+// Returns:
+//      document(*docxPackage) - The document, ready to write.
+//      failure?(error) - Any storage error.
+func newDocxPackage(res http.ResponseWriter, req *http.Request, bookID int64) (*docxPackage, error) {
+	book, loadErr := loadBookExport(NewContext(req), bookID)
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	scheme := "http"
+	if secureCookie(req) {
+		scheme = "https"
+	}
+	p := &docxPackage{
+		bookExport: book,
+		Created:    time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+		images:     book.readableImages(res, req),
+		media:      make(map[string][]byte),
+		embedded:   make(map[string]string),
+		links:      make(map[string]string),
+		base:       &url.URL{Scheme: scheme, Host: req.Host, Path: "/"},
+	}
+
+	book.Description = p.wordML(book.Description, "")
+	for ci := range book.Chapters {
+		c := &book.Chapters[ci]
+		c.Description = p.wordML(c.Description, "")
+		for si := range c.Sections {
+			s := &c.Sections[si]
+			s.Description = p.wordML(s.Description, "")
+			for oi := range s.Objectives {
+				o := &s.Objectives[oi]
+				o.Content = p.wordML(o.Content, "")
+				o.KeyTakeaways = p.wordML(o.KeyTakeaways, "KeyTakeaways")
+				for ei := range o.Exercises {
+					e := &o.Exercises[ei]
+					e.Question = p.wordML(e.Question, "Exercise")
+					e.Solution = p.wordML(e.Solution, "Exercise")
+					e.Answer = p.wordML(e.Answer, "Exercise")
+				}
+			}
+		}
+	}
+
+	extensions := make(map[string]bool)
+	for file := range p.media {
+		extensions[stringedExt(file)] = true
+	}
+	for ext := range extensions {
+		p.Extensions = append(p.Extensions, docxExtension{ext, docxImageTypes[ext]})
+	}
+	sort.Slice(p.Extensions, func(i, j int) bool { return p.Extensions[i].Extension < p.Extensions[j].Extension })
+	return p, nil
+}
+
+// Method: write
+// Writes the document as a zip to w.
+func (p *docxPackage) write(w io.Writer) error {
+	files := []zipTemplate{
+		{"[Content_Types].xml", "DocxContentTypes", p},
+		{"_rels/.rels", "DocxPackageRels", p},
+		{"docProps/core.xml", "DocxCore", p},
+		{"word/document.xml", "DocxDocument", p},
+		{"word/_rels/document.xml.rels", "DocxDocumentRels", p},
+		{"word/styles.xml", "DocxStyles", p},
+		{"word/numbering.xml", "DocxNumbering", p},
+	}
+	return writeZipPackage(zip.NewWriter(w), files, "word/", p.media)
+}
+
+// Internal Function
+// Description:
+// Writes book bookID to res as a Word document. The reader must already
+// be allowed to read the book.
+func exportBookDocx(res http.ResponseWriter, req *http.Request, bookID int64) {
+	p, packErr := newDocxPackage(res, req, bookID)
+	if packErr != nil {
+		http.Error(res, packErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveDownload(res, docxMimetype, fmt.Sprint("book-", bookID, ".docx"), p.write)
+}
+
+/////---------------------------------
+// Importer
+////
+
+// Type: docxNode
+// An element of a part of a Word document, read without its schema.
+// Elements and attributes are matched by local name, so documents saved
+// as Strict Open XML read as well.
+type docxNode struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Nodes   []docxNode `xml:",any"`
+	Text    string     `xml:",chardata"`
+}
+
+// Method: attr
+// The value of the attribute of n with local name local, empty if none.
+func (n *docxNode) attr(local string) string {
+	for _, a := range n.Attrs {
+		if a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// Method: child
+// The first element directly in n with local name local, nil if none.
+func (n *docxNode) child(local string) *docxNode {
+	for i := range n.Nodes {
+		if n.Nodes[i].XMLName.Local == local {
+			return &n.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// Method: find
+// The first element in n, at any depth, with local name local, nil if none.
+func (n *docxNode) find(local string) *docxNode {
+	for i := range n.Nodes {
+		if n.Nodes[i].XMLName.Local == local {
+			return &n.Nodes[i]
+		}
+		if found := n.Nodes[i].find(local); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// Method: on
+// Whether n, an on/off property such as bold, is on.
+func (n *docxNode) on() bool {
+	switch strings.ToLower(n.attr("val")) {
+	case "0", "false", "off", "none":
+		return false
+	}
+	return true
+}
+
+// Type: docxStyle
+// A style of a Word document, as far as the importer reads it.
+type docxStyle struct {
+	Name, BasedOn string
+	Outline       int // Outline level, from 0, -1 if it has none
+	NumID         string
+	NumLevel      int
+	Format        docxFormat // Of character styles
+}
+
+// Type: docxFormat
+// The formatting of a run of text the importer keeps.
+type docxFormat struct {
+	Bold, Italic, Underline, Strike, Code bool
+	VertAlign                             string
+}
+
+// Type: docxNumbering
+// How a level of a list of a Word document is numbered.
+type docxNumbering struct {
+	Format string // bullet, decimal, ...
+	Start  int
+}
+
+// Type: docxBlock
+// A paragraph or table of a Word document, read.
+type docxBlock struct {
+	Role     string // Of its style, see docxRoles; "table" for a table
+	Level    int    // Of a heading, from 1
+	NumID    string // Of a list item, empty if it is not one
+	NumLevel int
+	Indent   int    // Of a paragraph, from the left, in twips
+	HTML     string // Of its content: inline for a paragraph
+	Text     string // Of a paragraph
+}
+
+// Type: docxReader
+// The parts of an uploaded Word document, what is read from them, and
+// the problems found.
+type docxReader struct {
+	parts       map[string][]byte
+	main        string // Path of the document part
+	rels        map[string]docxRelation
+	styles      map[string]docxStyle
+	numbering   map[string]map[int]docxNumbering
+	counters    map[string][]int  // Items of each list seen, by level
+	images      map[string][]byte // Of the bundle, by name
+	named       map[string]string // Names in images, by part
+	diagnostics []ImportDiagnostic
+}
+
+// The roles of paragraph styles, by name in lower case without spaces.
+// Heading styles are found by name or outline level instead.
+var docxRoles = map[string]string{
+	"title":               "title",
+	"subtitle":            "subtitle",
+	"keytakeawaysheading": "takeaways",
+	"exerciseheading":     "exercise",
+	"solutionheading":     "solution",
+	"answerheading":       "answer",
+	"code":                "code",
+	"htmlpreformatted":    "code",
+	"sourcecode":          "code",
+	"quote":               "quote",
+	"intensequote":        "quote",
+	"blocktext":           "quote",
+	"horizontalrule":      "rule",
+}
+
+// Fonts that make a run code.
+var docxCodeFonts = map[string]bool{
+	"consolas": true, "courier": true, "courier new": true, "lucida console": true, "menlo": true,
+	"monaco": true, "source code pro": true, "dejavu sans mono": true, "liberation mono": true,
+}
+
+var docxHeadingName = regexp.MustCompile(`^heading([1-9])$`)
+
+// Internal Function
+// Description:
+// Finds the document part of a Word document among the files of a zip.
+//
+// Returns:
+//      main(string) - Its path.
+//      found(bool) - False if the zip is no Word document.
+func docxMainPart(files map[string][]byte) (string, bool) {
+	if files["[Content_Types].xml"] == nil {
+		return "", false
+	}
+	var rels docxNode
+	if xml.Unmarshal(files["_rels/.rels"], &rels) == nil {
+		for _, r := range rels.Nodes {
+			if strings.HasSuffix(r.attr("Type"), "/officeDocument") {
+				main := strings.TrimPrefix(path.Clean("/"+r.attr("Target")), "/")
+				_, found := files[main]
+				return main, found
+			}
+		}
+	}
+	_, found := files["word/document.xml"]
+	return "word/document.xml", found
+}
+
+// Internal Function
+// Description:
+// Reads a part of the document as XML.
+//
+// Returns:
+//      root(*docxNode) - nil if the part is missing or cannot be read.
+func (r *docxReader) part(name string) *docxNode {
+	data, held := r.parts[name]
+	if !held {
+		return nil
+	}
+	root := &docxNode{}
+	if parseErr := xml.Unmarshal(data, root); parseErr != nil {
+		r.report(name, "", ImportDiagnostic{Severity: ImportWarning, Message: "The part cannot be read and is left out: " + parseErr.Error()})
+		return nil
+	}
+	return root
+}
+
+// Method: report
+// Adds a diagnostic about file, found at the paragraph with text.
+func (r *docxReader) report(file, text string, d ImportDiagnostic) {
+	d.File = file
+	if text = strings.TrimSpace(text); text != "" {
+		if len(text) > 40 {
+			text = strings.TrimRight(text[:40], " ") + "..."
+		}
+		d.Found = strconv.Quote(text)
+	}
+	r.diagnostics = append(r.diagnostics, d)
+}
+
+// Method: target
+// The part or address a relationship of the document points to, and
+// whether it is outside the document.
+func (r *docxReader) target(id string) (string, bool) {
+	rel, related := r.rels[id]
+	if !related {
+		return "", false
+	}
+	if rel.External {
+		return rel.Target, true
+	}
+	if strings.HasPrefix(rel.Target, "/") {
+		return strings.TrimPrefix(path.Clean(rel.Target), "/"), false
+	}
+	return strings.TrimPrefix(path.Clean("/"+path.Join(path.Dir(r.main), rel.Target)), "/"), false
+}
+
+// Method: readParts
+// Reads the relationships, styles and numbering of the document.
+func (r *docxReader) readParts() {
+	r.rels = make(map[string]docxRelation)
+	if rels := r.part(path.Join(path.Dir(r.main), "_rels", path.Base(r.main)+".rels")); rels != nil {
+		for _, n := range rels.Nodes {
+			r.rels[n.attr("Id")] = docxRelation{n.attr("Id"), n.attr("Type"), n.attr("Target"), strings.EqualFold(n.attr("TargetMode"), "External")}
+		}
+	}
+	partOf := func(kind, fallback string) string {
+		for id, rel := range r.rels {
+			if strings.HasSuffix(rel.Type, "/"+kind) {
+				target, _ := r.target(id)
+				return target
+			}
+		}
+		return path.Join(path.Dir(r.main), fallback)
+	}
+
+	r.styles = make(map[string]docxStyle)
+	if styles := r.part(partOf("styles", "styles.xml")); styles != nil {
+		for _, n := range styles.Nodes {
+			if n.XMLName.Local != "style" {
+				continue
+			}
+			s := docxStyle{Outline: -1}
+			if name := n.child("name"); name != nil {
+				s.Name = name.attr("val")
+			}
+			if based := n.child("basedOn"); based != nil {
+				s.BasedOn = based.attr("val")
+			}
+			if pPr := n.child("pPr"); pPr != nil {
+				if outline := pPr.child("outlineLvl"); outline != nil {
+					s.Outline, _ = strconv.Atoi(outline.attr("val"))
+				}
+				if numPr := pPr.child("numPr"); numPr != nil {
+					s.NumID, s.NumLevel = docxNumPr(numPr)
+				}
+			}
+			s.Format = docxReadFormat(n.child("rPr"), docxFormat{})
+			r.styles[n.attr("styleId")] = s
+		}
+	}
+
+	r.numbering = make(map[string]map[int]docxNumbering)
+	r.counters = make(map[string][]int)
+	if numbering := r.part(partOf("numbering", "numbering.xml")); numbering != nil {
+		abstract := make(map[string]map[int]docxNumbering)
+		for _, n := range numbering.Nodes {
+			if n.XMLName.Local != "abstractNum" {
+				continue
+			}
+			levels := make(map[int]docxNumbering)
+			for _, l := range n.Nodes {
+				if l.XMLName.Local == "lvl" {
+					level, _ := strconv.Atoi(l.attr("ilvl"))
+					levels[level] = docxReadLevel(&l, docxNumbering{Format: "decimal", Start: 1})
+				}
+			}
+			abstract[n.attr("abstractNumId")] = levels
+		}
+		for _, n := range numbering.Nodes {
+			if n.XMLName.Local != "num" || n.child("abstractNumId") == nil {
+				continue
+			}
+			levels := make(map[int]docxNumbering)
+			for level, l := range abstract[n.child("abstractNumId").attr("val")] {
+				levels[level] = l
+			}
+			for _, o := range n.Nodes {
+				if o.XMLName.Local != "lvlOverride" {
+					continue
+				}
+				level, _ := strconv.Atoi(o.attr("ilvl"))
+				l, defined := levels[level]
+				if !defined {
+					l = docxNumbering{Format: "decimal", Start: 1}
+				}
+				if lvl := o.child("lvl"); lvl != nil {
+					l = docxReadLevel(lvl, l)
+				}
+				if start := o.child("startOverride"); start != nil {
+					l.Start, _ = strconv.Atoi(start.attr("val"))
+				}
+				levels[level] = l
+			}
+			r.numbering[n.attr("numId")] = levels
+		}
+	}
+}
+
+// Internal Function
+// Description:
+// The list and level a numPr element puts a paragraph in.
+func docxNumPr(numPr *docxNode) (string, int) {
+	numID, level := "", 0
+	if id := numPr.child("numId"); id != nil {
+		numID = id.attr("val")
+	}
+	if l := numPr.child("ilvl"); l != nil {
+		level, _ = strconv.Atoi(l.attr("val"))
+	}
+	return numID, level
+}
+
+// Internal Function
+// Description:
+// Reads a lvl element of numbering over l.
+func docxReadLevel(lvl *docxNode, l docxNumbering) docxNumbering {
+	if format := lvl.child("numFmt"); format != nil {
+		l.Format = format.attr("val")
+	}
+	if start := lvl.child("start"); start != nil {
+		l.Start, _ = strconv.Atoi(start.attr("val"))
+	}
+	return l
+}
+
+// Internal Function
+// Description:
+// Reads run properties rPr over format f.
+func docxReadFormat(rPr *docxNode, f docxFormat) docxFormat {
+	if rPr == nil {
+		return f
+	}
+	for i := range rPr.Nodes {
+		p := &rPr.Nodes[i]
+		switch p.XMLName.Local {
+		case "b":
+			f.Bold = p.on()
+		case "i":
+			f.Italic = p.on()
+		case "u":
+			f.Underline = p.on()
+		case "strike", "dstrike":
+			f.Strike = p.on()
+		case "vertAlign":
+			f.VertAlign = map[string]string{"superscript": "sup", "subscript": "sub"}[p.attr("val")]
+		case "rFonts":
+			f.Code = f.Code || docxCodeFonts[strings.ToLower(p.attr("ascii"))]
+		}
+	}
+	return f
+}
+
+// Method: paragraphStyle
+// The role, heading level and list of paragraph style id, looked up
+// through the styles it is based on.
+func (r *docxReader) paragraphStyle(id string) (role string, level int, numID string, numLevel int) {
+	outline := -1
+	for depth := 0; id != "" && depth < 10; depth++ {
+		s, defined := r.styles[id]
+		name := strings.NewReplacer(" ", "", "-", "", "_", "").Replace(strings.ToLower(s.Name))
+		if !defined || name == "" {
+			name = strings.ToLower(id)
+		}
+		if role == "" && level == 0 {
+			if m := docxHeadingName.FindStringSubmatch(name); m != nil {
+				level = int(m[1][0] - '0')
+			} else {
+				role = docxRoles[name]
+			}
+		}
+		if outline < 0 && defined {
+			outline = s.Outline
+		}
+		if numID == "" && s.NumID != "" {
+			numID, numLevel = s.NumID, s.NumLevel
+		}
+		id = s.BasedOn
+	}
+	if role == "" && level == 0 && outline >= 0 && outline < 9 {
+		level = outline + 1
+	}
+	return role, level, numID, numLevel
+}
+
+// Method: blocks
+// Reads the paragraphs and tables of body, a document body or a table cell.
+func (r *docxReader) blocks(body *docxNode) []docxBlock {
+	blocks := make([]docxBlock, 0)
+	for i := range body.Nodes {
+		n := &body.Nodes[i]
+		switch n.XMLName.Local {
+		case "p":
+			blocks = append(blocks, r.paragraph(n))
+		case "tbl":
+			blocks = append(blocks, docxBlock{Role: "table", HTML: r.table(n)})
+		case "sdt":
+			if content := n.child("sdtContent"); content != nil {
+				blocks = append(blocks, r.blocks(content)...)
+			}
+		case "customXml", "ins", "moveTo":
+			blocks = append(blocks, r.blocks(n)...)
+		}
+	}
+	return blocks
+}
+
+// Method: paragraph
+// Reads a paragraph: its style's role, its list, and its content.
+func (r *docxReader) paragraph(p *docxNode) docxBlock {
+	b := docxBlock{}
+	var styleID string
+	pPr := p.child("pPr")
+	if pPr != nil {
+		if style := pPr.child("pStyle"); style != nil {
+			styleID = style.attr("val")
+		}
+	}
+	b.Role, b.Level, b.NumID, b.NumLevel = r.paragraphStyle(styleID)
+	if pPr != nil {
+		if numPr := pPr.child("numPr"); numPr != nil {
+			b.NumID, b.NumLevel = docxNumPr(numPr)
+		}
+		if ind := pPr.child("ind"); ind != nil {
+			left := ind.attr("left")
+			if left == "" {
+				left = ind.attr("start")
+			}
+			b.Indent, _ = strconv.Atoi(left)
+		}
+		if outline := pPr.child("outlineLvl"); outline != nil && b.Role == "" && b.Level == 0 {
+			if o, convErr := strconv.Atoi(outline.attr("val")); convErr == nil && o >= 0 && o < 9 {
+				b.Level = o + 1
+			}
+		}
+	}
+	if b.NumID == "0" || b.Level > 0 || b.Role != "" {
+		b.NumID = ""
+	}
+
+	segments := make([]docxSegment, 0)
+	var text bytes.Buffer
+	r.inline(p, "", b.Role == "code", &segments, &text)
+	b.HTML, b.Text = docxSegmentsHTML(segments), text.String()
+	return b
+}
+
+// Type: docxSegment
+// A piece of the content of a paragraph and how it is formatted.
+type docxSegment struct {
+	Format docxFormat
+	Link   string
+	HTML   string
+}
+
+// Method: inline
+// Reads the runs in n, a paragraph or something in one, as segments of
+// HTML, linked to link, and their text into text. Runs of pre
+// paragraphs keep white space, and are not marked as code.
+func (r *docxReader) inline(n *docxNode, link string, pre bool, segments *[]docxSegment, text *bytes.Buffer) {
+	for i := range n.Nodes {
+		c := &n.Nodes[i]
+		switch c.XMLName.Local {
+		case "r":
+			r.run(c, link, pre, segments, text)
+		case "hyperlink":
+			href := ""
+			if target, external := r.target(c.attr("id")); external {
+				if u, parseErr := url.Parse(target); parseErr == nil && docxLinkSchemes[strings.ToLower(u.Scheme)] {
+					href = u.String()
+				}
+			}
+			r.inline(c, href, pre, segments, text)
+		case "ins", "smartTag", "customXml", "fldSimple", "bdo", "dir", "moveTo":
+			r.inline(c, link, pre, segments, text)
+		case "sdt":
+			if content := c.child("sdtContent"); content != nil {
+				r.inline(content, link, pre, segments, text)
+			}
+		}
+	}
+}
+
+// Method: run
+// Reads a run of text: its text, breaks and pictures.
+func (r *docxReader) run(run *docxNode, link string, pre bool, segments *[]docxSegment, text *bytes.Buffer) {
+	f := docxFormat{}
+	if rPr := run.child("rPr"); rPr != nil {
+		if style := rPr.child("rStyle"); style != nil {
+			s := r.styles[style.attr("val")]
+			f = s.Format
+			name := strings.ToLower(s.Name + " " + style.attr("val"))
+			f.Code = f.Code || strings.Contains(name, "code") || strings.Contains(name, "html keyboard") || strings.Contains(name, "html typewriter")
+			f.Bold = f.Bold || name == "strong strong"
+			f.Italic = f.Italic || name == "emphasis emphasis"
+		}
+		f = docxReadFormat(rPr, f)
+	}
+	if pre {
+		f.Code = false
+	}
+	if link != "" {
+		f.Underline = false // Word underlines every link
+	}
+	add := func(h string) {
+		*segments = append(*segments, docxSegment{f, link, h})
+	}
+
+	for i := range run.Nodes {
+		c := &run.Nodes[i]
+		switch c.XMLName.Local {
+		case "t":
+			add(html.EscapeString(xmlCharacters(c.Text)))
+			text.WriteString(c.Text)
+		case "tab":
+			if pre {
+				add("\t")
+			} else {
+				add(" ")
+			}
+			text.WriteString(" ")
+		case "br", "cr":
+			if t := c.attr("type"); t == "page" || t == "column" {
+				continue
+			}
+			if pre {
+				add("\n")
+			} else {
+				add("<br />")
+			}
+			text.WriteString(" ")
+		case "noBreakHyphen":
+			add("-")
+			text.WriteString("-")
+		case "drawing", "pict", "object":
+			if img := r.picture(c, text.String()); img != "" {
+				*segments = append(*segments, docxSegment{docxFormat{}, link, img})
+			}
+		}
+	}
+}
+
+// Method: picture
+// Reads a picture, a drawing or the image of a VML shape, into the
+// images of the bundle, and writes it as an img element. A picture that
+// is not in the document, or of a type this server does not take, is
+// written as its alt text. context is the text before it, to report it by.
+func (r *docxReader) picture(n *docxNode, context string) string {
+	alt, id := "", ""
+	if docPr := n.find("docPr"); docPr != nil {
+		alt = docPr.attr("descr")
+		if alt == "" {
+			alt = docPr.attr("title")
+		}
+	}
+	if blip := n.find("blip"); blip != nil {
+		id = blip.attr("embed")
+	} else if data := n.find("imagedata"); data != nil {
+		id = data.attr("id")
+	}
+	if shape := n.find("shape"); alt == "" && shape != nil {
+		alt = shape.attr("alt")
+	}
+	if id == "" {
+		return ""
+	}
+
+	target, external := r.target(id)
+	data, held := r.parts[target]
+	if external || !held {
+		r.report(r.main, context, ImportDiagnostic{Severity: ImportWarning, Message: "A picture linked from outside the document is left out, its alt text is kept", Expected: "an embedded picture"})
+		return html.EscapeString(xmlCharacters(alt))
+	}
+	if _, extErr := filterExtension(target); extErr != nil {
+		r.report(r.main, context, ImportDiagnostic{Severity: ImportWarning, Message: "Picture " + path.Base(target) + " is left out, its alt text is kept: " + extErr.Error(), Expected: "a picture saved as " + strings.Join(allowedImageTypes(), ", ")})
+		return html.EscapeString(xmlCharacters(alt))
+	}
+
+	name, named := r.named[target]
+	if !named {
+		base := strings.Trim(docxUnsafeName.ReplaceAllString(path.Base(target), "-"), "-")
+		name = base
+		for k := 2; r.images[name] != nil; k++ {
+			name = fmt.Sprint(k, "-", base)
+		}
+		r.named[target], r.images[name] = name, data
+	}
+
+	img := `<img src="/image?id=` + name + `" alt="` + html.EscapeString(xmlCharacters(alt)) + `"`
+	if extent := n.find("extent"); extent != nil {
+		if cx, convErr := strconv.Atoi(extent.attr("cx")); convErr == nil && cx >= docxEMU {
+			img += fmt.Sprintf(` width="%d"`, cx/docxEMU)
+		}
+	}
+	return img + " />"
+}
+
+var docxUnsafeName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Internal Function
+// Description:
+// The image extensions this server takes, sorted.
+func allowedImageTypes() []string {
+	types := make([]string, 0, len(Settings.Images.Types))
+	for ext := range Settings.Images.Types {
+		types = append(types, ext)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Internal Function
+// Description:
+// Writes segments as HTML, with the formatting of neighbouring segments
+// that are formatted alike written once.
+func docxSegmentsHTML(segments []docxSegment) string {
+	var out bytes.Buffer
+	for i := 0; i < len(segments); {
+		s := segments[i]
+		var inner bytes.Buffer
+		for ; i < len(segments) && segments[i].Format == s.Format && segments[i].Link == s.Link; i++ {
+			inner.WriteString(segments[i].HTML)
+		}
+		h := inner.String()
+		f := s.Format
+		if f.VertAlign != "" {
+			h = "<" + f.VertAlign + ">" + h + "</" + f.VertAlign + ">"
+		}
+		for _, tag := range []struct {
+			on   bool
+			name string
+		}{{f.Strike, "s"}, {f.Underline, "u"}, {f.Italic, "em"}, {f.Bold, "strong"}, {f.Code, "code"}} {
+			if tag.on {
+				h = "<" + tag.name + ">" + h + "</" + tag.name + ">"
+			}
+		}
+		if s.Link != "" {
+			h = `<a href="` + html.EscapeString(s.Link) + `">` + h + "</a>"
+		}
+		out.WriteString(h)
+	}
+	return out.String()
+}
+
+// Method: table
+// Reads a table as a table element. Merged cells span their rows and
+// columns, and header rows are written with th cells.
+func (r *docxReader) table(tbl *docxNode) string {
+	type cell struct {
+		html             string
+		colspan, rowspan int
+		header, merged   bool
+	}
+	rows := make([][]*cell, 0)
+	origins := make(map[int]*cell) // The cell each column was last merged down from
+	for i := range tbl.Nodes {
+		tr := &tbl.Nodes[i]
+		if tr.XMLName.Local != "tr" {
+			continue
+		}
+		header, column := false, 0
+		if trPr := tr.child("trPr"); trPr != nil {
+			header = trPr.child("tblHeader") != nil && trPr.child("tblHeader").on()
+			if before := trPr.child("gridBefore"); before != nil {
+				column, _ = strconv.Atoi(before.attr("val"))
+			}
+		}
+		row := make([]*cell, 0)
+		for j := range tr.Nodes {
+			tc := &tr.Nodes[j]
+			if tc.XMLName.Local != "tc" {
+				continue
+			}
+			c := &cell{colspan: 1, rowspan: 1, header: header}
+			if tcPr := tc.child("tcPr"); tcPr != nil {
+				if span := tcPr.child("gridSpan"); span != nil {
+					if s, convErr := strconv.Atoi(span.attr("val")); convErr == nil && s > 1 {
+						c.colspan = s
+					}
+				}
+				if merge := tcPr.child("vMerge"); merge != nil {
+					if origin := origins[column]; merge.attr("val") != "restart" && origin != nil {
+						origin.rowspan++
+						c.merged = true
+					} else {
+						origins[column] = c
+					}
+				} else {
+					delete(origins, column)
+				}
+			}
+			if !c.merged {
+				c.html = docxUnwrap(r.blocksHTML(r.blocks(tc)))
+			}
+			row = append(row, c)
+			column += c.colspan
+		}
+		rows = append(rows, row)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("<table><tbody>")
+	for _, row := range rows {
+		out.WriteString("<tr>")
+		for _, c := range row {
+			if c.merged {
+				continue
+			}
+			tag := "td"
+			if c.header {
+				tag = "th"
+			}
+			out.WriteString("<" + tag)
+			if c.colspan > 1 {
+				fmt.Fprintf(&out, ` colspan="%d"`, c.colspan)
+			}
+			if c.rowspan > 1 {
+				fmt.Fprintf(&out, ` rowspan="%d"`, c.rowspan)
+			}
+			out.WriteString(">" + c.html + "</" + tag + ">")
+		}
+		out.WriteString("</tr>")
+	}
+	out.WriteString("</tbody></table>")
+	return out.String()
+}
+
+// Internal Function
+// Description:
+// The inline content of HTML that is one paragraph, else the HTML.
+func docxUnwrap(content string) string {
+	if strings.HasPrefix(content, "<p>") && strings.HasSuffix(content, "</p>") && strings.Count(content, "<p>") == 1 {
+		return strings.TrimSuffix(strings.TrimPrefix(content, "<p>"), "</p>")
+	}
+	return content
+}
+
+// Method: blocksHTML
+// Writes blocks as HTML. Neighbouring list items are written as lists,
+// nested by their level, and paragraphs indented under an item, as the
+// exporter writes the paragraphs after an item's first, are more of the
+// item. Code paragraphs are written as one pre element, and quote
+// paragraphs as one blockquote. Empty paragraphs are left out.
+func (r *docxReader) blocksHTML(blocks []docxBlock) string {
+	var out bytes.Buffer
+	type openList struct {
+		tag, numID string
+		level      int
+	}
+	lists := make([]openList, 0)
+	closeLists := func(level int) {
+		for len(lists) > 0 && lists[len(lists)-1].level >= level {
+			out.WriteString("</li></" + lists[len(lists)-1].tag + ">")
+			lists = lists[:len(lists)-1]
+		}
+	}
+
+	for i := 0; i < len(blocks); i++ {
+		b := blocks[i]
+		if level := b.Indent/720 - 1; len(lists) > 0 && b.NumID == "" && b.Role == "" && b.Level == 0 && level >= 0 {
+			closeLists(level + 1)
+			if len(lists) > 0 {
+				if strings.TrimSpace(b.Text) != "" || strings.Contains(b.HTML, "<img") {
+					out.WriteString("<p>" + b.HTML + "</p>")
+				}
+				continue
+			}
+		}
+		if b.NumID == "" {
+			closeLists(0)
+		}
+		switch {
+		case b.Role == "table":
+			out.WriteString(b.HTML)
+		case b.NumID != "":
+			numbering := r.numbering[b.NumID][b.NumLevel]
+			count := r.counters[b.NumID]
+			if count == nil {
+				count = make([]int, 9)
+				r.counters[b.NumID] = count
+			}
+			level := b.NumLevel
+			if level < 0 || level > 8 {
+				level = 0
+			}
+			count[level]++
+			for deeper := level + 1; deeper < len(count); deeper++ {
+				count[deeper] = 0
+			}
+
+			if top := len(lists) - 1; top >= 0 && lists[top].level > level {
+				closeLists(level + 1)
+			}
+			if top := len(lists) - 1; top >= 0 && lists[top].level == level && lists[top].numID == b.NumID {
+				out.WriteString("</li><li>" + b.HTML)
+				continue
+			}
+			if top := len(lists) - 1; top >= 0 && lists[top].level == level {
+				closeLists(level)
+			}
+			tag := "ol"
+			if numbering.Format == "bullet" || numbering.Format == "none" {
+				tag = "ul"
+			}
+			out.WriteString("<" + tag)
+			if start := numbering.Start + count[level] - 1; tag == "ol" && start != 1 {
+				fmt.Fprintf(&out, ` start="%d"`, start)
+			}
+			out.WriteString("><li>" + b.HTML)
+			lists = append(lists, openList{tag, b.NumID, level})
+		case b.Role == "rule":
+			out.WriteString("<hr />")
+			if strings.TrimSpace(b.Text) != "" {
+				out.WriteString("<p>" + b.HTML + "</p>")
+			}
+		case b.Role == "code":
+			lines := []string{b.HTML}
+			for i+1 < len(blocks) && blocks[i+1].Role == "code" && blocks[i+1].NumID == "" {
+				i++
+				lines = append(lines, blocks[i].HTML)
+			}
+			out.WriteString("<pre>" + strings.Join(lines, "\n") + "</pre>")
+		case strings.TrimSpace(b.Text) == "" && !strings.Contains(b.HTML, "<img"):
+		case b.Role == "quote":
+			out.WriteString("<blockquote><p>" + b.HTML + "</p>")
+			for i+1 < len(blocks) && blocks[i+1].Role == "quote" && blocks[i+1].NumID == "" {
+				i++
+				if strings.TrimSpace(blocks[i].Text) != "" || strings.Contains(blocks[i].HTML, "<img") {
+					out.WriteString("<p>" + blocks[i].HTML + "</p>")
+				}
+			}
+			out.WriteString("</blockquote>")
+		case b.Level > 3:
+			level := b.Level - 3
+			if level > 6 {
+				level = 6
+			}
+			fmt.Fprintf(&out, "<h%d>%s</h%d>", level, b.HTML, level)
+		default:
+			out.WriteString("<p>" + b.HTML + "</p>")
+		}
+	}
+	closeLists(0)
+	return out.String()
+}
+
+// Type: docxField
+// An HTML field of a structure being read, and the blocks read into it.
+type docxField struct {
+	node   *importNode
+	name   string // Go name of the field
+	blocks []docxBlock
+}
+
+// Internal Function
+// Description:
+// Reads an uploaded Word document into a book, checking all of it.
+// Heading 1, 2 and 3 start a chapter, section and objective, titled by
+// their text, and what follows each is its description, or the
+// objective's content. What comes before the first chapter is the
+// book's description. The Title paragraph titles the book, or else the
+// document's title property, and its author property is the book's.
+// Key Takeaways Heading, Exercise Heading, Solution Heading and Answer
+// Heading paragraphs start the key takeaways of an objective, an
+// exercise, and its solution and answer, as the exporter writes them.
+// A section or objective without a heading above it gets an untitled one.
+// The pictures the book shows are put in images, by the name it refers
+// to them as.
+//
+// Returns:
+//      book(*importNode) - As parseBookHTML reads it. nil if the document cannot be read.
+//      diagnostics([]ImportDiagnostic) - Every problem found, with the text of the paragraph it is at.
+func parseDocxBook(parts map[string][]byte, images map[string][]byte) (*importNode, []ImportDiagnostic) {
+	r := &docxReader{parts: parts, images: images, named: make(map[string]string), diagnostics: make([]ImportDiagnostic, 0)}
+	r.main, _ = docxMainPart(parts)
+	root := r.part(r.main)
+	if root == nil || root.child("body") == nil {
+		r.diagnostics = append(r.diagnostics[:0], ImportDiagnostic{File: r.main, Severity: ImportError, Message: "The document cannot be read", Expected: "a Word document"})
+		return nil, r.diagnostics
+	}
+	r.readParts()
+
+	newNode := func(kind string) *importNode {
+		return &importNode{Kind: kind, Entity: newImportEntity(kind), At: importPosition{File: r.main}, Fields: make(map[string]importPosition), Children: make([]*importNode, 0)}
+	}
+	book := newNode("book")
+	var chapter, section, objective, exercise *importNode
+	fields := []*docxField{{node: book, name: "Description"}}
+	field := fields[0]
+	set := func(n *importNode, name, value string) {
+		setImportField(n.Entity, n.Kind, strings.ToLower(name), value, value)
+		n.Fields[strings.ToLower(name)] = n.At
+	}
+	start := func(parent *importNode, kind, title, name string) *importNode {
+		n := newNode(kind)
+		if title != "" {
+			set(n, importFields[kind][0], title)
+		}
+		set(n, "Order", strconv.Itoa(len(parent.Children)+1))
+		parent.Children = append(parent.Children, n)
+		field = &docxField{node: n, name: name}
+		fields = append(fields, field)
+		return n
+	}
+	untitled := func(kind, above, text string) {
+		r.report(r.main, text, ImportDiagnostic{Severity: ImportWarning, Message: "The " + kind + " has no heading above it, it is put in an untitled " + above, Expected: "a heading for the " + above})
+	}
+
+	titled := false
+	for _, b := range r.blocks(root.child("body")) {
+		title := strings.Join(strings.Fields(b.Text), " ")
+		switch {
+		case b.Role == "title" && !titled:
+			set(book, "Title", title)
+			titled = true
+		case b.Role == "subtitle":
+		case b.Level == 1:
+			chapter, section, objective, exercise = start(book, "chapter", title, "Description"), nil, nil, nil
+		case b.Level == 2:
+			if chapter == nil {
+				untitled("section", "chapter", title)
+				chapter = start(book, "chapter", "", "Description")
+			}
+			section, objective, exercise = start(chapter, "section", title, "Description"), nil, nil
+		case b.Level == 3:
+			if section == nil {
+				if chapter == nil {
+					untitled("objective", "chapter", title)
+					chapter = start(book, "chapter", "", "Description")
+				} else {
+					untitled("objective", "section", title)
+				}
+				section = start(chapter, "section", "", "Description")
+			}
+			objective, exercise = start(section, "objective", title, "Content"), nil
+		case b.Role == "takeaways" && objective != nil:
+			exercise = nil
+			field = &docxField{node: objective, name: "KeyTakeaways"}
+			fields = append(fields, field)
+		case b.Role == "exercise" && objective != nil:
+			if title == "Exercise" {
+				title = ""
+			}
+			exercise = start(objective, "exercise", title, "Question")
+		case (b.Role == "solution" || b.Role == "answer") && exercise != nil:
+			field = &docxField{node: exercise, name: strings.Title(b.Role)}
+			fields = append(fields, field)
+		case b.Role == "takeaways" || b.Role == "exercise" || b.Role == "solution" || b.Role == "answer":
+			r.report(r.main, title, ImportDiagnostic{Severity: ImportWarning, Message: "The " + b.Role + " heading is not in an objective or exercise, and is read as content", Expected: "an objective heading above it"})
+			b.Role = ""
+			field.blocks = append(field.blocks, b)
+		default:
+			field.blocks = append(field.blocks, b)
+		}
+	}
+
+	for _, f := range fields {
+		content := r.blocksHTML(f.blocks)
+		if f.name == "Answer" {
+			content = docxUnwrap(content)
+		}
+		if content == "" {
+			continue
+		}
+		old := reflect.ValueOf(f.node.Entity).Elem().FieldByName(f.name).Interface().(template.HTML)
+		set(f.node, f.name, string(old)+content)
+	}
+
+	if core := r.part("docProps/core.xml"); core != nil {
+		if t := core.child("title"); !titled && t != nil && strings.TrimSpace(t.Text) != "" {
+			set(book, "Title", strings.TrimSpace(t.Text))
+			titled = true
+		}
+		if creator := core.child("creator"); creator != nil && strings.TrimSpace(creator.Text) != "" {
+			set(book, "Author", strings.TrimSpace(creator.Text))
+		}
+	}
+	if !titled {
+		r.report(r.main, "", ImportDiagnostic{Severity: ImportWarning, Message: "The document has no Title paragraph or title property, the book is untitled", Expected: "a paragraph in the Title style"})
+	}
+	if len(book.Children) == 0 {
+		r.report(r.main, "", ImportDiagnostic{Severity: ImportWarning, Message: "The document has no Heading 1 paragraphs, so the book has no chapters", Expected: "Heading 1, 2 and 3 for chapters, sections and objectives"})
+	}
+	return book, r.diagnostics
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"golang.org/x/net/context"
+	"html/template"
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+// Internal Function
+// Description:
+// Exports book bookID as a Word document, as an anonymous reader gets it,
+// reads it back through parseDocxBook and imports it into catalog catalogID.
+//
+// Returns:
+//      book(*bookExport) - The imported book, as loadBookExport reads it.
+//      bundle(*bookBundle) - The document as it was read.
+func docxRoundTrip(t *testing.T, ctx context.Context, bookID, catalogID int64) (*bookExport, *bookBundle) {
+	p, packErr := newDocxPackage(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), bookID)
+	if packErr != nil {
+		t.Fatal(packErr)
+	}
+	var docx bytes.Buffer
+	if writeErr := p.write(&docx); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	bundle, readErr := readBookUpload(docx.Bytes())
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if bundle.Parts == nil {
+		t.Fatal("export was not read as a Word document")
+	}
+	node, diagnostics := parseDocxBook(bundle.Parts, bundle.Images)
+	if len(diagnostics) > 0 {
+		t.Fatalf("export of a stored book has problems: %v", diagnostics)
+	}
+	if report, imported := importBook(ctx, node, catalogID, bundle); !imported {
+		t.Fatalf("import failed: %v", report)
+	}
+	book, loadErr := loadBookExport(ctx, node.Entity.(*Book).ID)
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+	return book, bundle
+}
+
+func TestBookDocxRoundTrip(t *testing.T) {
+	ctx := setupBookTest(t)
+	bid, imageName := placeTestBook(t, ctx)
+	want, loadErr := loadBookExport(ctx, bid)
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+
+	got, bundle := docxRoundTrip(t, ctx, bid, want.Catalog.ID)
+	if len(bundle.Images) != 1 {
+		t.Errorf("document carries %d images, want 1", len(bundle.Images))
+	}
+	if got.Title != "Alge bra" || got.Author != want.Author || got.Catalog.ID != want.Catalog.ID {
+		t.Errorf("book is %q by %q in catalog %d", got.Title, got.Author, got.Catalog.ID)
+	}
+	if len(got.Chapters) != 2 || got.Chapters[0].Title != "Empty" || len(got.Chapters[1].Sections) != 1 {
+		t.Fatalf("chapters are %+v", got.Chapters)
+	}
+	s, ws := got.Chapters[1].Sections[0], want.Chapters[1].Sections[0]
+	if s.Title != ws.Title || len(s.Objectives) != 1 || len(s.Objectives[0].Exercises) != 2 {
+		t.Fatalf("section is %+v", s)
+	}
+	o, wo := s.Objectives[0], ws.Objectives[0]
+	e := o.Exercises[0]
+
+	stored := regexp.MustCompile(`<p><img src="/image\?id=([0-9a-f]+\.png)" alt="graph" width="2" /></p>$`).FindStringSubmatch(string(e.Question))
+	fields := []struct {
+		name      string
+		got, want template.HTML
+	}{
+		{"list and table", s.Description, ws.Description},
+		{"pre", o.Content, "<pre>  x = 1\n\ty &lt; 2</pre><p>&amp; ¬it;</p>"},
+		{"key takeaways", o.KeyTakeaways, wo.KeyTakeaways},
+		{"instruction", template.HTML(e.Instruction), "Solve"},
+		{"answer", e.Answer, "<em>42</em>"},
+		{"second answer", o.Exercises[1].Answer, "x = 2"},
+	}
+	for _, f := range fields {
+		if f.got != f.want {
+			t.Errorf("%s is %q, want %q", f.name, f.got, f.want)
+		}
+	}
+
+	if stored == nil {
+		t.Fatalf("question is %q, want the image", e.Question)
+	}
+	if stored[1] == imageName {
+		t.Error("image was not stored under the imported book")
+	}
+	original, _ := Stores.Blobs.GetBlob(ctx, imageName)
+	copied, getErr := Stores.Blobs.GetBlob(ctx, stored[1])
+	if getErr != nil {
+		t.Fatalf("image %s was not stored: %v", stored[1], getErr)
+	}
+	a, _ := ioutil.ReadAll(original)
+	b, _ := ioutil.ReadAll(copied)
+	original.Close()
+	copied.Close()
+	if !bytes.Equal(a, b) {
+		t.Error("stored image differs")
+	}
+
+	// What Word cannot carry is lost the first time; after that the
+	// document reads back as the same book.
+	again, _ := docxRoundTrip(t, ctx, got.ID, want.Catalog.ID)
+	imageIDs := regexp.MustCompile(`id=[0-9]*([0-9a-f]{40}\.png)`)
+	for _, x := range []*bookExport{got, again} {
+		clearExportIDs(reflect.ValueOf(x))
+		q := &x.Chapters[1].Sections[0].Objectives[0].Exercises[0].Question
+		*q = template.HTML(imageIDs.ReplaceAllString(string(*q), "id=$1"))
+	}
+	if !reflect.DeepEqual(got, again) {
+		t.Errorf("second import differs\nfirst  %+v\nsecond %+v", got, again)
+	}
+}
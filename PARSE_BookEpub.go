@@ -0,0 +1,460 @@
+package main
+
+/*
+PARSE_BookEpub.go by Allen J. Mills
+    mm.d.yy
+
+    Books as EPUB 3 packages, for reading offline on e-readers.
+    /export/<book id>?format=epub writes:
+        mimetype                        application/epub+zip, stored first
+        META-INF/container.xml          Points readers at the package
+        EPUB/package.opf                Metadata, manifest and spine
+        EPUB/nav.xhtml                  Contents, the data of /api/toc.xml
+        EPUB/title.xhtml                Title page with the book description
+        EPUB/chapter-<id>.xhtml         One document per chapter, section
+        EPUB/section-<id>.xhtml         and objective, in their order
+        EPUB/objective-<id>.xhtml
+        EPUB/review-<chapter id>.xhtml  Key takeaways and exercises of the chapter
+        EPUB/images/<name>              Every image the book refers to
+    Content is HTML written by the editors, so it is parsed and written
+    again as XHTML. Scripts, event handlers and style sheets are left
+    out, readers bring their own, and images that cannot be read are
+    replaced by their alt text. The documents are in
+    templates/BookEpub.gohtml.
+*/
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	epubMimetype = "application/epub+zip" // Contents of the mimetype file, and the type served
+	epubFolder   = "EPUB/"                // The folder of the package inside the zip
+	epubLanguage = "en"                   // Books do not record their language
+)
+
+// Elements left out of content. They hold raw text that is not XML, or need scripting.
+var epubDropped = map[atom.Atom]bool{
+	atom.Script:    true,
+	atom.Style:     true,
+	atom.Noscript:  true,
+	atom.Iframe:    true,
+	atom.Noembed:   true,
+	atom.Noframes:  true,
+	atom.Plaintext: true,
+	atom.Xmp:       true,
+}
+
+// Namespaces of the foreign elements content may hold, see x/net/html.
+var epubNamespaces = map[string]string{
+	"svg":  "http://www.w3.org/2000/svg",
+	"math": "http://www.w3.org/1998/Math/MathML",
+}
+
+// Type: epubPackage
+// A book with what its package lists: every content document in reading
+// order, and every image.
+type epubPackage struct {
+	*bookExport
+	Identifier string
+	Language   string
+	Modified   string
+	Documents  []epubDocument
+	Images     []epubImage
+
+	images map[string][]byte // By name, the images held
+}
+
+// Type: epubDocument
+// A content document, and the template and data it is written with.
+type epubDocument struct {
+	ID, Href string
+	template string
+	data     interface{}
+}
+
+// Type: epubImage
+// An image of a package.
+type epubImage struct {
+	ID, Href, Type string
+}
+
+// Internal Function
+// Description:
+// The name of the document of a structure in a package.
+func epubHref(kind string, id int64) string {
+	return fmt.Sprintf("%s-%d.xhtml", kind, id)
+}
+
+// Method: HasBackMatter
+// Whether an objective has key takeaways or exercises.
+func (o objectiveExport) HasBackMatter() bool {
+	return strings.TrimSpace(string(o.KeyTakeaways)) != "" || len(o.Exercises) > 0
+}
+
+// Method: HasBackMatter
+// Whether any objective of a chapter has key takeaways or exercises.
+func (c chapterExport) HasBackMatter() bool {
+	for _, s := range c.Sections {
+		for _, o := range s.Objectives {
+			if o.HasBackMatter() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Method: eachHTML
+// Calls f with every HTML field of the book and everything inside it,
+// and the kind of structure the field is of.
+func (b *bookExport) eachHTML(f func(kind string, field *template.HTML)) {
+	htmlType := reflect.TypeOf(template.HTML(""))
+	visit := func(kind string, v interface{}) {
+		e := reflect.ValueOf(v).Elem()
+		for i := 0; i < e.NumField(); i++ {
+			if e.Field(i).Type() == htmlType {
+				f(kind, e.Field(i).Addr().Interface().(*template.HTML))
+			}
+		}
+	}
+
+	visit("Book", &b.Book)
+	for ci := range b.Chapters {
+		c := &b.Chapters[ci]
+		visit("Chapter", &c.Chapter)
+		for si := range c.Sections {
+			s := &c.Sections[si]
+			visit("Section", &s.Section)
+			for oi := range s.Objectives {
+				o := &s.Objectives[oi]
+				visit("Objective", &o.Objective)
+				for ei := range o.Exercises {
+					visit("Exercise", &o.Exercises[ei])
+				}
+			}
+		}
+	}
+}
+
+// Method: readableImages
+// Reads the images the book refers to that the reader of req may see,
+// by name. Images that are not stored are left out.
+func (b *bookExport) readableImages(res http.ResponseWriter, req *http.Request) map[string][]byte {
+	content := make([]string, 0)
+	b.eachHTML(func(_ string, field *template.HTML) {
+		content = append(content, string(*field))
+	})
+	return readableImages(res, req, content)
+}
+
+// Internal Function
+// Description:
+// Reads the images content refers to that the reader of req may see,
+// by name. Images that are not stored are left out.
+func readableImages(res http.ResponseWriter, req *http.Request, content []string) map[string][]byte {
+	ctx := NewContext(req)
+	reader := NewReadChecker(res, req)
+	images := make(map[string][]byte)
+	seen := make(map[string]bool)
+	for _, c := range content {
+		for _, m := range imageReference.FindAllStringSubmatch(c, -1) {
+			name := m[1]
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			if !reader.CanRead(imageScope(req, imageOwner(name))) {
+				continue
+			}
+			rdr, getErr := Stores.Blobs.GetBlob(ctx, name)
+			if getErr != nil {
+				continue
+			}
+			data, readErr := ioutil.ReadAll(rdr)
+			rdr.Close()
+			if readErr == nil {
+				images[name] = data
+			}
+		}
+	}
+	return images
+}
+
+// Internal Function
+// Description:
+// The names of images, sorted.
+func imageNames(images map[string][]byte) []string {
+	names := make([]string, 0, len(images))
+	for name := range images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Internal Function
+// Description:
+// Gathers book bookID into a package: its images that the reader of req
+// may see and that are stored, its content as XHTML, and its documents.
+//
+// Returns:
+//      package(*epubPackage) - The package, ready to write.
+//      failure?(error) - Any storage error.
+func newEpubPackage(res http.ResponseWriter, req *http.Request, bookID int64) (*epubPackage, error) {
+	book, loadErr := loadBookExport(NewContext(req), bookID)
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	p := &epubPackage{
+		bookExport: book,
+		Identifier: fmt.Sprintf("urn:textbook:%s:book:%d", req.Host, bookID),
+		Language:   epubLanguage,
+		Modified:   time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+	}
+
+	p.images = book.readableImages(res, req)
+	for i, name := range imageNames(p.images) {
+		p.Images = append(p.Images, epubImage{ID: fmt.Sprint("image-", i+1), Href: "images/" + name, Type: imageContentType(name)})
+	}
+
+	book.eachHTML(func(_ string, field *template.HTML) {
+		*field = template.HTML(portableXHTML(string(*field), p.images, "images/"))
+	})
+
+	p.Documents = append(p.Documents, epubDocument{"title", "title.xhtml", "EpubTitle", p})
+	for _, c := range book.Chapters {
+		p.Documents = append(p.Documents, epubDocument{fmt.Sprint("chapter-", c.ID), epubHref("chapter", c.ID), "EpubChapter", c})
+		for _, s := range c.Sections {
+			p.Documents = append(p.Documents, epubDocument{fmt.Sprint("section-", s.ID), epubHref("section", s.ID), "EpubSection", s})
+			for _, o := range s.Objectives {
+				p.Documents = append(p.Documents, epubDocument{fmt.Sprint("objective-", o.ID), epubHref("objective", o.ID), "EpubObjective", o})
+			}
+		}
+		if c.HasBackMatter() {
+			p.Documents = append(p.Documents, epubDocument{fmt.Sprint("review-", c.ID), epubHref("review", c.ID), "EpubReview", c})
+		}
+	}
+	return p, nil
+}
+
+// Method: write
+// Writes the package as an EPUB zip to w.
+func (p *epubPackage) write(w io.Writer) error {
+	// The mimetype file comes first, stored, with no extra fields, so
+	// readers can tell the type from the start of the file.
+	zw := zip.NewWriter(w)
+	mw, createErr := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if createErr != nil {
+		return createErr
+	}
+	mw.Write([]byte(epubMimetype))
+
+	files := []zipTemplate{
+		{"META-INF/container.xml", "EpubContainer", p},
+		{epubFolder + "package.opf", "EpubPackage", p},
+		{epubFolder + "nav.xhtml", "EpubNav", p},
+	}
+	for _, d := range p.Documents {
+		files = append(files, zipTemplate{epubFolder + d.Href, d.template, d.data})
+	}
+	return writeZipPackage(zw, files, epubFolder+"images/", p.images)
+}
+
+// Internal Function
+// Description:
+// Writes book bookID to res as an EPUB 3 package. The reader must
+// already be allowed to read the book.
+func exportBookEpub(res http.ResponseWriter, req *http.Request, bookID int64) {
+	p, packErr := newEpubPackage(res, req, bookID)
+	if packErr != nil {
+		http.Error(res, packErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveDownload(res, epubMimetype, fmt.Sprint("book-", bookID, ".epub"), p.write)
+}
+
+// Type: zipTemplate
+// A file of a zip package, written by executing Template on Data.
+type zipTemplate struct {
+	Name, Template string
+	Data           interface{}
+}
+
+// Internal Function
+// Description:
+// Writes files, then images under folder in name order, to w and closes
+// it. Images are stored as they are, since they are compressed already.
+//
+// Returns:
+//      failure?(error) - Any template or write error.
+func writeZipPackage(w *zip.Writer, files []zipTemplate, folder string, images map[string][]byte) error {
+	now := time.Now()
+	for _, f := range files {
+		fw, createErr := w.CreateHeader(&zip.FileHeader{Name: f.Name, Method: zip.Deflate, Modified: now})
+		if createErr != nil {
+			return createErr
+		}
+		if execErr := pages.ExecuteTemplate(fw, f.Template, f.Data); execErr != nil {
+			return execErr
+		}
+	}
+	for _, name := range imageNames(images) {
+		iw, createErr := w.CreateHeader(&zip.FileHeader{Name: folder + name, Method: zip.Store, Modified: now})
+		if createErr != nil {
+			return createErr
+		}
+		if _, writeErr := iw.Write(images[name]); writeErr != nil {
+			return writeErr
+		}
+	}
+	return w.Close()
+}
+
+// Internal Function
+// Description:
+// Serves what write writes as a download of contentType named filename.
+// It is written to memory first, so an error is still reported as one
+// rather than cutting the download short.
+func serveDownload(res http.ResponseWriter, contentType, filename string, write func(w io.Writer) error) {
+	var file bytes.Buffer
+	if writeErr := write(&file); writeErr != nil {
+		http.Error(res, writeErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", contentType)
+	res.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	res.Write(file.Bytes())
+}
+
+// Internal Function
+// Description:
+// Writes HTML content again as XHTML, for packages read away from this
+// server. References to the images in held point to imageDir + name,
+// and images not held are replaced by their alt text.
+func portableXHTML(content string, held map[string][]byte, imageDir string) string {
+	body := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, parseErr := html.ParseFragment(strings.NewReader(content), body)
+	if parseErr != nil {
+		return html.EscapeString(content)
+	}
+	for _, n := range nodes {
+		body.AppendChild(n)
+	}
+	portableClean(body, held, imageDir)
+
+	var out bytes.Buffer
+	for c := body.FirstChild; c != nil; c = c.NextSibling {
+		html.Render(&out, c)
+	}
+	return out.String()
+}
+
+// Internal Function
+// Description:
+// Makes the children of n, and everything in them, fit to write as XHTML.
+func portableClean(n *html.Node, held map[string][]byte, imageDir string) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		switch {
+		case c.Type == html.CommentNode || (c.Type == html.ElementNode && epubDropped[c.DataAtom]):
+			n.RemoveChild(c)
+		case c.Type == html.TextNode:
+			c.Data = xmlCharacters(c.Data)
+		case c.Type == html.ElementNode && c.DataAtom == atom.Img && epubMissingImage(c, held):
+			alt := ""
+			for _, a := range c.Attr {
+				if a.Key == "alt" {
+					alt = a.Val
+				}
+			}
+			n.InsertBefore(&html.Node{Type: html.TextNode, Data: xmlCharacters(alt)}, c)
+			n.RemoveChild(c)
+		case c.Type == html.ElementNode:
+			attrs := make([]html.Attribute, 0, len(c.Attr))
+			for _, a := range c.Attr {
+				if a.Namespace != "" || !xmlName(a.Key) || a.Key == "xmlns" || strings.HasPrefix(a.Key, "on") {
+					continue
+				}
+				a.Val = imageReference.ReplaceAllStringFunc(xmlCharacters(a.Val), func(ref string) string {
+					if name := imageReference.FindStringSubmatch(ref)[1]; held[name] != nil {
+						return imageDir + name
+					}
+					return ref
+				})
+				attrs = append(attrs, a)
+			}
+			if c.DataAtom == atom.Img && !hasAttribute(attrs, "alt") {
+				attrs = append(attrs, html.Attribute{Key: "alt", Val: ""})
+			}
+			if ns, foreign := epubNamespaces[c.Namespace]; foreign && c.Namespace != n.Namespace {
+				attrs = append(attrs, html.Attribute{Key: "xmlns", Val: ns})
+			}
+			c.Attr = attrs
+			portableClean(c, held, imageDir)
+		}
+		c = next
+	}
+}
+
+// Internal Function
+// Description:
+// Whether img shows an image of this server that the package does not hold.
+func epubMissingImage(img *html.Node, held map[string][]byte) bool {
+	for _, a := range img.Attr {
+		if a.Key == "src" {
+			m := imageReference.FindStringSubmatch(a.Val)
+			return m != nil && held[m[1]] == nil
+		}
+	}
+	return false
+}
+
+// Internal Function
+// Description:
+// Whether attrs has an attribute named key.
+func hasAttribute(attrs []html.Attribute, key string) bool {
+	for _, a := range attrs {
+		if a.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Internal Function
+// Description:
+// Removes the characters XML does not allow from s.
+func xmlCharacters(s string) string {
+	return strings.Map(func(r rune) rune {
+		if (r < 0x20 && r != '\t' && r != '\n' && r != '\r') || r == 0xFFFE || r == 0xFFFF {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// Internal Function
+// Description:
+// Whether s can be written as an XML attribute name without a namespace.
+func xmlName(s string) bool {
+	for i, r := range s {
+		letter := r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || r > 0x7F
+		if !letter && (i == 0 || !(r == '-' || r == '.' || (r >= '0' && r <= '9'))) {
+			return false
+		}
+	}
+	return s != ""
+}
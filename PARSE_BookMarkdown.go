@@ -0,0 +1,707 @@
+package main
+
+/*
+PARSE_BookMarkdown.go by Allen J. Mills
+    mm.d.yy
+
+    Books as a tree of Markdown files, for authors who keep their
+    sources in git. /export/<book id>?format=markdown writes a gzipped
+    tarball of:
+        book-<id>/book.md                       The book
+        book-<id>/catalog.md                    The catalog it is in
+        book-<id>/01-<title>/chapter.md         Each chapter, in a folder
+        .../01-<title>/01-<title>/section.md    Each section, in a folder in its chapter's
+        .../01-<title>/objective.md             Each objective, in a folder in its section's
+        .../01-<title>/01-<instruction>.md      Each exercise, beside its objective
+        book-<id>/images/<name>                 Every image the book refers to
+    Folders and exercise files are numbered in book order. Each file
+    starts with YAML front matter between --- lines, giving the fields
+    of its structure:
+        ---
+        id: 5712
+        title: "Solving for x: the basics"
+        version: 1
+        order: 2
+        author: A. Author
+        keyTakeaways: |-
+          - Do the same to both sides.
+        ---
+    The rest of the file is the structure's main HTML field as Markdown:
+    a description, an objective's content or an exercise's question.
+    The other HTML fields, keyTakeaways, and an exercise's solution and
+    answer, are Markdown in the front matter, where a single paragraph
+    is read without its <p>. See PARSE_Markdown.go.
+
+    /import/book reads the same tree as a tarball, gzipped or not, or as
+    a zip. The book is the shallowest book.md. Folders and exercise files
+    are read in the order of the numbers their names start with, and a
+    structure whose front matter gives no order takes its place in that
+    order. Front matter is read as text values only; lists and maps are
+    reported. Images are stored as those of a bundle, see
+    PARSE_BookBundle.go.
+*/
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	markdownBook     = "book.md"    // The book inside a Markdown tree
+	markdownCatalog  = "catalog.md" // Its catalog, beside the book
+	markdownFileType = ".md"        // Files of a tree that are read
+)
+
+// The field each structure's body holds, by kind. The other fields are front matter.
+var markdownBodies = map[string]string{
+	"catalog":   "Description",
+	"book":      "Description",
+	"chapter":   "Description",
+	"section":   "Description",
+	"objective": "Content",
+	"exercise":  "Question",
+}
+
+var (
+	markdownSlugBreak = regexp.MustCompile(`[^a-z0-9]+`)
+	markdownNumbered  = regexp.MustCompile(`^[0-9]+`)
+	frontMatterKey    = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_-]*)[ \t]*:(?:[ \t]+(.*))?$`)
+	frontMatterBlock  = regexp.MustCompile(`^([|>])([+-]?)[ \t]*(?:#.*)?$`)
+	yamlPlainUnsafe   = regexp.MustCompile("^(?:[-?:,\\[\\]{}#&*!|>'\"%@` \\t]|$)|: |:$| #|[ \\t]$|[\\x00-\\x1f\\x7f]|^(?i:true|false|yes|no|on|off|y|n|null|~)$|^[-+.]?[0-9]")
+)
+
+// The characters a YAML double quoted string escapes, by the letter after its \.
+var yamlEscapes = map[byte]string{
+	'0': "\x00", 'a': "\a", 'b': "\b", 't': "\t", '\t': "\t", 'n': "\n", 'v': "\v", 'f': "\f", 'r': "\r",
+	'e': "\x1b", ' ': " ", '"': `"`, '/': "/", '\\': `\`, 'N': "\u0085", '_': "\u00a0", 'L': "\u2028", 'P': "\u2029",
+}
+
+/////---------------------------------
+// Front matter
+////
+
+// Type: frontMatterEntry
+// A key of front matter, its value, and the line it is on.
+type frontMatterEntry struct {
+	Key, Value string
+	Line       int
+}
+
+// Internal Function
+// Description:
+// The front matter key of a field: its Go name, starting in lower case.
+func markdownKey(field string) string {
+	return strings.ToLower(field[:1]) + field[1:]
+}
+
+// Internal Function
+// Description:
+// Writes a line of front matter to b: value as a YAML scalar, plain when
+// YAML reads it back as the same text, a literal block when it has
+// several lines, else double quoted.
+func writeFrontMatter(b *bytes.Buffer, key, value string) {
+	lines := strings.Split(value, "\n")
+	literal := len(lines) > 1 && !strings.HasSuffix(value, "\n") && !strings.HasPrefix(strings.TrimLeft(value, "\n"), " ")
+	for _, r := range value {
+		literal = literal && (r == '\n' || r == '\t' || r >= ' ') && r != 0x7f && r != utf8.RuneError
+	}
+
+	switch {
+	case literal:
+		b.WriteString(key + ": |-\n")
+		for _, l := range lines {
+			if l == "" {
+				b.WriteString("\n")
+			} else {
+				b.WriteString("  " + l + "\n")
+			}
+		}
+	case !yamlPlainUnsafe.MatchString(value) && utf8.ValidString(value):
+		b.WriteString(key + ": " + value + "\n")
+	default:
+		b.WriteString(key + ": " + strconv.Quote(value) + "\n")
+	}
+}
+
+// Internal Function
+// Description:
+// Splits a Markdown file into its front matter and its body. A file that
+// does not start with a --- line has no front matter.
+//
+// Returns:
+//      entries([]frontMatterEntry) - In file order.
+//      body(string) - The rest of the file.
+//      bodyLine(int) - The line the body starts on.
+//      problems([]ImportDiagnostic) - With their line, but no file.
+func readFrontMatter(source string) ([]frontMatterEntry, string, int, []ImportDiagnostic) {
+	source = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(strings.TrimPrefix(source, "\ufeff"))
+	lines := strings.Split(source, "\n")
+	entries := make([]frontMatterEntry, 0)
+	problems := make([]ImportDiagnostic, 0)
+	if strings.TrimRight(lines[0], " \t") != "---" {
+		return entries, source, 1, problems
+	}
+
+	for i := 1; i < len(lines); {
+		line := lines[i]
+		if end := strings.TrimRight(line, " \t"); end == "---" || end == "..." {
+			return entries, strings.Join(lines[i+1:], "\n"), i + 2, problems
+		}
+		if blankLine(line) || strings.HasPrefix(strings.TrimLeft(line, " \t"), "#") {
+			i++
+			continue
+		}
+		m := frontMatterKey.FindStringSubmatch(line)
+		if m == nil {
+			problems = append(problems, ImportDiagnostic{Line: i + 1, Column: 1, Severity: ImportError, Message: "Front matter lines must be a key and a text value", Expected: "key: value", Found: strconv.Quote(line)})
+			i++
+			continue
+		}
+		value, next, problem := readYAMLScalar(lines, i, strings.Trim(m[2], " \t"))
+		if problem != nil {
+			problem.Line, problem.Column = i+1, len(m[1])+2
+			problems = append(problems, *problem)
+		} else {
+			entries = append(entries, frontMatterEntry{m[1], value, i + 1})
+		}
+		i = next
+	}
+	problems = append(problems, ImportDiagnostic{Line: len(lines), Column: 1, Severity: ImportError, Message: "The front matter is never closed", Expected: "---", Found: "end of file"})
+	return entries, "", len(lines) + 1, problems
+}
+
+// Internal Function
+// Description:
+// Reads the value v given on line i of front matter, and the lines of a
+// block scalar after it.
+//
+// Returns:
+//      value(string) - As text.
+//      next(int) - The index of the line after the value.
+//      problem(*ImportDiagnostic) - Without a position, if the value is not text.
+func readYAMLScalar(lines []string, i int, v string) (string, int, *ImportDiagnostic) {
+	if m := frontMatterBlock.FindStringSubmatch(v); m != nil {
+		block := make([]string, 0)
+		indent := 0
+		j := i + 1
+		for ; j < len(lines); j++ {
+			l := lines[j]
+			if blankLine(l) {
+				block = append(block, "")
+				continue
+			}
+			if indent == 0 {
+				indent = leadingSpaces(l)
+			}
+			if indent == 0 || leadingSpaces(l) < indent {
+				break
+			}
+			block = append(block, l[indent:])
+		}
+		trailing := 0
+		for trailing < len(block) && block[len(block)-1-trailing] == "" {
+			trailing++
+		}
+		block = block[:len(block)-trailing]
+
+		value := strings.Join(block, "\n")
+		if m[1] == ">" {
+			value = foldYAML(block)
+		}
+		switch {
+		case value == "" || m[2] == "-":
+		case m[2] == "+":
+			value += strings.Repeat("\n", trailing+1)
+		default:
+			value += "\n"
+		}
+		return value, j, nil
+	}
+
+	first := ""
+	if v != "" {
+		first = v[:1]
+	}
+	switch first {
+	case `"`:
+		value, rest, ok := unquoteYAML(v)
+		if !ok {
+			return "", i + 1, &ImportDiagnostic{Severity: ImportError, Message: "The quoted value is never closed, or has an escape YAML does not have", Expected: `"text"`, Found: v}
+		}
+		if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", i + 1, &ImportDiagnostic{Severity: ImportError, Message: "Text follows the quoted value", Expected: "the end of the line", Found: rest}
+		}
+		return value, i + 1, nil
+	case "'":
+		var value bytes.Buffer
+		for k := 1; k < len(v); k++ {
+			if v[k] != '\'' {
+				value.WriteByte(v[k])
+			} else if k+1 < len(v) && v[k+1] == '\'' {
+				value.WriteByte('\'')
+				k++
+			} else if rest := strings.TrimSpace(v[k+1:]); rest == "" || strings.HasPrefix(rest, "#") {
+				return value.String(), i + 1, nil
+			} else {
+				return "", i + 1, &ImportDiagnostic{Severity: ImportError, Message: "Text follows the quoted value", Expected: "the end of the line", Found: rest}
+			}
+		}
+		return "", i + 1, &ImportDiagnostic{Severity: ImportError, Message: "The quoted value is never closed", Expected: "'text'", Found: v}
+	case "[", "{", "&", "*", "!":
+		return "", i + 1, &ImportDiagnostic{Severity: ImportError, Message: "Front matter values are read as text; lists, maps, anchors and tags are not", Expected: "text", Found: v}
+	}
+
+	if comment := strings.Index(v, " #"); comment >= 0 {
+		v = strings.TrimRight(v[:comment], " \t")
+	}
+	if v == "~" || strings.ToLower(v) == "null" {
+		v = ""
+	}
+	return v, i + 1, nil
+}
+
+// Internal Function
+// Description:
+// Folds the lines of a > block scalar: lines join with a space, and each
+// empty line, or a line indented more, keeps a line break.
+func foldYAML(lines []string) string {
+	var b bytes.Buffer
+	for k, l := range lines {
+		switch {
+		case k == 0:
+		case l == "":
+			b.WriteByte('\n')
+		case lines[k-1] == "":
+		case strings.HasPrefix(l, " ") || strings.HasPrefix(lines[k-1], " "):
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(' ')
+		}
+		b.WriteString(l)
+	}
+	return b.String()
+}
+
+// Internal Function
+// Description:
+// Reads the YAML double quoted string v starts with.
+//
+// Returns:
+//      value(string) - Its text, escapes read.
+//      rest(string) - What follows it.
+//      ok(bool) - False if it is never closed or has an unknown escape.
+func unquoteYAML(v string) (string, string, bool) {
+	var b bytes.Buffer
+	for i := 1; i < len(v); i++ {
+		switch v[i] {
+		case '"':
+			return b.String(), v[i+1:], true
+		case '\\':
+			if i++; i >= len(v) {
+				return "", "", false
+			}
+			if escaped, known := yamlEscapes[v[i]]; known {
+				b.WriteString(escaped)
+				continue
+			}
+			digits := map[byte]int{'x': 2, 'u': 4, 'U': 8}[v[i]]
+			if digits == 0 || i+digits >= len(v) {
+				return "", "", false
+			}
+			r, hexErr := strconv.ParseUint(v[i+1:i+1+digits], 16, 32)
+			if hexErr != nil {
+				return "", "", false
+			}
+			b.WriteRune(rune(r))
+			i += digits
+		default:
+			b.WriteByte(v[i])
+		}
+	}
+	return "", "", false
+}
+
+/////---------------------------------
+// Exporter
+////
+
+// Type: markdownFile
+// A file of a Markdown tree, by its path under the book's folder.
+type markdownFile struct {
+	Name string
+	Data []byte
+}
+
+// Internal Function
+// Description:
+// The name of the folder or exercise file of the structure at position,
+// from 1, of count: the position, padded so names sort in book order,
+// then the title in lower case words joined by -, or the kind if it has
+// none.
+func markdownName(position, count int, title, kind string) string {
+	slug := strings.Trim(markdownSlugBreak.ReplaceAllString(strings.ToLower(title), "-"), "-")
+	if len(slug) > 40 {
+		slug = strings.TrimRight(slug[:40], "-")
+	}
+	if slug == "" {
+		slug = kind
+	}
+	width := len(strconv.Itoa(count))
+	if width < 2 {
+		width = 2
+	}
+	return fmt.Sprintf("%0*d-%s", width, position, slug)
+}
+
+// Internal Function
+// Description:
+// Writes structure e of kind as a Markdown file: its id and fields as
+// front matter, its body field as the body. HTML fields left empty are
+// left out of the front matter.
+func markdownDocument(kind string, id int64, e Entity) []byte {
+	var b bytes.Buffer
+	b.WriteString("---\n")
+	fmt.Fprintf(&b, "id: %d\n", id)
+	v := reflect.ValueOf(e).Elem()
+	for _, name := range importFields[kind] {
+		if name == markdownBodies[kind] {
+			continue
+		}
+		switch f := v.FieldByName(name).Interface().(type) {
+		case template.HTML:
+			if f != "" {
+				writeFrontMatter(&b, markdownKey(name), htmlToMarkdown(string(f)))
+			}
+		case string:
+			writeFrontMatter(&b, markdownKey(name), f)
+		case float64:
+			fmt.Fprintf(&b, "%s: %s\n", markdownKey(name), strconv.FormatFloat(f, 'f', -1, 64))
+		case int:
+			fmt.Fprintf(&b, "%s: %d\n", markdownKey(name), f)
+		}
+	}
+	b.WriteString("---\n")
+	if body := htmlToMarkdown(string(v.FieldByName(markdownBodies[kind]).Interface().(template.HTML))); body != "" {
+		b.WriteString("\n" + body + "\n")
+	}
+	return b.Bytes()
+}
+
+// Method: markdownFiles
+// The book as the files of a Markdown tree, in book order.
+func (b *bookExport) markdownFiles() []markdownFile {
+	files := []markdownFile{
+		{markdownBook, markdownDocument("book", b.ID, &b.Book)},
+		{markdownCatalog, markdownDocument("catalog", b.Catalog.ID, &b.Catalog)},
+	}
+	for i, ch := range b.Chapters {
+		chapterDir := markdownName(i+1, len(b.Chapters), ch.Title, "chapter") + "/"
+		files = append(files, markdownFile{chapterDir + "chapter.md", markdownDocument("chapter", ch.ID, &ch.Chapter)})
+		for j, s := range ch.Sections {
+			sectionDir := chapterDir + markdownName(j+1, len(ch.Sections), s.Title, "section") + "/"
+			files = append(files, markdownFile{sectionDir + "section.md", markdownDocument("section", s.ID, &s.Section)})
+			for k, o := range s.Objectives {
+				objectiveDir := sectionDir + markdownName(k+1, len(s.Objectives), o.Title, "objective") + "/"
+				files = append(files, markdownFile{objectiveDir + "objective.md", markdownDocument("objective", o.ID, &o.Objective)})
+				for l, e := range o.Exercises {
+					files = append(files, markdownFile{objectiveDir + markdownName(l+1, len(o.Exercises), e.Instruction, "exercise") + markdownFileType, markdownDocument("exercise", e.ID, &e)})
+				}
+			}
+		}
+	}
+	return files
+}
+
+// Internal Function
+// Description:
+// Writes files and images under folder root as a gzipped tarball to w,
+// with an entry for each folder before what is in it.
+func writeMarkdownTree(w io.Writer, root string, files []markdownFile, images map[string][]byte) error {
+	for _, name := range imageNames(images) {
+		files = append(files, markdownFile{bundleImages + name, images[name]})
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	folders := make(map[string]bool)
+	for _, f := range files {
+		parts := strings.Split(root+f.Name, "/")
+		for k := 1; k < len(parts); k++ {
+			if folder := strings.Join(parts[:k], "/") + "/"; !folders[folder] {
+				folders[folder] = true
+				if headerErr := tw.WriteHeader(&tar.Header{Name: folder, Mode: 0755, ModTime: now, Typeflag: tar.TypeDir}); headerErr != nil {
+					return headerErr
+				}
+			}
+		}
+		if headerErr := tw.WriteHeader(&tar.Header{Name: root + f.Name, Mode: 0644, Size: int64(len(f.Data)), ModTime: now, Typeflag: tar.TypeReg}); headerErr != nil {
+			return headerErr
+		}
+		if _, writeErr := tw.Write(f.Data); writeErr != nil {
+			return writeErr
+		}
+	}
+	if closeErr := tw.Close(); closeErr != nil {
+		return closeErr
+	}
+	return gz.Close()
+}
+
+// Internal Function
+// Description:
+// Writes book bookID to res as a gzipped tarball of Markdown files, with
+// its images that the reader of req may see. The reader must already be
+// allowed to read the book.
+func exportBookMarkdown(res http.ResponseWriter, req *http.Request, bookID int64) {
+	book, loadErr := loadBookExport(NewContext(req), bookID)
+	if loadErr != nil {
+		http.Error(res, loadErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	images := book.readableImages(res, req)
+	serveDownload(res, "application/gzip", fmt.Sprint("book-", bookID, ".tar.gz"), func(w io.Writer) error {
+		return writeMarkdownTree(w, fmt.Sprint("book-", bookID, "/"), book.markdownFiles(), images)
+	})
+}
+
+/////---------------------------------
+// Importer
+////
+
+// Internal Function
+// Description:
+// Finds the folder of the Markdown tree among the files of an archive:
+// the one holding the shallowest book.md.
+//
+// Returns:
+//      root(string) - The folder, with a / after it, or empty for the top.
+//      found(bool) - False if there is no book.md.
+func markdownRoot(files map[string][]byte) (string, bool) {
+	root, depth := "", -1
+	for name := range files {
+		if name != markdownBook && !strings.HasSuffix(name, "/"+markdownBook) {
+			continue
+		}
+		folder := strings.TrimSuffix(name, markdownBook)
+		if d := strings.Count(folder, "/"); depth < 0 || d < depth || (d == depth && folder < root) {
+			root, depth = folder, d
+		}
+	}
+	return root, depth >= 0
+}
+
+// Internal Function
+// Description:
+// Reports whether Markdown name a goes before b: names starting with a
+// number first, by that number, then by name.
+func markdownNameLess(a, b string) bool {
+	na, nb := markdownNumbered.FindString(a), markdownNumbered.FindString(b)
+	if (na == "") != (nb == "") {
+		return na != ""
+	}
+	if na != "" {
+		ia, _ := strconv.ParseUint(na, 10, 64)
+		ib, _ := strconv.ParseUint(nb, 10, 64)
+		if ia != ib {
+			return ia < ib
+		}
+	}
+	return a < b
+}
+
+// Type: markdownTree
+// The files of an uploaded Markdown tree, by path under its folder, and
+// the problems found reading them.
+type markdownTree struct {
+	files       map[string][]byte
+	diagnostics []ImportDiagnostic
+}
+
+// Method: report
+// Adds a diagnostic at at.
+func (t *markdownTree) report(at importPosition, d ImportDiagnostic) {
+	d.File, d.Line, d.Column = at.File, at.Line, at.Column
+	t.diagnostics = append(t.diagnostics, d)
+}
+
+// Method: list
+// The files and folders directly in folder dir, "" for the top, in the
+// order of markdownNameLess.
+func (t *markdownTree) list(dir string) ([]string, []string) {
+	fileSet, folderSet := make(map[string]bool), make(map[string]bool)
+	for name := range t.files {
+		if !strings.HasPrefix(name, dir) {
+			continue
+		}
+		if rest := name[len(dir):]; strings.Contains(rest, "/") {
+			folderSet[rest[:strings.Index(rest, "/")]] = true
+		} else {
+			fileSet[rest] = true
+		}
+	}
+	sorted := func(set map[string]bool) []string {
+		names := make([]string, 0, len(set))
+		for name := range set {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool { return markdownNameLess(names[i], names[j]) })
+		return names
+	}
+	return sorted(fileSet), sorted(folderSet)
+}
+
+// Method: structure
+// Reads the structure of kind the file at name gives.
+func (t *markdownTree) structure(name, kind string) *importNode {
+	n := &importNode{Kind: kind, Entity: newImportEntity(kind), At: importPosition{Line: 1, Column: 1, File: name}, Fields: make(map[string]importPosition), Children: make([]*importNode, 0)}
+	entries, body, bodyLine, problems := readFrontMatter(string(t.files[name]))
+	for _, d := range problems {
+		t.report(importPosition{Line: d.Line, Column: d.Column, File: name}, d)
+	}
+
+	keys := []string{"id"}
+	fields := make(map[string]string) // Go names, by key in lower case
+	for _, field := range importFields[kind] {
+		if field != markdownBodies[kind] {
+			keys = append(keys, markdownKey(field))
+			fields[strings.ToLower(field)] = field
+		}
+	}
+	v := reflect.ValueOf(n.Entity).Elem()
+
+	for _, e := range entries {
+		at := importPosition{Line: e.Line, Column: 1, File: name}
+		field := strings.ToLower(e.Key)
+		if first, set := n.Fields[field]; set {
+			t.report(at, ImportDiagnostic{Severity: ImportWarning, Message: fmt.Sprint(e.Key, " replaces the one on line ", first.Line), Expected: "one " + e.Key, Found: "two"})
+		}
+		switch {
+		case field == "id":
+			text := strings.TrimSpace(e.Value)
+			id, parseErr := strconv.ParseInt(text, 10, 64)
+			if text != "" && (parseErr != nil || id <= 0) {
+				t.report(at, ImportDiagnostic{Severity: ImportError, Message: "id is not an id", Expected: "a positive whole number", Found: strconv.Quote(text)})
+				continue
+			}
+			n.ID = id
+		case fields[field] == "":
+			message := e.Key + " is not a " + kind + " field"
+			if strings.ToLower(markdownBodies[kind]) == field {
+				message = e.Key + " is the body of the file, after the front matter"
+			}
+			t.report(at, ImportDiagnostic{Severity: ImportError, Message: message, Expected: strings.Join(keys, ", "), Found: e.Key})
+			continue
+		default:
+			markup := e.Value
+			if _, isHTML := v.FieldByName(fields[field]).Interface().(template.HTML); isHTML {
+				markup = markdownLineToHTML(e.Value)
+			}
+			if problem := setImportField(n.Entity, kind, field, e.Value, markup); problem != nil {
+				t.report(at, *problem)
+				continue
+			}
+		}
+		n.Fields[field] = at
+	}
+
+	if strings.TrimSpace(body) != "" {
+		field := strings.ToLower(markdownBodies[kind])
+		setImportField(n.Entity, kind, field, body, markdownToHTML(body))
+		n.Fields[field] = importPosition{Line: bodyLine, Column: 1, File: name}
+	}
+	if b, isBook := n.Entity.(*Book); isBook && b.Visibility != "" {
+		if _, visErr := ParseVisibility(b.Visibility); visErr != nil {
+			t.report(n.Fields["visibility"], ImportDiagnostic{Severity: ImportError, Message: "visibility is not a visibility", Expected: VisibilityPublic + ", " + VisibilityUnlisted + " or " + VisibilityPrivate, Found: strconv.Quote(b.Visibility)})
+		}
+	}
+	return n
+}
+
+// Method: folder
+// Reads the structure at level of importLevels whose folder is dir, and
+// everything inside it. A child without an order in its front matter is
+// given its place among the others, from 1.
+//
+// Returns:
+//      structure(*importNode) - nil if dir does not hold its <kind>.md.
+func (t *markdownTree) folder(dir string, level int) *importNode {
+	kind := importLevels[level]
+	document := kind + markdownFileType
+	files, folders := t.list(dir)
+	if !hasImportAttribute(files, document) {
+		found := strings.Join(files, ", ")
+		if found == "" {
+			found = "no files"
+		}
+		t.report(importPosition{File: dir}, ImportDiagnostic{Severity: ImportError, Message: "The folder has no " + document + ", and is not read", Expected: document, Found: found})
+		return nil
+	}
+	n := t.structure(dir+document, kind)
+
+	children := make([]string, 0)
+	exercises := importLevels[level+1] == "exercise"
+	for _, f := range files {
+		switch {
+		case f == document || !strings.HasSuffix(f, markdownFileType) || (level == 0 && f == markdownCatalog):
+		case exercises:
+			children = append(children, dir+f)
+		default:
+			t.report(importPosition{Line: 1, Column: 1, File: dir + f}, ImportDiagnostic{Severity: ImportWarning, Message: "The file is not read, each " + importLevels[level+1] + " is a folder of its own", Expected: "a folder holding " + importLevels[level+1] + markdownFileType, Found: f})
+		}
+	}
+	for _, f := range folders {
+		switch {
+		case level == 0 && f+"/" == bundleImages:
+		case exercises:
+			t.report(importPosition{File: dir + f + "/"}, ImportDiagnostic{Severity: ImportWarning, Message: "The folder is not read, exercises are files beside objective.md", Expected: "exercise files", Found: f + "/"})
+		default:
+			children = append(children, dir+f+"/")
+		}
+	}
+
+	for i, c := range children {
+		var child *importNode
+		if exercises {
+			child = t.structure(c, "exercise")
+		} else if child = t.folder(c, level+1); child == nil {
+			continue
+		}
+		if _, set := child.Fields["order"]; !set {
+			reflect.ValueOf(child.Entity).Elem().FieldByName("Order").SetInt(int64(i + 1))
+		}
+		n.Children = append(n.Children, child)
+	}
+	return n
+}
+
+// Internal Function
+// Description:
+// Reads the files of a Markdown tree into a book, checking all of it.
+//
+// Returns:
+//      book(*importNode) - As parseBookHTML reads it. nil if there is no book.md.
+//      diagnostics([]ImportDiagnostic) - Every problem found, in tree order.
+func parseMarkdownBook(files map[string][]byte) (*importNode, []ImportDiagnostic) {
+	t := &markdownTree{files: files, diagnostics: make([]ImportDiagnostic, 0)}
+	book := t.folder("", 0)
+	if book != nil {
+		if _, hasCatalog := files[markdownCatalog]; hasCatalog {
+			book.Catalog = t.structure(markdownCatalog, "catalog")
+		}
+		checkImportOrders(book, t.report)
+	}
+	return book, t.diagnostics
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"golang.org/x/net/context"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// Internal Function
+// Description:
+// Stores a book whose HTML is written as markdownToHTML writes it, so it
+// reads back the same, and whose text fields need quoting in YAML.
+func placeMarkdownTestBook(t *testing.T, ctx context.Context) int64 {
+	place := func(e Entity) int64 {
+		id, putErr := PlaceInDatastore(ctx, 0, e)
+		if putErr != nil {
+			t.Fatal(putErr)
+		}
+		return id
+	}
+	cid := place(&Catalog{Title: "Cat & <dogs>", Version: 1.25, Company: "Co\r\nInc", Description: "<p>Catalog of <strong>books</strong></p>"})
+	bid := place(&Book{Title: "Solving for x: the basics", Version: 0.1, Author: "yes", Tags: "#tag, 1.5", Visibility: VisibilityUnlisted, Parent: cid,
+		Description: "<p>One <em>two</em> <code>x &lt; y</code> <a href=\"http://example.com/a\" title=\"T\">link</a></p>\n<p>Second<br />\nline</p>"})
+	chid := place(&Chapter{Title: " Leading and trailing ", Version: 2, Order: 2, Description: "<div class=\"note\"><div>nested</div></div>", Parent: bid})
+	place(&Chapter{Title: "Empty", Order: 1, Parent: bid})
+	sid := place(&Section{Title: "Lists", Order: 1, Parent: chid,
+		Description: "<h2>Heading</h2>\n<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n<ol start=\"3\">\n<li>c</li>\n</ol>"})
+	oid := place(&Objective{Title: "Code", Author: "line 1\nline 2", Version: 1.5, Order: 3, Parent: sid,
+		Content:      "<pre><code>  x = 1\n    y &lt; 2\n</code></pre>\n<blockquote>\n<p>quoted</p>\n</blockquote>\n<table><tbody><tr><td>1</td></tr></tbody></table>",
+		KeyTakeaways: "<ul>\n<li>k</li>\n</ul>"})
+	place(&Exercise{Instruction: "Solve: \"quoted\" 'single'", Question: "<p>*not em* 1. not list # not heading</p>", Solution: "<p>S</p>\n<p>two paragraphs</p>", Answer: "<em>42</em>", Order: 1, Parent: oid})
+	place(&Exercise{Question: "<p>Second</p>", Answer: "x = 2", Order: 2, Parent: oid})
+	return bid
+}
+
+// Internal Function
+// Description:
+// Writes book bookID as a Markdown tarball and reads the tarball back.
+func markdownTreeOf(t *testing.T, ctx context.Context, bookID int64) (map[string][]byte, []markdownFile) {
+	book, loadErr := loadBookExport(ctx, bookID)
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+	files := book.markdownFiles()
+	var tarball bytes.Buffer
+	if writeErr := writeMarkdownTree(&tarball, "book-1/", files, nil); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	bundle, readErr := readBookUpload(tarball.Bytes())
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if bundle.Sources == nil {
+		t.Fatal("tarball was not read as a Markdown tree")
+	}
+	return bundle.Sources, files
+}
+
+func TestMarkdownBookRoundTrip(t *testing.T) {
+	ctx := setupBookTest(t)
+	bid := placeMarkdownTestBook(t, ctx)
+
+	sources, files := markdownTreeOf(t, ctx, bid)
+	book, diagnostics := parseMarkdownBook(sources)
+	if len(diagnostics) > 0 {
+		t.Fatalf("export of a stored book has problems: %v", diagnostics)
+	}
+	if report, imported := importBook(ctx, book, 0, nil); !imported {
+		t.Fatalf("import failed: %v", report)
+	}
+
+	want, wantErr := loadBookExport(ctx, bid)
+	got, gotErr := loadBookExport(ctx, book.Entity.(*Book).ID)
+	if wantErr != nil || gotErr != nil {
+		t.Fatal(wantErr, gotErr)
+	}
+	clearExportIDs(reflect.ValueOf(want))
+	clearExportIDs(reflect.ValueOf(got))
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("imported book differs\nwant %+v\n got %+v", want, got)
+	}
+
+	_, again := markdownTreeOf(t, ctx, book.Entity.(*Book).ID)
+	ids := regexp.MustCompile(`(?m)^id: [0-9]+$`)
+	if len(again) != len(files) {
+		t.Fatalf("second export has %d files, want %d", len(again), len(files))
+	}
+	for i := range files {
+		if a, b := ids.ReplaceAllString(string(files[i].Data), "id:"), ids.ReplaceAllString(string(again[i].Data), "id:"); files[i].Name != again[i].Name || a != b {
+			t.Errorf("second export differs\nfirst  %s\n%s\nsecond %s\n%s", files[i].Name, a, again[i].Name, b)
+		}
+	}
+}
+
+func TestFrontMatterRoundTrip(t *testing.T) {
+	values := []string{
+		"",
+		"plain text",
+		"Solving for x: the basics",
+		"key:",
+		"yes",
+		"Null",
+		"~",
+		"1.5",
+		"-1",
+		"- dash",
+		"#hash",
+		"text # not a comment",
+		" leading",
+		"trailing ",
+		"\"double\" and 'single'",
+		"'quoted'",
+		"[not, a, list]",
+		"tab\there",
+		"control\x01\x7f",
+		"unicode \u00e9 \u2713 \u2028",
+		"two\nlines",
+		"blank\n\nbetween",
+		"\nstarts blank",
+		"  indented\nsecond",
+		"ends in a break\n",
+		"ends in breaks\n\n",
+		"Co\r\nInc",
+		"  Alge  \n bra ",
+	}
+	for _, v := range values {
+		var b bytes.Buffer
+		b.WriteString("---\n")
+		writeFrontMatter(&b, "key", v)
+		b.WriteString("---\nbody\n")
+		entries, body, bodyLine, problems := readFrontMatter(b.String())
+		if len(problems) > 0 || len(entries) != 1 || entries[0].Key != "key" || entries[0].Value != v {
+			t.Errorf("%q was written as\n%s\nand read as %+v, %v", v, b.String(), entries, problems)
+			continue
+		}
+		if body != "body\n" || bodyLine != strings.Count(b.String(), "\n") {
+			t.Errorf("%q: body %q on line %d", v, body, bodyLine)
+		}
+	}
+}
+
+func TestReadFrontMatter(t *testing.T) {
+	cases := []struct {
+		name, source, want string
+	}{
+		{"plain", "k: plain text", "plain text"},
+		{"comment", "k: plain text # comment", "plain text"},
+		{"empty", "k:", ""},
+		{"null", "k: null", ""},
+		{"tilde", "k: ~", ""},
+		{"single quoted", "k: 'it''s' # comment", "it's"},
+		{"double quoted", `k: "a\tb\u00e9\x41\"\\" # comment`, "a\tb\u00e9A\"\\"},
+		{"literal", "k: |\n  one\n  two\n\n", "one\ntwo\n"},
+		{"literal strip", "k: |-\n  one\n\n  two\n", "one\n\ntwo"},
+		{"literal keep", "k: |+\n  keep\n", "keep\n\n"},
+		{"literal more indented", "k: |\n    four\n      six\n", "four\n  six\n"},
+		{"folded", "k: >\n  folded\n  lines\n\n  para\n    indented\n", "folded lines\npara\n  indented\n"},
+		{"folded strip", "k: >-\n  a\n  b\n", "a b"},
+		{"CRLF", "k: |-\r\n  one\r\n  two\r\n", "one\ntwo"},
+	}
+	for _, c := range cases {
+		entries, _, _, problems := readFrontMatter("---\n" + c.source + "\n---\n")
+		if len(problems) > 0 || len(entries) != 1 || entries[0].Value != c.want {
+			t.Errorf("%s: read %q as %+v, %v, want %q", c.name, c.source, entries, problems, c.want)
+		}
+	}
+
+	problems := []struct {
+		name, source string
+		line         int
+		message      string
+	}{
+		{"list", "---\nk: [a, b]\n---\n", 2, "lists, maps"},
+		{"map", "---\nt: x\nk: {a: b}\n---\n", 3, "lists, maps"},
+		{"anchor", "---\nk: &a x\n---\n", 2, "anchors"},
+		{"open double quote", "---\nk: \"open\n---\n", 2, "never closed"},
+		{"unknown escape", "---\nk: \"\\q\"\n---\n", 2, "escape"},
+		{"open single quote", "---\nk: 'open\n---\n", 2, "never closed"},
+		{"text after quote", "---\nk: \"x\" y\n---\n", 2, "Text follows"},
+		{"not a key", "---\njust text\n---\n", 2, "key and a text value"},
+		{"never closed", "---\nk: v\n", 3, "never closed"},
+	}
+	for _, p := range problems {
+		_, _, _, found := readFrontMatter(p.source)
+		if len(found) != 1 || found[0].Line != p.line || found[0].Severity != ImportError || !strings.Contains(found[0].Message, p.message) {
+			t.Errorf("%s: want an error on line %d containing %q, got %v", p.name, p.line, p.message, found)
+		}
+	}
+
+	entries, body, bodyLine, found := readFrontMatter("\ufeffNo front matter\n")
+	if len(entries) != 0 || body != "No front matter\n" || bodyLine != 1 || len(found) != 0 {
+		t.Errorf("file without front matter read as %v, %q, %d, %v", entries, body, bodyLine, found)
+	}
+}
@@ -0,0 +1,527 @@
+package main
+
+/*
+PARSE_BookMerge.go by Allen J. Mills
+    mm.d.yy
+
+    Imports a book file into a book that already exists, updating it in
+    place rather than making a copy. Each structure of the file is
+    matched to one inside the same structure of the book: by the
+    <kind>-id it was exported with, or else by its title, an exercise's
+    instruction, and its order when the file gives one. Matched
+    structures get the fields the file sets, structures the book does
+    not have are created with everything inside them, and structures
+    the file does not have are kept, or moved to the trash when asked.
+
+    A merge is previewed first. The preview lists every change and gives
+    a token, which must be sent back as Confirm with the same file to
+    make them. The changes are made all together or not at all.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/net/context"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMergeBundle = errors.New("Merge: Bundles, Markdown trees and Word documents cannot be merged, merge a book.html.") // ErrMergeBundle is returned when a bundle, Markdown tree or Word document is uploaded to merge.
+)
+
+const (
+	// Merge actions.
+	MergeCreate = "create" // In the file, not the book
+	MergeUpdate = "update" // In both, the file changes some fields
+	MergeDelete = "delete" // In the book, not the file, and moved to the trash
+	MergeKeep   = "keep"   // In the book, not the file, and left alone
+)
+
+// Type: MergeChange
+// One change a merge makes, or a structure of the book it leaves alone.
+type MergeChange struct {
+	Action  string   // MergeCreate, MergeUpdate, MergeDelete or MergeKeep
+	Kind    string   // Book, Chapter, Section, Objective or Exercise
+	ID      int64    `json:",string"` // 0 for creates until the merge is made
+	Title   string   // Title, or instruction for exercises
+	In      string   // Title of the structure it is inside
+	Line    int      `json:",omitempty"` // Where it is in the file
+	Fields  []string `json:",omitempty"` // Fields an update changes
+	Cascade int      `json:",omitempty"` // Other records a delete removes with it
+
+	id            *int64      // Filled when created
+	before, after interface{} // For the audit log
+	digest        string      // Of the subtree a delete removes
+}
+
+func (c MergeChange) String() string {
+	msg := fmt.Sprint(c.Action, " ", c.Kind, " ", c.ID, " ", strconv.Quote(c.Title))
+	if c.In != "" {
+		msg += " in " + strconv.Quote(c.In)
+	}
+	if c.Line != 0 {
+		msg += fmt.Sprint(" (line ", c.Line, ")")
+	}
+	if len(c.Fields) > 0 {
+		msg += ": " + strings.Join(c.Fields, ", ")
+	}
+	if c.Cascade > 0 {
+		msg += fmt.Sprint(", with ", c.Cascade, " other records")
+	}
+	return msg
+}
+
+// Type: MergePlan
+// Everything merging a book file into book BookID changes, staged in a batch.
+type MergePlan struct {
+	BookID        int64 `json:",string"`
+	DeleteMissing bool
+	Changes       []*MergeChange
+	Unchanged     int                // Structures matched that the file does not change
+	Diagnostics   []ImportDiagnostic // Of the file, and of matching it
+
+	batch     *Batch
+	deletedBy string // Names the trash bins of deletes
+}
+
+// Internal Function
+// Description:
+// Gets the title of a structure, or the instruction of an exercise.
+func mergeTitle(e Entity) string {
+	v := reflect.ValueOf(e).Elem()
+	if name := v.FieldByName("Title"); name.IsValid() {
+		return name.String()
+	}
+	return v.FieldByName("Instruction").String()
+}
+
+// Internal Function
+// Description:
+// Gets a pointer to the ID field of a structure.
+func mergeID(e Entity) *int64 {
+	return reflect.ValueOf(e).Elem().FieldByName("ID").Addr().Interface().(*int64)
+}
+
+// Internal Function
+// Description:
+// Plans merging book, read by parseBookHTML, into book bookID. Nothing is
+// stored until the plan is committed.
+//
+// Returns:
+//      plan(*MergePlan) - Every change, and the diagnostics of matching.
+//      failure?(error) - ErrNoSuchEntity if there is no book bookID, or any storage error.
+func planMerge(ctx context.Context, book *importNode, bookID int64, deleteMissing bool, deletedBy string) (*MergePlan, error) {
+	current := &Book{}
+	if getErr := Stores.Entities.Get(ctx, MakeBookKey(bookID), current); getErr != nil {
+		return nil, getErr
+	}
+	current.ID = bookID
+
+	p := &MergePlan{BookID: bookID, DeleteMissing: deleteMissing, Changes: make([]*MergeChange, 0), Diagnostics: make([]ImportDiagnostic, 0), batch: NewBatch(), deletedBy: deletedBy}
+	if book.ID != 0 && book.ID != bookID {
+		at := book.Fields["id"]
+		p.Diagnostics = append(p.Diagnostics, ImportDiagnostic{Line: at.Line, Column: at.Column, Severity: ImportWarning, Message: fmt.Sprint("The file was exported from book ", book.ID, ", its structures are matched by title"), Expected: fmt.Sprint(bookID), Found: fmt.Sprint(book.ID)})
+	}
+	p.update(book, current, "")
+	if mergeErr := p.children(ctx, book, current); mergeErr != nil {
+		return nil, mergeErr
+	}
+	return p, nil
+}
+
+// Method: update
+// Stages setting the fields n sets on current, the structure it matched.
+func (p *MergePlan) update(n *importNode, current Entity, in string) {
+	v := reflect.ValueOf(current).Elem()
+	before := reflect.New(v.Type())
+	before.Elem().Set(v)
+
+	file := reflect.ValueOf(n.Entity).Elem()
+	changed := make([]string, 0)
+	for _, name := range importFields[n.Kind] {
+		if _, set := n.Fields[strings.ToLower(name)]; !set {
+			continue
+		}
+		if !reflect.DeepEqual(v.FieldByName(name).Interface(), file.FieldByName(name).Interface()) {
+			v.FieldByName(name).Set(file.FieldByName(name))
+			changed = append(changed, name)
+		}
+	}
+	if len(changed) == 0 {
+		p.Unchanged++
+		return
+	}
+
+	id := mergeID(current)
+	p.Changes = append(p.Changes, &MergeChange{Action: MergeUpdate, Kind: strings.Title(n.Kind), ID: *id, Title: mergeTitle(current), In: in, Line: n.At.Line, Fields: changed, id: id, before: before.Interface(), after: current})
+	p.batch.Place(id, current, nil)
+}
+
+// Method: children
+// Matches the structures inside n to those inside current, the structure
+// n matched, and plans the changes to each.
+func (p *MergePlan) children(ctx context.Context, n *importNode, current Entity) error {
+	childKind, hasChildren := childKinds[strings.Title(n.Kind)]
+	if !hasChildren {
+		return nil
+	}
+
+	existing, getErr := getOrderedChildren(ctx, *mergeID(current), childKind)
+	if getErr != nil {
+		return getErr
+	}
+
+	matched := make([]Entity, len(n.Children))
+	claimed := make(map[Entity]bool)
+	for i, c := range n.Children {
+		if c.ID == 0 {
+			continue
+		}
+		for _, e := range existing {
+			if !claimed[e] && *mergeID(e) == c.ID {
+				matched[i], claimed[e] = e, true
+				break
+			}
+		}
+		if matched[i] == nil {
+			at := c.Fields["id"]
+			p.Diagnostics = append(p.Diagnostics, ImportDiagnostic{Line: at.Line, Column: at.Column, Severity: ImportWarning, Message: fmt.Sprint(c.Kind, "-id ", c.ID, " is not a ", c.Kind, " of ", strconv.Quote(mergeTitle(current)), ", it is matched by title"), Found: fmt.Sprint(c.ID)})
+		}
+	}
+	for i, c := range n.Children {
+		if matched[i] != nil {
+			continue
+		}
+		_, hasOrder := c.Fields["order"]
+		for _, e := range existing {
+			if claimed[e] || mergeTitle(e) != mergeTitle(c.Entity) {
+				continue
+			}
+			if hasOrder && reflect.ValueOf(e).Elem().FieldByName("Order").Int() != reflect.ValueOf(c.Entity).Elem().FieldByName("Order").Int() {
+				continue
+			}
+			matched[i], claimed[e] = e, true
+			break
+		}
+	}
+
+	in := mergeTitle(current)
+	for i, c := range n.Children {
+		if matched[i] == nil {
+			p.create(c, mergeID(current), in)
+			continue
+		}
+		p.update(c, matched[i], in)
+		if mergeErr := p.children(ctx, c, matched[i]); mergeErr != nil {
+			return mergeErr
+		}
+	}
+	for _, e := range existing {
+		if !claimed[e] {
+			p.missing(ctx, childKind, e, in)
+		}
+	}
+	return nil
+}
+
+// Method: create
+// Stages creating n and everything inside it. parent points at the id of
+// the structure n goes in, which is known once that is placed.
+func (p *MergePlan) create(n *importNode, parent *int64, in string) {
+	id := mergeID(n.Entity)
+	p.Changes = append(p.Changes, &MergeChange{Action: MergeCreate, Kind: strings.Title(n.Kind), Title: mergeTitle(n.Entity), In: in, Line: n.At.Line, id: id, after: n.Entity})
+
+	p.batch.Place(id, n.Entity, func() {
+		*reflect.ValueOf(n.Entity).Elem().FieldByName("Parent").Addr().Interface().(*int64) = *parent
+	})
+	for _, c := range n.Children {
+		p.create(c, id, mergeTitle(n.Entity))
+	}
+}
+
+// Method: missing
+// Plans for e, a structure of kind the file does not have: kept, or with
+// DeleteMissing moved to the trash along with everything inside it.
+func (p *MergePlan) missing(ctx context.Context, kind string, e Entity, in string) {
+	change := &MergeChange{Action: MergeKeep, Kind: kind, ID: *mergeID(e), Title: mergeTitle(e), In: in, before: e}
+	p.Changes = append(p.Changes, change)
+	if !p.DeleteMissing {
+		return
+	}
+
+	t := CollectSubtree(ctx, Scope{kind, change.ID})
+	change.Action = MergeDelete
+	change.Cascade = len(t.Keys) - 1
+	change.digest = t.digest()
+
+	var bin *TrashBin
+	p.batch.Do(fmt.Sprint("move ", kind, ":", change.ID, " to the trash"), func(ctx context.Context) error {
+		var trashErr error
+		bin, trashErr = MoveToTrash(ctx, t, change.Title, p.deletedBy)
+		return trashErr
+	}, func(ctx context.Context) error {
+		return RestoreFromTrash(ctx, bin)
+	})
+}
+
+// Method: change
+// What a Confirm token for p is made over: the book, the file, and every
+// change with the values it replaces, so the token is refused once the
+// file or anything the merge touches is different.
+func (p *MergePlan) change(file []byte) string {
+	h := sha256.New()
+	h.Write(file)
+	for _, c := range p.Changes {
+		planned, _ := json.Marshal(c)
+		before, _ := json.Marshal(c.before)
+		h.Write(planned)
+		h.Write(before)
+		h.Write([]byte(c.digest))
+	}
+	return fmt.Sprint("merge:", p.BookID, ":", p.DeleteMissing, ":", base64.RawURLEncoding.EncodeToString(h.Sum(nil)))
+}
+
+// Internal Function
+// Description:
+// Makes every change of p, all or nothing, filling in the ids of created structures.
+//
+// Returns:
+//      failure?(error) - *Rollback if a change failed.
+func (p *MergePlan) commit(ctx context.Context) error {
+	if commitErr := p.batch.Commit(ctx); commitErr != nil {
+		return commitErr
+	}
+	for _, c := range p.Changes {
+		if c.id != nil {
+			c.ID = *c.id
+		}
+	}
+	return nil
+}
+
+// Method: record
+// Adds the committed changes of p to the audit log and revision history, for the user of req.
+func (p *MergePlan) record(res http.ResponseWriter, req *http.Request) {
+	for _, c := range p.Changes {
+		switch c.Action {
+		case MergeCreate:
+			RecordAudit(res, req, AuditCreate, c.Kind, c.ID, nil, c.after)
+			SaveRevision(res, req, c.Kind, c.ID, nil, c.after)
+		case MergeUpdate:
+			RecordAudit(res, req, AuditUpdate, c.Kind, c.ID, c.before, c.after)
+			SaveRevision(res, req, c.Kind, c.ID, c.before, c.after)
+		case MergeDelete:
+			RecordAuditCascade(res, req, AuditDelete, c.Kind, c.ID, c.before, nil, c.Cascade)
+		}
+	}
+}
+
+// Internal Function
+// Description:
+// Reads the uploaded book file of req and plans merging it into BookID.
+// Permission to make, and with DeleteMissing to delete, in the book is checked.
+//
+// Returns:
+//      plan(*MergePlan) - nil when failing, or when the file has errors.
+//      file([]byte) - The file as uploaded.
+//      diagnostics([]ImportDiagnostic) - Of the file, when it has errors.
+//      code(int) - 400, 418 or 500 when failing.
+//      failure?(error) - What went wrong.
+func mergeUploadedBook(res http.ResponseWriter, req *http.Request) (*MergePlan, []byte, []ImportDiagnostic, int, error) {
+	deleteMissing := req.FormValue("DeleteMissing") == "true"
+	scope := ScopeOf("Book", req.FormValue("BookID"))
+	if validPerm, permErr := HasPermission(res, req, Settings.Permissions.APIMake, scope); !validPerm {
+		// User Must be at least Writer.
+		return nil, nil, nil, 418, permErr
+	}
+	if validPerm, permErr := HasPermission(res, req, Settings.Permissions.APIDelete, scope); deleteMissing && !validPerm {
+		// User Must be able to delete, to delete what the file is missing.
+		return nil, nil, nil, 418, permErr
+	}
+
+	bookID, convErr := strconv.ParseInt(req.FormValue("BookID"), 10, 64)
+	if convErr != nil || bookID == 0 {
+		return nil, nil, nil, 400, ErrNoSuchEntity
+	}
+
+	multipartFile, _, fileError := req.FormFile("upload")
+	if fileError != nil {
+		return nil, nil, nil, 400, fileError
+	}
+	defer multipartFile.Close()
+	file, readErr := readUpload(multipartFile)
+	if readErr == ErrUploadTooLarge {
+		return nil, nil, nil, 400, readErr
+	} else if readErr != nil {
+		return nil, nil, nil, 500, readErr
+	}
+	if bundle, bundleErr := readBookUpload(file); bundleErr != nil || bundle.Images != nil {
+		return nil, nil, nil, 400, ErrMergeBundle
+	}
+
+	book, diagnostics, parseErr := parseBookHTML(bytes.NewReader(file))
+	if parseErr != nil {
+		return nil, file, nil, 500, parseErr
+	}
+	if importFailed(diagnostics) {
+		return nil, file, diagnostics, 400, fmt.Errorf("The file has %d problems, nothing was merged", len(diagnostics))
+	}
+
+	deletedBy := ""
+	if u, authErr := GetUserFromRequest(res, req); authErr == nil {
+		deletedBy = u.Email
+	}
+	plan, planErr := planMerge(NewContext(req), book, bookID, deleteMissing, deletedBy)
+	if planErr == ErrNoSuchEntity {
+		return nil, file, nil, 400, planErr
+	} else if planErr != nil {
+		return nil, file, nil, 500, planErr
+	}
+
+	plan.Diagnostics = append(diagnostics, plan.Diagnostics...)
+	sortImportDiagnostics(plan.Diagnostics)
+	return plan, file, nil, 0, nil
+}
+
+// Call: /import/book/merge
+// Description:
+// This call merges a book file into the existing book BookID. Without
+// Confirm nothing is stored: the merge is previewed, listing every change
+// in Changes, with a Token. Sending the same file and options again with
+// Token as Confirm, before Expires, makes the changes, all or none.
+// Structures of the book that the file does not have are kept, or moved
+// to the trash when DeleteMissing is true.
+//
+// Method: POST
+// Results: JSON
+// Mandatory Options: upload, BookID
+// Optional Options: DeleteMissing, Confirm
+// Codes:
+//      0 - Success, previewed, or merged when Applied is true
+//    400 - Failure, No file, invalid BookID, or the file has errors; Results has its Diagnostics
+//    409 - Failure, Confirm does not match the merge; Results is a new preview
+//    418 - Failure, Authorization error
+//    500 - Failure, Internal Services Error; Results is the Rollback if changes were undone
+func PARSE_POST_MergeBook(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	limitUpload(res, req)
+	plan, file, diagnostics, code, mergeErr := mergeUploadedBook(res, req)
+	switch {
+	case code == 418:
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Invalid Authorization: " + mergeErr.Error(), Code: 418}, nil)
+		return
+	case diagnostics != nil:
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: mergeErr.Error(), Code: code}, struct{ Diagnostics []ImportDiagnostic }{diagnostics})
+		return
+	case mergeErr == ErrNoSuchEntity:
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Invalid BookID", Code: 400}, nil)
+		return
+	case mergeErr != nil:
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: mergeErr.Error(), Code: code}, nil)
+		return
+	}
+
+	change := plan.change(file)
+	if req.FormValue("Confirm") == "" {
+		expires := time.Now().Add(confirmLifetime)
+		ServeJsonOfStruct(res, JsonOptions{Status: "Success"}, struct {
+			*MergePlan
+			Applied bool
+			Token   string
+			Expires time.Time
+		}{plan, false, confirmToken(res, req, change, expires), expires})
+		return
+	}
+	if confirmErr := checkConfirmToken(res, req, change); confirmErr != nil {
+		expires := time.Now().Add(confirmLifetime)
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: confirmErr.Error(), Code: 409}, struct {
+			*MergePlan
+			Applied bool
+			Token   string
+			Expires time.Time
+		}{plan, false, confirmToken(res, req, change, expires), expires})
+		return
+	}
+
+	if commitErr := plan.commit(NewContext(req)); commitErr != nil {
+		if rb, rolledBack := commitErr.(*Rollback); rolledBack {
+			ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Internal Error: Merge rolled back", Code: 500}, rb)
+			return
+		}
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Internal Error: " + commitErr.Error(), Code: 500}, nil)
+		return
+	}
+	plan.record(res, req)
+
+	ServeJsonOfStruct(res, JsonOptions{Status: "Success"}, struct {
+		*MergePlan
+		Applied bool
+	}{plan, true})
+}
+
+// Internal Function
+// Description:
+// The merge of the /import/book uploader, used when BookID is given. Prints
+// the changes merging the uploaded file would make, and makes them when
+// the Confirm it printed is sent with the same file.
+func printUploadedMerge(res http.ResponseWriter, req *http.Request) {
+	fmt.Fprint(res, "<html><plaintext>")
+
+	plan, file, diagnostics, _, mergeErr := mergeUploadedBook(res, req)
+	for _, d := range diagnostics {
+		fmt.Fprintln(res, d.Error())
+	}
+	if mergeErr != nil {
+		fmt.Fprintln(res, mergeErr.Error())
+		fmt.Fprintln(res, "Nothing was merged.")
+		return
+	}
+	for _, d := range plan.Diagnostics {
+		fmt.Fprintln(res, d.Error())
+	}
+	for _, c := range plan.Changes {
+		fmt.Fprintln(res, c)
+	}
+	fmt.Fprintln(res, plan.Unchanged, "structures unchanged.")
+
+	change := plan.change(file)
+	if confirmErr := checkConfirmToken(res, req, change); confirmErr != nil {
+		if req.FormValue("Confirm") != "" {
+			fmt.Fprintln(res, confirmErr.Error())
+		}
+		fmt.Fprintln(res, "Nothing was merged. To merge, upload the same file again with Confirm:")
+		fmt.Fprintln(res, confirmToken(res, req, change, time.Now().Add(confirmLifetime)))
+		return
+	}
+
+	if commitErr := plan.commit(NewContext(req)); commitErr != nil {
+		fmt.Fprintln(res, "Error in merging book into datastore! Nothing was merged.")
+		fmt.Fprintln(res, commitErr.Error())
+		if rb, rolledBack := commitErr.(*Rollback); rolledBack {
+			for _, change := range rb.Undone {
+				fmt.Fprintln(res, "Rolled back: "+change)
+			}
+			for _, change := range rb.Stuck {
+				fmt.Fprintln(res, "Could not roll back: "+change)
+			}
+		}
+		return
+	}
+	plan.record(res, req)
+
+	fmt.Fprintln(res, "Merged. Created structures have the ids:")
+	for _, c := range plan.Changes {
+		if c.Action == MergeCreate {
+			fmt.Fprintln(res, c)
+		}
+	}
+	fmt.Fprintln(res, "End Of File")
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"golang.org/x/net/context"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Internal Function
+// Description:
+// Exports book bookID and reads the file back, ready to edit and merge.
+func mergeTestFile(t *testing.T, ctx context.Context, bookID int64) ([]byte, *importNode) {
+	var file bytes.Buffer
+	if writeErr := writeBookExport(ctx, &file, bookID); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	book, diagnostics, parseErr := parseBookHTML(bytes.NewReader(file.Bytes()))
+	if parseErr != nil || len(diagnostics) > 0 {
+		t.Fatal(parseErr, diagnostics)
+	}
+	return file.Bytes(), book
+}
+
+// Internal Function
+// Description:
+// Lists the changes of p without their ids, which change between runs.
+func mergeSummary(p *MergePlan) []string {
+	summary := make([]string, 0)
+	for _, c := range p.Changes {
+		s := c.Action + " " + c.Kind + " " + strconv.Quote(c.Title)
+		if len(c.Fields) > 0 {
+			s += ": " + strings.Join(c.Fields, ", ")
+		}
+		summary = append(summary, s)
+	}
+	return summary
+}
+
+// Internal Function
+// Description:
+// Plans merging book into bookID and checks its changes are want.
+func planTestMerge(t *testing.T, ctx context.Context, book *importNode, bookID int64, deleteMissing bool, want ...string) *MergePlan {
+	p, planErr := planMerge(ctx, book, bookID, deleteMissing, "test@example.com")
+	if planErr != nil {
+		t.Fatal(planErr)
+	}
+	if got := mergeSummary(p); len(got) != len(want) || len(want) > 0 && !reflect.DeepEqual(got, want) {
+		t.Errorf("changes are %q, want %q", got, want)
+	}
+	if len(p.Diagnostics) > 0 {
+		t.Errorf("plan has problems: %v", p.Diagnostics)
+	}
+	return p
+}
+
+func TestMergeUnchanged(t *testing.T) {
+	ctx := setupBookTest(t)
+	bid, _ := placeTestBook(t, ctx)
+	_, book := mergeTestFile(t, ctx, bid)
+
+	if p := planTestMerge(t, ctx, book, bid, true); p.Unchanged != 7 {
+		t.Errorf("%d structures unchanged, want 7", p.Unchanged)
+	}
+}
+
+func TestMergeRetitledByID(t *testing.T) {
+	ctx := setupBookTest(t)
+	bid, _ := placeTestBook(t, ctx)
+	_, book := mergeTestFile(t, ctx, bid)
+	chapter := book.Children[1]
+	chapter.Entity.(*Chapter).Title = "Linear equations"
+
+	p := planTestMerge(t, ctx, book, bid, false, `update Chapter "Linear equations": Title`)
+	if p.Changes[0].ID != chapter.ID {
+		t.Errorf("updates chapter %d, want %d", p.Changes[0].ID, chapter.ID)
+	}
+	if commitErr := p.commit(ctx); commitErr != nil {
+		t.Fatal(commitErr)
+	}
+	stored := &Chapter{}
+	if getErr := GetFromDatastore(ctx, chapter.ID, stored); getErr != nil || stored.Title != "Linear equations" {
+		t.Errorf("stored chapter is %+v, %v", stored, getErr)
+	}
+	if chapters, _ := getOrderedChildren(ctx, bid, "Chapter"); len(chapters) != 2 {
+		t.Errorf("book has %d chapters, want 2", len(chapters))
+	}
+
+	// Without its id, the chapter is matched by title and no longer found.
+	_, book = mergeTestFile(t, ctx, bid)
+	book.Children[1].ID = 0
+	book.Children[1].Entity.(*Chapter).Title = "Equations"
+	planTestMerge(t, ctx, book, bid, false,
+		`create Chapter "Equations"`, `create Section "Linear"`, `create Objective "Solving"`, `create Exercise "Solve"`, `create Exercise ""`,
+		`keep Chapter "Linear equations"`)
+}
+
+func TestMergeMovedExercise(t *testing.T) {
+	ctx := setupBookTest(t)
+	bid, _ := placeTestBook(t, ctx)
+	_, book := mergeTestFile(t, ctx, bid)
+	objective := book.Children[1].Children[0].Children[0]
+	first, second := objective.Children[0], objective.Children[1]
+	objective.Children = []*importNode{second, first}
+	first.Entity.(*Exercise).Order, second.Entity.(*Exercise).Order = 2, 1
+
+	p := planTestMerge(t, ctx, book, bid, false, `update Exercise "": Order`, `update Exercise "Solve": Order`)
+	if p.Changes[0].ID != second.ID || p.Changes[1].ID != first.ID {
+		t.Errorf("updates exercises %d and %d, want %d and %d", p.Changes[0].ID, p.Changes[1].ID, second.ID, first.ID)
+	}
+
+	// By instruction and order alone, a moved exercise is another one.
+	first.ID, second.ID = 0, 0
+	planTestMerge(t, ctx, book, bid, false, `create Exercise ""`, `create Exercise "Solve"`, `keep Exercise "Solve"`, `keep Exercise ""`)
+
+	// Unless the file gives no order.
+	delete(first.Fields, "order")
+	delete(second.Fields, "order")
+	planTestMerge(t, ctx, book, bid, false)
+}
+
+func TestMergeNewChapter(t *testing.T) {
+	ctx := setupBookTest(t)
+	bid, _ := placeTestBook(t, ctx)
+	_, book := mergeTestFile(t, ctx, bid)
+	position := importPosition{Line: 1}
+	section := &importNode{Kind: "section", Entity: &Section{Title: "First"}, At: position, Fields: map[string]importPosition{"title": position}}
+	chapter := &importNode{Kind: "chapter", Entity: &Chapter{Title: "New", Order: 3}, At: position, Fields: map[string]importPosition{"title": position, "order": position}, Children: []*importNode{section}}
+	book.Children = append(book.Children, chapter)
+
+	p := planTestMerge(t, ctx, book, bid, false, `create Chapter "New"`, `create Section "First"`)
+	if p.Changes[1].In != "New" {
+		t.Errorf("section is planned in %q", p.Changes[1].In)
+	}
+	if commitErr := p.commit(ctx); commitErr != nil {
+		t.Fatal(commitErr)
+	}
+	newChapter, newSection := chapter.Entity.(*Chapter), section.Entity.(*Section)
+	if p.Changes[0].ID != newChapter.ID || newChapter.Parent != bid || newSection.Parent != newChapter.ID {
+		t.Errorf("chapter %d in %d, section in %d", newChapter.ID, newChapter.Parent, newSection.Parent)
+	}
+	if chapters, _ := getOrderedChildren(ctx, bid, "Chapter"); len(chapters) != 3 {
+		t.Errorf("book has %d chapters, want 3", len(chapters))
+	}
+}
+
+func TestMergeDeleteMissing(t *testing.T) {
+	ctx := setupBookTest(t)
+	bid, _ := placeTestBook(t, ctx)
+	_, book := mergeTestFile(t, ctx, bid)
+	empty := book.Children[0]
+	book.Children = book.Children[1:]
+	objective := book.Children[0].Children[0].Children[0]
+	objective.Children = objective.Children[:1]
+
+	planTestMerge(t, ctx, book, bid, false, `keep Exercise ""`, `keep Chapter "Empty"`)
+	p := planTestMerge(t, ctx, book, bid, true, `delete Exercise ""`, `delete Chapter "Empty"`)
+	if commitErr := p.commit(ctx); commitErr != nil {
+		t.Fatal(commitErr)
+	}
+	if getErr := GetFromDatastore(ctx, empty.ID, &Chapter{}); getErr != ErrNoSuchEntity {
+		t.Errorf("deleted chapter gave %v", getErr)
+	}
+	if exercises, _ := getOrderedChildren(ctx, objective.ID, "Exercise"); len(exercises) != 1 {
+		t.Errorf("objective has %d exercises, want 1", len(exercises))
+	}
+	if bins, _ := Stores.Entities.GetAll(ctx, NewEntityQuery(TrashTable), nil); len(bins) != 2 {
+		t.Errorf("%d trash bins, want 2", len(bins))
+	}
+	_, book = mergeTestFile(t, ctx, bid)
+	planTestMerge(t, ctx, book, bid, true)
+}
+
+func TestMergeConfirmGoesStale(t *testing.T) {
+	ctx := setupBookTest(t)
+	u := MakeUser("Test User", "test@example.com")
+	if putErr := PlaceUserInDatastore(ctx, &u); putErr != nil {
+		t.Fatal(putErr)
+	}
+	c, s := loginForTest(t, ctx, &u)
+	bid, _ := placeTestBook(t, ctx)
+	file, _ := mergeTestFile(t, ctx, bid)
+
+	// The file renames a chapter and leaves out the empty one.
+	edit := func() *MergePlan {
+		_, book := mergeTestFile(t, ctx, bid)
+		book.Children[1].Entity.(*Chapter).Title = "Linear equations"
+		book.Children = book.Children[1:]
+		p, planErr := planMerge(ctx, book, bid, true, u.Email)
+		if planErr != nil {
+			t.Fatal(planErr)
+		}
+		return p
+	}
+	confirm := func(token string, p *MergePlan) error {
+		form := url.Values{"Confirm": {token}, CSRFFieldName: {CSRFTokenFor(s)}}
+		return checkConfirmToken(httptest.NewRecorder(), sessionRequest("POST", c, form), p.change(file))
+	}
+	preview := func(p *MergePlan) string {
+		return confirmToken(httptest.NewRecorder(), sessionRequest("GET", c, nil), p.change(file), time.Now().Add(confirmLifetime))
+	}
+
+	token := preview(edit())
+	if err := confirm(token, edit()); err != nil {
+		t.Fatalf("token for the same merge refused: %v", err)
+	}
+
+	renamed := edit().Changes[0]
+	chapter := &Chapter{}
+	if getErr := GetFromDatastore(ctx, renamed.ID, chapter); getErr != nil {
+		t.Fatal(getErr)
+	}
+	chapter.Description = "<p>Changed since the preview</p>"
+	if _, putErr := PlaceInDatastore(ctx, renamed.ID, chapter); putErr != nil {
+		t.Fatal(putErr)
+	}
+	if err := confirm(token, edit()); err != ErrConfirmMismatch {
+		t.Errorf("token after the updated chapter changed gave %v", err)
+	}
+
+	deleted := edit().Changes[1]
+	if deleted.Action != MergeDelete {
+		t.Fatalf("second change is %v", deleted)
+	}
+	sectionID, putErr := PlaceInDatastore(ctx, 0, &Section{Title: "Inside", Parent: deleted.ID})
+	if putErr != nil {
+		t.Fatal(putErr)
+	}
+	token = preview(edit())
+	// Another section in its place: as many records, but not the same.
+	if deleteErr := Stores.Entities.Delete(ctx, []EntityKey{NewEntityKey(structureTables["Section"], sectionID)}); deleteErr != nil {
+		t.Fatal(deleteErr)
+	}
+	if _, putErr := PlaceInDatastore(ctx, 0, &Section{Title: "Inside", Parent: deleted.ID}); putErr != nil {
+		t.Fatal(putErr)
+	}
+	if err := confirm(token, edit()); err != ErrConfirmMismatch {
+		t.Errorf("token after a section of the deleted chapter was replaced gave %v", err)
+	}
+}
@@ -1,60 +1,669 @@
 package main
 
 /*
-filename.go by Allen J. Mills
+PARSE_BookParser.go by Allen J. Mills
     mm.d.yy
 
-    Description
+    Imports and exports whole books as HTML. A book file marks each
+    structure with an empty <i> element, followed by a <div> for each
+    of its fields:
+        <i book=""></i>
+        <div book-title="">Algebra</div>
+        <i chapter=""></i>
+        <div chapter-title="">Equations</div>
+    Structures nest in the order book, chapter, section, objective,
+    exercise; each belongs to the last structure of the kind above it.
+
+    The importer reads the file with an HTML tokenizer, so fields may
+    span lines, hold nested markup, and carry other attributes in any
+    order. The whole file is read into a tree before anything is
+    stored, and the tree is stored all together or not at all.
+
+    Files are versioned by <meta name="textbook-format" content="2">.
+    Format 2, which the exporter writes, carries every field of every
+    structure, and of the catalog the book is in, as escaped text kept
+    exactly as written, so exporting and importing a book reproduces it.
+    Files without the meta tag are format 1: runs of white space in text
+    fields are made one space, and HTML fields are the markup inside
+    their div.
 */
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/datastore"
+	"golang.org/x/net/context"
+	"golang.org/x/net/html"
 	"html/template"
-	"mime/multipart"
+	"io"
 	"net/http"
-	"regexp"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 )
 
-var (
-	// This regex will select on html structures exactly:
-	// Begun with <div or <i,
-	//  followed by a space with any (book/chapter/section/objective/exercise)
-	//  eventually closed with >.
-	//  Then eventually, it must finish with a closing div or i tag and a newline
-	// Example: https://regex101.com/r/hY2nK8/2
-	re = regexp.MustCompile(`<(div|i) (book|chapter|section|objective|exercise).*>.*<\/(div|i)>\n`)
+// The structure kinds of a book file, outermost first. A file may also
+// give the catalog of the book, before the book.
+var importLevels = []string{"book", "chapter", "section", "objective", "exercise"}
+
+const (
+	importFormatMeta = "textbook-format" // Name of the <meta> tag giving the format of a file
+	importFormat     = 2                 // The format the exporter writes, and the newest read
 )
 
+// The fields each structure may set, by Go field name. A field div is
+// named by kind and field in lower case, such as objective-keytakeaways.
+// Every structure may also give the id it was exported with, as book-id,
+// which is only used when merging into an existing book.
+var importFields = map[string][]string{
+	"catalog":   {"Title", "Version", "Company", "Description"},
+	"book":      {"Title", "Version", "Author", "Tags", "Description", "Visibility"},
+	"chapter":   {"Title", "Version", "Order", "Description"},
+	"section":   {"Title", "Version", "Order", "Description"},
+	"objective": {"Title", "Version", "Order", "Author", "Content", "KeyTakeaways"},
+	"exercise":  {"Instruction", "Order", "Question", "Solution", "Answer"},
+}
+
 /////---------------------------------
-// Importer: Helpers
+// Importer: Book Tree
 ////
 
-func getAllLinesFromFile(mpf multipart.File) ([]string, error) {
-	readLength := 1000
-	readStream := make([]byte, readLength)
-	retnData := ""
-	for {
-		bytesRead, readErr := mpf.Read(readStream)
-		retnData += fmt.Sprintf("%s", readStream[:bytesRead])
+// Type: importNode
+// One structure read from a book file, with the structures inside it.
+type importNode struct {
+	Kind     string // One of importLevels
+	Entity   Entity
+	ID       int64 // The <kind>-id the file gives, 0 if none
+	At       importPosition
+	Fields   map[string]importPosition // Where each field was set
+	Children []*importNode
+	Catalog  *importNode // The <i catalog> before a book, nil if none
+}
+
+// Type: ImportDiagnostic
+// A problem found in a book file, and where. Files with any error are not imported;
+// warnings are reported but do not stop an import. File names the file of a
+// Markdown tree it is in, or the part of a Word document, and Line is 0 for a
+// problem with a whole folder or any problem in a Word document.
+type ImportDiagnostic struct {
+	File         string `json:",omitempty"`
+	Line, Column int
+	Severity     string // ImportError or ImportWarning
+	Message      string
+	Expected     string `json:",omitempty"`
+	Found        string `json:",omitempty"`
+}
+
+const (
+	ImportError   = "error"
+	ImportWarning = "warning"
+)
+
+func (d ImportDiagnostic) Error() string {
+	msg := fmt.Sprint("Line ", d.Line, ", column ", d.Column, ": ", d.Severity, ": ", d.Message)
+	if d.Line == 0 {
+		msg = d.Severity + ": " + d.Message
+	}
+	if d.File != "" {
+		msg = d.File + ": " + msg
+	}
+	switch {
+	case d.Expected != "" && d.Found != "":
+		msg += " (expected " + d.Expected + ", found " + d.Found + ")"
+	case d.Found != "":
+		msg += " (found " + d.Found + ")"
+	}
+	return msg
+}
+
+// Type: importPosition
+// Line and column of the next byte the tokenizer reads, and the file of a
+// Markdown tree it is in.
+type importPosition struct {
+	Line, Column int
+	File         string
+}
+
+// Method: String
+// Where p is, as a diagnostic names a place.
+func (p importPosition) String() string {
+	if p.File != "" {
+		return "in " + p.File
+	}
+	return fmt.Sprint("on line ", p.Line)
+}
+
+// Method: advance
+// Moves past raw.
+func (p *importPosition) advance(raw []byte) {
+	for _, r := range string(raw) {
+		if r == '\r' {
+			continue
+		}
+		if r == '\n' {
+			p.Line++
+			p.Column = 1
+			continue
+		}
+		p.Column++
+	}
+}
+
+// Internal Function
+// Description:
+// Makes an empty entity for a kind of importLevels, or the catalog.
+func newImportEntity(kind string) Entity {
+	switch kind {
+	case "catalog":
+		return &Catalog{}
+	case "book":
+		return &Book{}
+	case "chapter":
+		return &Chapter{}
+	case "section":
+		return &Section{}
+	case "objective":
+		return &Objective{}
+	case "exercise":
+		return &Exercise{}
+	}
+	return nil
+}
+
+// Internal Function
+// Description:
+// Reads the attributes of the current tag. Names are lower case.
+func importAttributes(z *html.Tokenizer) []string {
+	names := make([]string, 0)
+	for more := true; more; {
+		var name []byte
+		name, _, more = z.TagAttr()
+		names = append(names, string(name))
+	}
+	return names
+}
 
-		if bytesRead == 0 {
-			break
+// Internal Function
+// Description:
+// Reads the attributes of the current tag with their values. Names are lower case.
+func importAttributeValues(z *html.Tokenizer) map[string]string {
+	values := make(map[string]string)
+	for more := true; more; {
+		var name, value []byte
+		name, value, more = z.TagAttr()
+		values[string(name)] = string(value)
+	}
+	return values
+}
+
+// Internal Function
+// Description:
+// Reports whether attributes holds name.
+func hasImportAttribute(attributes []string, name string) bool {
+	for _, a := range attributes {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Internal Function
+// Description:
+// Finds the structure an <i> tag marks, from attributes such as book="".
+//
+// Returns:
+//      level(int) - Index into importLevels, -1 if the tag marks none.
+func importLevel(attributes []string) int {
+	for _, a := range attributes {
+		for level, kind := range importLevels {
+			if a == kind {
+				return level
+			}
+		}
+	}
+	return -1
+}
+
+// Internal Function
+// Description:
+// Finds the field a <div> tag holds, from attributes such as book-title="".
+//
+// Returns:
+//      kind(string) - Structure kind, empty if the tag holds no field.
+//      field(string) - The lower case field name as written.
+func importFieldOf(attributes []string) (string, string) {
+	for _, a := range attributes {
+		if dash := strings.Index(a, "-"); dash > 0 && newImportEntity(a[:dash]) != nil {
+			return a[:dash], a[dash+1:]
+		}
+	}
+	return "", ""
+}
+
+// Internal Function
+// Description:
+// Reads the inside of a <div> whose start tag was just read, up to its end tag.
+//
+// Returns:
+//      text(string) - Its text, unescaped, exactly as written.
+//      markup(string) - Its inner HTML as written.
+//      failure?(error) - ErrorToken errors; io.ErrUnexpectedEOF if never closed.
+func readImportField(z *html.Tokenizer, pos *importPosition) (string, string, error) {
+	var text, markup bytes.Buffer
+	for depth := 1; ; {
+		tt := z.Next()
+		raw := z.Raw()
+		pos.advance(raw)
+		switch tt {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return "", "", io.ErrUnexpectedEOF
+			}
+			return "", "", z.Err()
+		case html.TextToken:
+			markup.Write(raw)
+			text.Write(z.Text())
+			continue
+		case html.StartTagToken:
+			markup.Write(raw)
+			if name, _ := z.TagName(); string(name) == "div" {
+				depth++
+			}
+			continue
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "div" {
+				if depth--; depth == 0 {
+					return text.String(), markup.String(), nil
+				}
+			}
+		}
+		markup.Write(raw)
+	}
+}
+
+// Internal Function
+// Description:
+// Sets the field of e named, in lower case, field. HTML fields take the
+// markup; text and number fields take the text.
+//
+// Returns:
+//      problem(*ImportDiagnostic) - Without a position, if the field is unknown
+//          or its number will not parse. nil when the field was set.
+func setImportField(e Entity, kind, field, text, markup string) *ImportDiagnostic {
+	known := make([]string, 0, len(importFields[kind]))
+	for _, name := range importFields[kind] {
+		known = append(known, kind+"-"+strings.ToLower(name))
+		if strings.ToLower(name) != field {
+			continue
+		}
+		v := reflect.ValueOf(e).Elem().FieldByName(name)
+		switch v.Interface().(type) {
+		case template.HTML:
+			v.Set(reflect.ValueOf(template.HTML(markup)))
+		case string:
+			v.SetString(text)
+		case float64:
+			text = strings.TrimSpace(text)
+			f, parseErr := strconv.ParseFloat(text, 64)
+			if text != "" && parseErr != nil {
+				return &ImportDiagnostic{Severity: ImportError, Message: kind + "-" + field + " is not a number", Expected: "a number", Found: strconv.Quote(text)}
+			}
+			v.SetFloat(f)
+		case int:
+			text = strings.TrimSpace(text)
+			i, parseErr := strconv.Atoi(text)
+			if text != "" && parseErr != nil {
+				return &ImportDiagnostic{Severity: ImportError, Message: kind + "-" + field + " is not a whole number", Expected: "a whole number", Found: strconv.Quote(text)}
+			}
+			v.SetInt(int64(i))
+		}
+		return nil
+	}
+	return &ImportDiagnostic{Severity: ImportError, Message: kind + "-" + field + " is not a " + kind + " field", Expected: strings.Join(known, ", "), Found: kind + "-" + field}
+}
+
+// Type: bookParser
+// The state of parseBookHTML while it reads a file.
+type bookParser struct {
+	z           *html.Tokenizer
+	pos         importPosition
+	format      int // 1 until a <meta> tag gives another
+	catalog     *importNode
+	book        *importNode
+	open        []*importNode // The structure last begun at each level, nil where there is none
+	diagnostics []ImportDiagnostic
+}
+
+// Method: report
+// Adds a diagnostic at at.
+func (p *bookParser) report(at importPosition, d ImportDiagnostic) {
+	d.File, d.Line, d.Column = at.File, at.Line, at.Column
+	p.diagnostics = append(p.diagnostics, d)
+}
+
+// Method: begin
+// Starts a structure at level, marked by an <i> tag at at. A structure
+// that is out of place is reported and read, but kept out of the book.
+func (p *bookParser) begin(at importPosition, level int) {
+	kind := importLevels[level]
+	n := &importNode{Kind: kind, Entity: newImportEntity(kind), At: at, Fields: make(map[string]importPosition), Children: make([]*importNode, 0)}
+	switch {
+	case level == 0 && p.book != nil:
+		p.report(at, ImportDiagnostic{Severity: ImportError, Message: "A file holds one book, this is a second", Expected: "one <i book>", Found: "another <i book>"})
+	case level == 0:
+		p.book = n
+	case p.open[level-1] == nil:
+		p.report(at, ImportDiagnostic{Severity: ImportError, Message: "<i " + kind + "> must come inside a " + importLevels[level-1], Expected: "<i " + importLevels[level-1] + ">", Found: "<i " + kind + ">"})
+	default:
+		p.open[level-1].Children = append(p.open[level-1].Children, n)
+	}
+	p.open[level] = n
+	for l := level + 1; l < len(p.open); l++ {
+		p.open[l] = nil
+	}
+}
+
+// Method: beginCatalog
+// Starts the catalog, marked by an <i catalog> tag at at. It must come before the book.
+func (p *bookParser) beginCatalog(at importPosition) {
+	n := &importNode{Kind: "catalog", Entity: newImportEntity("catalog"), At: at, Fields: make(map[string]importPosition), Children: make([]*importNode, 0)}
+	switch {
+	case p.catalog != nil:
+		p.report(at, ImportDiagnostic{Severity: ImportError, Message: "A file holds one catalog, this is a second", Expected: "one <i catalog>", Found: "another <i catalog>"})
+	case p.book != nil:
+		p.report(at, ImportDiagnostic{Severity: ImportError, Message: "<i catalog> must come before the book", Expected: "<i catalog> before <i book>", Found: "<i catalog> after it"})
+	default:
+		p.catalog = n
+	}
+}
+
+// Method: setFormat
+// Reads the format a <meta> tag at at gives. It must come before any structure.
+func (p *bookParser) setFormat(at importPosition, content string) {
+	format, parseErr := strconv.Atoi(strings.TrimSpace(content))
+	switch {
+	case parseErr != nil || format < 1 || format > importFormat:
+		p.report(at, ImportDiagnostic{Severity: ImportError, Message: "The file is in a format this importer cannot read", Expected: fmt.Sprint("a format from 1 to ", importFormat), Found: strconv.Quote(content)})
+	case p.catalog != nil || p.book != nil:
+		p.report(at, ImportDiagnostic{Severity: ImportError, Message: "<meta name=\"" + importFormatMeta + "\"> must come before the structures", Expected: "the format first", Found: "structures before it"})
+	default:
+		p.format = format
+	}
+}
+
+// Method: current
+// The structure begun last, or the catalog before the book. nil before the first.
+func (p *bookParser) current() *importNode {
+	for l := len(p.open) - 1; l >= 0; l-- {
+		if p.open[l] != nil {
+			return p.open[l]
+		}
+	}
+	if p.book == nil {
+		return p.catalog
+	}
+	return nil
+}
+
+// Method: field
+// Reads a field <div> at at, whose start tag was just read.
+// selfClosing is true for <div book-title/>, which holds nothing.
+func (p *bookParser) field(at importPosition, kind, field string, selfClosing bool) error {
+	tag := "<div " + kind + "-" + field + ">"
+	text, markup := "", ""
+	if !selfClosing {
+		var readErr error
+		if text, markup, readErr = readImportField(p.z, &p.pos); readErr == io.ErrUnexpectedEOF {
+			p.report(at, ImportDiagnostic{Severity: ImportError, Message: tag + " is never closed", Expected: "</div>", Found: "end of file"})
+			return nil
 		} else if readErr != nil {
-			return make([]string, 0), readErr
+			return readErr
 		}
 	}
-	return re.FindAllString(retnData, -1), nil
+	if p.format < 2 {
+		text, markup = strings.Join(strings.Fields(text), " "), strings.TrimSpace(markup)
+	} else {
+		markup = text
+	}
+
+	n := p.current()
+	if n == nil || n.Kind != kind {
+		found := "the start of the file"
+		if n != nil {
+			found = "<i " + n.Kind + ">"
+		}
+		p.report(at, ImportDiagnostic{Severity: ImportError, Message: tag + " must follow <i " + kind + "> and its other fields", Expected: "<i " + kind + ">", Found: found})
+		return nil
+	}
+	if field == "id" {
+		text = strings.TrimSpace(text)
+		id, parseErr := strconv.ParseInt(text, 10, 64)
+		if text != "" && (parseErr != nil || id <= 0) {
+			p.report(at, ImportDiagnostic{Severity: ImportError, Message: kind + "-id is not an id", Expected: "a positive whole number", Found: strconv.Quote(text)})
+			return nil
+		}
+		n.ID = id
+	} else if problem := setImportField(n.Entity, kind, field, text, markup); problem != nil {
+		p.report(at, *problem)
+		return nil
+	}
+	if b, isBook := n.Entity.(*Book); isBook && field == "visibility" && b.Visibility != "" {
+		if _, visErr := ParseVisibility(b.Visibility); visErr != nil {
+			p.report(at, ImportDiagnostic{Severity: ImportError, Message: "book-visibility is not a visibility", Expected: VisibilityPublic + ", " + VisibilityUnlisted + " or " + VisibilityPrivate, Found: strconv.Quote(b.Visibility)})
+			return nil
+		}
+	}
+	if first, set := n.Fields[field]; set {
+		p.report(at, ImportDiagnostic{Severity: ImportWarning, Message: fmt.Sprint(tag, " replaces the one on line ", first.Line), Expected: "one " + tag, Found: "two"})
+	}
+	n.Fields[field] = at
+	return nil
 }
 
-func breakCommand(s string) (string, string) {
-	prefixLim := strings.Index(s, ">")
-	suffixLim := strings.LastIndex(s, "<")
-	return s[prefixLim+1 : suffixLim], s[:prefixLim+1]
+// Method: unknownAttributes
+// Warns of attributes of a structure or field tag at at that mean nothing to the importer.
+func (p *bookParser) unknownAttributes(at importPosition, tag string, attributes []string, marker string) {
+	for _, a := range attributes {
+		switch a {
+		case marker, "id", "class", "style", "":
+			continue
+		}
+		p.report(at, ImportDiagnostic{Severity: ImportWarning, Message: "Attribute " + a + " of <" + tag + " " + marker + "> is ignored", Found: a})
+	}
+}
+
+// Internal Function
+// Description:
+// Warns of structures inside n that share an order, through report.
+func checkImportOrders(n *importNode, report func(importPosition, ImportDiagnostic)) {
+	used := make(map[int64]*importNode)
+	for _, c := range n.Children {
+		if at, set := c.Fields["order"]; set {
+			order := reflect.ValueOf(c.Entity).Elem().FieldByName("Order").Int()
+			if other, taken := used[order]; taken {
+				report(at, ImportDiagnostic{Severity: ImportWarning, Message: fmt.Sprint(c.Kind, "-order ", order, " is also used by the ", other.Kind, " ", other.At), Expected: "a different order", Found: fmt.Sprint(order)})
+			} else {
+				used[order] = c
+			}
+		}
+		checkImportOrders(c, report)
+	}
+}
+
+// Internal Function
+// Description:
+// Reads a book file into a tree, checking all of it. Markup other than
+// the structure <i> tags and field <div> tags is ignored.
+//
+// Returns:
+//      book(*importNode) - The book, with everything inside it. nil if there is none.
+//      diagnostics([]ImportDiagnostic) - Every problem found, in file order.
+//      failure?(error) - Any read error.
+func parseBookHTML(r io.Reader) (*importNode, []ImportDiagnostic, error) {
+	p := &bookParser{z: html.NewTokenizer(r), pos: importPosition{Line: 1, Column: 1}, format: 1, open: make([]*importNode, len(importLevels)), diagnostics: make([]ImportDiagnostic, 0)}
+
+	for {
+		at := p.pos
+		tt := p.z.Next()
+		p.pos.advance(p.z.Raw())
+
+		if tt == html.ErrorToken {
+			if p.z.Err() != io.EOF {
+				return nil, p.diagnostics, p.z.Err()
+			}
+			if p.book == nil {
+				p.report(at, ImportDiagnostic{Severity: ImportError, Message: "The file has no book", Expected: "<i book>", Found: "end of file"})
+			} else {
+				p.book.Catalog = p.catalog
+				checkImportOrders(p.book, p.report)
+			}
+			sortImportDiagnostics(p.diagnostics)
+			return p.book, p.diagnostics, nil
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+
+		name, hasAttributes := p.z.TagName()
+		if !hasAttributes {
+			continue
+		}
+		tag := string(name)
+		if tag == "meta" {
+			if values := importAttributeValues(p.z); values["name"] == importFormatMeta {
+				p.setFormat(at, values["content"])
+			}
+			continue
+		}
+		attributes := importAttributes(p.z)
+
+		switch kind, field := importFieldOf(attributes); {
+		case tag == "i" && hasImportAttribute(attributes, "catalog"):
+			p.unknownAttributes(at, tag, attributes, "catalog")
+			p.beginCatalog(at)
+		case tag == "i" && importLevel(attributes) >= 0:
+			level := importLevel(attributes)
+			p.unknownAttributes(at, tag, attributes, importLevels[level])
+			p.begin(at, level)
+		case tag == "i":
+			p.report(at, ImportDiagnostic{Severity: ImportWarning, Message: "<i> tag with attributes marks no structure and is ignored", Expected: "<i catalog>, <i " + strings.Join(importLevels, ">, <i ") + ">", Found: "<i " + strings.Join(attributes, " ") + ">"})
+		case tag == "div" && kind != "":
+			p.unknownAttributes(at, tag, attributes, kind+"-"+field)
+			if readErr := p.field(at, kind, field, tt == html.SelfClosingTagToken); readErr != nil {
+				return nil, p.diagnostics, readErr
+			}
+		}
+	}
+}
+
+// Internal Function
+// Description:
+// Finds the errors among diagnostics.
+//
+// Returns:
+//      failed(bool) - True if any diagnostic is an ImportError.
+func importFailed(diagnostics []ImportDiagnostic) bool {
+	for _, d := range diagnostics {
+		if d.Severity == ImportError {
+			return true
+		}
+	}
+	return false
+}
+
+// Internal Function
+// Description:
+// Stages n and everything inside it into batch. parent points at the id
+// of the structure n goes in, which is known once that is placed.
+func stageImportNode(batch *Batch, n *importNode, parent *int64) {
+	v := reflect.ValueOf(n.Entity).Elem()
+	id := v.FieldByName("ID").Addr().Interface().(*int64)
+	p := v.FieldByName("Parent").Addr().Interface().(*int64)
+
+	batch.Place(id, n.Entity, func() { *p = *parent })
+	for _, c := range n.Children {
+		stageImportNode(batch, c, id)
+	}
+}
+
+// Method: describe
+// Adds a line for n and each structure inside it to d, indented by depth.
+func (n *importNode) describe(d *debugger, depth int) {
+	v := reflect.ValueOf(n.Entity).Elem()
+	name := v.FieldByName("Title")
+	if !name.IsValid() {
+		name = v.FieldByName("Instruction")
+	}
+	d.add(fmt.Sprint(strings.Repeat("    ", depth), strings.Title(n.Kind), " ", v.FieldByName("ID").Int(), ": ", name.String()))
+	for _, c := range n.Children {
+		c.describe(d, depth+1)
+	}
+}
+
+// Method: record
+// Adds the creation of n and everything inside it to the audit log, for the user of req.
+func (n *importNode) record(res http.ResponseWriter, req *http.Request) {
+	id := reflect.ValueOf(n.Entity).Elem().FieldByName("ID").Int()
+	RecordAudit(res, req, AuditCreate, strings.Title(n.Kind), id, nil, n.Entity)
+	for _, c := range n.Children {
+		c.record(res, req)
+	}
+}
+
+// Internal Function
+// Description:
+// Stores book, read by parseBookHTML, into catalog catalogID, all or nothing.
+// A zero catalogID makes a new catalog from the one the file gives. The
+// images of bundle, if it is not nil, are stored along with the book.
+// A book the file gives no visibility starts with the configured one,
+// as a book made through the API does.
+//
+// Returns:
+//      report([]string) - The structures stored with their new ids, or what was rolled back.
+//      imported(bool) - False if nothing was stored.
+func importBook(ctx context.Context, book *importNode, catalogID int64, bundle *bookBundle) ([]string, bool) {
+	report := newDebugger()
+	if b := book.Entity.(*Book); b.Visibility == "" {
+		b.Visibility = Settings.Books.DefaultVisibility
+	}
+	batch := NewBatch()
+	var catalog *Catalog
+	if catalogID == 0 && book.Catalog != nil {
+		catalog = book.Catalog.Entity.(*Catalog)
+		batch.Place(&catalog.ID, catalog, nil)
+		stageImportNode(batch, book, &catalog.ID)
+	} else {
+		stageImportNode(batch, book, &catalogID)
+	}
+	structures, images := batch.Len(), 0
+	if bundle != nil && bundle.Images != nil {
+		images = stageBundleImages(batch, book, bundle)
+	}
+
+	if commitErr := batch.Commit(ctx); commitErr != nil {
+		report.add("Error in placing book into datastore! Nothing was imported.")
+		report.add(commitErr.Error())
+		if rb, rolledBack := commitErr.(*Rollback); rolledBack {
+			for _, change := range rb.Undone {
+				report.add("Rolled back: " + change)
+			}
+			for _, change := range rb.Stuck {
+				report.add("Could not roll back: " + change)
+			}
+		}
+		return report.data, false
+	}
+	report.add(fmt.Sprint("Imported ", structures, " structures"))
+	if images > 0 {
+		report.add(fmt.Sprint("Stored ", images, " images"))
+	}
+	if catalog != nil {
+		report.add(fmt.Sprint("Catalog ", catalog.ID, ": ", catalog.Title))
+	}
+	book.describe(&report, 0)
+	return report.data, true
 }
 
 //// -----------------
@@ -62,12 +671,25 @@ func breakCommand(s string) (string, string) {
 ////
 
 func PARSE_GET_FileUploader(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if validPerm, permErr := HasPermission(res, req, Settings.Permissions.APIMake, ScopeOf("Catalog", req.FormValue("catalogkey"))); !validPerm {
+		// User Must be at least Writer.
+		ErrorPage(res, "Invalid Permission", permErr)
+		return
+	}
+	pu, _ := GetUserFromSession(res, req)
+
 	page := `
         <html>
         <body>
         <form id="" method="POST" enctype="multipart/form-data">
+            <input type="hidden" name="` + CSRFFieldName + `" value="` + pu.CSRFToken + `" />
             <input type="file" name="upload" />
-            <input name="catalogkey" placeholder="Catalog ID" />
+            <input name="catalogkey" placeholder="Catalog ID, empty for a new one" value="` + template.HTMLEscapeString(req.FormValue("catalogkey")) + `" />
+            <label><input type="checkbox" name="validate" value="true" /> Check only, import nothing</label>
+            <br />
+            <input name="BookID" placeholder="Merge into Book ID" value="` + template.HTMLEscapeString(req.FormValue("BookID")) + `" />
+            <label><input type="checkbox" name="DeleteMissing" value="true" /> Delete what the file does not have</label>
+            <input name="Confirm" placeholder="Confirm" />
             <input type="submit">
         </form>
         </body>
@@ -77,6 +699,17 @@ func PARSE_GET_FileUploader(res http.ResponseWriter, req *http.Request, params h
 }
 
 func PARSE_POST_FileUploader(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	limitUpload(res, req)
+	if req.FormValue("BookID") != "" {
+		printUploadedMerge(res, req)
+		return
+	}
+	if validPerm, permErr := HasPermission(res, req, Settings.Permissions.APIMake, ScopeOf("Catalog", req.FormValue("catalogkey"))); !validPerm {
+		// User Must be at least Writer.
+		ErrorPage(res, "Invalid Permission", permErr)
+		return
+	}
+
 	multipartFile, multipartHeader, fileError := req.FormFile("upload") // pull uploaded image.
 	if fileError != nil {                                               // handle error in a stable way, this will be a part of another page.
 		fmt.Fprint(res, fileError.Error())
@@ -84,32 +717,100 @@ func PARSE_POST_FileUploader(res http.ResponseWriter, req *http.Request, params
 	}
 	defer multipartFile.Close()
 
-	catalogKey, convErr := strconv.ParseInt(req.FormValue("catalogkey"), 10, 64)
-	HandleError(res, convErr)
+	var catalogKey int64
+	if req.FormValue("catalogkey") != "" {
+		var convErr error
+		catalogKey, convErr = strconv.ParseInt(req.FormValue("catalogkey"), 10, 64)
+		HandleError(res, convErr)
+	}
 
 	contentType := multipartHeader.Header.Get("Content-Type")
 	filename := multipartHeader.Filename
-	filedata, _ := getAllLinesFromFile(multipartFile)
 
 	fmt.Fprint(res, "<html><plaintext>")
 	fmt.Fprintln(res, filename)
 	fmt.Fprintln(res, contentType)
 
-	if catalogKey == int64(0) {
-		fmt.Fprintln(res, "Cannot use zero catalogKey")
+	// Todo: Verify good key?
+
+	book, bundle, diagnostics, parseErr := parseBookUpload(multipartFile)
+	if parseErr != nil {
+		fmt.Fprintln(res, parseErr.Error())
+		fmt.Fprintln(res, "Nothing was imported.")
+		return
+	}
+	if catalogKey == int64(0) && (book == nil || book.Catalog == nil) && req.FormValue("validate") == "" {
+		fmt.Fprintln(res, "Cannot use zero catalogKey, the file gives no catalog")
 		fmt.Fprintln(res, "Input: ", req.FormValue("catalogkey"))
 		return
 	}
-	// Todo: Verify good key?
-	fmt.Fprintln(res, "Running State Machine")
-
-	for _, v := range runParserStateMachine(filedata, req, catalogKey) {
+	for _, d := range diagnostics {
+		fmt.Fprintln(res, d.Error())
+	}
+	if req.FormValue("validate") != "" {
+		fmt.Fprintln(res, len(diagnostics), "problems found. Checked only, nothing was imported.")
+		return
+	}
+	if importFailed(diagnostics) {
+		fmt.Fprintln(res, "Nothing was imported.")
+		return
+	}
+	report, imported := importBook(NewContext(req), book, catalogKey, bundle)
+	for _, v := range report {
 		fmt.Fprintln(res, v)
 	}
+	if imported {
+		if catalogKey == int64(0) && book.Catalog != nil {
+			catalog := book.Catalog.Entity.(*Catalog)
+			RecordAudit(res, req, AuditCreate, "Catalog", catalog.ID, nil, catalog)
+		}
+		book.record(res, req)
+	}
 
 	fmt.Fprintln(res, "End Of File")
 }
 
+// Call: /import/book/validate
+// Description:
+// This call checks a book file for import without storing anything.
+// upload is the file, as for /import/book. Valid is false when any
+// Diagnostics has Severity "error"; warnings do not stop an import.
+//
+// Method: POST
+// Results: JSON
+// Mandatory Options: upload
+// Optional Options: catalogkey
+// Codes:
+//      0 - Success, the file was checked
+//    400 - Failure, No file was uploaded
+//    418 - Failure, Authorization error
+//    500 - Failure, The file could not be read
+func PARSE_POST_ValidateBook(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	limitUpload(res, req)
+	if validPerm, permErr := HasPermission(res, req, Settings.Permissions.APIMake, ScopeOf("Catalog", req.FormValue("catalogkey"))); !validPerm {
+		// User Must be at least Writer.
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Invalid Authorization: " + permErr.Error(), Code: 418}, nil)
+		return
+	}
+
+	multipartFile, _, fileError := req.FormFile("upload")
+	if fileError != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: fileError.Error(), Code: 400}, nil)
+		return
+	}
+	defer multipartFile.Close()
+
+	_, _, diagnostics, parseErr := parseBookUpload(multipartFile)
+	if parseErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: parseErr.Error(), Code: 500}, nil)
+		return
+	}
+	ServeJsonOfStruct(res, JsonOptions{Status: "Success"}, struct {
+		Valid       bool
+		Diagnostics []ImportDiagnostic
+	}{!importFailed(diagnostics), diagnostics})
+}
+
 type debugger struct {
 	data []string
 }
@@ -121,321 +822,40 @@ func (d *debugger) add(s string) {
 	d.data = append(d.data, s)
 }
 
-// State Machine: Book Parser
-// TODO: Place Parser Def Link in here
-func runParserStateMachine(lines []string, req *http.Request, pCatalogKey int64) []string {
-	lines = append(lines, "<i END></i>")
-	commandsRan := newDebugger()
-	ctx := appengine.NewContext(req)
-	commandsRan.add(fmt.Sprint("Catalog Key:", pCatalogKey))
-	commandsRan.add("S10: FSM-Init")
-
-	// All Data:
-	pBook := Book{}
-	pChapter := Chapter{}
-	pSection := Section{}
-	pObjective := Objective{}
-	pExercise := Exercise{}
-
-	at := 0 // Ensure More data
-	if at >= len(lines) {
-		return commandsRan.data
-	}
-	data, command := breakCommand(lines[at])
-	// S10:
-	if command != `<i book="">` {
-		commandsRan.add("S10: MUST Failure.")
-		commandsRan.add(fmt.Sprint("Line[", at, "]: ", command, " ", data, " "))
-		return commandsRan.data
-	}
-	// S11:
-	commandsRan.add("S11: Create New Book")
-	pBook = Book{}
-	pBook.Parent = pCatalogKey
-S12:
-	at += 1 // Ensure More data
-	if at >= len(lines) {
-		return commandsRan.data
-	}
-	data, command = breakCommand(lines[at])
-
-	switch command {
-	default:
-		commandsRan.add("S12: IF Failure, Push Book")
-		pBK, putErr := PlaceInDatastore(ctx, pBook.ID, &pBook)
-		if putErr != nil {
-			commandsRan.add("Error in placing book into datastore!")
-			commandsRan.add(putErr.Error())
-			return commandsRan.data
-		}
-		pBook.ID = pBK.IntID()
-		commandsRan.add(fmt.Sprint(pBook))
-
-	case `<div book-title="">`:
-		commandsRan.add(fmt.Sprint("   : Book.Title=", data))
-		pBook.Title = data
-		goto S12
-	case `<div book-version="">`:
-		commandsRan.add(fmt.Sprint("   : Book.Version=", data))
-		pBook.Version, _ = strconv.ParseFloat(data, 64)
-		goto S12
-	case `<div book-author="">`:
-		commandsRan.add(fmt.Sprint("   : Book.Author=", data))
-		pBook.Author = data
-		goto S12
-	case `<div book-tags="">`:
-		commandsRan.add(fmt.Sprint("   : Book.Tags=", data))
-		pBook.Tags = data
-		goto S12
-	case `<div book-description="">`:
-		commandsRan.add(fmt.Sprint("   : Book.Description=", data))
-		pBook.Description = template.HTML(data)
-		goto S12
-	}
-	// S20:
-	if command != `<i chapter="">` {
-		commandsRan.add("S20: MUST Failure.")
-		commandsRan.add(fmt.Sprint("Line[", at, "]: ", command, " ", data, " "))
-		return commandsRan.data
-	}
-S21:
-	commandsRan.add("S21: Create New Chapter")
-	pChapter = Chapter{}
-	pChapter.Parent = pBook.ID
-S22:
-	at += 1 // Ensure More data
-	if at >= len(lines) {
-		return commandsRan.data
-	}
-	data, command = breakCommand(lines[at])
-
-	switch command {
-	default:
-		commandsRan.add("S22: IF Failure, Push Chapter")
-		pCK, putErr := PlaceInDatastore(ctx, pChapter.ID, &pChapter)
-		if putErr != nil {
-			commandsRan.add("Error in placing chapter into datastore!")
-			commandsRan.add(putErr.Error())
-			return commandsRan.data
-		}
-		pChapter.ID = pCK.IntID()
-		commandsRan.add(fmt.Sprint(pChapter))
-	case `<div chapter-title="">`:
-		commandsRan.add(fmt.Sprint("   : Chapter.Title=", data))
-		pChapter.Title = data
-		goto S22
-	case `<div chapter-version="">`:
-		commandsRan.add(fmt.Sprint("   : Chapter.Version=", data))
-		pChapter.Version, _ = strconv.ParseFloat(data, 64)
-		goto S22
-	case `<div chapter-order="">`:
-		commandsRan.add(fmt.Sprint("   : Chapter.Order=", data))
-		pChapter.Order, _ = strconv.Atoi(data)
-		goto S22
-	case `<div chapter-description="">`:
-		commandsRan.add(fmt.Sprint("   : Chapter.Description=", data))
-		pChapter.Description = template.HTML(data)
-		goto S22
-	}
-	// S30:
-	if command == `<i chapter="">` {
-		goto S21
-	}
-	// S40:
-	if command != `<i section="">` {
-		commandsRan.add("S40: MUST Failure.")
-		commandsRan.add(fmt.Sprint("Line[", at, "]: ", command, " ", data, " "))
-		return commandsRan.data
-	}
-S41:
-	commandsRan.add("S41: Create New Section")
-	pSection = Section{}
-	pSection.Parent = pChapter.ID
-S42:
-	at += 1 // Ensure More data
-	if at >= len(lines) {
-		return commandsRan.data
-	}
-	data, command = breakCommand(lines[at])
-
-	switch command {
-	default:
-		commandsRan.add("S42: IF Failure, Push Section")
-		pSK, putErr := PlaceInDatastore(ctx, pSection.ID, &pSection)
-		if putErr != nil {
-			commandsRan.add("Error in placing section into datastore!")
-			commandsRan.add(putErr.Error())
-			return commandsRan.data
-		}
-		pSection.ID = pSK.IntID()
-		commandsRan.add(fmt.Sprint(pSection))
-	case `<div section-title="">`:
-		commandsRan.add(fmt.Sprint("   : Section.Title=", data))
-		pSection.Title = data
-		goto S42
-	case `<div section-version="">`:
-		commandsRan.add(fmt.Sprint("   : Section.Version=", data))
-		pSection.Version, _ = strconv.ParseFloat(data, 64)
-		goto S42
-	case `<div section-order="">`:
-		commandsRan.add(fmt.Sprint("   : Section.Order=", data))
-		pSection.Order, _ = strconv.Atoi(data)
-		goto S42
-	case `<div section-description="">`:
-		commandsRan.add(fmt.Sprint("   : Section.Description=", data))
-		pSection.Description = template.HTML(data)
-		goto S42
-	}
-	// S50:
-	if command == `<i chapter="">` {
-		goto S21
-	}
-	// S51:
-	if command == `<i section="">` {
-		goto S41
-	}
-	// S60:
-	if command != `<i objective="">` {
-		commandsRan.add("S60: MUST Failure.")
-		commandsRan.add(fmt.Sprint("Line[", at, "]: ", command, " ", data, " "))
-		return commandsRan.data
-	}
-S61:
-	commandsRan.add("S61: Create New Objective")
-	pObjective = Objective{}
-	pObjective.Parent = pSection.ID
-S62:
-	at += 1 // Ensure More data
-	if at >= len(lines) {
-		return commandsRan.data
-	}
-	data, command = breakCommand(lines[at])
-
-	switch command {
-	default:
-		commandsRan.add("S62: IF Failure, Push Objective")
-		pOK, putErr := PlaceInDatastore(ctx, pObjective.ID, &pObjective)
-		if putErr != nil {
-			commandsRan.add("Error in placing objective into datastore!")
-			commandsRan.add(putErr.Error())
-			return commandsRan.data
-		}
-		pObjective.ID = pOK.IntID()
-		commandsRan.add(fmt.Sprint(pObjective))
-	case `<div objective-title="">`:
-		commandsRan.add(fmt.Sprint("   : Objective.Title=", data))
-		pObjective.Title = data
-		goto S62
-	case `<div objective-version="">`:
-		commandsRan.add(fmt.Sprint("   : Objective.Version=", data))
-		pObjective.Version, _ = strconv.ParseFloat(data, 64)
-		goto S62
-	case `<div objective-order="">`:
-		commandsRan.add(fmt.Sprint("   : Objective.Order=", data))
-		pObjective.Order, _ = strconv.Atoi(data)
-		goto S62
-	case `<div objective-author="">`:
-		commandsRan.add(fmt.Sprint("   : Objective.Author=", data))
-		pObjective.Author = data
-		goto S62
-	case `<div objective-content="">`:
-		commandsRan.add(fmt.Sprint("   : Objective.Content=", data))
-		pObjective.Content = template.HTML(data)
-		goto S62
-	case `<div objective-keyTakeaways="">`:
-		commandsRan.add(fmt.Sprint("   : Objective.KeyTakeaways=", data))
-		pObjective.KeyTakeaways = template.HTML(data)
-		goto S62
-	}
-	// S70:
-	if command == `<i chapter="">` {
-		goto S21
-	}
-	// S71:
-	if command == `<i section="">` {
-		goto S41
-	}
-	// S72:
-	if command == `<i objective="">` {
-		goto S61
-	}
-	// S80:
-	if command != `<i exercise="">` {
-		commandsRan.add("S80: MUST Failure.")
-		commandsRan.add(fmt.Sprint("Line[", at, "]: ", command, " ", data, " "))
-		return commandsRan.data
-	}
-S81:
-	commandsRan.add("S81: Create New Exercise")
-	pExercise = Exercise{}
-	pExercise.Parent = pObjective.ID
-S82:
-	at += 1 // Ensure More data
-	if at >= len(lines) {
-		return commandsRan.data
-	}
-	data, command = breakCommand(lines[at])
-
-	switch command {
-	default:
-		commandsRan.add("S82: IF Failure, Push Exercise")
-		pEK, putErr := PlaceInDatastore(ctx, pExercise.ID, &pExercise)
-		if putErr != nil {
-			commandsRan.add("Error in placing exercise into datastore!")
-			commandsRan.add(putErr.Error())
-			return commandsRan.data
-		}
-		pExercise.ID = pEK.IntID()
-		commandsRan.add(fmt.Sprint(pExercise))
-	case `<div exercise-instruction="">`:
-		commandsRan.add(fmt.Sprint("   : Exercise.Instruction=", data))
-		pExercise.Instruction = data
-		goto S82
-	case `<div exercise-order="">`:
-		commandsRan.add(fmt.Sprint("   : Exercise.Order=", data))
-		pExercise.Order, _ = strconv.Atoi(data)
-		goto S82
-	case `<div exercise-question="">`:
-		commandsRan.add(fmt.Sprint("   : Exercise.Question=", data))
-		pExercise.Question = template.HTML(data)
-		goto S82
-	case `<div exercise-solution="">`:
-		commandsRan.add(fmt.Sprint("   : Exercise.Solution=", data))
-		pExercise.Solution = template.HTML(data)
-		goto S82
-	}
-	// S90:
-	if command == `<i chapter="">` {
-		goto S21
-	}
-	// S91:
-	if command == `<i section="">` {
-		goto S41
-	}
-	// S92:
-	if command == `<i objective="">` {
-		goto S61
-	}
-	// S93:
-	if command == `<i exercise="">` {
-		goto S81
-	}
-	// Exit
-	return commandsRan.data
-}
-
 ////// ------------------------------
 // Exporter
 ////
 
+// Functions of the export templates. field writes a value as escaped
+// text, carriage returns included, so the importer reads it back exactly.
+// epubHref names the document of a structure in an EPUB package,
+// docxHeading gives a paragraph of the Word document its style, and
+// xmlDeclaration begins XML files, which html/template would escape.
+var exportFuncs = template.FuncMap{
+	"field": func(v interface{}) template.HTML {
+		return template.HTML(html.EscapeString(fmt.Sprint(v)))
+	},
+	"epubHref":    epubHref,
+	"docxHeading": docxHeading,
+	"xmlDeclaration": func() template.HTML {
+		return template.HTML(`<?xml version="1.0" encoding="UTF-8"?>`)
+	},
+}
+
 // Call: /export/:ID
 // Description:
-//  Book Export
+//  Book Export, in the newest format with the catalog of the book,
+//  as an EPUB 3 package when format=epub, see PARSE_BookEpub.go,
+//  as a Common Cartridge when format=imscc, see PARSE_BookCartridge.go,
+//  as a Word document when format=docx, see PARSE_BookDocx.go,
+//  as a tarball of Markdown files when format=markdown, see
+//  PARSE_BookMarkdown.go, or its exercises as Moodle XML or GIFT when format=moodle or gift,
+//  see PARSE_ExercisesMoodle.go.
 //
 // Method: GET
-// Results: HTML
+// Results: HTML, EPUB, IMSCC, DOCX, Tarball, XML, Text
 // Mandatory Options: ID
-// Optional Options:
+// Optional Options: format
 func exportBookToScreen(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
 	i, parseErr := strconv.Atoi(params.ByName("ID"))
 	HandleError(res, parseErr)
@@ -445,136 +865,137 @@ func exportBookToScreen(res http.ResponseWriter, req *http.Request, params httpr
 		return
 	}
 
-	ctx := appengine.NewContext(req)
-	parentBook, getErr := GetBookFromDatastore(ctx, int64(i))
-	HandleError(res, getErr)
+	if readErr := CheckReadable(res, req, Scope{"Book", int64(i)}); readErr != nil {
+		http.Error(res, readErr.Error(), http.StatusNotFound)
+		return
+	}
 
-	complexOutput := struct {
-		Book
-		Chapters []struct {
-			Chapter
-			Sections []struct {
-				Section
-				Objectives []struct {
-					Objective
-					Exercises []Exercise
-				}
-			}
-		}
-	}{}
-
-	GCK := Get_Child_Key_From_Parent
-	complexOutput.Book = parentBook.sanitize()
-
-	for ci, ck := range GCK(ctx, parentBook.ID, "Chapters") {
-		nextChapter := Chapter{}
-		datastore.Get(ctx, ck, &nextChapter)
-
-		cout := struct {
-			Chapter
-			Sections []struct {
-				Section
-				Objectives []struct {
-					Objective
-					Exercises []Exercise
-				}
-			}
-		}{}
-		cout.Chapter = nextChapter.sanitize()
-		complexOutput.Chapters = append(complexOutput.Chapters, cout)
-
-		for si, sk := range GCK(ctx, ck.IntID(), "Sections") {
-			nextSection := Section{}
-			datastore.Get(ctx, sk, &nextSection)
-
-			sout := struct {
-				Section
-				Objectives []struct {
-					Objective
-					Exercises []Exercise
-				}
-			}{}
-			sout.Section = nextSection.sanitize()
-			complexOutput.Chapters[ci].Sections = append(complexOutput.Chapters[ci].Sections, sout)
-
-			for oi, ok := range GCK(ctx, sk.IntID(), "Objectives") {
-				nextObjective := Objective{}
-				datastore.Get(ctx, ok, &nextObjective)
-
-				oout := struct {
-					Objective
-					Exercises []Exercise
-				}{}
-				oout.Objective = nextObjective.sanitize()
-				complexOutput.Chapters[ci].Sections[si].Objectives = append(complexOutput.Chapters[ci].Sections[si].Objectives, oout)
-
-				for _, ek := range GCK(ctx, ok.IntID(), "Exercises") {
-					nextExercise := Exercise{}
-					datastore.Get(ctx, ek, &nextExercise)
-
-					complexOutput.Chapters[ci].Sections[si].Objectives[oi].Exercises = append(complexOutput.Chapters[ci].Sections[si].Objectives[oi].Exercises, nextExercise.sanitize())
-				}
-			}
-		}
+	switch req.FormValue("format") {
+	case "", "html":
+		HandleError(res, writeBookExport(NewContext(req), res, int64(i)))
+	case "epub":
+		exportBookEpub(res, req, int64(i))
+	case "imscc":
+		exportBookCartridge(res, req, int64(i))
+	case "docx":
+		exportBookDocx(res, req, int64(i))
+	case "markdown":
+		exportBookMarkdown(res, req, int64(i))
+	case "moodle", "gift":
+		exportExerciseBank(res, req, "Book", int64(i), req.FormValue("format"))
+	default:
+		http.Error(res, "Unknown format, use html, epub, imscc, docx, markdown, moodle or gift", http.StatusBadRequest)
 	}
+}
 
-	ServeTemplateWithParams(res, "BookExport.gohtml", complexOutput)
+// Type: bookExport
+// A book with its catalog and everything inside it, each level in order.
+type bookExport struct {
+	Book
+	Catalog  Catalog
+	Format   int
+	Chapters []chapterExport
 }
 
-func (b Book) sanitize() Book {
-	return Book{
-		Title:       strings.Replace(b.Title, "\n", "", -1),
-		Version:     b.Version,
-		Author:      strings.Replace(b.Author, "\n", "", -1),
-		Tags:        strings.Replace(b.Tags, "\n", "", -1),
-		Description: template.HTML(strings.Replace(string(b.Description), "\n", "", -1)),
-		Parent:      b.Parent,
-		ID:          b.ID,
-	}
+type chapterExport struct {
+	Chapter
+	Sections []sectionExport
 }
 
-func (c Chapter) sanitize() Chapter {
-	return Chapter{
-		Title:       strings.Replace(c.Title, "\n", "", -1),
-		Version:     c.Version,
-		Order:       c.Order,
-		Description: template.HTML(strings.Replace(string(c.Description), "\n", "", -1)),
-		Parent:      c.Parent,
-		ID:          c.ID,
-	}
+type sectionExport struct {
+	Section
+	Objectives []objectiveExport
 }
 
-func (s Section) sanitize() Section {
-	return Section{
-		Title:       strings.Replace(s.Title, "\n", "", -1),
-		Version:     s.Version,
-		Order:       s.Order,
-		Description: template.HTML(strings.Replace(string(s.Description), "\n", "", -1)),
-		Parent:      s.Parent,
-		ID:          s.ID,
-	}
+type objectiveExport struct {
+	Objective
+	Exercises []Exercise
 }
 
-func (o Objective) sanitize() Objective {
-	return Objective{
-		Title:        strings.Replace(o.Title, "\n", "", -1),
-		Version:      o.Version,
-		Order:        o.Order,
-		Author:       strings.Replace(o.Author, "\n", "", -1),
-		Content:      template.HTML(strings.Replace(string(o.Content), "\n", "", -1)),
-		KeyTakeaways: template.HTML(strings.Replace(string(o.KeyTakeaways), "\n", "", -1)),
-		Parent:       o.Parent,
-		ID:           o.ID,
-	}
+// Internal Function
+// Description:
+// Gets the children of kind under parentID, ordered by their Order and
+// then by id.
+func getOrderedChildren(ctx context.Context, parentID int64, kind string) ([]Entity, error) {
+	children := make([]Entity, 0)
+	for _, k := range Get_Child_Key_From_Parent(ctx, parentID, structureTables[kind]) {
+		e := newRevisable(kind)
+		if getErr := Stores.Entities.Get(ctx, k, e); getErr != nil {
+			return nil, getErr
+		}
+		*mergeID(e) = k.IntID
+		children = append(children, e)
+	}
+	sort.SliceStable(children, func(i, j int) bool {
+		oi := reflect.ValueOf(children[i]).Elem().FieldByName("Order").Int()
+		oj := reflect.ValueOf(children[j]).Elem().FieldByName("Order").Int()
+		return oi < oj || (oi == oj && *mergeID(children[i]) < *mergeID(children[j]))
+	})
+	return children, nil
 }
 
-func (e Exercise) sanitize() Exercise {
-	return Exercise{
-		Instruction: strings.Replace(e.Instruction, "\n", "", -1),
-		Order:       e.Order,
-		Question:    template.HTML(strings.Replace(string(e.Question), "\n", "", -1)),
-		Solution:    template.HTML(strings.Replace(string(e.Solution), "\n", "", -1)),
-		Parent:      e.Parent,
-		ID:          e.ID,
+// Internal Function
+// Description:
+// Gets book bookID, with its catalog and everything inside it, for export.
+//
+// Returns:
+//      book(*bookExport) - The book, in order.
+//      failure?(error) - Any storage error.
+func loadBookExport(ctx context.Context, bookID int64) (*bookExport, error) {
+	parentBook, getErr := GetBookFromDatastore(ctx, bookID)
+	if getErr != nil {
+		return nil, getErr
+	}
+	parentCatalog, getErr := GetCatalogFromDatastore(ctx, parentBook.Parent)
+	if getErr != nil {
+		return nil, getErr
+	}
+	out := &bookExport{Book: parentBook, Catalog: parentCatalog, Format: importFormat}
+
+	chapters, getErr := getOrderedChildren(ctx, parentBook.ID, "Chapter")
+	if getErr != nil {
+		return nil, getErr
+	}
+	for _, c := range chapters {
+		cout := chapterExport{Chapter: *c.(*Chapter)}
+		sections, getErr := getOrderedChildren(ctx, cout.ID, "Section")
+		if getErr != nil {
+			return nil, getErr
+		}
+		for _, s := range sections {
+			sout := sectionExport{Section: *s.(*Section)}
+			objectives, getErr := getOrderedChildren(ctx, sout.ID, "Objective")
+			if getErr != nil {
+				return nil, getErr
+			}
+			for _, o := range objectives {
+				oout := objectiveExport{Objective: *o.(*Objective)}
+				exercises, getErr := getOrderedChildren(ctx, oout.ID, "Exercise")
+				if getErr != nil {
+					return nil, getErr
+				}
+				for _, e := range exercises {
+					oout.Exercises = append(oout.Exercises, *e.(*Exercise))
+				}
+				sout.Objectives = append(sout.Objectives, oout)
+			}
+			cout.Sections = append(cout.Sections, sout)
+		}
+		out.Chapters = append(out.Chapters, cout)
 	}
+	return out, nil
+}
+
+// Internal Function
+// Description:
+// Writes book bookID, with its catalog and everything inside it, to w in the newest format.
+//
+// Returns:
+//      failure?(error) - Any storage or template error.
+func writeBookExport(ctx context.Context, w io.Writer, bookID int64) error {
+	book, loadErr := loadBookExport(ctx, bookID)
+	if loadErr != nil {
+		return loadErr
+	}
+	return pages.ExecuteTemplate(w, "BookExport.gohtml", book)
 }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/net/context"
+	"html/template"
+	"image"
+	"image/png"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Internal Function
+// Description:
+// Starts a test with empty memory storage and the export templates.
+func setupBookTest(t *testing.T) context.Context {
+	Stores = NewMemoryBackend()
+	Settings = DefaultSettings()
+	pages = template.Must(template.New("pages").Funcs(exportFuncs).ParseGlob("templates/*.*"))
+	return context.Background()
+}
+
+// Internal Function
+// Description:
+// Zeroes every ID and Parent in v, an export or part of one, so two
+// copies of a book compare equal.
+func clearExportIDs(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		clearExportIDs(v.Elem())
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			clearExportIDs(v.Index(i))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			name := v.Type().Field(i).Name
+			if (name == "ID" || name == "Parent") && v.Field(i).Kind() == reflect.Int64 {
+				v.Field(i).SetInt(0)
+				continue
+			}
+			clearExportIDs(v.Field(i))
+		}
+	}
+}
+
+// Internal Function
+// Description:
+// Stores a book with every field filled, and the markup that is easy to
+// lose: CRLF line ends, white space in pre, nested divs, markup in answers,
+// lists, a table and a stored image.
+//
+// Returns:
+//      bookID(int64) - The stored book.
+//      imageName(string) - The name of the image its first exercise shows.
+func placeTestBook(t *testing.T, ctx context.Context) (int64, string) {
+	place := func(e Entity) int64 {
+		id, putErr := PlaceInDatastore(ctx, 0, e)
+		if putErr != nil {
+			t.Fatal(putErr)
+		}
+		return id
+	}
+	cid := place(&Catalog{Title: "Cat & <dogs>", Version: 1.25, Company: "Co\r\nInc", Description: "<p>Catalog</p>"})
+	bid := place(&Book{Title: "  Alge  \n bra ", Version: 0.1, Author: "A. Author", Tags: "t1, t2", Description: "line 1\r\nline 2\n", Visibility: VisibilityUnlisted, Parent: cid})
+	chid := place(&Chapter{Title: "Equations", Version: 2, Order: 2, Description: "<div><div>nested</div></div></div><div>", Parent: bid})
+	place(&Chapter{Title: "Empty", Order: 1, Parent: bid})
+	sid := place(&Section{Title: "Linear", Order: 1, Parent: chid,
+		Description: "<p>x</p><ol><li>one</li><li>two</li></ol><table><tbody><tr><td>a</td><td>b</td></tr><tr><td>1</td><td>2</td></tr></tbody></table>"})
+	oid := place(&Objective{Title: "Solving", Author: "me", Version: 1.5, Order: 3, Content: "<pre>\n  x = 1\r\n\ty &lt; 2\n</pre>&amp; &notit;", KeyTakeaways: "<ul><li>k</li></ul>", Parent: sid})
+
+	var picture bytes.Buffer
+	png.Encode(&picture, image.NewGray(image.Rect(0, 0, 2, 2)))
+	name := fmt.Sprint(oid, makeSHA(bytes.NewReader(picture.Bytes())), ".png")
+	if putErr := Stores.Blobs.PutBlob(ctx, name, "image/png", bytes.NewReader(picture.Bytes())); putErr != nil {
+		t.Fatal(putErr)
+	}
+	place(&Exercise{Instruction: "Solve", Question: template.HTML("<b>Q</b><p><img src=\"/image?id=" + name + "\" alt=\"graph\" /></p>"), Solution: "S\r\n", Answer: "<i>42</i>", Order: 1, Parent: oid})
+	place(&Exercise{Question: "Second", Answer: "x = 2", Order: 2, Parent: oid})
+	return bid, name
+}
+
+func TestBookExportRoundTrip(t *testing.T) {
+	ctx := setupBookTest(t)
+	bid, _ := placeTestBook(t, ctx)
+
+	var file bytes.Buffer
+	if writeErr := writeBookExport(ctx, &file, bid); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	book, diagnostics, parseErr := parseBookHTML(bytes.NewReader(file.Bytes()))
+	if parseErr != nil {
+		t.Fatal(parseErr)
+	}
+	if len(diagnostics) > 0 {
+		t.Fatalf("export of a stored book has problems: %v", diagnostics)
+	}
+	if report, imported := importBook(ctx, book, 0, nil); !imported {
+		t.Fatalf("import failed: %v", report)
+	}
+
+	want, wantErr := loadBookExport(ctx, bid)
+	got, gotErr := loadBookExport(ctx, book.Entity.(*Book).ID)
+	if wantErr != nil || gotErr != nil {
+		t.Fatal(wantErr, gotErr)
+	}
+	if got.Book.ID == want.Book.ID || got.Catalog.ID == want.Catalog.ID {
+		t.Fatalf("import reused book %d or catalog %d", got.Book.ID, got.Catalog.ID)
+	}
+	clearExportIDs(reflect.ValueOf(want))
+	clearExportIDs(reflect.ValueOf(got))
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("imported book differs\nwant %+v\n got %+v", want, got)
+	}
+
+	var again bytes.Buffer
+	if writeErr := writeBookExport(ctx, &again, book.Entity.(*Book).ID); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	if !strings.Contains(file.String(), `<div book-id="">`) {
+		t.Fatal("export has no book id")
+	}
+	if a, b := stripExportIDs(file.String()), stripExportIDs(again.String()); a != b {
+		t.Errorf("second export differs\nfirst  %s\nsecond %s", a, b)
+	}
+}
+
+// Internal Function
+// Description:
+// Removes the values of id fields from an export, which change on import.
+func stripExportIDs(s string) string {
+	var out bytes.Buffer
+	for {
+		at := strings.Index(s, `-id="">`)
+		if at < 0 {
+			out.WriteString(s)
+			return out.String()
+		}
+		out.WriteString(s[:at+len(`-id="">`)])
+		s = s[at+len(`-id="">`):]
+		s = strings.TrimLeft(s, "0123456789")
+	}
+}
+
+func TestBookImportDiagnostics(t *testing.T) {
+	setupBookTest(t)
+	const head = "<meta name=\"textbook-format\" content=\"2\">\n<i book=\"\"></i>\n<div book-title=\"\">B</div>\n"
+	cases := []struct {
+		name     string
+		file     string
+		severity string
+		line     int
+		message  string
+	}{
+		{"order not a number", head + "<i chapter=\"\"></i>\n<div chapter-title=\"\">C</div>\n<i section=\"\"></i>\n<i objective=\"\"></i>\n<i exercise=\"\"></i>\n<div exercise-order=\"\">first</div>\n",
+			ImportError, 9, "exercise-order is not a whole number"},
+		{"version not a number", head + "<div book-version=\"\">one</div>\n", ImportError, 4, "book-version is not a number"},
+		{"unknown field", head + "<div book-colour=\"\">red</div>\n", ImportError, 4, "book-colour is not a book field"},
+		{"out of place", head + "<i section=\"\"></i>\n", ImportError, 4, "<i section> must come inside a chapter"},
+		{"second book", head + "<i book=\"\"></i>\n", ImportError, 4, "A file holds one book"},
+		{"never closed", head + "<i chapter=\"\"></i>\n<div chapter-title=\"\">C\n", ImportError, 5, "is never closed"},
+		{"bad visibility", head + "<div book-visibility=\"\">secret</div>\n", ImportError, 4, "book-visibility is not a visibility"},
+		{"no book", "<p>nothing</p>\n", ImportError, 0, "The file has no book"},
+		{"same order", head + "<i chapter=\"\"></i>\n<div chapter-order=\"\">1</div>\n<i chapter=\"\"></i>\n<div chapter-order=\"\">1</div>\n", ImportWarning, 7, "chapter-order 1 is also used"},
+	}
+	for _, c := range cases {
+		_, diagnostics, parseErr := parseBookHTML(strings.NewReader(c.file))
+		if parseErr != nil {
+			t.Errorf("%s: %v", c.name, parseErr)
+			continue
+		}
+		found := false
+		for _, d := range diagnostics {
+			if d.Severity == c.severity && strings.Contains(d.Message, c.message) && (c.line == 0 || d.Line == c.line) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s: want %s on line %d containing %q, got %v", c.name, c.severity, c.line, c.message, diagnostics)
+		}
+		if failed := importFailed(diagnostics); failed != (c.severity == ImportError) {
+			t.Errorf("%s: importFailed is %v", c.name, failed)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+/*
+PARSE_ExercisesMoodle.go by Allen J. Mills
+    mm.d.yy
+
+    Exercises as Moodle question banks, in Moodle XML or GIFT.
+    Questions are put in categories named by the titles of the book,
+    chapter, section and objective their exercise is in, as
+    $course$/top/Book/Chapter/Section/Objective. An exercise with an
+    answer is a short answer question taking the answer, as text; one
+    without is an essay question. The instruction names the question,
+    and the solution is its general feedback.
+
+    Moodle XML carries images with the questions that show them. GIFT
+    cannot carry files, so its images are linked on this server.
+*/
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	moodleCategoryRoot = "$course$/top"    // The question bank categories are made in
+	moodleFiles        = "@@PLUGINFILE@@/" // Where questions refer to their own files
+)
+
+// Characters GIFT gives a meaning to, and how to write them as text.
+var giftEscaper = strings.NewReplacer(`\`, `\\`, `~`, `\~`, `=`, `\=`, `#`, `\#`, `{`, `\{`, `}`, `\}`, `:`, `\:`)
+
+// Type: moodleCategory
+// The questions of an objective, and the category they go in.
+type moodleCategory struct {
+	Path      string
+	Questions []moodleQuestion
+}
+
+// Type: moodleQuestion
+// An exercise as a Moodle question. Text and Feedback are HTML.
+type moodleQuestion struct {
+	Type, Name     string
+	Text, Feedback string
+	Answer         string // As text, empty for essay questions
+	TextFiles      []moodleFile
+	FeedbackFiles  []moodleFile
+}
+
+// Type: moodleFile
+// An image of a question, base64 encoded.
+type moodleFile struct {
+	Name, Data string
+}
+
+// Internal Function
+// Description:
+// The name of a question bank category under the course's, from the
+// titles of the structures it is for. Slashes in titles are doubled,
+// as Moodle reads a single one as the start of a sub category.
+func moodleCategoryPath(titles []string) string {
+	path := moodleCategoryRoot
+	for _, t := range titles {
+		path += "/" + strings.Replace(strings.TrimSpace(xmlCharacters(t)), "/", "//", -1)
+	}
+	return path
+}
+
+// Internal Function
+// Description:
+// The name of the question of exercise e.
+func questionName(e Exercise) string {
+	if name := strings.TrimSpace(xmlCharacters(e.Instruction)); name != "" {
+		return name
+	}
+	return fmt.Sprint("Exercise ", e.Order)
+}
+
+// Internal Function
+// Description:
+// The images of held that content refers to, to go with it.
+func moodleContentFiles(content string, held map[string][]byte) []moodleFile {
+	files := make([]moodleFile, 0)
+	seen := make(map[string]bool)
+	for _, m := range imageReference.FindAllStringSubmatch(content, -1) {
+		if name := m[1]; !seen[name] && held[name] != nil {
+			seen[name] = true
+			files = append(files, moodleFile{name, base64.StdEncoding.EncodeToString(held[name])})
+		}
+	}
+	return files
+}
+
+// Internal Function
+// Description:
+// Writes exercise groups to res as Moodle XML, with the images they
+// refer to that the reader of req may see.
+func writeMoodleXML(res http.ResponseWriter, req *http.Request, groups []exerciseGroup, name string) {
+	content := make([]string, 0)
+	for _, g := range groups {
+		for _, e := range g.Exercises {
+			content = append(content, string(e.Question), string(e.Solution))
+		}
+	}
+	held := readableImages(res, req, content)
+
+	categories := make([]moodleCategory, 0, len(groups))
+	for _, g := range groups {
+		c := moodleCategory{Path: moodleCategoryPath(g.Path)}
+		for _, e := range g.Exercises {
+			q := moodleQuestion{
+				Type:          "essay",
+				Name:          questionName(e),
+				Text:          portableXHTML(string(e.Question), held, moodleFiles),
+				Feedback:      portableXHTML(string(e.Solution), held, moodleFiles),
+				Answer:        htmlText(string(e.Answer)),
+				TextFiles:     moodleContentFiles(string(e.Question), held),
+				FeedbackFiles: moodleContentFiles(string(e.Solution), held),
+			}
+			if q.Answer != "" {
+				q.Type = "shortanswer"
+			}
+			c.Questions = append(c.Questions, q)
+		}
+		categories = append(categories, c)
+	}
+
+	serveDownload(res, "application/xml; charset=utf-8", name+".xml", func(w io.Writer) error {
+		return pages.ExecuteTemplate(w, "MoodleQuiz", categories)
+	})
+}
+
+// Internal Function
+// Description:
+// Writes HTML as text of a GIFT question. Line breaks are written as
+// character references, since a blank line ends a question.
+func giftHTML(content string) string {
+	content = strings.Replace(xmlCharacters(content), "\r\n", "\n", -1)
+	content = strings.NewReplacer("\n", "&#10;", "\r", "&#13;").Replace(content)
+	return giftEscaper.Replace(content)
+}
+
+// Internal Function
+// Description:
+// Writes exercise groups to res as GIFT. Images are linked on this
+// server, at the address req was made to, over https when cookies of
+// req would be Secure.
+func writeGIFT(res http.ResponseWriter, req *http.Request, groups []exerciseGroup, name string) {
+	scheme := "http"
+	if secureCookie(req) {
+		scheme = "https"
+	}
+	linkImages := func(content string) string {
+		return imageReference.ReplaceAllStringFunc(content, func(ref string) string {
+			return scheme + "://" + req.Host + ref
+		})
+	}
+
+	var gift bytes.Buffer
+	for _, g := range groups {
+		fmt.Fprintf(&gift, "$CATEGORY: %s\n\n", strings.Replace(moodleCategoryPath(g.Path), "\n", " ", -1))
+		for _, e := range g.Exercises {
+			fmt.Fprintf(&gift, "::%s::[html]%s{", giftEscaper.Replace(strings.Join(strings.Fields(questionName(e)), " ")), giftHTML(linkImages(string(e.Question))))
+			if answer := htmlText(string(e.Answer)); answer != "" {
+				fmt.Fprintf(&gift, "=%s", giftEscaper.Replace(answer))
+			}
+			if e.Solution != "" {
+				fmt.Fprintf(&gift, "####%s", giftHTML(linkImages(string(e.Solution))))
+			}
+			fmt.Fprint(&gift, "}\n\n")
+		}
+	}
+
+	res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	res.Header().Set("Content-Disposition", fmt.Sprint(`attachment; filename="`, name, `.txt"`))
+	res.Write(gift.Bytes())
+}
+
+// Internal Function
+// Description:
+// Writes the exercises of structure kind id, of instruction kind IKind
+// when req gives one, to res in format, moodle or gift.
+func exportExerciseBank(res http.ResponseWriter, req *http.Request, kind string, id int64, format string) {
+	groups, getErr := gatherExercises(res, req, kind, id, req.FormValue("IKind"))
+	if getErr != nil {
+		http.Error(res, getErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(groups) == 0 {
+		http.Error(res, "No exercises found", http.StatusNotFound)
+		return
+	}
+
+	name, _ := exerciseExportName(NewContext(req), kind, id)
+	if format == "gift" {
+		writeGIFT(res, req, groups, name)
+	} else {
+		writeMoodleXML(res, req, groups, name)
+	}
+}
+
+// Call: /api/exercises.xml
+// Description:
+// This call will return exercises as Moodle XML.
+// Limit results as on /api/exercises.zip.
+//
+// Method: GET
+// Results: XML
+// Mandatory Options:
+// Optional Options: BookID, ChapterID, SectionID, ObjectiveID, IKind
+// Codes:
+//      400 - More than one of the ID options, or an ID that is not a number.
+//      404 - The structure does not exist or may not be read, or there are no exercises.
+func exportExercisesMoodleXML(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if kind, id, ok := exerciseScope(res, req); ok {
+		exportExerciseBank(res, req, kind, id, "moodle")
+	}
+}
+
+// Call: /api/exercises.gift
+// Description:
+// This call will return exercises as GIFT text.
+// Limit results as on /api/exercises.zip.
+//
+// Method: GET
+// Results: Text
+// Mandatory Options:
+// Optional Options: BookID, ChapterID, SectionID, ObjectiveID, IKind
+// Codes:
+//      400 - More than one of the ID options, or an ID that is not a number.
+//      404 - The structure does not exist or may not be read, or there are no exercises.
+func exportExercisesGIFT(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if kind, id, ok := exerciseScope(res, req); ok {
+		exportExerciseBank(res, req, kind, id, "gift")
+	}
+}
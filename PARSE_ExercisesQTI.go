@@ -0,0 +1,343 @@
+package main
+
+/*
+PARSE_ExercisesQTI.go by Allen J. Mills
+    mm.d.yy
+
+    Exercises as a QTI 2.1 content package, for assessment tools.
+    /api/exercises.zip writes:
+        imsmanifest.xml             The items, the test and the images
+        test.xml                    One section per objective, in order
+        items/exercise-<id>.xml     One item per exercise
+        images/<name>               Every image the exercises refer to
+    An item's body is the exercise's instruction and question. Its
+    answer, as text, is the correct response to a text entry; exercises
+    without one take an extended text response. Its solution is the
+    feedback shown once the item is answered. Content is written as in
+    an EPUB, see PARSE_BookEpub.go. The documents are in
+    templates/ExercisesQTI.gohtml.
+*/
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/net/context"
+	"golang.org/x/net/html"
+	"html/template"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// The structures exercises may be exported from, by the option naming them.
+var exerciseScopes = []struct{ Option, Kind string }{
+	{"BookID", "Book"},
+	{"ChapterID", "Chapter"},
+	{"SectionID", "Section"},
+	{"ObjectiveID", "Objective"},
+}
+
+// Type: exerciseGroup
+// The exercises of an objective, and the titles of the book, chapter,
+// section and objective it is in.
+type exerciseGroup struct {
+	ID        int64 // Of the objective
+	Title     string
+	Path      []string
+	Exercises []Exercise
+}
+
+// Type: qtiPackage
+// Exercises grouped by objective, with the images they refer to.
+type qtiPackage struct {
+	Identifier string
+	Title      string
+	Sections   []qtiSection
+	Images     []string // Names of the images held
+
+	images map[string][]byte
+}
+
+// Type: qtiSection
+// The exercises of an objective.
+type qtiSection struct {
+	ID    int64 // Of the objective
+	Title string
+	Items []qtiItem
+}
+
+// Type: qtiItem
+// An exercise as an assessment item, its HTML ready to write.
+type qtiItem struct {
+	ID          int64
+	Title       string
+	Instruction string
+	Question    template.HTML
+	Solution    template.HTML
+	Answer      string // As text
+}
+
+// Internal Function
+// Description:
+// Gets the text of HTML content, with runs of white space made one space.
+func htmlText(content string) string {
+	var text bytes.Buffer
+	z := html.NewTokenizer(strings.NewReader(content))
+	for tt := z.Next(); tt != html.ErrorToken; tt = z.Next() {
+		if tt == html.TextToken {
+			text.Write(z.Text())
+			text.WriteByte(' ')
+		}
+	}
+	return xmlCharacters(strings.Join(strings.Fields(text.String()), " "))
+}
+
+// Internal Function
+// Description:
+// Gets the objectives of structure kind id, in order.
+func scopeObjectives(ctx context.Context, kind string, id int64) ([]*Objective, error) {
+	if kind == "Objective" {
+		o := &Objective{}
+		if getErr := GetFromDatastore(ctx, id, o); getErr != nil {
+			return nil, getErr
+		}
+		o.ID = id
+		return []*Objective{o}, nil
+	}
+
+	objectives := make([]*Objective, 0)
+	children, getErr := getOrderedChildren(ctx, id, childKinds[kind])
+	if getErr != nil {
+		return nil, getErr
+	}
+	for _, c := range children {
+		below, getErr := scopeObjectives(ctx, childKinds[kind], *mergeID(c))
+		if getErr != nil {
+			return nil, getErr
+		}
+		objectives = append(objectives, below...)
+	}
+	return objectives, nil
+}
+
+// Internal Function
+// Description:
+// The titles of structure kind id and of the structures it is in, from
+// its book down.
+func scopePath(ctx context.Context, kind string, id int64) []string {
+	path := make([]string, 0)
+	for e := newRevisable(kind); e != nil && id != 0; e = newRevisable(kind) {
+		if getErr := GetFromDatastore(ctx, id, e); getErr != nil {
+			break
+		}
+		path = append([]string{mergeTitle(e)}, path...)
+		id, kind = reflect.ValueOf(e).Elem().FieldByName("Parent").Int(), parentKinds[kind]
+	}
+	return path
+}
+
+// Internal Function
+// Description:
+// Reads which structure to export exercises from out of the options of
+// req, and checks that the reader may see it. An http.Error is written
+// when it fails.
+//
+// Returns:
+//      kind(string) - The kind of structure, empty for all exercises.
+//      id(int64) - The id of the structure.
+//      ok(bool) - Whether to go on.
+func exerciseScope(res http.ResponseWriter, req *http.Request) (string, int64, bool) {
+	kind, id := "", int64(0)
+	for _, s := range exerciseScopes {
+		if req.FormValue(s.Option) == "" {
+			continue
+		}
+		if kind != "" {
+			http.Error(res, "Give only one of BookID, ChapterID, SectionID or ObjectiveID", http.StatusBadRequest)
+			return "", 0, false
+		}
+		i, numErr := strconv.ParseInt(req.FormValue(s.Option), 10, 64)
+		if numErr != nil || i == 0 {
+			http.Error(res, "Invalid "+s.Option, http.StatusBadRequest)
+			return "", 0, false
+		}
+		kind, id = s.Kind, i
+	}
+
+	if kind != "" {
+		if readErr := CheckReadable(res, req, Scope{kind, id}); readErr != nil {
+			http.Error(res, readErr.Error(), http.StatusNotFound)
+			return "", 0, false
+		}
+	}
+	return kind, id, true
+}
+
+// Internal Function
+// Description:
+// Gathers the exercises of structure kind id, or of every objective the
+// reader of req may see when kind is empty, of instruction kind ikind
+// when that is given, by objective. Objectives without exercises are
+// left out.
+//
+// Returns:
+//      groups([]exerciseGroup) - The exercises, in book order under a structure.
+//      failure?(error) - Any storage error.
+func gatherExercises(res http.ResponseWriter, req *http.Request, kind string, id int64, ikind string) ([]exerciseGroup, error) {
+	ctx := NewContext(req)
+	groups := make([]exerciseGroup, 0)
+	if kind != "" {
+		objectives, getErr := scopeObjectives(ctx, kind, id)
+		if getErr != nil {
+			return nil, getErr
+		}
+		for _, o := range objectives {
+			exercises, getErr := GetExercises(ctx, &o.ID, ikind)
+			if getErr != nil {
+				return nil, getErr
+			}
+			if len(exercises) > 0 {
+				groups = append(groups, exerciseGroup{o.ID, o.Title, scopePath(ctx, "Objective", o.ID), exercises})
+			}
+		}
+		return groups, nil
+	}
+
+	all, getErr := GetExercises(ctx, nil, ikind)
+	if getErr != nil {
+		return nil, getErr
+	}
+	reader := NewReadChecker(res, req)
+	index := make(map[int64]int) // Of each objective's group
+	for _, e := range all {
+		if !reader.CanRead(Scope{"Objective", e.Parent}) {
+			continue
+		}
+		i, listed := index[e.Parent]
+		if !listed {
+			path := scopePath(ctx, "Objective", e.Parent)
+			title := ""
+			if len(path) > 0 {
+				title = path[len(path)-1]
+			}
+			i, index[e.Parent] = len(groups), len(groups)
+			groups = append(groups, exerciseGroup{ID: e.Parent, Title: title, Path: path})
+		}
+		groups[i].Exercises = append(groups[i].Exercises, e)
+	}
+	return groups, nil
+}
+
+// Internal Function
+// Description:
+// Gathers exercise groups into a package, with the images they refer to
+// that the reader of req may see.
+func newQTIPackage(res http.ResponseWriter, req *http.Request, groups []exerciseGroup) *qtiPackage {
+	p := &qtiPackage{}
+	content := make([]string, 0)
+	for _, g := range groups {
+		for _, e := range g.Exercises {
+			content = append(content, string(e.Question), string(e.Solution))
+		}
+	}
+	p.images = readableImages(res, req, content)
+	p.Images = imageNames(p.images)
+
+	for _, g := range groups {
+		s := qtiSection{ID: g.ID, Title: g.Title}
+		for _, e := range g.Exercises {
+			item := qtiItem{
+				ID:          e.ID,
+				Title:       e.Instruction,
+				Instruction: e.Instruction,
+				Question:    template.HTML(portableXHTML(string(e.Question), p.images, "../images/")),
+				Solution:    template.HTML(portableXHTML(string(e.Solution), p.images, "../images/")),
+				Answer:      htmlText(string(e.Answer)),
+			}
+			if item.Title == "" {
+				item.Title = fmt.Sprint("Exercise ", e.Order)
+			}
+			s.Items = append(s.Items, item)
+		}
+		p.Sections = append(p.Sections, s)
+	}
+	return p
+}
+
+// Internal Function
+// Description:
+// The name of an export of the exercises of structure kind id, and its title.
+func exerciseExportName(ctx context.Context, kind string, id int64) (string, string) {
+	if kind == "" {
+		return "exercises", "Exercises"
+	}
+	name := fmt.Sprint("exercises-", strings.ToLower(kind), "-", id)
+	if title, getErr := scopeTitle(ctx, kind, id); getErr == nil {
+		return name, title + ": Exercises"
+	}
+	return name, "Exercises"
+}
+
+// Internal Function
+// Description:
+// The title of structure kind id.
+func scopeTitle(ctx context.Context, kind string, id int64) (string, error) {
+	e := newRevisable(kind)
+	if getErr := GetFromDatastore(ctx, id, e); getErr != nil {
+		return "", getErr
+	}
+	return mergeTitle(e), nil
+}
+
+// Method: write
+// Writes the package as a zip to w.
+func (p *qtiPackage) write(w io.Writer) error {
+	files := []zipTemplate{
+		{"imsmanifest.xml", "QTIManifest", p},
+		{"test.xml", "QTITest", p},
+	}
+	for _, s := range p.Sections {
+		for _, item := range s.Items {
+			files = append(files, zipTemplate{fmt.Sprint("items/exercise-", item.ID, ".xml"), "QTIItem", item})
+		}
+	}
+	return writeZipPackage(zip.NewWriter(w), files, "images/", p.images)
+}
+
+// Call: /api/exercises.zip
+// Description:
+// This call will return exercises as a QTI 2.1 content package.
+// Limit results to the exercises under a book, chapter, section or
+// objective by one of BookID, ChapterID, SectionID or ObjectiveID.
+// Limit results by Instruction kind by IKind
+//
+// Method: GET
+// Results: ZIP
+// Mandatory Options:
+// Optional Options: BookID, ChapterID, SectionID, ObjectiveID, IKind
+// Codes:
+//      400 - More than one of the ID options, or an ID that is not a number.
+//      404 - The structure does not exist or may not be read, or there are no exercises.
+func exportExercisesQTI(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	kind, id, ok := exerciseScope(res, req)
+	if !ok {
+		return
+	}
+	groups, getErr := gatherExercises(res, req, kind, id, req.FormValue("IKind"))
+	if getErr != nil {
+		http.Error(res, getErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(groups) == 0 {
+		http.Error(res, "No exercises found", http.StatusNotFound)
+		return
+	}
+	p := newQTIPackage(res, req, groups)
+	p.Identifier, p.Title = exerciseExportName(NewContext(req), kind, id)
+
+	serveDownload(res, "application/zip", p.Identifier+".zip", p.write)
+}
@@ -0,0 +1,1254 @@
+package main
+
+/*
+PARSE_Markdown.go by Allen J. Mills
+    mm.d.yy
+
+    Content as Markdown, for books kept as Markdown files, see
+    PARSE_BookMarkdown.go.
+
+    htmlToMarkdown writes paragraphs, headings, lists, block quotes,
+    code, links, images, emphasis and line breaks as Markdown. Markup
+    Markdown has no way to write, such as a table or an element with a
+    class or style, is kept as the HTML it is, which Markdown passes
+    through. Comments are left out.
+
+    markdownToHTML reads that back, along with the rest of common
+    Markdown: setext headings, indented code, autolinks, lazy lines of
+    block quotes and lists, and hard breaks written as two spaces.
+    Tables, footnotes and other extensions are not read.
+*/
+
+import (
+	"bytes"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Elements that are blocks, by tag. A line of Markdown starting with one
+// of them begins HTML that is passed through as it is.
+var markdownBlockTags = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "body": true, "caption": true,
+	"center": true, "col": true, "colgroup": true, "dd": true, "details": true, "dialog": true, "dir": true,
+	"div": true, "dl": true, "dt": true, "fieldset": true, "figcaption": true, "figure": true, "footer": true,
+	"form": true, "frame": true, "frameset": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true,
+	"h6": true, "head": true, "header": true, "hr": true, "html": true, "iframe": true, "legend": true,
+	"li": true, "link": true, "main": true, "menu": true, "menuitem": true, "nav": true, "noframes": true,
+	"ol": true, "optgroup": true, "option": true, "p": true, "param": true, "pre": true, "script": true,
+	"section": true, "source": true, "style": true, "summary": true, "table": true, "tbody": true, "td": true,
+	"textarea": true, "tfoot": true, "th": true, "thead": true, "title": true, "tr": true, "track": true, "ul": true,
+}
+
+// Blocks whose HTML may hold blank lines, and so runs to their end tag.
+var markdownRawText = map[string]bool{"pre": true, "script": true, "style": true, "textarea": true}
+
+// Elements with no end tag.
+var markdownVoid = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true, "input": true,
+	"link": true, "meta": true, "param": true, "source": true, "track": true, "wbr": true,
+}
+
+var (
+	markdownSpaces     = regexp.MustCompile(`[ \t\n\f\r]+`)
+	markdownEntityLike = regexp.MustCompile(`^&(?:#[0-9]{1,7}|#[xX][0-9a-fA-F]{1,6}|[A-Za-z][A-Za-z0-9]{1,31});`)
+	markdownMarkerLine = regexp.MustCompile(`(?m)^[#>+=~-]`)
+	markdownNumberLine = regexp.MustCompile(`(?m)^([0-9]+)([.)])`)
+	markdownBlankLines = regexp.MustCompile(`\n([ \t]*)\n`)
+	markdownBackticks  = regexp.MustCompile("`+")
+
+	markdownFence      = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})(.*)$")
+	markdownHeading    = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+|$)(.*)$`)
+	markdownBreak      = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	markdownSetext     = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	markdownListItem   = regexp.MustCompile(`^( {0,3})([-+*]|[0-9]{1,9}[.)])([ \t]+|$)`)
+	markdownHTMLStart  = regexp.MustCompile(`^ {0,3}<(?:(!--)|(/?)([A-Za-z][A-Za-z0-9-]*)(?:[ \t/>]|$))`)
+	markdownOpenTag    = regexp.MustCompile(`^<[A-Za-z][A-Za-z0-9-]*(?:\s+[A-Za-z_:][A-Za-z0-9_.:-]*(?:\s*=\s*(?:[^\s"'=<>` + "`" + `]+|'[^']*'|"[^"]*"))?)*\s*/?>`)
+	markdownCloseTag   = regexp.MustCompile(`^</[A-Za-z][A-Za-z0-9-]*\s*>`)
+	markdownComment    = regexp.MustCompile(`^<!--[\s\S]*?-->`)
+	markdownAutolink   = regexp.MustCompile(`^<([A-Za-z][A-Za-z0-9+.-]{1,31}:[^\s<>]*)>`)
+	markdownEscapeText = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	markdownEscapeAttr = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&#34;")
+)
+
+/////---------------------------------
+// HTML to Markdown
+////
+
+// Internal Function
+// Description:
+// Writes HTML content as Markdown, blocks apart by a blank line.
+func htmlToMarkdown(content string) string {
+	nodes, parseErr := html.ParseFragment(strings.NewReader(content), &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div})
+	if parseErr != nil {
+		return content
+	}
+	return strings.Join(markdownBlocksOf(nodes), "\n\n")
+}
+
+// Internal Function
+// Description:
+// The children of n.
+func childNodes(n *html.Node) []*html.Node {
+	nodes := make([]*html.Node, 0)
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		nodes = append(nodes, c)
+	}
+	return nodes
+}
+
+// Internal Function
+// Description:
+// Reports whether n has no attributes but those allowed, so Markdown can write it.
+func plainElement(n *html.Node, allowed ...string) bool {
+	for _, a := range n.Attr {
+		if a.Namespace != "" || !hasImportAttribute(allowed, a.Key) {
+			return false
+		}
+	}
+	return true
+}
+
+// Internal Function
+// Description:
+// Writes nodes as Markdown blocks. Runs of text and inline elements
+// outside of a block are written as paragraphs.
+func markdownBlocksOf(nodes []*html.Node) []string {
+	blocks := make([]string, 0)
+	inline := make([]*html.Node, 0)
+	flush := func() {
+		if p := markdownParagraph(inline); p != "" {
+			blocks = append(blocks, p)
+		}
+		inline = inline[:0]
+	}
+	for _, n := range nodes {
+		if n.Type == html.ElementNode && markdownBlockTags[n.Data] {
+			flush()
+			blocks = append(blocks, markdownBlock(n))
+		} else {
+			inline = append(inline, n)
+		}
+	}
+	flush()
+	return blocks
+}
+
+// Internal Function
+// Description:
+// Writes block element n as Markdown, or as HTML when Markdown cannot.
+func markdownBlock(n *html.Node) string {
+	switch n.Data {
+	case "p":
+		if p := markdownParagraph(childNodes(n)); p != "" && plainElement(n) {
+			return p
+		}
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		if h := markdownParagraph(childNodes(n)); h != "" && !strings.Contains(h, "\n") && plainElement(n) {
+			if strings.HasSuffix(h, "#") {
+				h = strings.TrimSuffix(h, "#") + `\#`
+			}
+			return strings.Repeat("#", int(n.Data[1]-'0')) + " " + h
+		}
+	case "hr":
+		if plainElement(n) {
+			return "***"
+		}
+	case "blockquote":
+		if blocks := markdownBlocksOf(childNodes(n)); len(blocks) > 0 && plainElement(n) {
+			return prefixLines(strings.Join(blocks, "\n\n"), "> ", ">")
+		}
+	case "pre":
+		if code, ok := markdownCodeBlock(n); ok {
+			return code
+		}
+	case "ul", "ol":
+		if list, ok := markdownList(n); ok {
+			return list
+		}
+	}
+	return rawMarkdownBlock(n)
+}
+
+// Internal Function
+// Description:
+// Writes block element n as HTML to pass through Markdown. A blank line
+// would end it, so line breaks between blank lines are written as
+// character references, except in elements that run to their end tag.
+func rawMarkdownBlock(n *html.Node) string {
+	var raw bytes.Buffer
+	html.Render(&raw, n)
+	if markdownRawText[n.Data] {
+		return raw.String()
+	}
+	s := raw.String()
+	for markdownBlankLines.MatchString(s) {
+		s = markdownBlankLines.ReplaceAllString(s, "\n$1&#10;")
+	}
+	return s
+}
+
+// Internal Function
+// Description:
+// Prefixes every line of s, empty lines by empty.
+func prefixLines(s, prefix, empty string) string {
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		if l == "" {
+			lines[i] = empty
+		} else {
+			lines[i] = prefix + l
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Internal Function
+// Description:
+// Writes a <pre> holding only a <code> as a fenced code block, the
+// language its class names as the info string.
+func markdownCodeBlock(pre *html.Node) (string, bool) {
+	code := pre.FirstChild
+	if !plainElement(pre) || code == nil || code.NextSibling != nil || code.Type != html.ElementNode || code.Data != "code" || !plainElement(code, "class") {
+		return "", false
+	}
+	info := ""
+	for _, a := range code.Attr {
+		if fields := strings.Fields(a.Val); len(fields) != 1 || !strings.HasPrefix(fields[0], "language-") {
+			return "", false
+		}
+		info = strings.TrimPrefix(strings.TrimSpace(a.Val), "language-")
+	}
+	var text bytes.Buffer
+	for c := code.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.TextNode {
+			return "", false
+		}
+		text.WriteString(c.Data)
+	}
+	content := strings.TrimSuffix(strings.Replace(text.String(), "\r\n", "\n", -1), "\n")
+
+	fence := "```"
+	for strings.Contains(content, fence) || strings.Contains(info, "`") {
+		fence += "`"
+		if strings.Contains(info, "`") {
+			fence = strings.Repeat("~", len(fence))
+		}
+	}
+	if content == "" {
+		return fence + info + "\n" + fence, true
+	}
+	return fence + info + "\n" + content + "\n" + fence, true
+}
+
+// Internal Function
+// Description:
+// Writes a list as Markdown. A list is written tight, without blank
+// lines, when each item is some text and then any lists in it.
+func markdownList(n *html.Node) (string, bool) {
+	start := 1
+	if n.Data == "ol" {
+		if !plainElement(n, "start") {
+			return "", false
+		}
+		for _, a := range n.Attr {
+			s, numErr := strconv.Atoi(a.Val)
+			if numErr != nil || s < 0 {
+				return "", false
+			}
+			start = s
+		}
+	} else if !plainElement(n) {
+		return "", false
+	}
+
+	items := make([]*html.Node, 0)
+	tight := true
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		switch {
+		case c.Type == html.ElementNode && c.Data == "li" && plainElement(c):
+			items = append(items, c)
+			tight = tight && tightListItem(c)
+		case c.Type == html.TextNode && strings.Trim(c.Data, " \t\n\f\r") == "":
+		case c.Type == html.CommentNode:
+		default:
+			return "", false
+		}
+	}
+	if len(items) == 0 {
+		return "", false
+	}
+
+	separator := "\n\n"
+	if tight {
+		separator = "\n"
+	}
+	written := make([]string, 0, len(items))
+	for i, li := range items {
+		marker := "- "
+		if n.Data == "ol" {
+			marker = strconv.Itoa(start+i) + ". "
+		}
+		item := strings.Join(markdownBlocksOf(childNodes(li)), separator)
+		written = append(written, marker+prefixLines(item, strings.Repeat(" ", len(marker)), "")[len(marker):])
+	}
+	return strings.Join(written, separator), true
+}
+
+// Internal Function
+// Description:
+// Reports whether li is inline content followed only by lists.
+func tightListItem(li *html.Node) bool {
+	lists := false
+	for c := li.FirstChild; c != nil; c = c.NextSibling {
+		switch {
+		case c.Type == html.ElementNode && (c.Data == "ul" || c.Data == "ol"):
+			lists = true
+		case c.Type == html.ElementNode && markdownBlockTags[c.Data]:
+			return false
+		case c.Type == html.TextNode && strings.Trim(c.Data, " \t\n\f\r") == "":
+		case lists:
+			return false
+		}
+	}
+	return true
+}
+
+// Internal Function
+// Description:
+// Writes nodes as a paragraph of Markdown, empty if they hold nothing.
+// Line breaks end lines; a line that would start a block is escaped.
+func markdownParagraph(nodes []*html.Node) string {
+	var b bytes.Buffer
+	for i, n := range nodes {
+		var next *html.Node
+		if i+1 < len(nodes) {
+			next = nodes[i+1]
+		}
+		writeMarkdownInline(&b, n, next)
+	}
+	lines := strings.Split(b.String(), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimLeft(lines[i], " ")
+	}
+	p := strings.TrimRight(strings.Join(lines, "\n"), " ")
+	for strings.HasSuffix(p, "\\\n") || strings.HasPrefix(p, "\\\n") {
+		p = strings.TrimRight(strings.TrimPrefix(strings.TrimSuffix(p, "\\\n"), "\\\n"), " ")
+	}
+	p = markdownMarkerLine.ReplaceAllString(p, `\$0`)
+	return markdownNumberLine.ReplaceAllString(p, `$1\$2`)
+}
+
+// Internal Function
+// Description:
+// Writes inline nodes as Markdown, as for a paragraph.
+func markdownInlineOf(nodes []*html.Node) string {
+	var b bytes.Buffer
+	for i, n := range nodes {
+		var next *html.Node
+		if i+1 < len(nodes) {
+			next = nodes[i+1]
+		}
+		writeMarkdownInline(&b, n, next)
+	}
+	return b.String()
+}
+
+// Internal Function
+// Description:
+// Escapes text so Markdown reads it as text. Runs of white space are
+// written as one space, as HTML shows them.
+func markdownText(text string) string {
+	text = markdownSpaces.ReplaceAllString(text, " ")
+	var b bytes.Buffer
+	for i, r := range text {
+		switch r {
+		case '\\', '*', '`', '[', ']', '<':
+			b.WriteByte('\\')
+		case '_':
+			before, _ := utf8.DecodeLastRuneInString(text[:i])
+			after, _ := utf8.DecodeRuneInString(text[i+1:])
+			if !isWordRune(before) || !isWordRune(after) {
+				b.WriteByte('\\')
+			}
+		case '&':
+			if markdownEntityLike.MatchString(text[i:]) {
+				b.WriteByte('\\')
+			}
+		case '\u00a0':
+			b.WriteString("&nbsp;")
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Internal Function
+// Description:
+// Reports whether r is a letter or digit.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// Internal Function
+// Description:
+// The start tag of n as HTML.
+func rawStartTag(n *html.Node) string {
+	var b bytes.Buffer
+	b.WriteString("<" + n.Data)
+	for _, a := range n.Attr {
+		name := a.Key
+		if a.Namespace != "" {
+			name = a.Namespace + ":" + a.Key
+		}
+		b.WriteString(" " + name + `="` + strings.Replace(html.EscapeString(a.Val), "\n", "&#10;", -1) + `"`)
+	}
+	b.WriteString(">")
+	return b.String()
+}
+
+// Internal Function
+// Description:
+// Writes inline node n as Markdown to b. next is the node after it, if any.
+func writeMarkdownInline(b *bytes.Buffer, n *html.Node, next *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		b.WriteString(markdownText(n.Data))
+		return
+	case html.ElementNode:
+	default:
+		return // comments and the like are left out.
+	}
+
+	children := childNodes(n)
+	switch n.Data {
+	case "br":
+		if plainElement(n) {
+			b.WriteString("\\\n")
+			return
+		}
+	case "strong", "b", "em", "i":
+		if !plainElement(n) {
+			break
+		}
+		inner := markdownInlineOf(children)
+		trimmed := strings.Trim(inner, " ")
+		if trimmed == "" {
+			b.WriteString(inner)
+			return
+		}
+		delimiter := "**"
+		if n.Data == "em" || n.Data == "i" {
+			before, _ := utf8.DecodeLastRune(b.Bytes())
+			after := ' '
+			if next != nil && next.Type == html.TextNode {
+				after, _ = utf8.DecodeRuneInString(next.Data)
+			}
+			if (isWordRune(before) && !strings.HasPrefix(inner, " ")) || (isWordRune(after) && !strings.HasSuffix(inner, " ")) {
+				break // inside a word, where _ does not emphasize.
+			}
+			delimiter = "_"
+		}
+		b.WriteString(inner[:strings.Index(inner, trimmed)])
+		b.WriteString(delimiter + trimmed + delimiter)
+		b.WriteString(inner[strings.Index(inner, trimmed)+len(trimmed):])
+		return
+	case "code":
+		if code, ok := markdownCodeSpan(n); ok {
+			b.WriteString(code)
+			return
+		}
+	case "a":
+		href, hasHref := markdownAttribute(n, "href")
+		if dest, ok := markdownDestination(href); ok && hasHref && plainElement(n, "href", "title") {
+			b.WriteString("[" + markdownInlineOf(children) + "](" + dest + markdownTitle(n) + ")")
+			return
+		}
+	case "img":
+		src, hasSrc := markdownAttribute(n, "src")
+		if dest, ok := markdownDestination(src); ok && hasSrc && plainElement(n, "src", "alt", "title") {
+			alt, _ := markdownAttribute(n, "alt")
+			b.WriteString("![" + markdownText(alt) + "](" + dest + markdownTitle(n) + ")")
+			return
+		}
+	}
+
+	if n.Namespace != "" || markdownRawText[n.Data] || n.Data == "template" {
+		var raw bytes.Buffer
+		html.Render(&raw, n)
+		b.WriteString(strings.Replace(raw.String(), "\n", "&#10;", -1))
+		return
+	}
+	b.WriteString(rawStartTag(n))
+	if markdownVoid[n.Data] {
+		return
+	}
+	b.WriteString(markdownInlineOf(children))
+	b.WriteString("</" + n.Data + ">")
+}
+
+// Internal Function
+// Description:
+// The value of attribute name of n, and whether n has it.
+func markdownAttribute(n *html.Node, name string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == name {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+// Internal Function
+// Description:
+// Writes a link address as the destination of a Markdown link, in angle
+// brackets when it holds spaces or parentheses.
+//
+// Returns:
+//      destination(string) - As it is written.
+//      ok(bool) - False when Markdown cannot write it.
+func markdownDestination(href string) (string, bool) {
+	if strings.ContainsAny(href, "<>\n\r") {
+		return "", false
+	}
+	href = strings.Replace(href, `\`, `\\`, -1)
+	if href == "" || strings.ContainsAny(href, " \t()") {
+		return "<" + href + ">", true
+	}
+	return href, true
+}
+
+// Internal Function
+// Description:
+// Writes the title of link or image n, with a space before it, if it has one.
+func markdownTitle(n *html.Node) string {
+	if title, hasTitle := markdownAttribute(n, "title"); hasTitle {
+		return ` "` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(title) + `"`
+	}
+	return ""
+}
+
+// Internal Function
+// Description:
+// Writes a <code> holding only text as a code span.
+func markdownCodeSpan(n *html.Node) (string, bool) {
+	if !plainElement(n) || n.FirstChild == nil {
+		return "", false
+	}
+	var text bytes.Buffer
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.TextNode {
+			return "", false
+		}
+		text.WriteString(c.Data)
+	}
+	content := strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ").Replace(text.String())
+	if strings.Trim(content, " ") == "" {
+		return "", false
+	}
+
+	longest := 0
+	for _, run := range markdownBackticks.FindAllString(content, -1) {
+		if len(run) > longest {
+			longest = len(run)
+		}
+	}
+	fence := strings.Repeat("`", longest+1)
+	if strings.HasPrefix(content, "`") || strings.HasSuffix(content, "`") || (strings.HasPrefix(content, " ") && strings.HasSuffix(content, " ")) {
+		content = " " + content + " "
+	}
+	return fence + content + fence, true
+}
+
+/////---------------------------------
+// Markdown to HTML
+////
+
+
+// Type: markdownRead
+// A block read from Markdown. A paragraph also keeps its inline HTML,
+// to be written without <p> in a tight list or a field of one line.
+type markdownRead struct {
+	HTML   string
+	Inline string // Of a paragraph, empty for other blocks
+}
+
+// Internal Function
+// Description:
+// Writes Markdown as HTML.
+func markdownToHTML(source string) string {
+	blocks := make([]string, 0)
+	for _, b := range readMarkdown(source) {
+		blocks = append(blocks, b.HTML)
+	}
+	return strings.Join(blocks, "\n")
+}
+
+// Internal Function
+// Description:
+// Writes Markdown as HTML, as markdownToHTML does, but a single paragraph
+// without its <p>, for fields that are often a line of text, such as an
+// exercise's answer.
+func markdownLineToHTML(source string) string {
+	if blocks := readMarkdown(source); len(blocks) == 1 && blocks[0].Inline != "" {
+		return blocks[0].Inline
+	}
+	return markdownToHTML(source)
+}
+
+// Internal Function
+// Description:
+// Reads the blocks of Markdown source.
+func readMarkdown(source string) []markdownRead {
+	source = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(source)
+	lines := strings.Split(source, "\n")
+	for i, l := range lines {
+		lines[i] = expandLeadingTabs(l)
+	}
+	return readMarkdownBlocks(lines)
+}
+
+// Internal Function
+// Description:
+// Writes the tabs in the indentation of line as spaces, to stops of four.
+func expandLeadingTabs(line string) string {
+	column := 0
+	for i, r := range line {
+		switch r {
+		case ' ':
+			column++
+		case '\t':
+			column += 4 - column%4
+		default:
+			return strings.Repeat(" ", column) + line[i:]
+		}
+	}
+	return strings.Repeat(" ", column)
+}
+
+// Internal Function
+// Description:
+// The number of spaces line starts with.
+func leadingSpaces(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// Internal Function
+// Description:
+// Reports whether line holds nothing but spaces.
+func blankLine(line string) bool {
+	return strings.Trim(line, " \t") == ""
+}
+
+// Internal Function
+// Description:
+// Finds the HTML a line starts, if it starts one Markdown passes through.
+//
+// Returns:
+//      ends(func(string) bool) - Reports whether a line ends the HTML, nil if line starts none.
+//      blankEnds(bool) - True when a blank line ends it instead, before that line.
+func markdownHTMLBlock(line string) (func(string) bool, bool) {
+	m := markdownHTMLStart.FindStringSubmatch(line)
+	switch {
+	case m == nil:
+		return nil, false
+	case m[1] != "":
+		return func(l string) bool { return strings.Contains(l, "-->") }, false
+	case m[2] == "" && markdownRawText[strings.ToLower(m[3])]:
+		end := "</" + strings.ToLower(m[3]) + ">"
+		return func(l string) bool { return strings.Contains(strings.ToLower(l), end) }, false
+	case markdownBlockTags[strings.ToLower(m[3])]:
+		return func(string) bool { return false }, true
+	}
+	return nil, false
+}
+
+// Internal Function
+// Description:
+// Reports whether line starts a block that ends a paragraph before it.
+func interruptsParagraph(line string) bool {
+	if leadingSpaces(line) > 3 {
+		return false
+	}
+	if markdownFence.MatchString(line) || markdownHeading.MatchString(line) || markdownBreak.MatchString(line) || strings.HasPrefix(strings.TrimLeft(line, " "), ">") {
+		return true
+	}
+	if ends, _ := markdownHTMLBlock(line); ends != nil {
+		return true
+	}
+	if m := markdownListItem.FindStringSubmatch(line); m != nil && !blankLine(line[len(m[0]):]) {
+		return !unicode.IsDigit(rune(m[2][0])) || strings.TrimLeft(m[2][:len(m[2])-1], "0") == "1"
+	}
+	return false
+}
+
+// Internal Function
+// Description:
+// Reads lines of Markdown as blocks.
+func readMarkdownBlocks(lines []string) []markdownRead {
+	blocks := make([]markdownRead, 0)
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		indent := leadingSpaces(line)
+
+		if blankLine(line) {
+			i++
+			continue
+		}
+
+		if indent >= 4 {
+			end := i
+			for j := i; j < len(lines) && (blankLine(lines[j]) || leadingSpaces(lines[j]) >= 4); j++ {
+				if !blankLine(lines[j]) {
+					end = j + 1
+				}
+			}
+			code := make([]string, 0, end-i)
+			for _, l := range lines[i:end] {
+				if len(l) >= 4 {
+					code = append(code, l[4:])
+				} else {
+					code = append(code, "")
+				}
+			}
+			blocks = append(blocks, markdownRead{HTML: "<pre><code>" + markdownEscapeText.Replace(strings.Join(code, "\n")+"\n") + "</code></pre>"})
+			i = end
+			continue
+		}
+
+		if m := markdownFence.FindStringSubmatch(line); m != nil && !(m[2][0] == '`' && strings.Contains(m[3], "`")) {
+			fence, info := m[2], strings.Fields(m[3])
+			code := make([]string, 0)
+			j := i + 1
+			for ; j < len(lines); j++ {
+				l := lines[j]
+				if c := strings.TrimLeft(l, " "); leadingSpaces(l) <= 3 && strings.HasPrefix(c, fence) && strings.Trim(c, fence[:1]+" \t") == "" {
+					break
+				}
+				strip := leadingSpaces(l)
+				if strip > len(m[1]) {
+					strip = len(m[1])
+				}
+				code = append(code, l[strip:])
+			}
+			class := ""
+			if len(info) > 0 {
+				class = ` class="language-` + markdownEscapeAttr.Replace(info[0]) + `"`
+			}
+			text := strings.Join(code, "\n")
+			if len(code) > 0 {
+				text += "\n"
+			}
+			blocks = append(blocks, markdownRead{HTML: "<pre><code" + class + ">" + markdownEscapeText.Replace(text) + "</code></pre>"})
+			i = j + 1
+			continue
+		}
+
+		if m := markdownHeading.FindStringSubmatch(line); m != nil {
+			text := strings.TrimRight(m[2], " \t")
+			if closed := strings.TrimRight(text, "#"); closed == "" || strings.HasSuffix(closed, " ") || strings.HasSuffix(closed, "\t") {
+				text = strings.TrimRight(closed, " \t")
+			}
+			level := strconv.Itoa(len(m[1]))
+			blocks = append(blocks, markdownRead{HTML: "<h" + level + ">" + markdownInline(text) + "</h" + level + ">"})
+			i++
+			continue
+		}
+
+		if markdownBreak.MatchString(line) {
+			blocks = append(blocks, markdownRead{HTML: "<hr />"})
+			i++
+			continue
+		}
+
+		if strings.HasPrefix(line[indent:], ">") {
+			quote := make([]string, 0)
+			for ; i < len(lines); i++ {
+				l := lines[i]
+				if c := strings.TrimLeft(l, " "); leadingSpaces(l) <= 3 && strings.HasPrefix(c, ">") {
+					quote = append(quote, strings.TrimPrefix(c[1:], " "))
+					continue
+				}
+				if blankLine(l) || blankLine(quote[len(quote)-1]) || interruptsParagraph(l) {
+					break
+				}
+				quote = append(quote, l) // a lazy line, going on with a paragraph.
+			}
+			inner := make([]string, 0)
+			for _, b := range readMarkdownBlocks(quote) {
+				inner = append(inner, b.HTML)
+			}
+			blocks = append(blocks, markdownRead{HTML: "<blockquote>\n" + strings.Join(inner, "\n") + "\n</blockquote>"})
+			continue
+		}
+
+		if ends, blankEnds := markdownHTMLBlock(line); ends != nil {
+			j := i
+			for ; j < len(lines); j++ {
+				if blankEnds && blankLine(lines[j]) {
+					break
+				}
+				if ends(lines[j]) {
+					j++
+					break
+				}
+			}
+			blocks = append(blocks, markdownRead{HTML: strings.Join(lines[i:j], "\n")})
+			i = j
+			continue
+		}
+
+		if markdownListItem.MatchString(line) {
+			var list string
+			list, i = readMarkdownList(lines, i)
+			blocks = append(blocks, markdownRead{HTML: list})
+			continue
+		}
+
+		paragraph := []string{strings.TrimLeft(line, " ")}
+		heading := ""
+		for i++; i < len(lines); i++ {
+			l := lines[i]
+			if m := markdownSetext.FindStringSubmatch(l); m != nil {
+				heading = map[byte]string{'=': "1", '-': "2"}[m[1][0]]
+				i++
+				break
+			}
+			if blankLine(l) || interruptsParagraph(l) {
+				break
+			}
+			paragraph = append(paragraph, strings.TrimLeft(l, " "))
+		}
+		inline := markdownInline(strings.TrimRight(strings.Join(paragraph, "\n"), " \t"))
+		if heading != "" {
+			blocks = append(blocks, markdownRead{HTML: "<h" + heading + ">" + inline + "</h" + heading + ">"})
+		} else {
+			blocks = append(blocks, markdownRead{HTML: "<p>" + inline + "</p>", Inline: inline})
+		}
+	}
+	return blocks
+}
+
+// Internal Function
+// Description:
+// Reads a list starting at lines[start]. The list is loose, its
+// paragraphs written with <p>, when a blank line comes between items or
+// between blocks of an item.
+//
+// Returns:
+//      list(string) - The list as HTML.
+//      next(int) - The index of the line after the list.
+func readMarkdownList(lines []string, start int) (string, int) {
+	first := markdownListItem.FindStringSubmatch(lines[start])
+	ordered := unicode.IsDigit(rune(first[2][0]))
+
+	items := make([][]markdownRead, 0)
+	loose := false
+	i := start
+	for i < len(lines) {
+		m := markdownListItem.FindStringSubmatch(lines[i])
+		if !sameListKind(m, first) {
+			break
+		}
+		width := len(m[1]) + len(m[2]) + len(m[3])
+		rest := lines[i][len(m[0]):]
+		if spaces := len(m[3]); spaces > 4 {
+			width = len(m[1]) + len(m[2]) + 1
+			rest = strings.Repeat(" ", spaces-1) + rest
+		} else if blankLine(rest) {
+			width = len(m[1]) + len(m[2]) + 1
+		}
+		item := []string{rest}
+	itemLines:
+		for i++; i < len(lines); i++ {
+			l := lines[i]
+			switch {
+			case blankLine(l):
+				item = append(item, "")
+			case leadingSpaces(l) >= width:
+				item = append(item, l[width:])
+			case !blankLine(item[len(item)-1]) && !interruptsParagraph(l) && !markdownListItem.MatchString(l):
+				item = append(item, strings.TrimLeft(l, " ")) // a lazy line, going on with a paragraph.
+			default:
+				break itemLines
+			}
+		}
+		trailing := 0
+		for len(item) > 1 && blankLine(item[len(item)-1]) {
+			item = item[:len(item)-1]
+			trailing++
+		}
+		blocks := readMarkdownBlocks(item)
+		if len(blocks) > 1 {
+			for _, l := range item {
+				loose = loose || blankLine(l)
+			}
+		}
+		items = append(items, blocks)
+		if trailing > 0 && i < len(lines) && sameListKind(markdownListItem.FindStringSubmatch(lines[i]), first) {
+			loose = true
+		}
+	}
+
+	open, end := "<ul>", "</ul>"
+	if ordered {
+		open, end = "<ol>", "</ol>"
+		if n, _ := strconv.Atoi(first[2][:len(first[2])-1]); n != 1 {
+			open = `<ol start="` + strconv.Itoa(n) + `">`
+		}
+	}
+	var list bytes.Buffer
+	list.WriteString(open + "\n")
+	for _, blocks := range items {
+		parts := make([]string, 0, len(blocks))
+		for _, b := range blocks {
+			if !loose && b.Inline != "" {
+				parts = append(parts, b.Inline)
+			} else {
+				parts = append(parts, b.HTML)
+			}
+		}
+		switch {
+		case len(parts) == 0:
+			list.WriteString("<li></li>\n")
+		case loose:
+			list.WriteString("<li>\n" + strings.Join(parts, "\n") + "\n</li>\n")
+		default:
+			list.WriteString("<li>" + strings.Join(parts, "\n") + "</li>\n")
+		}
+	}
+	list.WriteString(end)
+	return list.String(), i
+}
+
+// Internal Function
+// Description:
+// Reports whether list item marker m goes on the list first began: both
+// the same bullet, or both numbers with the same delimiter.
+func sameListKind(m, first []string) bool {
+	return m != nil && m[2][len(m[2])-1] == first[2][len(first[2])-1] && unicode.IsDigit(rune(m[2][0])) == unicode.IsDigit(rune(first[2][0]))
+}
+
+// Type: markdownInlineParser
+// The state of markdownInline. Emphasis and links are read by reading on
+// to their closing delimiter, and an opening delimiter that is never
+// closed is text. failed holds the delimiters tried and found unclosed,
+// so no stretch of text is read for the same one twice.
+type markdownInlineParser struct {
+	s      string
+	failed map[markdownAttempt]bool
+}
+
+type markdownAttempt struct {
+	start  int
+	closer string
+}
+
+// Internal Function
+// Description:
+// Writes the inline Markdown of a paragraph or heading as HTML.
+func markdownInline(s string) string {
+	p := &markdownInlineParser{s: s, failed: make(map[markdownAttempt]bool)}
+	out, _, _ := p.parse(0, "")
+	return out
+}
+
+// Method: parse
+// Reads from start up to closer, or to the end when closer is empty.
+//
+// Returns:
+//      html(string) - What was read, as HTML.
+//      next(int) - The index after closer.
+//      ok(bool) - False when closer never came.
+func (p *markdownInlineParser) parse(start int, closer string) (string, int, bool) {
+	attempt := markdownAttempt{start, closer}
+	if p.failed[attempt] {
+		return "", start, false
+	}
+	s := p.s
+	var b bytes.Buffer
+	for i := start; i < len(s); {
+		if closer != "" && (i > start || closer == "]") && p.closes(i, closer) {
+			return b.String(), i + len(closer), true
+		}
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\n':
+			b.WriteString("<br />\n")
+			i = skipLineSpaces(s, i+2)
+		case c == '\\' && i+1 < len(s) && isASCIIPunctuation(s[i+1]):
+			b.WriteString(markdownEscapeText.Replace(s[i+1 : i+2]))
+			i += 2
+		case c == '`':
+			run := len(s[i:]) - len(strings.TrimLeft(s[i:], "`"))
+			end := closingBackticks(s, i+run, run)
+			if end < 0 {
+				b.WriteString(s[i : i+run])
+				i += run
+				break
+			}
+			code := strings.Replace(s[i+run:end], "\n", " ", -1)
+			if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.Trim(code, " ") != "" {
+				code = code[1 : len(code)-1]
+			}
+			b.WriteString("<code>" + markdownEscapeText.Replace(code) + "</code>")
+			i = end + run
+		case c == '!' && i+1 < len(s) && s[i+1] == '[':
+			if link, next, ok := p.link(i+1, true); ok {
+				b.WriteString(link)
+				i = next
+			} else {
+				b.WriteByte('!')
+				i++
+			}
+		case c == '[':
+			if link, next, ok := p.link(i, false); ok {
+				b.WriteString(link)
+				i = next
+			} else {
+				b.WriteByte('[')
+				i++
+			}
+		case c == '*' || c == '_':
+			run := len(s[i:]) - len(strings.TrimLeft(s[i:], string(c)))
+			if emphasis, next, ok := p.emphasis(i, c, run); ok {
+				b.WriteString(emphasis)
+				i = next
+			} else {
+				b.WriteString(s[i : i+run])
+				i += run
+			}
+		case c == '<':
+			if m := markdownAutolink.FindStringSubmatch(s[i:]); m != nil {
+				b.WriteString(`<a href="` + markdownEscapeAttr.Replace(m[1]) + `">` + markdownEscapeText.Replace(m[1]) + "</a>")
+				i += len(m[0])
+			} else if tag := markdownOpenTag.FindString(s[i:]) + markdownCloseTag.FindString(s[i:]) + markdownComment.FindString(s[i:]); tag != "" {
+				b.WriteString(tag)
+				i += len(tag)
+			} else {
+				b.WriteString("&lt;")
+				i++
+			}
+		case c == '&':
+			if entity := markdownEntityLike.FindString(s[i:]); entity != "" {
+				b.WriteString(entity)
+				i += len(entity)
+			} else {
+				b.WriteString("&amp;")
+				i++
+			}
+		case c == '>':
+			b.WriteString("&gt;")
+			i++
+		case c == '\n':
+			spaces := len(b.Bytes()) - len(bytes.TrimRight(b.Bytes(), " "))
+			b.Truncate(b.Len() - spaces)
+			if spaces >= 2 {
+				b.WriteString("<br />")
+			}
+			b.WriteByte('\n')
+			i = skipLineSpaces(s, i+1)
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	if closer != "" {
+		p.failed[attempt] = true
+		return "", start, false
+	}
+	return b.String(), len(s), true
+}
+
+// Method: closes
+// Reports whether closer closes emphasis or link text at i.
+func (p *markdownInlineParser) closes(i int, closer string) bool {
+	s := p.s
+	if !strings.HasPrefix(s[i:], closer) {
+		return false
+	}
+	if closer == "]" {
+		return true
+	}
+	if s[i-1] == ' ' || s[i-1] == '\n' || s[i-1] == '\t' {
+		return false
+	}
+	after := i + len(closer)
+	if len(closer) == 1 && after < len(s) && s[after] == closer[0] {
+		return false
+	}
+	if closer[0] == '_' && after < len(s) {
+		r, _ := utf8.DecodeRuneInString(s[after:])
+		return !isWordRune(r)
+	}
+	return true
+}
+
+// Method: emphasis
+// Reads emphasis opened by a run of n delimiters c at i: both for three,
+// strong for two, else emphasis for one. _ does not open inside a word.
+func (p *markdownInlineParser) emphasis(i int, c byte, n int) (string, int, bool) {
+	s := p.s
+	if i+n >= len(s) || s[i+n] == ' ' || s[i+n] == '\n' || s[i+n] == '\t' {
+		return "", i, false
+	}
+	if before, _ := utf8.DecodeLastRuneInString(s[:i]); c == '_' && isWordRune(before) {
+		return "", i, false
+	}
+	if n >= 3 {
+		if inner, next, ok := p.parse(i+3, s[i:i+3]); ok {
+			return "<em><strong>" + inner + "</strong></em>", next, true
+		}
+	}
+	if n >= 2 {
+		if inner, next, ok := p.parse(i+2, s[i:i+2]); ok {
+			return "<strong>" + inner + "</strong>", next, true
+		}
+	}
+	if inner, next, ok := p.parse(i+1, s[i:i+1]); ok {
+		return "<em>" + inner + "</em>", next, true
+	}
+	return "", i, false
+}
+
+// Method: link
+// Reads a link, or an image, whose text opens with the [ at i.
+func (p *markdownInlineParser) link(i int, image bool) (string, int, bool) {
+	s := p.s
+	inner, next, ok := p.parse(i+1, "]")
+	if !ok || next >= len(s) || s[next] != '(' {
+		return "", i, false
+	}
+	dest, title, next, ok := readLinkDestination(s, next+1)
+	if !ok {
+		return "", i, false
+	}
+	attributes := ""
+	if title != "" {
+		attributes = ` title="` + markdownEscapeAttr.Replace(title) + `"`
+	}
+	if image {
+		return `<img src="` + markdownEscapeAttr.Replace(dest) + `" alt="` + markdownEscapeAttr.Replace(htmlText(inner)) + `"` + attributes + " />", next, true
+	}
+	return `<a href="` + markdownEscapeAttr.Replace(dest) + `"` + attributes + ">" + inner + "</a>", next, true
+}
+
+// Internal Function
+// Description:
+// Reads the destination and title of a link from s[i:], after its (.
+//
+// Returns:
+//      destination(string) - With backslash escapes read.
+//      title(string) - Empty if none.
+//      next(int) - The index after the ).
+//      ok(bool) - False if there is no destination.
+func readLinkDestination(s string, i int) (string, string, int, bool) {
+	i = skipLineSpaces(s, i)
+	var dest bytes.Buffer
+	if i < len(s) && s[i] == '<' {
+		for i++; i < len(s) && s[i] != '>'; i++ {
+			switch {
+			case s[i] == '\n' || s[i] == '<':
+				return "", "", i, false
+			case s[i] == '\\' && i+1 < len(s) && isASCIIPunctuation(s[i+1]):
+				i++
+			}
+			dest.WriteByte(s[i])
+		}
+		if i >= len(s) {
+			return "", "", i, false
+		}
+		i++
+	} else {
+		for depth := 0; i < len(s); i++ {
+			c := s[i]
+			if c == '\\' && i+1 < len(s) && isASCIIPunctuation(s[i+1]) {
+				i++
+				dest.WriteByte(s[i])
+				continue
+			}
+			if c <= ' ' || (c == ')' && depth == 0) {
+				break
+			}
+			if c == '(' {
+				depth++
+			} else if c == ')' {
+				depth--
+			}
+			dest.WriteByte(c)
+		}
+	}
+
+	title := ""
+	j := skipLineSpaces(s, i)
+	if j > i && j < len(s) && (s[j] == '"' || s[j] == '\'' || s[j] == '(') {
+		closing := s[j]
+		if closing == '(' {
+			closing = ')'
+		}
+		var t bytes.Buffer
+		for j++; j < len(s) && s[j] != closing; j++ {
+			if s[j] == '\\' && j+1 < len(s) && isASCIIPunctuation(s[j+1]) {
+				j++
+			}
+			t.WriteByte(s[j])
+		}
+		if j >= len(s) {
+			return "", "", j, false
+		}
+		title = t.String()
+		j = skipLineSpaces(s, j+1)
+	}
+	if j >= len(s) || s[j] != ')' {
+		return "", "", j, false
+	}
+	return dest.String(), title, j + 1, true
+}
+
+// Internal Function
+// Description:
+// The index of the run of exactly n backticks closing a code span that
+// opens before from, or -1 if none does.
+func closingBackticks(s string, from, n int) int {
+	for i := from; i < len(s); {
+		if s[i] != '`' {
+			i++
+			continue
+		}
+		run := len(s[i:]) - len(strings.TrimLeft(s[i:], "`"))
+		if run == n {
+			return i
+		}
+		i += run
+	}
+	return -1
+}
+
+// Internal Function
+// Description:
+// The index of the first byte from i that is not a space or tab, and
+// past one line break.
+func skipLineSpaces(s string, i int) int {
+	for newline := false; i < len(s); i++ {
+		switch {
+		case s[i] == ' ' || s[i] == '\t':
+		case s[i] == '\n' && !newline:
+			newline = true
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// Internal Function
+// Description:
+// Reports whether c is ASCII punctuation, which a backslash escapes.
+func isASCIIPunctuation(c byte) bool {
+	return c < utf8.RuneSelf && unicode.IsPunct(rune(c)) || strings.IndexByte("$+<=>^`|~", c) >= 0
+}
@@ -0,0 +1,233 @@
+package main
+
+/*
+STORAGE_appengine.go by Allen J. Mills
+    mm.d.yy
+
+    App Engine storage backend.
+    Entities live in datastore, cache entries in memcache, and
+    blobs in a private Google Cloud Storage bucket.
+*/
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+	"google.golang.org/cloud/storage"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Internal Function
+// Description:
+// Makes the App Engine backend, keeping blobs in bucket. Only usable while running on App Engine.
+func NewAppEngineBackend(bucket string) StorageBackend {
+	return StorageBackend{
+		Name:     "appengine",
+		Entities: datastoreEntityStore{},
+		Cache:    memcacheCacheStore{},
+		Blobs:    gcsBlobStore{bucket},
+		Context: func(req *http.Request) context.Context {
+			return appengine.NewContext(req)
+		},
+	}
+}
+
+// ------------------------------------
+// Datastore
+/////
+
+type datastoreEntityStore struct{}
+
+func toDatastoreKey(ctx context.Context, k EntityKey) *datastore.Key {
+	if k.Incomplete() {
+		return datastore.NewIncompleteKey(ctx, k.Kind, nil)
+	}
+	return datastore.NewKey(ctx, k.Kind, k.StringID, k.IntID, nil)
+}
+
+func fromDatastoreKey(k *datastore.Key) EntityKey {
+	return EntityKey{Kind: k.Kind(), StringID: k.StringID(), IntID: k.IntID()}
+}
+
+func (datastoreEntityStore) Get(ctx context.Context, k EntityKey, dst interface{}) error {
+	err := datastore.Get(ctx, toDatastoreKey(ctx, k), dst)
+	if err == datastore.ErrNoSuchEntity {
+		return ErrNoSuchEntity
+	}
+	return err
+}
+
+func (datastoreEntityStore) Put(ctx context.Context, k EntityKey, src interface{}) (EntityKey, error) {
+	rk, err := datastore.Put(ctx, toDatastoreKey(ctx, k), src)
+	if err != nil {
+		return k, err
+	}
+	return fromDatastoreKey(rk), nil
+}
+
+func (datastoreEntityStore) Insert(ctx context.Context, k EntityKey, src interface{}) error {
+	return datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		dk := toDatastoreKey(tc, k)
+		switch getErr := datastore.Get(tc, dk, &datastore.PropertyList{}); getErr {
+		case nil:
+			return ErrEntityExists
+		case datastore.ErrNoSuchEntity:
+			_, putErr := datastore.Put(tc, dk, src)
+			return putErr
+		default:
+			return getErr
+		}
+	}, nil)
+}
+
+func (datastoreEntityStore) Delete(ctx context.Context, keys []EntityKey) error {
+	dkeys := make([]*datastore.Key, 0, len(keys))
+	for _, k := range keys {
+		dkeys = append(dkeys, toDatastoreKey(ctx, k))
+	}
+	return datastore.DeleteMulti(ctx, dkeys)
+}
+
+func (datastoreEntityStore) GetAll(ctx context.Context, q *EntityQuery, dst interface{}) ([]EntityKey, error) {
+	dq := datastore.NewQuery(q.Kind)
+	for _, f := range q.Filters {
+		dq = dq.Filter(f.Field+" "+f.Op, f.Value)
+	}
+	for _, o := range q.Orders {
+		dq = dq.Order(o)
+	}
+	if len(q.Projection) > 0 {
+		dq = dq.Project(q.Projection...)
+	}
+	if q.Max > 0 {
+		dq = dq.Limit(q.Max)
+	}
+	if dst == nil {
+		dq = dq.KeysOnly()
+	}
+
+	dkeys, err := dq.GetAll(ctx, dst)
+	keys := make([]EntityKey, 0, len(dkeys))
+	for _, k := range dkeys {
+		keys = append(keys, fromDatastoreKey(k))
+	}
+	return keys, err
+}
+
+// ------------------------------------
+// Memcache
+/////
+
+type memcacheCacheStore struct{}
+
+func (memcacheCacheStore) CacheSet(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	return ToMemcache(ctx, key, string(value), expiration)
+}
+
+func (memcacheCacheStore) CacheGet(ctx context.Context, key string) ([]byte, error) {
+	v, err := FromMemcache(ctx, key)
+	if err == memcache.ErrCacheMiss {
+		return nil, ErrCacheMiss
+	}
+	return []byte(v), err
+}
+
+func (memcacheCacheStore) CacheDelete(ctx context.Context, key string) error {
+	err := DeleteMemcache(ctx, key)
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
+
+// ------------------------------------
+// Google Cloud Storage
+/////
+
+type gcsBlobStore struct {
+	bucket string
+}
+
+func (g gcsBlobStore) PutBlob(ctx context.Context, name, contentType string, r io.Reader) error {
+	client, clientErr := storage.NewClient(ctx)
+	if clientErr != nil {
+		return clientErr
+	}
+	defer client.Close()
+
+	csWriter := client.Bucket(g.bucket).Object(name).NewWriter(ctx)
+
+	// Cloud Storage Writer - Permissions
+	// Objects take the bucket's default ACL, which must not be public:
+	// images are only served through /image, which checks the book's visibility.
+	csWriter.ContentType = contentType
+
+	if _, err := io.Copy(csWriter, r); err != nil {
+		csWriter.Close()
+		return err
+	}
+	return csWriter.Close()
+}
+
+// Type: gcsReader
+// Closes the storage client along with the object reader.
+type gcsReader struct {
+	*storage.Reader
+	client *storage.Client
+}
+
+func (g gcsReader) Close() error {
+	g.Reader.Close()
+	return g.client.Close()
+}
+
+func (g gcsBlobStore) GetBlob(ctx context.Context, name string) (io.ReadCloser, error) {
+	client, clientErr := storage.NewClient(ctx)
+	if clientErr != nil {
+		return nil, clientErr
+	}
+	rdr, err := client.Bucket(g.bucket).Object(name).NewReader(ctx)
+	if err != nil {
+		client.Close()
+		if err == storage.ErrObjectNotExist {
+			return nil, ErrNoSuchBlob
+		}
+		return nil, err
+	}
+	return gcsReader{rdr, client}, nil
+}
+
+func (g gcsBlobStore) DeleteBlob(ctx context.Context, name string) error {
+	client, clientErr := storage.NewClient(ctx)
+	if clientErr != nil {
+		return clientErr
+	}
+	defer client.Close()
+	return client.Bucket(g.bucket).Object(name).Delete(ctx)
+}
+
+func (g gcsBlobStore) ListBlobs(ctx context.Context, prefix string) ([]string, error) {
+	results := make([]string, 0)
+
+	client, clientErr := storage.NewClient(ctx)
+	if clientErr != nil {
+		return results, clientErr
+	}
+	defer client.Close()
+
+	q := &storage.Query{Prefix: prefix}
+	for q != nil {
+		objectList, errList := client.Bucket(g.bucket).List(ctx, q)
+		if errList != nil {
+			return results, errList
+		}
+		for _, elem := range objectList.Results {
+			results = append(results, elem.Name)
+		}
+		q = objectList.Next
+	}
+	return results, nil
+}
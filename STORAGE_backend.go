@@ -0,0 +1,232 @@
+// Storage
+// This package describes the storage services the application depends on.
+package main
+
+/*
+STORAGE_backend.go by Allen J. Mills
+    mm.d.yy
+
+    Every handler reaches persistent state through the stores held in
+    Stores. Backends exist for App Engine (datastore, memcache, GCS),
+    process memory, and the local filesystem.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoSuchEntity   = errors.New("Storage: No such entity.")        // ErrNoSuchEntity is returned when a key does not exist in an EntityStore.
+	ErrCacheMiss      = errors.New("Storage: Cache miss.")            // ErrCacheMiss is returned when a key does not exist in a CacheStore.
+	ErrNoSuchBlob     = errors.New("Storage: No such file.")          // ErrNoSuchBlob is returned when a name does not exist in a BlobStore.
+	ErrUnknownBackend = errors.New("Storage: Unknown backend.")       // ErrUnknownBackend is returned when selecting a backend that does not exist.
+	ErrInvalidQuery   = errors.New("Storage: Invalid query filter.")  // ErrInvalidQuery is returned for malformed EntityQuery filters.
+	ErrEntityExists   = errors.New("Storage: Entity already exists.") // ErrEntityExists is returned when inserting at a key that is taken.
+)
+
+//// --------------------------
+// Entity Keys and Queries
+// Backend neutral keys and queries for stored entities.
+////
+
+// Type: EntityKey
+// Identifies a single entity of Kind by either IntID or StringID.
+type EntityKey struct {
+	Kind     string
+	StringID string
+	IntID    int64
+}
+
+// Internal Function
+// Description:
+// Makes an EntityKey for kind. id may be an int64, int, or string.
+func NewEntityKey(kind string, id interface{}) EntityKey {
+	switch v := id.(type) {
+	case int64:
+		return EntityKey{Kind: kind, IntID: v}
+	case int:
+		return EntityKey{Kind: kind, IntID: int64(v)}
+	case string:
+		return EntityKey{Kind: kind, StringID: v}
+	}
+	panic(fmt.Sprintf("Storage: invalid id type %T", id))
+}
+
+// Method: Incomplete
+// An incomplete key has no id yet, storing to it will allocate one.
+func (k EntityKey) Incomplete() bool {
+	return k.IntID == 0 && k.StringID == ""
+}
+
+func (k EntityKey) String() string {
+	if k.StringID != "" {
+		return k.Kind + ":" + k.StringID
+	}
+	return fmt.Sprint(k.Kind, ":", k.IntID)
+}
+
+// Type: EntityFilter
+// A single property comparison within an EntityQuery.
+type EntityFilter struct {
+	Field string
+	Op    string // one of =, <, <=, >, >=
+	Value interface{}
+}
+
+// Type: EntityQuery
+// Backend neutral query description. Modeled after datastore.Query,
+// every method returns a modified copy.
+type EntityQuery struct {
+	Kind       string
+	Filters    []EntityFilter
+	Orders     []string // Field for ascending, -Field for descending
+	Projection []string
+	Max        int
+}
+
+func NewEntityQuery(kind string) *EntityQuery {
+	return &EntityQuery{Kind: kind}
+}
+
+func (q *EntityQuery) clone() *EntityQuery {
+	c := *q
+	c.Filters = append([]EntityFilter(nil), q.Filters...)
+	c.Orders = append([]string(nil), q.Orders...)
+	c.Projection = append([]string(nil), q.Projection...)
+	return &c
+}
+
+// Method: Filter
+// Adds a filter such as Filter("Parent =", id). Invalid filters panic,
+// they are programming errors.
+func (q *EntityQuery) Filter(filterStr string, value interface{}) *EntityQuery {
+	parts := strings.Fields(filterStr)
+	if len(parts) != 2 {
+		panic(ErrInvalidQuery)
+	}
+	switch parts[1] {
+	case "=", "<", "<=", ">", ">=":
+	default:
+		panic(ErrInvalidQuery)
+	}
+	c := q.clone()
+	c.Filters = append(c.Filters, EntityFilter{parts[0], parts[1], value})
+	return c
+}
+
+func (q *EntityQuery) Order(fieldName string) *EntityQuery {
+	c := q.clone()
+	c.Orders = append(c.Orders, fieldName)
+	return c
+}
+
+func (q *EntityQuery) Project(fieldNames ...string) *EntityQuery {
+	c := q.clone()
+	c.Projection = append(c.Projection, fieldNames...)
+	return c
+}
+
+func (q *EntityQuery) Limit(limit int) *EntityQuery {
+	c := q.clone()
+	c.Max = limit
+	return c
+}
+
+//// --------------------------
+// Store Interfaces
+////
+
+// Type: EntityStore
+// Structured storage for entities. Holds the Catalog, Book, Chapter,
+// Section, Objective and Exercise tree as well as Users and Logins.
+type EntityStore interface {
+	// Get loads the entity at k into dst. Returns ErrNoSuchEntity if missing.
+	Get(ctx context.Context, k EntityKey, dst interface{}) error
+	// Put stores src at k. Incomplete keys are allocated a new IntID.
+	Put(ctx context.Context, k EntityKey, src interface{}) (EntityKey, error)
+	// Insert stores src at the complete key k only if nothing is stored there,
+	// atomically. Returns ErrEntityExists if something is.
+	Insert(ctx context.Context, k EntityKey, src interface{}) error
+	// Delete removes all keys. Missing keys are not an error.
+	Delete(ctx context.Context, keys []EntityKey) error
+	// GetAll runs q, appending results to dst (a pointer to a slice of structs).
+	// If dst is nil only keys are returned.
+	GetAll(ctx context.Context, q *EntityQuery, dst interface{}) ([]EntityKey, error)
+}
+
+// Type: CacheStore
+// Short lived key-value storage. Entries may disappear at any time.
+type CacheStore interface {
+	// CacheSet stores value at key for expiration. Zero means no expiration.
+	CacheSet(ctx context.Context, key string, value []byte, expiration time.Duration) error
+	// CacheGet returns the value at key or ErrCacheMiss.
+	CacheGet(ctx context.Context, key string) ([]byte, error)
+	CacheDelete(ctx context.Context, key string) error
+}
+
+// Type: BlobStore
+// Named file storage, used for images.
+type BlobStore interface {
+	PutBlob(ctx context.Context, name, contentType string, r io.Reader) error
+	// GetBlob opens name for reading, returning ErrNoSuchBlob if missing.
+	GetBlob(ctx context.Context, name string) (io.ReadCloser, error)
+	DeleteBlob(ctx context.Context, name string) error
+	// ListBlobs returns every name that begins with prefix.
+	ListBlobs(ctx context.Context, prefix string) ([]string, error)
+}
+
+//// --------------------------
+// Backends
+////
+
+// Type: StorageBackend
+// The full set of stores the application runs against.
+type StorageBackend struct {
+	Name     string
+	Entities EntityStore
+	Cache    CacheStore
+	Blobs    BlobStore
+
+	// Context makes the request scoped context handed to the stores.
+	Context func(req *http.Request) context.Context
+}
+
+// Stores is the active storage backend.
+var Stores = NewAppEngineBackend(Settings.Storage.GCSBucket)
+
+// Internal Function
+// Description:
+// Makes the storage context for a request. Use this in place of appengine.NewContext.
+func NewContext(req *http.Request) context.Context {
+	return Stores.Context(req)
+}
+
+// Internal Function
+// Description:
+// Builds the backend named by cfg.Storage.Backend.
+//
+// Backends:
+//      appengine - datastore, memcache, and Google Cloud Storage bucket Storage.GCSBucket
+//      memory - process memory, lost on exit
+//      file - JSON and image files under Storage.DataDir
+//
+// Returns:
+//      backend(StorageBackend) - Ready to use backend.
+//      failure?(error) - If the backend is unknown or cannot be opened.
+func OpenStorageBackend(cfg Config) (StorageBackend, error) {
+	switch cfg.Storage.Backend {
+	case "appengine":
+		return NewAppEngineBackend(cfg.Storage.GCSBucket), nil
+	case "memory":
+		return NewMemoryBackend(), nil
+	case "file":
+		return NewFileBackend(cfg.Storage.DataDir)
+	}
+	return StorageBackend{}, ErrUnknownBackend
+}
@@ -0,0 +1,227 @@
+package main
+
+/*
+STORAGE_batch.go by Allen J. Mills
+    mm.d.yy
+
+    Changes that span many entities and files, made all together or not
+    at all. None of the stores have transactions that reach across
+    kinds and the blob store, so a Batch stages its changes and only
+    makes them on Commit, keeping what each one replaced. If any change
+    fails, every change already made is undone in reverse order: puts
+    are deleted or put back, deletes are put back, and files are moved
+    back. Commit then returns a Rollback describing what was undone.
+*/
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"reflect"
+	"strings"
+)
+
+// Type: Batch
+// Staged changes. Use NewBatch, stage with Place, Put, Delete, MoveBlob or Do, then Commit.
+type Batch struct {
+	steps []batchStep
+}
+
+type batchStep struct {
+	change string
+	apply  func(ctx context.Context, s *batchStep) (undo func(ctx context.Context) error, err error)
+}
+
+// Type: Rollback
+// The error Commit returns when a change failed and the batch was undone.
+type Rollback struct {
+	Failed string   // The change that failed
+	Reason string   // Why it failed
+	Undone []string // Changes undone, most recent first
+	Stuck  []string // Changes that could not be undone, and why; these need fixing by hand
+}
+
+func (r *Rollback) Error() string {
+	msg := fmt.Sprint("Storage: ", r.Failed, " failed: ", r.Reason, ". ", len(r.Undone), " changes rolled back.")
+	if len(r.Stuck) > 0 {
+		msg += " Could not roll back: " + strings.Join(r.Stuck, "; ")
+	}
+	return msg
+}
+
+func NewBatch() *Batch {
+	return &Batch{steps: make([]batchStep, 0)}
+}
+
+// Method: Len
+// The number of changes staged.
+func (b *Batch) Len() int {
+	return len(b.steps)
+}
+
+// Method: Do
+// Stages any change. undo must reverse apply, it is only called if apply succeeded.
+func (b *Batch) Do(change string, apply, undo func(ctx context.Context) error) {
+	b.steps = append(b.steps, batchStep{change, func(ctx context.Context, s *batchStep) (func(ctx context.Context) error, error) {
+		return undo, apply(ctx)
+	}})
+}
+
+// Method: Place
+// Stages PlaceInDatastore(ctx, *id, source). A zero *id allocates a new id,
+// which is written back to *id once placed. prepare, if not nil, is called
+// just before placing, when the ids of earlier changes are known.
+func (b *Batch) Place(id *int64, source Entity, prepare func()) {
+	b.steps = append(b.steps, batchStep{"place " + source.Kind(), func(ctx context.Context, s *batchStep) (func(ctx context.Context) error, error) {
+		if prepare != nil {
+			prepare()
+		}
+		key, undo, putErr := batchPut(ctx, NewEntityKey(source.Kind(), *id), source)
+		if putErr != nil {
+			return nil, putErr
+		}
+		s.change = "place " + key.String()
+		if *id != 0 {
+			return undo, nil
+		}
+		*id = key.IntID
+		return func(ctx context.Context) error {
+			*id = 0
+			return undo(ctx)
+		}, nil
+	}})
+}
+
+// Method: Put
+// Stages storing src at the complete key k.
+func (b *Batch) Put(k EntityKey, src interface{}) {
+	b.steps = append(b.steps, batchStep{"put " + k.String(), func(ctx context.Context, s *batchStep) (func(ctx context.Context) error, error) {
+		_, undo, putErr := batchPut(ctx, k, src)
+		return undo, putErr
+	}})
+}
+
+// Internal Function
+// Description:
+// Stores src at k, keeping what was there before.
+//
+// Returns:
+//      key(EntityKey) - The key stored under, allocated if k was incomplete.
+//      undo(func) - Puts back what was at key, or deletes it if nothing was.
+//      failure?(error) - Any storage error; nothing was stored.
+func batchPut(ctx context.Context, k EntityKey, src interface{}) (EntityKey, func(ctx context.Context) error, error) {
+	var was interface{}
+	if !k.Incomplete() {
+		was = reflect.New(reflect.TypeOf(src).Elem()).Interface()
+		if getErr := Stores.Entities.Get(ctx, k, was); getErr == ErrNoSuchEntity {
+			was = nil
+		} else if getErr != nil {
+			return k, nil, getErr
+		}
+	}
+
+	key, putErr := Stores.Entities.Put(ctx, k, src)
+	if putErr != nil {
+		return k, nil, putErr
+	}
+	return key, func(ctx context.Context) error {
+		if was != nil {
+			_, putErr := Stores.Entities.Put(ctx, key, was)
+			return putErr
+		}
+		return Stores.Entities.Delete(ctx, []EntityKey{key})
+	}, nil
+}
+
+// Method: Delete
+// Stages deleting k. was must point to a value of k's type; the entity
+// is loaded into it when deleted, so it can be put back.
+func (b *Batch) Delete(k EntityKey, was interface{}) {
+	b.steps = append(b.steps, batchStep{"delete " + k.String(), func(ctx context.Context, s *batchStep) (func(ctx context.Context) error, error) {
+		existed := true
+		if getErr := Stores.Entities.Get(ctx, k, was); getErr == ErrNoSuchEntity {
+			existed = false
+		} else if getErr != nil {
+			return nil, getErr
+		}
+		if delErr := Stores.Entities.Delete(ctx, []EntityKey{k}); delErr != nil {
+			return nil, delErr
+		}
+
+		return func(ctx context.Context) error {
+			if !existed {
+				return nil
+			}
+			_, putErr := Stores.Entities.Put(ctx, k, was)
+			return putErr
+		}, nil
+	}})
+}
+
+// Method: MoveBlob
+// Stages moving file from to to. Undoing moves it back.
+func (b *Batch) MoveBlob(from, to string) {
+	b.Do("move file "+from+" to "+to, func(ctx context.Context) error {
+		return moveBlob(ctx, from, to)
+	}, func(ctx context.Context) error {
+		return moveBlob(ctx, to, from)
+	})
+}
+
+// Internal Function
+// Description:
+// Makes every staged change in order. On the first failure the changes
+// already made are undone, newest first.
+//
+// Returns:
+//      failure?(error) - *Rollback if a change failed.
+func (b *Batch) Commit(ctx context.Context) error {
+	type made struct {
+		change string
+		undo   func(ctx context.Context) error
+	}
+	done := make([]made, 0, len(b.steps))
+
+	for i := range b.steps {
+		s := &b.steps[i]
+		undo, applyErr := s.apply(ctx, s)
+		if applyErr == nil {
+			done = append(done, made{s.change, undo})
+			continue
+		}
+
+		rb := &Rollback{Failed: s.change, Reason: applyErr.Error(), Undone: make([]string, 0), Stuck: make([]string, 0)}
+		for i := len(done) - 1; i >= 0; i-- {
+			if undoErr := done[i].undo(ctx); undoErr != nil {
+				rb.Stuck = append(rb.Stuck, done[i].change+": "+undoErr.Error())
+				continue
+			}
+			rb.Undone = append(rb.Undone, done[i].change)
+		}
+		return rb
+	}
+	return nil
+}
+
+// Internal Function
+// Description:
+// Copies file from to to, then removes from. If from cannot be removed
+// the copy is removed, leaving things as they were.
+//
+// Returns:
+//      failure?(error) - Any storage error, ErrNoSuchBlob if from is missing.
+func moveBlob(ctx context.Context, from, to string) error {
+	rdr, getErr := Stores.Blobs.GetBlob(ctx, from)
+	if getErr != nil {
+		return getErr
+	}
+	putErr := Stores.Blobs.PutBlob(ctx, to, imageContentType(to), rdr)
+	rdr.Close()
+	if putErr != nil {
+		return putErr
+	}
+	if delErr := Stores.Blobs.DeleteBlob(ctx, from); delErr != nil {
+		Stores.Blobs.DeleteBlob(ctx, to)
+		return delErr
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Type: failingEntityStore
+// An EntityStore whose failAt'th write fails, counting from 1, and when
+// stuck every write after it too.
+type failingEntityStore struct {
+	EntityStore
+	writes int
+	failAt int
+	stuck  bool
+}
+
+var errWriteFailed = errors.New("Test: Write failed.")
+
+func (f *failingEntityStore) write() error {
+	if f.writes++; f.writes == f.failAt || f.stuck && f.writes > f.failAt {
+		return errWriteFailed
+	}
+	return nil
+}
+
+func (f *failingEntityStore) Put(ctx context.Context, k EntityKey, src interface{}) (EntityKey, error) {
+	if err := f.write(); err != nil {
+		return k, err
+	}
+	return f.EntityStore.Put(ctx, k, src)
+}
+
+func (f *failingEntityStore) Delete(ctx context.Context, keys []EntityKey) error {
+	if err := f.write(); err != nil {
+		return err
+	}
+	return f.EntityStore.Delete(ctx, keys)
+}
+
+type batchTestEntity struct {
+	Value int
+}
+
+// Internal Function
+// Description:
+// Stores A=1 and B=2 and the file old.png, then stages a batch that
+// changes all of them and adds more: five entity writes and a file move.
+func stageTestBatch(t *testing.T, ctx context.Context) (*Batch, *int64) {
+	Stores = NewMemoryBackend()
+	for k, v := range map[string]int{"A": 1, "B": 2} {
+		if _, putErr := Stores.Entities.Put(ctx, EntityKey{Kind: "Test", StringID: k}, &batchTestEntity{v}); putErr != nil {
+			t.Fatal(putErr)
+		}
+	}
+	if putErr := Stores.Blobs.PutBlob(ctx, "old.png", "image/png", bytes.NewReader([]byte("png"))); putErr != nil {
+		t.Fatal(putErr)
+	}
+
+	placed := new(int64)
+	b := NewBatch()
+	b.Put(EntityKey{Kind: "Test", StringID: "A"}, &batchTestEntity{10})
+	b.Put(EntityKey{Kind: "Test", StringID: "C"}, &batchTestEntity{30})
+	b.Delete(EntityKey{Kind: "Test", StringID: "B"}, &batchTestEntity{})
+	b.MoveBlob("old.png", "new.png")
+	b.Place(placed, &Book{Title: "Placed"}, nil)
+	b.Put(EntityKey{Kind: "Test", StringID: "D"}, &batchTestEntity{40})
+	return b, placed
+}
+
+// Internal Function
+// Description:
+// Gets the stored values of the test entities, -1 for those missing.
+func batchTestValues(ctx context.Context) map[string]int {
+	values := make(map[string]int)
+	for _, k := range []string{"A", "B", "C", "D"} {
+		e := &batchTestEntity{}
+		if getErr := Stores.Entities.Get(ctx, EntityKey{Kind: "Test", StringID: k}, e); getErr != nil {
+			values[k] = -1
+			continue
+		}
+		values[k] = e.Value
+	}
+	return values
+}
+
+func TestBatchCommit(t *testing.T) {
+	ctx := context.Background()
+	b, placed := stageTestBatch(t, ctx)
+	if commitErr := b.Commit(ctx); commitErr != nil {
+		t.Fatal(commitErr)
+	}
+	if got, want := batchTestValues(ctx), map[string]int{"A": 10, "B": -1, "C": 30, "D": 40}; !reflect.DeepEqual(got, want) {
+		t.Errorf("values are %v, want %v", got, want)
+	}
+	if *placed == 0 {
+		t.Error("placed id was not set")
+	}
+}
+
+func TestBatchRollback(t *testing.T) {
+	ctx := context.Background()
+	b, placed := stageTestBatch(t, ctx)
+	store := &failingEntityStore{EntityStore: Stores.Entities, failAt: 5}
+	Stores.Entities = store
+
+	commitErr := b.Commit(ctx)
+	rb, isRollback := commitErr.(*Rollback)
+	if !isRollback {
+		t.Fatalf("Commit gave %v, want a *Rollback", commitErr)
+	}
+	if rb.Failed != "put Test:D" || rb.Reason != errWriteFailed.Error() {
+		t.Errorf("failed change is %q because %q", rb.Failed, rb.Reason)
+	}
+	if len(rb.Stuck) != 0 {
+		t.Errorf("stuck changes %v", rb.Stuck)
+	}
+	Stores.Entities = store.EntityStore
+
+	if len(rb.Undone) > 0 && strings.HasPrefix(rb.Undone[0], "place Books:") {
+		rb.Undone[0] = "place Books"
+	}
+	wantUndone := []string{"place Books", "move file old.png to new.png", "delete Test:B", "put Test:C", "put Test:A"}
+	if *placed != 0 || !reflect.DeepEqual(rb.Undone, wantUndone) {
+		t.Errorf("undone %q with placed id %d, want %q", rb.Undone, *placed, wantUndone)
+	}
+	if got, want := batchTestValues(ctx), map[string]int{"A": 1, "B": 2, "C": -1, "D": -1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("values are %v, want %v", got, want)
+	}
+	if keys, _ := Stores.Entities.GetAll(ctx, NewEntityQuery("Books"), nil); len(keys) != 0 {
+		t.Errorf("placed book %v was kept", keys)
+	}
+	if rdr, getErr := Stores.Blobs.GetBlob(ctx, "old.png"); getErr != nil {
+		t.Error("moved file was not moved back")
+	} else {
+		data, _ := ioutil.ReadAll(rdr)
+		rdr.Close()
+		if string(data) != "png" {
+			t.Errorf("moved back file holds %q", data)
+		}
+	}
+	if _, getErr := Stores.Blobs.GetBlob(ctx, "new.png"); getErr != ErrNoSuchBlob {
+		t.Errorf("moved file left a copy: %v", getErr)
+	}
+}
+
+func TestBatchRollbackStuck(t *testing.T) {
+	ctx := context.Background()
+	b, _ := stageTestBatch(t, ctx)
+	// The third write fails, and so does every undo after it.
+	Stores.Entities = &failingEntityStore{EntityStore: Stores.Entities, failAt: 3, stuck: true}
+
+	rb, isRollback := b.Commit(ctx).(*Rollback)
+	if !isRollback {
+		t.Fatal("Commit did not roll back")
+	}
+	if rb.Failed != "delete Test:B" || len(rb.Undone) != 0 || len(rb.Stuck) != 2 {
+		t.Fatalf("rollback is %+v", rb)
+	}
+	for i, change := range []string{"put Test:C", "put Test:A"} {
+		if want := change + ": " + errWriteFailed.Error(); rb.Stuck[i] != want {
+			t.Errorf("stuck %q, want %q", rb.Stuck[i], want)
+		}
+	}
+}
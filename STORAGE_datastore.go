@@ -1,24 +1,91 @@
 package main
 
 /*
-filename.go by Allen J. Mills
+STORAGE_datastore.go by Allen J. Mills
     mm.d.yy
 
-    Description
+    Helpers for placing application structs into the active
+    EntityStore and CacheStore.
 */
 
 import (
-	"github.com/Esseh/retrievable"
+	"encoding/json"
 	"golang.org/x/net/context"
-	"google.golang.org/appengine/datastore"
+	"time"
 )
 
-func PlaceInDatastore(ctx context.Context, key interface{}, source retrievable.Retrievable) (*datastore.Key, error) {
-	return retrievable.PlaceInDatastore(ctx, key, source)
+// Type: Entity
+// Any struct stored in an EntityStore. Kind names its table.
+type Entity interface {
+	Kind() string
 }
-func GetFromDatastore(ctx context.Context, key interface{}, source retrievable.Retrievable) error {
-	return retrievable.GetFromDatastore(ctx, key, source)
+
+// Internal Function
+// Description:
+// Stores source under key. A zero key allocates a new id.
+//
+// Returns:
+//      id(int64) - Id the entity was stored under.
+//      failure?(error) - If any errors occur they exist here.
+func PlaceInDatastore(ctx context.Context, key int64, source Entity) (int64, error) {
+	k, err := Stores.Entities.Put(ctx, NewEntityKey(source.Kind(), key), source)
+	return k.IntID, err
+}
+func GetFromDatastore(ctx context.Context, key int64, source Entity) error {
+	return Stores.Entities.Get(ctx, NewEntityKey(source.Kind(), key), source)
+}
+func DeleteFromDatastore(ctx context.Context, key int64, source Entity) error {
+	return Stores.Entities.Delete(ctx, []EntityKey{NewEntityKey(source.Kind(), key)})
 }
-func DeleteFromDatastore(ctx context.Context, key interface{}, source retrievable.Retrievable) error {
-	return retrievable.DeleteFromDatastore(ctx, key, source)
+
+// Most keys the datastore deletes in one call.
+const maxDeleteKeys = 500
+
+// Internal Function
+// Description:
+// Deletes keys in calls of at most maxDeleteKeys, in order. A failure
+// leaves the keys of the failed call and those after it in place.
+//
+// Returns:
+//      failure?(error) - The first error met.
+func DeleteAllFromDatastore(ctx context.Context, keys []EntityKey) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxDeleteKeys {
+			n = maxDeleteKeys
+		}
+		if err := Stores.Entities.Delete(ctx, keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// Internal Function
+// Description:
+// Stores value as JSON in the cache at key with a life of expiration.
+//
+// Returns:
+//      failure?(error) - If any errors occur they exist here.
+func PlaceInCache(ctx context.Context, key string, value interface{}, expiration time.Duration) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return Stores.Cache.CacheSet(ctx, key, b, expiration)
+}
+
+// Internal Function
+// Description:
+// Loads the JSON value at key from the cache into dst.
+//
+// Returns:
+//      failure?(error) - ErrCacheMiss if the key is not present.
+func GetFromCache(ctx context.Context, key string, dst interface{}) error {
+	b, err := Stores.Cache.CacheGet(ctx, key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
 }
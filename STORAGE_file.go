@@ -0,0 +1,232 @@
+package main
+
+/*
+STORAGE_file.go by Allen J. Mills
+    mm.d.yy
+
+    Filesystem storage backend.
+    Layout under the data directory:
+        entities/<Kind>.json   every entity of a kind
+        blobs/<name>           one file per blob
+    Cache entries are kept in memory only.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrInvalidBlobName = errors.New("Storage: Invalid file name.") // ErrInvalidBlobName is returned for blob names that would leave the blob directory.
+)
+
+// Internal Function
+// Description:
+// Makes a backend that stores entities and blobs under dataDir,
+// creating the directory if needed.
+//
+// Returns:
+//      backend(StorageBackend) - Ready to use backend.
+//      failure?(error) - If dataDir cannot be created or read.
+func NewFileBackend(dataDir string) (StorageBackend, error) {
+	if dataDir == "" {
+		return StorageBackend{}, errors.New("Storage: file backend requires a data directory.")
+	}
+	entities, err := NewFileEntityStore(filepath.Join(dataDir, "entities"))
+	if err != nil {
+		return StorageBackend{}, err
+	}
+	blobs, err := NewFileBlobStore(filepath.Join(dataDir, "blobs"))
+	if err != nil {
+		return StorageBackend{}, err
+	}
+	return StorageBackend{
+		Name:     "file",
+		Entities: entities,
+		Cache:    NewMemoryCacheStore(),
+		Blobs:    blobs,
+		Context: func(req *http.Request) context.Context {
+			return req.Context()
+		},
+	}, nil
+}
+
+// Internal Function
+// Description:
+// Writes data to path by way of a temporary file, so readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ------------------------------------
+// Entities
+/////
+
+// Type: FileEntityStore
+// A MemoryEntityStore that writes each kind back to disk after every change.
+type FileEntityStore struct {
+	*MemoryEntityStore
+	dir string
+}
+
+// Type: fileEntityRecord
+// On disk form of a single entity.
+type fileEntityRecord struct {
+	StringID string `json:",omitempty"`
+	IntID    int64  `json:",omitempty"`
+	Data     json.RawMessage
+}
+
+func NewFileEntityStore(dir string) (*FileEntityStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f := &FileEntityStore{NewMemoryEntityStore(), dir}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range files {
+		kind := strings.TrimSuffix(filepath.Base(path), ".json")
+		data, readErr := ioutil.ReadFile(path)
+		if readErr != nil {
+			return nil, readErr
+		}
+		records := make([]fileEntityRecord, 0)
+		if jsonErr := json.Unmarshal(data, &records); jsonErr != nil {
+			return nil, jsonErr
+		}
+		f.kinds[kind] = make(map[EntityKey][]byte)
+		for _, r := range records {
+			k := EntityKey{Kind: kind, StringID: r.StringID, IntID: r.IntID}
+			f.kinds[kind][k] = []byte(r.Data)
+			if k.IntID >= f.nextID {
+				f.nextID = k.IntID + 1
+			}
+		}
+	}
+
+	f.onChange = f.writeKind
+	return f, nil
+}
+
+// Internal Function
+// Description:
+// Writes every entity of kind to its file. Called with the store lock held.
+//
+// Returns:
+//      failure?(error) - If the file could not be written, in which case the old file is kept.
+func (f *FileEntityStore) writeKind(kind string) error {
+	records := make([]fileEntityRecord, 0, len(f.kinds[kind]))
+	for k, data := range f.kinds[kind] {
+		records = append(records, fileEntityRecord{k.StringID, k.IntID, json.RawMessage(data)})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].IntID != records[j].IntID {
+			return records[i].IntID < records[j].IntID
+		}
+		return records[i].StringID < records[j].StringID
+	})
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(f.dir, kind+".json"), data)
+}
+
+// ------------------------------------
+// Blobs
+/////
+
+// Type: FileBlobStore
+// BlobStore kept as plain files under a directory.
+type FileBlobStore struct {
+	dir string
+}
+
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileBlobStore{dir}, nil
+}
+
+// Internal Function
+// Description:
+// Maps a blob name onto a path inside the blob directory.
+func (f *FileBlobStore) path(name string) (string, error) {
+	clean := filepath.Clean("/" + name)
+	if name == "" || clean == "/" || clean != "/"+name {
+		return "", ErrInvalidBlobName
+	}
+	return filepath.Join(f.dir, filepath.FromSlash(clean)), nil
+}
+
+func (f *FileBlobStore) PutBlob(ctx context.Context, name, contentType string, r io.Reader) error {
+	path, err := f.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+func (f *FileBlobStore) GetBlob(ctx context.Context, name string) (io.ReadCloser, error) {
+	path, err := f.path(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNoSuchBlob
+	}
+	return file, err
+}
+
+func (f *FileBlobStore) DeleteBlob(ctx context.Context, name string) error {
+	path, err := f.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return ErrNoSuchBlob
+	}
+	return err
+}
+
+func (f *FileBlobStore) ListBlobs(ctx context.Context, prefix string) ([]string, error) {
+	names := make([]string, 0)
+	err := filepath.Walk(f.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return err
+		}
+		rel, _ := filepath.Rel(f.dir, path)
+		name := filepath.ToSlash(rel)
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
@@ -0,0 +1,440 @@
+package main
+
+/*
+STORAGE_memory.go by Allen J. Mills
+    mm.d.yy
+
+    Process memory storage backend.
+    Entities are held as JSON documents so that queries behave the
+    same as they would against datastore: filters and orders work on
+    stored property names, and loaded values are copies.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryFirstID is where allocated ids begin. Ids share one sequence
+// across kinds and are all the same width, so an id is never the
+// prefix of another. Image names depend on this.
+const memoryFirstID = int64(1) << 52
+
+// Internal Function
+// Description:
+// Makes a backend that keeps everything in process memory.
+func NewMemoryBackend() StorageBackend {
+	return StorageBackend{
+		Name:     "memory",
+		Entities: NewMemoryEntityStore(),
+		Cache:    NewMemoryCacheStore(),
+		Blobs:    NewMemoryBlobStore(),
+		Context: func(req *http.Request) context.Context {
+			return req.Context()
+		},
+	}
+}
+
+// ------------------------------------
+// Entities
+/////
+
+// Type: MemoryEntityStore
+// EntityStore held in process memory.
+type MemoryEntityStore struct {
+	mu     sync.RWMutex
+	kinds  map[string]map[EntityKey][]byte
+	nextID int64
+
+	// onChange, if set, is called with the kind after every write while mu is held.
+	// When it fails the write is undone and its error returned.
+	onChange func(kind string) error
+}
+
+func NewMemoryEntityStore() *MemoryEntityStore {
+	return &MemoryEntityStore{
+		kinds:  make(map[string]map[EntityKey][]byte),
+		nextID: memoryFirstID,
+	}
+}
+
+func (m *MemoryEntityStore) Get(ctx context.Context, k EntityKey, dst interface{}) error {
+	m.mu.RLock()
+	data, ok := m.kinds[k.Kind][k]
+	m.mu.RUnlock()
+	if !ok {
+		return ErrNoSuchEntity
+	}
+	return json.Unmarshal(data, dst)
+}
+
+func (m *MemoryEntityStore) Put(ctx context.Context, k EntityKey, src interface{}) (EntityKey, error) {
+	data, err := json.Marshal(src)
+	if err != nil {
+		return k, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.store(k, data)
+}
+
+func (m *MemoryEntityStore) Insert(ctx context.Context, k EntityKey, src interface{}) error {
+	data, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, taken := m.kinds[k.Kind][k]; taken {
+		return ErrEntityExists
+	}
+	_, err = m.store(k, data)
+	return err
+}
+
+// Internal Function
+// Description:
+// Stores data at k, allocating an id for an incomplete key. Called with the lock held.
+// If onChange fails, the previous value at k is put back.
+func (m *MemoryEntityStore) store(k EntityKey, data []byte) (EntityKey, error) {
+	if k.Incomplete() {
+		k.IntID = m.nextID
+		m.nextID++
+	} else if k.IntID >= m.nextID {
+		m.nextID = k.IntID + 1
+	}
+	if m.kinds[k.Kind] == nil {
+		m.kinds[k.Kind] = make(map[EntityKey][]byte)
+	}
+	previous, existed := m.kinds[k.Kind][k]
+	m.kinds[k.Kind][k] = data
+	if m.onChange != nil {
+		if err := m.onChange(k.Kind); err != nil {
+			if existed {
+				m.kinds[k.Kind][k] = previous
+			} else {
+				delete(m.kinds[k.Kind], k)
+			}
+			return k, err
+		}
+	}
+	return k, nil
+}
+
+func (m *MemoryEntityStore) Delete(ctx context.Context, keys []EntityKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	removed := make(map[string]map[EntityKey][]byte)
+	for _, k := range keys {
+		if data, ok := m.kinds[k.Kind][k]; ok {
+			delete(m.kinds[k.Kind], k)
+			if removed[k.Kind] == nil {
+				removed[k.Kind] = make(map[EntityKey][]byte)
+			}
+			removed[k.Kind][k] = data
+		}
+	}
+	if m.onChange == nil {
+		return nil
+	}
+	var failure error
+	for kind, entities := range removed {
+		if err := m.onChange(kind); err != nil {
+			// Kinds already written stay deleted; this one is put back as it was.
+			for k, data := range entities {
+				m.kinds[kind][k] = data
+			}
+			failure = err
+		}
+	}
+	return failure
+}
+
+// Type: memoryRow
+// A stored entity decoded for query evaluation.
+type memoryRow struct {
+	key    EntityKey
+	data   []byte
+	fields map[string]interface{}
+}
+
+func (m *MemoryEntityStore) GetAll(ctx context.Context, q *EntityQuery, dst interface{}) ([]EntityKey, error) {
+	m.mu.RLock()
+	rows := make([]memoryRow, 0, len(m.kinds[q.Kind]))
+	for k, data := range m.kinds[q.Kind] {
+		fields := make(map[string]interface{})
+		json.Unmarshal(data, &fields)
+		rows = append(rows, memoryRow{k, data, fields})
+	}
+	m.mu.RUnlock()
+
+	filters := make([]EntityFilter, 0, len(q.Filters))
+	for _, f := range q.Filters {
+		f.Value = normalizeQueryValue(f.Value)
+		filters = append(filters, f)
+	}
+
+	matched := rows[:0]
+	for _, r := range rows {
+		if rowMatches(r, filters) {
+			matched = append(matched, r)
+		}
+	}
+
+	// Key order first, so results are stable when no order is given.
+	sort.Slice(matched, func(i, j int) bool {
+		if matched[i].key.IntID != matched[j].key.IntID {
+			return matched[i].key.IntID < matched[j].key.IntID
+		}
+		return matched[i].key.StringID < matched[j].key.StringID
+	})
+	sort.SliceStable(matched, func(i, j int) bool {
+		for _, o := range q.Orders {
+			field, desc := strings.TrimPrefix(o, "-"), strings.HasPrefix(o, "-")
+			c := compareQueryValues(matched[i].fields[field], matched[j].fields[field])
+			if c != 0 {
+				return (c < 0) != desc
+			}
+		}
+		return false
+	})
+
+	if q.Max > 0 && len(matched) > q.Max {
+		matched = matched[:q.Max]
+	}
+
+	keys := make([]EntityKey, 0, len(matched))
+	var slice reflect.Value
+	if dst != nil {
+		slice = reflect.ValueOf(dst).Elem()
+	}
+	for _, r := range matched {
+		keys = append(keys, r.key)
+		if dst == nil {
+			continue
+		}
+		elem := reflect.New(slice.Type().Elem())
+		if err := json.Unmarshal(r.data, elem.Interface()); err != nil {
+			return keys, err
+		}
+		slice.Set(reflect.Append(slice, elem.Elem()))
+	}
+	return keys, nil
+}
+
+func rowMatches(r memoryRow, filters []EntityFilter) bool {
+	for _, f := range filters {
+		c := compareQueryValues(r.fields[f.Field], f.Value)
+		switch f.Op {
+		case "=":
+			if c != 0 {
+				return false
+			}
+		case "<":
+			if c >= 0 {
+				return false
+			}
+		case "<=":
+			if c > 0 {
+				return false
+			}
+		case ">":
+			if c <= 0 {
+				return false
+			}
+		case ">=":
+			if c < 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Internal Function
+// Description:
+// Converts a filter value to the same representation stored fields decode to.
+func normalizeQueryValue(v interface{}) interface{} {
+	b, _ := json.Marshal(v)
+	var out interface{}
+	json.Unmarshal(b, &out)
+	return out
+}
+
+// Internal Function
+// Description:
+// Orders two decoded JSON values. Times, stored as RFC3339 strings,
+// are compared as times. Missing values sort first.
+func compareQueryValues(a, b interface{}) int {
+	switch av := a.(type) {
+	case nil:
+		if b == nil {
+			return 0
+		}
+		return -1
+	case float64:
+		bv, ok := b.(float64)
+		if !ok {
+			return -1
+		}
+		switch {
+		case av < bv:
+			return -1
+		case av > bv:
+			return 1
+		}
+		return 0
+	case bool:
+		bv, _ := b.(bool)
+		switch {
+		case av == bv:
+			return 0
+		case !av:
+			return -1
+		}
+		return 1
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return 1
+		}
+		at, aErr := time.Parse(time.RFC3339Nano, av)
+		bt, bErr := time.Parse(time.RFC3339Nano, bv)
+		if aErr == nil && bErr == nil {
+			switch {
+			case at.Before(bt):
+				return -1
+			case at.After(bt):
+				return 1
+			}
+			return 0
+		}
+		return strings.Compare(av, bv)
+	}
+	if b == nil {
+		return 1
+	}
+	return 0
+}
+
+// ------------------------------------
+// Cache
+/////
+
+type memoryCacheEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// Type: MemoryCacheStore
+// CacheStore held in process memory.
+type MemoryCacheStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryCacheEntry
+}
+
+func NewMemoryCacheStore() *MemoryCacheStore {
+	return &MemoryCacheStore{entries: make(map[string]memoryCacheEntry)}
+}
+
+func (m *MemoryCacheStore) CacheSet(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	e := memoryCacheEntry{value: append([]byte(nil), value...)}
+	if expiration > 0 {
+		e.expires = time.Now().Add(expiration)
+	}
+	m.mu.Lock()
+	m.entries[key] = e
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryCacheStore) CacheGet(ctx context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		delete(m.entries, key)
+		return nil, ErrCacheMiss
+	}
+	return append([]byte(nil), e.value...), nil
+}
+
+func (m *MemoryCacheStore) CacheDelete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	delete(m.entries, key)
+	m.mu.Unlock()
+	return nil
+}
+
+// ------------------------------------
+// Blobs
+/////
+
+// Type: MemoryBlobStore
+// BlobStore held in process memory.
+type MemoryBlobStore struct {
+	mu    sync.RWMutex
+	blobs map[string][]byte
+}
+
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{blobs: make(map[string][]byte)}
+}
+
+func (m *MemoryBlobStore) PutBlob(ctx context.Context, name, contentType string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.blobs[name] = data
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryBlobStore) GetBlob(ctx context.Context, name string) (io.ReadCloser, error) {
+	m.mu.RLock()
+	data, ok := m.blobs[name]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, ErrNoSuchBlob
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *MemoryBlobStore) DeleteBlob(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.blobs[name]; !ok {
+		return ErrNoSuchBlob
+	}
+	delete(m.blobs, name)
+	return nil
+}
+
+func (m *MemoryBlobStore) ListBlobs(ctx context.Context, prefix string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	names := make([]string, 0)
+	for name := range m.blobs {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
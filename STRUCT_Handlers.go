@@ -10,7 +10,6 @@ filename.go by Allen J. Mills
 import (
 	"errors"
 	"github.com/julienschmidt/httprouter"
-	"google.golang.org/appengine"
 	"net/http"
 	"strconv"
 )
@@ -27,7 +26,7 @@ import (
 // Mandatory Options: ID
 // Optional Options:
 func getCatalogEditor(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	if validPerm, permErr := HasPermission(res, req, WritePermissions); !validPerm {
+	if validPerm, permErr := HasPermission(res, req, WritePermissions, ScopeOf("Catalog", params.ByName("ID"))); !validPerm {
 		// User Must be at least Writer.
 		ErrorPage(res, "Invalid Permission", permErr)
 		return
@@ -44,7 +43,7 @@ func getCatalogEditor(res http.ResponseWriter, req *http.Request, params httprou
 		return
 	}
 
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 	itemToScreen, getErr := GetCatalogFromDatastore(ctx, int64(i))
 	if ErrorPage(res, "Internal Services Error", getErr) {
 		return
@@ -56,11 +55,13 @@ func getCatalogEditor(res http.ResponseWriter, req *http.Request, params httprou
 		Name       string
 		Email      string
 		Permission int
+		CSRFToken  string
 		Catalog
 	}{
 		pu.Name,
 		pu.Email,
 		pu.Permission,
+		pu.CSRFToken,
 		itemToScreen,
 	}
 
@@ -75,7 +76,7 @@ func getCatalogEditor(res http.ResponseWriter, req *http.Request, params httprou
 // Mandatory Options: ID
 // Optional Options:
 func getBookEditor(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	if validPerm, permErr := HasPermission(res, req, WritePermissions); !validPerm {
+	if validPerm, permErr := HasPermission(res, req, WritePermissions, ScopeOf("Book", params.ByName("ID"))); !validPerm {
 		// User Must be at least Writer.
 		ErrorPage(res, "Invalid Permission", permErr)
 		return
@@ -92,7 +93,7 @@ func getBookEditor(res http.ResponseWriter, req *http.Request, params httprouter
 		return
 	}
 
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 	itemToScreen, getErr := GetBookFromDatastore(ctx, int64(i))
 	if ErrorPage(res, "Internal Services Error", getErr) {
 		return
@@ -104,11 +105,13 @@ func getBookEditor(res http.ResponseWriter, req *http.Request, params httprouter
 		Name       string
 		Email      string
 		Permission int
+		CSRFToken  string
 		Book
 	}{
 		pu.Name,
 		pu.Email,
 		pu.Permission,
+		pu.CSRFToken,
 		itemToScreen,
 	}
 
@@ -123,7 +126,7 @@ func getBookEditor(res http.ResponseWriter, req *http.Request, params httprouter
 // Mandatory Options: ID
 // Optional Options:
 func getChapterEditor(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	if validPerm, permErr := HasPermission(res, req, WritePermissions); !validPerm {
+	if validPerm, permErr := HasPermission(res, req, WritePermissions, ScopeOf("Chapter", params.ByName("ID"))); !validPerm {
 		// User Must be at least Writer.
 		ErrorPage(res, "Invalid Permission", permErr)
 		return
@@ -140,7 +143,7 @@ func getChapterEditor(res http.ResponseWriter, req *http.Request, params httprou
 		return
 	}
 
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 	itemToScreen, getErr := GetChapterFromDatastore(ctx, int64(i))
 	if ErrorPage(res, "Internal Services Error", getErr) {
 		return
@@ -152,11 +155,13 @@ func getChapterEditor(res http.ResponseWriter, req *http.Request, params httprou
 		Name       string
 		Email      string
 		Permission int
+		CSRFToken  string
 		Chapter
 	}{
 		pu.Name,
 		pu.Email,
 		pu.Permission,
+		pu.CSRFToken,
 		itemToScreen,
 	}
 
@@ -171,7 +176,7 @@ func getChapterEditor(res http.ResponseWriter, req *http.Request, params httprou
 // Mandatory Options: ID
 // Optional Options:
 func getSectionEditor(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	if validPerm, permErr := HasPermission(res, req, WritePermissions); !validPerm {
+	if validPerm, permErr := HasPermission(res, req, WritePermissions, ScopeOf("Section", params.ByName("ID"))); !validPerm {
 		// User Must be at least Writer.
 		ErrorPage(res, "Invalid Permission", permErr)
 		return
@@ -188,7 +193,7 @@ func getSectionEditor(res http.ResponseWriter, req *http.Request, params httprou
 		return
 	}
 
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 	itemToScreen, getErr := GetSectionFromDatastore(ctx, int64(i))
 	if ErrorPage(res, "Internal Services Error", getErr) {
 		return
@@ -200,11 +205,13 @@ func getSectionEditor(res http.ResponseWriter, req *http.Request, params httprou
 		Name       string
 		Email      string
 		Permission int
+		CSRFToken  string
 		Section
 	}{
 		pu.Name,
 		pu.Email,
 		pu.Permission,
+		pu.CSRFToken,
 		itemToScreen,
 	}
 
@@ -221,7 +228,7 @@ func getSectionEditor(res http.ResponseWriter, req *http.Request, params httprou
 // Mandatory Options: ID
 // Optional Options:
 func getSimpleObjectiveEditor(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	if validPerm, permErr := HasPermission(res, req, WritePermissions); !validPerm {
+	if validPerm, permErr := HasPermission(res, req, WritePermissions, ScopeOf("Objective", params.ByName("ID"))); !validPerm {
 		// User Must be at least Writer.
 		ErrorPage(res, "Invalid Permission", permErr)
 		return
@@ -238,7 +245,7 @@ func getSimpleObjectiveEditor(res http.ResponseWriter, req *http.Request, params
 		return
 	}
 
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 	itemToScreen, getErr := GetObjectiveFromDatastore(ctx, int64(i))
 	if ErrorPage(res, "Internal Services Error", getErr) {
 		return
@@ -250,11 +257,13 @@ func getSimpleObjectiveEditor(res http.ResponseWriter, req *http.Request, params
 		Name       string
 		Email      string
 		Permission int
+		CSRFToken  string
 		Objective
 	}{
 		pu.Name,
 		pu.Email,
 		pu.Permission,
+		pu.CSRFToken,
 		itemToScreen,
 	}
 
@@ -269,7 +278,7 @@ func getSimpleObjectiveEditor(res http.ResponseWriter, req *http.Request, params
 // Mandatory Options: ID
 // Optional Options:
 func getExerciseEditor(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	if validPerm, permErr := HasPermission(res, req, WritePermissions); !validPerm {
+	if validPerm, permErr := HasPermission(res, req, WritePermissions, ScopeOf("Exercise", params.ByName("ID"))); !validPerm {
 		// User Must be at least Writer.
 		ErrorPage(res, "Invalid Permission", permErr)
 		return
@@ -286,7 +295,7 @@ func getExerciseEditor(res http.ResponseWriter, req *http.Request, params httpro
 		return
 	}
 
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 	itemToScreen, getErr := GetExerciseFromDatastore(ctx, int64(i))
 	if ErrorPage(res, "Internal Services Error", getErr) {
 		return
@@ -298,11 +307,13 @@ func getExerciseEditor(res http.ResponseWriter, req *http.Request, params httpro
 		Name       string
 		Email      string
 		Permission int
+		CSRFToken  string
 		Exercise
 	}{
 		pu.Name,
 		pu.Email,
 		pu.Permission,
+		pu.CSRFToken,
 		itemToScreen,
 	}
 
@@ -325,6 +336,9 @@ func getExerciseEditor(res http.ResponseWriter, req *http.Request, params httpro
 // Optional Options:
 func getSimpleObjectiveReader(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
 	readID := params.ByName("ID")
+	if ErrorPage(res, "Objective Not Found", CheckReadable(res, req, ScopeOf("Objective", readID))) {
+		return
+	}
 	ServeTemplateWithParams(res, "simpleReader.html", readID)
 }
 
@@ -349,11 +363,14 @@ func getSimpleExerciseReader(res http.ResponseWriter, req *http.Request, params
 		return
 	}
 
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 	itemToScreen, getErr := GetExerciseFromDatastore(ctx, int64(i))
 	if ErrorPage(res, "Internal Services Error", getErr) {
 		return
 	}
+	if ErrorPage(res, "Exercise Not Found", CheckReadable(res, req, Scope{"Exercise", int64(i)})) {
+		return
+	}
 	ServeTemplateWithParams(res, "reader_exercise.html", itemToScreen)
 }
 
@@ -375,20 +392,25 @@ func getObjectivePreview(res http.ResponseWriter, req *http.Request, params http
 		return
 	}
 
-	ctx := appengine.NewContext(req)
+	ctx := NewContext(req)
 	objToScreen, getErr := GetObjectiveFromDatastore(ctx, objKey)
 	if ErrorPage(res, "Internal Services Error", getErr) {
 		return
 	}
+	if ErrorPage(res, "Objective Not Found", CheckReadable(res, req, Scope{"Objective", objKey})) {
+		return
+	}
 	screenOutput := struct {
 		Name       string
 		Email      string
 		Permission int
+		CSRFToken  string
 		Objective
 	}{
 		pu.Name,
 		pu.Email,
 		pu.Permission,
+		pu.CSRFToken,
 		objToScreen,
 	}
 
@@ -8,8 +8,6 @@ Model.go by Allen J. Mills
 */
 
 import (
-	"golang.org/x/net/context"
-	"google.golang.org/appengine/datastore"
 	"html/template"
 )
 
@@ -22,8 +20,8 @@ type Catalog struct {
 	ID int64 `datastore:"-"`
 }
 
-func (c *Catalog) Key(ctx context.Context, id interface{}) *datastore.Key {
-	return datastore.NewKey(ctx, "Catalogs", "", id.(int64), nil)
+func (c *Catalog) Kind() string {
+	return "Catalogs"
 }
 
 type Book struct { // Book has an ancestor in catalog, searchable based on catalog that it was a part of.
@@ -32,13 +30,14 @@ type Book struct { // Book has an ancestor in catalog, searchable based on catal
 	Author      string        // or array of strings
 	Tags        string        // searchable tags to describe the book, We can search based on substring.
 	Description template.HTML `datastore:",noindex"`
+	Visibility  string        // public, unlisted or private. Empty is public, see USER_Visibility.go.
 
 	Parent int64 // This is the key.string for Catalog
 	ID     int64 `datastore:"-"` // self.ID, assigned when pulled from datastore.
 }
 
-func (b *Book) Key(ctx context.Context, id interface{}) *datastore.Key {
-	return datastore.NewKey(ctx, "Books", "", id.(int64), nil)
+func (b *Book) Kind() string {
+	return "Books"
 }
 
 type Chapter struct { // Chapter has an ancestor in Book. Chapter only has meaning from book.
@@ -51,8 +50,8 @@ type Chapter struct { // Chapter has an ancestor in Book. Chapter only has meani
 	ID     int64 `datastore:"-"` // self.ID assigned when pulled from datastore.
 }
 
-func (c *Chapter) Key(ctx context.Context, id interface{}) *datastore.Key {
-	return datastore.NewKey(ctx, "Chapters", "", id.(int64), nil)
+func (c *Chapter) Kind() string {
+	return "Chapters"
 }
 
 type Section struct {
@@ -65,8 +64,8 @@ type Section struct {
 	ID     int64 `datastore:"-"`
 }
 
-func (s *Section) Key(ctx context.Context, id interface{}) *datastore.Key {
-	return datastore.NewKey(ctx, "Sections", "", id.(int64), nil)
+func (s *Section) Kind() string {
+	return "Sections"
 }
 
 type Objective struct {
@@ -82,8 +81,8 @@ type Objective struct {
 	ID     int64 `datastore:"-"`
 }
 
-func (o *Objective) Key(ctx context.Context, id interface{}) *datastore.Key {
-	return datastore.NewKey(ctx, "Objectives", "", id.(int64), nil)
+func (o *Objective) Kind() string {
+	return "Objectives"
 }
 
 type Exercise struct {
@@ -97,6 +96,6 @@ type Exercise struct {
 	ID     int64 `datastore:"-"`
 }
 
-func (e *Exercise) Key(ctx context.Context, id interface{}) *datastore.Key {
-	return datastore.NewKey(ctx, "Exercises", "", id.(int64), nil)
+func (e *Exercise) Kind() string {
+	return "Exercises"
 }
@@ -0,0 +1,518 @@
+package main
+
+/*
+STRUCT_revisions.go by Allen J. Mills
+    mm.d.yy
+
+    Revision history for written content. Every save through the
+    API_Make* calls that changes a kept field stores a new, numbered
+    revision holding those fields. Revisions are never changed; a
+    restore copies an old revision's fields back onto the structure
+    and is itself saved as a new revision.
+
+    Structures saved before history existed get their old state kept
+    as a first revision, without an author, the first time they change.
+
+    Revisions are keyed by <kind>:<id>:<number> and stored only if that
+    key is free, so two saves at once cannot both take a number; the
+    one that loses takes the next.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/net/context"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrNotRevisioned    = errors.New("Revisions: Kind has no revision history. Use Book, Chapter, Section, Objective, or Exercise.") // ErrNotRevisioned is returned for kinds without history.
+	ErrNoSuchRevision   = errors.New("Revisions: No such revision.")                                                                 // ErrNoSuchRevision is returned when a revision number does not exist.
+	ErrNothingToRestore = errors.New("Revisions: The structure no longer exists.")                                                   // ErrNothingToRestore is returned when restoring onto a deleted structure.
+	ErrRevisionBusy     = errors.New("Revisions: Too many saves at once, no revision number was free.")                              // ErrRevisionBusy is returned when every number tried was taken.
+)
+
+const (
+	RevisionsTable = "Revisions"
+
+	revisionAttempts = 10 // Numbers tried before a save gives up on its revision
+)
+
+// The fields each kind keeps in its revisions. A restore puts back exactly these.
+var revisionFields = map[string][]string{
+	"Book":      {"Title", "Author", "Version", "Tags", "Description"},
+	"Chapter":   {"Title", "Version", "Description"},
+	"Section":   {"Title", "Version", "Description"},
+	"Objective": {"Title", "Author", "Version", "Content", "KeyTakeaways"},
+	"Exercise":  {"Instruction", "Question", "Solution", "Answer"},
+}
+
+// Type: Revision
+// The kept fields of EntityKind EntityID as saved at Saved.
+// Number counts up from 1 for each structure.
+type Revision struct {
+	EntityKind   string
+	EntityID     int64
+	Number       int
+	Fields       string `datastore:",noindex" json:",omitempty"` // JSON object of the kept fields, cleared in listings
+	Author       string // Email of whoever saved it
+	Saved        time.Time
+	RestoredFrom int    // Revision brought back by a restore, 0 for ordinary saves
+	ID           string `datastore:"-"` // <kind>:<id>:<number>
+}
+
+// Method: Kind
+// Implements Entity interface
+func (r *Revision) Kind() string {
+	return RevisionsTable
+}
+
+// Type: FieldChange
+// One field that differs between two revisions.
+type FieldChange struct {
+	Field         string
+	Before, After interface{}
+}
+
+// Internal Function
+// Description:
+// Makes an empty structure of a kind with history.
+//
+// Returns:
+//      entity(Entity) - Empty structure, nil for kinds without history.
+func newRevisable(kind string) Entity {
+	switch kind {
+	case "Book":
+		return &Book{}
+	case "Chapter":
+		return &Chapter{}
+	case "Section":
+		return &Section{}
+	case "Objective":
+		return &Objective{}
+	case "Exercise":
+		return &Exercise{}
+	}
+	return nil
+}
+
+// Internal Function
+// Description:
+// The kept fields of v, a structure of the given kind, as a JSON object.
+func revisionSnapshot(kind string, v interface{}) string {
+	all := auditFields(v)
+	kept := make(map[string]interface{})
+	for _, f := range revisionFields[kind] {
+		kept[f] = all[f]
+	}
+	b, _ := json.Marshal(kept)
+	return string(b)
+}
+
+// Internal Function
+// Description:
+// The key of revision number of kind id.
+func revisionKey(kind string, id int64, number int) EntityKey {
+	return NewEntityKey(RevisionsTable, fmt.Sprint(kind, ":", id, ":", number))
+}
+
+// Internal Function
+// Description:
+// Gets the newest revision of kind id.
+//
+// Returns:
+//      revision(*Revision) - Newest revision, nil when there is no history.
+//      failure?(error) - Any storage error.
+func latestRevision(ctx context.Context, kind string, id int64) (*Revision, error) {
+	q := NewEntityQuery(RevisionsTable).Filter("EntityKind =", kind).Filter("EntityID =", id).Order("-Number").Limit(1)
+	found := make([]Revision, 0)
+	keys, getErr := Stores.Entities.GetAll(ctx, q, &found)
+	if getErr != nil || len(found) == 0 {
+		return nil, getErr
+	}
+	found[0].ID = keys[0].StringID
+	return &found[0], nil
+}
+
+// Internal Function
+// Description:
+// Stores a revision of kind id if its kept fields changed. before is the
+// structure as it was, used to start the history of older structures;
+// for new structures it is the empty structure or nil. A number taken by
+// another save in the meantime is skipped.
+//
+// Returns:
+//      revision(*Revision) - The stored revision, nil when nothing changed.
+//      failure?(error) - ErrNotRevisioned, ErrRevisionBusy or any storage error.
+func saveRevision(ctx context.Context, kind string, id int64, before, after interface{}, author string, restoredFrom int) (*Revision, error) {
+	empty := newRevisable(kind)
+	if empty == nil {
+		return nil, ErrNotRevisioned
+	}
+
+	latest, getErr := latestRevision(ctx, kind, id)
+	if getErr != nil {
+		return nil, getErr
+	}
+	snap := revisionSnapshot(kind, after)
+	if latest != nil && latest.Fields == snap {
+		return nil, nil
+	}
+
+	number := 1
+	if latest != nil {
+		number = latest.Number + 1
+	} else if before != nil {
+		if old := revisionSnapshot(kind, before); old != snap && old != revisionSnapshot(kind, empty) {
+			// Another save starting the history at once keeps its own baseline.
+			baseline := &Revision{EntityKind: kind, EntityID: id, Number: 1, Fields: old, Saved: time.Now()}
+			if insertErr := Stores.Entities.Insert(ctx, revisionKey(kind, id, 1), baseline); insertErr != nil && insertErr != ErrEntityExists {
+				return nil, insertErr
+			}
+			number = 2
+		}
+	}
+
+	r := &Revision{
+		EntityKind:   kind,
+		EntityID:     id,
+		Fields:       snap,
+		Author:       author,
+		Saved:        time.Now(),
+		RestoredFrom: restoredFrom,
+	}
+	for attempt := 0; attempt < revisionAttempts; attempt, number = attempt+1, number+1 {
+		r.Number = number
+		k := revisionKey(kind, id, number)
+		switch insertErr := Stores.Entities.Insert(ctx, k, r); insertErr {
+		case nil:
+			r.ID = k.StringID
+			return r, nil
+		case ErrEntityExists:
+		default:
+			return nil, insertErr
+		}
+	}
+	return nil, ErrRevisionBusy
+}
+
+// Internal Function
+// Description:
+// Stores a revision for a save made by the user of req, see saveRevision.
+// A save whose revision fails to be stored is not undone.
+//
+// Returns:
+//      failure?(error) - Any storage error.
+func SaveRevision(res http.ResponseWriter, req *http.Request, kind string, id int64, before, after interface{}) error {
+	author := ""
+	if u, authErr := GetUserFromRequest(res, req); authErr == nil {
+		author = u.Email
+	}
+	_, saveErr := saveRevision(NewContext(req), kind, id, before, after, author, 0)
+	return saveErr
+}
+
+// Internal Function
+// Description:
+// Gets every revision of kind id, newest first, without their fields.
+func GetRevisions(ctx context.Context, kind string, id int64) ([]Revision, error) {
+	q := NewEntityQuery(RevisionsTable).Filter("EntityKind =", kind).Filter("EntityID =", id)
+	revisions := make([]Revision, 0)
+	keys, getErr := Stores.Entities.GetAll(ctx, q, &revisions)
+	if getErr != nil {
+		return []Revision{}, getErr
+	}
+	for i, k := range keys {
+		revisions[i].ID = k.StringID
+		revisions[i].Fields = ""
+	}
+	sort.Slice(revisions, func(i, j int) bool { return revisions[i].Number > revisions[j].Number })
+	return revisions, nil
+}
+
+// Internal Function
+// Description:
+// Gets revision number of kind id. Number zero is the newest revision.
+//
+// Returns:
+//      revision(*Revision) - The revision with its fields.
+//      failure?(error) - ErrNoSuchRevision or any storage error.
+func GetRevision(ctx context.Context, kind string, id int64, number int) (*Revision, error) {
+	if number == 0 {
+		latest, getErr := latestRevision(ctx, kind, id)
+		if latest == nil && getErr == nil {
+			return nil, ErrNoSuchRevision
+		}
+		return latest, getErr
+	}
+
+	q := NewEntityQuery(RevisionsTable).Filter("EntityKind =", kind).Filter("EntityID =", id).Filter("Number =", number)
+	found := make([]Revision, 0)
+	keys, getErr := Stores.Entities.GetAll(ctx, q, &found)
+	if getErr != nil {
+		return nil, getErr
+	}
+	if len(found) == 0 {
+		return nil, ErrNoSuchRevision
+	}
+	found[0].ID = keys[0].StringID
+	return &found[0], nil
+}
+
+// Internal Function
+// Description:
+// Compares the fields of two revisions of the same structure.
+//
+// Returns:
+//      changes([]FieldChange) - Changed fields in the kind's field order.
+func DiffRevisions(from, to *Revision) []FieldChange {
+	before := make(map[string]interface{})
+	after := make(map[string]interface{})
+	json.Unmarshal([]byte(from.Fields), &before)
+	json.Unmarshal([]byte(to.Fields), &after)
+
+	changes := make([]FieldChange, 0)
+	for _, f := range revisionFields[to.EntityKind] {
+		if !reflect.DeepEqual(before[f], after[f]) {
+			changes = append(changes, FieldChange{f, before[f], after[f]})
+		}
+	}
+	return changes
+}
+
+// Internal Function
+// Description:
+// Copies the fields of revision number back onto kind id and saves it.
+//
+// Returns:
+//      revision(*Revision) - The new revision made by the restore, nil if nothing changed.
+//      failure?(error) - ErrNoSuchRevision, ErrNothingToRestore, or any storage error.
+func RestoreRevision(res http.ResponseWriter, req *http.Request, kind string, id int64, number int) (*Revision, error) {
+	ctx := NewContext(req)
+	r, getErr := GetRevision(ctx, kind, id, number)
+	if getErr != nil {
+		return nil, getErr
+	}
+
+	current := newRevisable(kind)
+	if loadErr := GetFromDatastore(ctx, id, current); loadErr != nil {
+		return nil, ErrNothingToRestore
+	}
+	before := reflect.ValueOf(current).Elem().Interface()
+	if jsonErr := json.Unmarshal([]byte(r.Fields), current); jsonErr != nil {
+		return nil, jsonErr
+	}
+	if _, putErr := PlaceInDatastore(ctx, id, current); putErr != nil {
+		return nil, putErr
+	}
+
+	author := ""
+	if u, authErr := GetUserFromRequest(res, req); authErr == nil {
+		author = u.Email
+	}
+	RecordAudit(res, req, AuditUpdate, kind, id, before, current)
+	return saveRevision(ctx, kind, id, before, current, author, r.Number)
+}
+
+// ------------------------------------
+// Handlers
+/////
+
+// Internal Function
+// Description:
+// Reads Kind and ID for the revision handlers and checks the caller holds
+// minimum on that structure. Failures are written to res.
+//
+// Returns:
+//      target(Scope) - The structure, the zero Scope on failure.
+func revisionTarget(res http.ResponseWriter, req *http.Request, minimum PermissionLevel) Scope {
+	target := ScopeOf(req.FormValue("Kind"), req.FormValue("ID"))
+	if newRevisable(target.Kind) == nil || target.ID == 0 {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: ErrNotRevisioned.Error(), Code: 400}, nil)
+		return Scope{}
+	}
+	if validPerm, permErr := HasPermission(res, req, minimum, target); !validPerm {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Invalid Authorization: " + permErr.Error(), Code: 418}, nil)
+		return Scope{}
+	}
+	return target
+}
+
+// Call: /api/revisions.json
+// Description:
+// Lists the revisions of a structure, newest first, without their fields.
+// Mandatory:Kind is Book, Chapter, Section, Objective, or Exercise.
+//
+// Method: GET
+// Results: JSON
+// Mandatory Options: Kind, ID
+// Optional Options:
+// Codes:
+//      0 - Success, All actions completed
+//    400 - Failure, Bad Kind or ID
+//    418 - Invalid Authorization; Editor on the structure is required.
+//    500 - Failure, Internal Services Error
+func API_GetRevisions(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	target := revisionTarget(res, req, EditPermissions)
+	if target.ID == 0 {
+		return
+	}
+
+	revisions, getErr := GetRevisions(NewContext(req), target.Kind, target.ID)
+	if getErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: getErr.Error(), Code: 500}, nil)
+		return
+	}
+	ServeJsonOfStruct(res, JsonOptions{Status: "Success"}, revisions)
+}
+
+// Call: /api/revision.json
+// Description:
+// Shows one revision of a structure with its fields. Without Option:Number
+// the newest revision is shown.
+//
+// Method: GET
+// Results: JSON
+// Mandatory Options: Kind, ID
+// Optional Options: Number
+// Codes:
+//      0 - Success, All actions completed
+//    400 - Failure, Bad Kind, ID, or Number
+//    404 - Failure, No such revision
+//    418 - Invalid Authorization; Editor on the structure is required.
+//    500 - Failure, Internal Services Error
+func API_GetRevision(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	target := revisionTarget(res, req, EditPermissions)
+	if target.ID == 0 {
+		return
+	}
+	number, numErr := revisionNumber(req.FormValue("Number"))
+	if numErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Invalid Number", Code: 400}, nil)
+		return
+	}
+
+	r, getErr := GetRevision(NewContext(req), target.Kind, target.ID, number)
+	if getErr == ErrNoSuchRevision {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: getErr.Error(), Code: 404}, nil)
+		return
+	} else if getErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: getErr.Error(), Code: 500}, nil)
+		return
+	}
+	ServeJsonOfStruct(res, JsonOptions{Status: "Success"}, r)
+}
+
+// Call: /api/revision/diff.json
+// Description:
+// Lists the fields that differ between two revisions of a structure.
+// Option:To defaults to the newest revision and Option:From to the one before To.
+//
+// Method: GET
+// Results: JSON
+// Mandatory Options: Kind, ID
+// Optional Options: From, To
+// Codes:
+//      0 - Success, All actions completed
+//    400 - Failure, Bad Kind, ID, From, or To
+//    404 - Failure, No such revision
+//    418 - Invalid Authorization; Editor on the structure is required.
+//    500 - Failure, Internal Services Error
+func API_DiffRevisions(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	target := revisionTarget(res, req, EditPermissions)
+	if target.ID == 0 {
+		return
+	}
+	fromNum, fromErr := revisionNumber(req.FormValue("From"))
+	toNum, toErr := revisionNumber(req.FormValue("To"))
+	if fromErr != nil || toErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Invalid From or To", Code: 400}, nil)
+		return
+	}
+
+	ctx := NewContext(req)
+	to, getErr := GetRevision(ctx, target.Kind, target.ID, toNum)
+	var from *Revision
+	if getErr == nil {
+		if fromNum == 0 {
+			fromNum = to.Number - 1
+		}
+		if fromNum == 0 { // the first revision is compared with nothing
+			from = &Revision{EntityKind: to.EntityKind, Fields: "{}"}
+		} else {
+			from, getErr = GetRevision(ctx, target.Kind, target.ID, fromNum)
+		}
+	}
+	if getErr == ErrNoSuchRevision {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: getErr.Error(), Code: 404}, nil)
+		return
+	} else if getErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: getErr.Error(), Code: 500}, nil)
+		return
+	}
+
+	ServeJsonOfStruct(res, JsonOptions{Status: "Success"}, struct {
+		From, To int
+		Changes  []FieldChange
+	}{from.Number, to.Number, DiffRevisions(from, to)})
+}
+
+// Call: /api/restore/revision
+// Description:
+// Puts the fields of an old revision back onto a structure. The restore is
+// saved as a new revision, so it can itself be undone.
+//
+// Method: POST
+// Results: JSON
+// Mandatory Options: Kind, ID, Number
+// Optional Options:
+// Codes:
+//      0 - Success, Results holds the new revision, or null if nothing changed
+//    400 - Failure, Bad Kind, ID, or Number
+//    404 - Failure, No such revision, or the structure was deleted
+//    418 - Invalid Authorization; Writer on the structure is required.
+//    500 - Failure, Internal Services Error
+func API_RestoreRevision(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	target := revisionTarget(res, req, Settings.Permissions.APIMake)
+	if target.ID == 0 {
+		return
+	}
+	number, numErr := revisionNumber(req.FormValue("Number"))
+	if numErr != nil || number == 0 {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Invalid Number", Code: 400}, nil)
+		return
+	}
+
+	r, restoreErr := RestoreRevision(res, req, target.Kind, target.ID, number)
+	if restoreErr == ErrNoSuchRevision || restoreErr == ErrNothingToRestore {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: restoreErr.Error(), Code: 404}, nil)
+		return
+	} else if restoreErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: restoreErr.Error(), Code: 500}, nil)
+		return
+	}
+	if r != nil {
+		r.Fields = ""
+	}
+	ServeJsonOfStruct(res, JsonOptions{Status: "Success"}, r)
+}
+
+// Internal Function
+// Description:
+// Parses an optional revision number; empty is zero.
+func revisionNumber(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, parseErr := strconv.Atoi(s)
+	if parseErr != nil || n < 0 {
+		return 0, ErrNoSuchRevision
+	}
+	return n, nil
+}
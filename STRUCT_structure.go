@@ -9,33 +9,32 @@ structure.go by Allen J. Mills
 
 import (
 	"golang.org/x/net/context"
-	"google.golang.org/appengine/datastore"
 )
 
 // ------------------------------
-// Datastore Keys for structure objects.
+// Entity Keys for structure objects.
 //
 // Using Tables: Catalogs, Books, Chapters, Sections, and Objectives
 // for our structure objects.
 /////
 
-func MakeCatalogKey(ctx context.Context, id int64) *datastore.Key {
-	return (&Catalog{}).Key(ctx, id)
+func MakeCatalogKey(id int64) EntityKey {
+	return NewEntityKey((&Catalog{}).Kind(), id)
 }
-func MakeBookKey(ctx context.Context, id int64) *datastore.Key {
-	return (&Book{}).Key(ctx, id)
+func MakeBookKey(id int64) EntityKey {
+	return NewEntityKey((&Book{}).Kind(), id)
 }
-func MakeChapterKey(ctx context.Context, id int64) *datastore.Key {
-	return (&Chapter{}).Key(ctx, id)
+func MakeChapterKey(id int64) EntityKey {
+	return NewEntityKey((&Chapter{}).Kind(), id)
 }
-func MakeSectionKey(ctx context.Context, id int64) *datastore.Key {
-	return (&Section{}).Key(ctx, id)
+func MakeSectionKey(id int64) EntityKey {
+	return NewEntityKey((&Section{}).Kind(), id)
 }
-func MakeObjectiveKey(ctx context.Context, id int64) *datastore.Key {
-	return (&Objective{}).Key(ctx, id)
+func MakeObjectiveKey(id int64) EntityKey {
+	return NewEntityKey((&Objective{}).Kind(), id)
 }
-func MakeExerciseKey(ctx context.Context, id int64) *datastore.Key {
-	return (&Exercise{}).Key(ctx, id)
+func MakeExerciseKey(id int64) EntityKey {
+	return NewEntityKey((&Exercise{}).Kind(), id)
 }
 
 // ------------------------------
@@ -48,7 +47,7 @@ func GetCatalogFromDatastore(ctx context.Context, key int64) (Catalog, error) {
 
 	c := Catalog{}
 	getErr := GetFromDatastore(ctx, key, &c)
-	if getErr == datastore.ErrNoSuchEntity {
+	if getErr == ErrNoSuchEntity {
 		getErr = nil
 	}
 	c.ID = key
@@ -65,7 +64,7 @@ func GetBookFromDatastore(ctx context.Context, key int64) (Book, error) {
 
 	b := Book{}
 	getErr := GetFromDatastore(ctx, key, &b)
-	if getErr == datastore.ErrNoSuchEntity {
+	if getErr == ErrNoSuchEntity {
 		getErr = nil
 	}
 	b.ID = key
@@ -82,7 +81,7 @@ func GetChapterFromDatastore(ctx context.Context, key int64) (Chapter, error) {
 
 	e := Chapter{}
 	getErr := GetFromDatastore(ctx, key, &e)
-	if getErr == datastore.ErrNoSuchEntity {
+	if getErr == ErrNoSuchEntity {
 		getErr = nil
 	}
 	e.ID = key
@@ -99,7 +98,7 @@ func GetSectionFromDatastore(ctx context.Context, key int64) (Section, error) {
 
 	e := Section{}
 	getErr := GetFromDatastore(ctx, key, &e)
-	if getErr == datastore.ErrNoSuchEntity {
+	if getErr == ErrNoSuchEntity {
 		getErr = nil
 	}
 	e.ID = key
@@ -116,7 +115,7 @@ func GetObjectiveFromDatastore(ctx context.Context, key int64) (Objective, error
 
 	e := Objective{}
 	getErr := GetFromDatastore(ctx, key, &e)
-	if getErr == datastore.ErrNoSuchEntity {
+	if getErr == ErrNoSuchEntity {
 		getErr = nil
 	}
 	e.ID = key
@@ -133,7 +132,7 @@ func GetExerciseFromDatastore(ctx context.Context, key int64) (Exercise, error)
 
 	e := Exercise{}
 	getErr := GetFromDatastore(ctx, key, &e)
-	if getErr == datastore.ErrNoSuchEntity {
+	if getErr == ErrNoSuchEntity {
 		getErr = nil
 	}
 	e.ID = key
@@ -159,7 +158,7 @@ func Get_Name_ID_From_Parent(ctx context.Context, parentID interface{}, kind str
 	ID    int64
 } {
 	// function Get_Name_ID_From_Parent to collect Title/Key information for each given kind
-	q := datastore.NewQuery(kind)      // Make a query into the given kind
+	q := NewEntityQuery(kind)          // Make a query into the given kind
 	q = q.Filter("Parent =", parentID) // Limit to only the parent ID
 	q = q.Project("Title")             // return a struct containing only {Title string}
 
@@ -167,20 +166,17 @@ func Get_Name_ID_From_Parent(ctx context.Context, parentID interface{}, kind str
 		Title string
 		ID    int64
 	}, 0)
-	for t := q.Run(ctx); ; { // standard query run.
-		var cName struct{ Title string }
-		k, qErr := t.Next(&cName)
-
-		if qErr == datastore.Done {
-			break
-		} else if qErr != nil {
-			return output_chapters
-		}
+	titles := make([]struct{ Title string }, 0)
+	keys, qErr := Stores.Entities.GetAll(ctx, q, &titles)
+	if qErr != nil {
+		return output_chapters
+	}
 
+	for i, k := range keys {
 		output_chapters = append(output_chapters, struct {
 			Title string
 			ID    int64
-		}{cName.Title, k.IntID()})
+		}{titles[i].Title, k.IntID})
 	}
 	return output_chapters
 }
@@ -188,12 +184,11 @@ func Get_Name_ID_From_Parent(ctx context.Context, parentID interface{}, kind str
 // Internal Function
 // Description:
 //
-func Get_Child_Key_From_Parent(ctx context.Context, parentID interface{}, kind string) []*datastore.Key {
+func Get_Child_Key_From_Parent(ctx context.Context, parentID interface{}, kind string) []EntityKey {
 	// function Get_Name_ID_From_Parent to collect Title/Key information for each given kind
-	q := datastore.NewQuery(kind)      // Make a query into the given kind
+	q := NewEntityQuery(kind)          // Make a query into the given kind
 	q = q.Filter("Parent =", parentID) // Limit to only the parent ID
-	q = q.KeysOnly()
 
-	cks, _ := q.GetAll(ctx, nil)
+	cks, _ := Stores.Entities.GetAll(ctx, q, nil)
 	return cks
 }
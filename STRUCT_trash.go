@@ -0,0 +1,538 @@
+package main
+
+/*
+STRUCT_trash.go by Allen J. Mills
+    mm.d.yy
+
+    Deleting a structure moves it to the trash instead of removing it.
+    Each delete makes one TrashBin; every record removed with it (the
+    structure, its children, their grants and share links) is copied
+    into a TrashedRecord, and their images are moved under
+        trash/<bin id>/<image name>
+    Restoring puts the records back under their old keys and the images
+    back under their old names, so links to them keep working.
+
+    Bins older than Trash.Retention are purged. App Engine does this
+    from cron.yaml; the standalone server runs it every Trash.PurgeInterval.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/net/context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoSuchTrash        = errors.New("Trash: No such trash entry.")                                           // ErrNoSuchTrash is returned for unknown trash ids.
+	ErrTrashParentMissing = errors.New("Trash: The structure it was deleted from is gone. Restore that first.") // ErrTrashParentMissing is returned when restoring below a deleted parent.
+)
+
+const (
+	TrashTable          = "Trash"
+	TrashedRecordsTable = "TrashedRecords"
+	trashPrefix         = "trash/" // Images in the trash are kept under this prefix.
+)
+
+// The datastore kind of each structure.
+var structureTables = map[string]string{
+	"Catalog":   "Catalogs",
+	"Book":      "Books",
+	"Chapter":   "Chapters",
+	"Section":   "Sections",
+	"Objective": "Objectives",
+	"Exercise":  "Exercises",
+}
+
+// The structure kind each kind lives in.
+var parentKinds = map[string]string{
+	"Book":      "Catalog",
+	"Chapter":   "Book",
+	"Section":   "Chapter",
+	"Objective": "Section",
+	"Exercise":  "Objective",
+}
+
+// Type: TrashBin
+// One delete: the structure RootKind RootID and everything removed with it.
+type TrashBin struct {
+	RootKind  string
+	RootID    int64
+	Title     string
+	DeletedBy string
+	Deleted   time.Time
+	Records   int      // Records kept, the root included
+	Files     []string `datastore:",noindex"` // Original names of the images kept
+	ID        int64    `datastore:"-" json:",string"`
+}
+
+// Method: Kind
+// Implements Entity interface
+func (b *TrashBin) Kind() string {
+	return TrashTable
+}
+
+// Type: TrashedRecord
+// A copy of one removed record, stored as JSON under the key it had.
+type TrashedRecord struct {
+	Bin        int64
+	EntityKind string
+	IntID      int64
+	StringID   string
+	Data       string `datastore:",noindex"`
+}
+
+// Method: Kind
+// Implements Entity interface
+func (r *TrashedRecord) Kind() string {
+	return TrashedRecordsTable
+}
+
+// Method: Key
+// The key the record had before it was trashed.
+func (r *TrashedRecord) Key() EntityKey {
+	return EntityKey{Kind: r.EntityKind, IntID: r.IntID, StringID: r.StringID}
+}
+
+// Internal Function
+// Description:
+// Makes an empty value for every datastore kind a delete can remove.
+//
+// Returns:
+//      entity(interface{}) - Pointer to an empty value, nil for other kinds.
+func newTrashable(kind string) interface{} {
+	switch kind {
+	case "Catalogs":
+		return &Catalog{}
+	case "Books":
+		return &Book{}
+	case "Chapters":
+		return &Chapter{}
+	case "Sections":
+		return &Section{}
+	case "Objectives":
+		return &Objective{}
+	case "Exercises":
+		return &Exercise{}
+	case GrantsTable:
+		return &Grant{}
+	case ShareLinksTable:
+		return &ShareLink{}
+	}
+	return nil
+}
+
+// Internal Function
+// Description:
+// The name image name is kept under while in trash bin binID.
+func trashBlobName(binID int64, name string) string {
+	return fmt.Sprint(trashPrefix, binID, "/", name)
+}
+
+// Internal Function
+// Description:
+// Moves the subtree t into a new trash bin. Either all of t is moved or,
+// when anything fails, none of it is.
+//
+// Returns:
+//      bin(*TrashBin) - The stored bin.
+//      failure?(error) - Any storage error, a *Rollback if changes were undone.
+func MoveToTrash(ctx context.Context, t *Subtree, title, deletedBy string) (*TrashBin, error) {
+	bin := &TrashBin{
+		RootKind:  t.Root.Kind,
+		RootID:    t.Root.ID,
+		Title:     title,
+		DeletedBy: deletedBy,
+		Deleted:   time.Now(),
+		Files:     t.Files,
+	}
+	batch := NewBatch()
+	batch.Place(&bin.ID, bin, nil)
+
+	removed := make([]EntityKey, 0, len(t.Keys))
+	for _, k := range t.Keys {
+		v := newTrashable(k.Kind)
+		if v == nil {
+			continue
+		}
+		if getErr := Stores.Entities.Get(ctx, k, v); getErr == ErrNoSuchEntity {
+			continue
+		} else if getErr != nil {
+			return nil, getErr
+		}
+		data, jsonErr := json.Marshal(v)
+		if jsonErr != nil {
+			return nil, jsonErr
+		}
+		r := &TrashedRecord{EntityKind: k.Kind, IntID: k.IntID, StringID: k.StringID, Data: string(data)}
+		batch.Place(new(int64), r, func() { r.Bin = bin.ID })
+		removed = append(removed, k)
+		bin.Records++
+	}
+
+	for _, f := range t.Files {
+		f := f
+		batch.Do("move file "+f+" to the trash", func(ctx context.Context) error {
+			return moveBlob(ctx, f, trashBlobName(bin.ID, f))
+		}, func(ctx context.Context) error {
+			return moveBlob(ctx, trashBlobName(bin.ID, f), f)
+		})
+	}
+	for _, k := range removed {
+		batch.Delete(k, newTrashable(k.Kind))
+	}
+
+	if commitErr := batch.Commit(ctx); commitErr != nil {
+		return nil, commitErr
+	}
+	return bin, nil
+}
+
+// Internal Function
+// Description:
+// Gets trash bin binID.
+//
+// Returns:
+//      bin(*TrashBin) - The bin with ID set.
+//      failure?(error) - ErrNoSuchTrash or any storage error.
+func GetTrashBin(ctx context.Context, binID int64) (*TrashBin, error) {
+	bin := &TrashBin{}
+	if getErr := GetFromDatastore(ctx, binID, bin); getErr == ErrNoSuchEntity {
+		return nil, ErrNoSuchTrash
+	} else if getErr != nil {
+		return nil, getErr
+	}
+	bin.ID = binID
+	return bin, nil
+}
+
+// Internal Function
+// Description:
+// Gets every trash bin, newest first.
+func GetTrashBins(ctx context.Context) ([]TrashBin, error) {
+	bins := make([]TrashBin, 0)
+	keys, getErr := Stores.Entities.GetAll(ctx, NewEntityQuery(TrashTable), &bins)
+	if getErr != nil {
+		return []TrashBin{}, getErr
+	}
+	for i, k := range keys {
+		bins[i].ID = k.IntID
+	}
+	sort.Slice(bins, func(i, j int) bool { return bins[i].Deleted.After(bins[j].Deleted) })
+	return bins, nil
+}
+
+// Internal Function
+// Description:
+// Gets the records kept in bin binID.
+func getTrashedRecords(ctx context.Context, binID int64) ([]TrashedRecord, []EntityKey, error) {
+	records := make([]TrashedRecord, 0)
+	keys, getErr := Stores.Entities.GetAll(ctx, NewEntityQuery(TrashedRecordsTable).Filter("Bin =", binID), &records)
+	return records, keys, getErr
+}
+
+// Internal Function
+// Description:
+// Puts everything in trash bin bin back where it was and empties the bin.
+// The structure the root was deleted from must still exist. Either
+// everything is restored or, when anything fails, nothing is.
+//
+// Returns:
+//      failure?(error) - ErrTrashParentMissing, any storage error, or a *Rollback if changes were undone.
+func RestoreFromTrash(ctx context.Context, bin *TrashBin) error {
+	records, recordKeys, getErr := getTrashedRecords(ctx, bin.ID)
+	if getErr != nil {
+		return getErr
+	}
+
+	if parentKind, hasParent := parentKinds[bin.RootKind]; hasParent {
+		for _, r := range records {
+			if r.EntityKind != structureTables[bin.RootKind] || r.IntID != bin.RootID {
+				continue
+			}
+			var root struct{ Parent int64 }
+			json.Unmarshal([]byte(r.Data), &root)
+			if Stores.Entities.Get(ctx, NewEntityKey(structureTables[parentKind], root.Parent), newTrashable(structureTables[parentKind])) != nil {
+				return ErrTrashParentMissing
+			}
+		}
+	}
+
+	batch := NewBatch()
+	for _, r := range records {
+		v := newTrashable(r.EntityKind)
+		if v == nil {
+			continue
+		}
+		if jsonErr := json.Unmarshal([]byte(r.Data), v); jsonErr != nil {
+			return jsonErr
+		}
+		batch.Put(r.Key(), v)
+	}
+	kept := make(map[string]bool)
+	for _, name := range GetFilesFromGCS_WithPrefix(ctx, fmt.Sprint(trashPrefix, bin.ID, "/")) {
+		kept[name] = true
+	}
+	for _, f := range bin.Files {
+		if kept[trashBlobName(bin.ID, f)] {
+			batch.MoveBlob(trashBlobName(bin.ID, f), f)
+		}
+	}
+	for i, k := range recordKeys {
+		batch.Delete(k, &records[i])
+	}
+	batch.Delete(NewEntityKey(TrashTable, bin.ID), &TrashBin{})
+
+	return batch.Commit(ctx)
+}
+
+// Internal Function
+// Description:
+// Removes trash bin bin for good: its images, its records, and then the
+// revision history of the structures in it. The bin goes with the last
+// of its records, so a purge that fails before then is tried again.
+//
+// Returns:
+//      failure?(error) - Any storage error.
+func PurgeTrash(ctx context.Context, bin *TrashBin) error {
+	records, recordKeys, getErr := getTrashedRecords(ctx, bin.ID)
+	if getErr != nil {
+		return getErr
+	}
+
+	historyKeys := make([]EntityKey, 0)
+	for _, r := range records {
+		kind := strings.TrimSuffix(r.EntityKind, "s")
+		if newRevisable(kind) == nil {
+			continue
+		}
+		keys, historyErr := Stores.Entities.GetAll(ctx, NewEntityQuery(RevisionsTable).Filter("EntityKind =", kind).Filter("EntityID =", r.IntID), nil)
+		if historyErr != nil {
+			return historyErr
+		}
+		historyKeys = append(historyKeys, keys...)
+	}
+
+	files := GetFilesFromGCS_WithPrefix(ctx, fmt.Sprint(trashPrefix, bin.ID, "/"))
+	if rmErr := RemoveFilesFromGCS(ctx, files); rmErr != nil {
+		return rmErr
+	}
+
+	if delErr := DeleteAllFromDatastore(ctx, append(recordKeys, NewEntityKey(TrashTable, bin.ID))); delErr != nil {
+		return delErr
+	}
+	return DeleteAllFromDatastore(ctx, historyKeys)
+}
+
+// Internal Function
+// Description:
+// Purges every trash bin deleted before now less Trash.Retention.
+// A zero retention keeps the trash until it is purged by hand.
+//
+// Returns:
+//      purged(int) - Bins purged.
+//      failure?(error) - The first storage error met.
+func PurgeExpiredTrash(ctx context.Context, now time.Time) (int, error) {
+	if Settings.Trash.Retention.Duration == 0 {
+		return 0, nil
+	}
+
+	cutoff := now.Add(-Settings.Trash.Retention.Duration)
+	bins := make([]TrashBin, 0)
+	keys, getErr := Stores.Entities.GetAll(ctx, NewEntityQuery(TrashTable).Filter("Deleted <", cutoff), &bins)
+	if getErr != nil {
+		return 0, getErr
+	}
+
+	for i := range bins {
+		bins[i].ID = keys[i].IntID
+		if purgeErr := PurgeTrash(ctx, &bins[i]); purgeErr != nil {
+			return i, purgeErr
+		}
+		appendAudit(ctx, &AuditEntry{Time: now, Action: AuditPurge, EntityKind: bins[i].RootKind, EntityID: bins[i].RootID, Cascade: bins[i].Records - 1})
+	}
+	return len(bins), nil
+}
+
+// ------------------------------------
+// Handlers
+/////
+
+// Call: /admin/trash
+// Description:
+// The trash page, listing deleted structures to restore or purge.
+// Must be an Administrator to access.
+//
+// Method: GET
+// Results: HTML
+// Mandatory Options:
+// Optional Options:
+func ADMIN_TrashPage(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if validPerm, permErr := HasPermission(res, req, AdminPermissions); !validPerm {
+		// User Must be at least Admin.
+		http.Error(res, permErr.Error(), http.StatusUnauthorized)
+		return
+	}
+	u, _ := GetUserFromSession(res, req)
+
+	ServeTemplateWithParams(res, "trash.html", u)
+}
+
+// Call: /admin/trash.json
+// Description:
+// This call lists the trash, newest first.
+//
+// Method: GET
+// Results: JSON
+// Mandatory Options:
+// Optional Options:
+// Codes:
+//      0 - Success, All actions completed
+//    500 - Failure, Internal Services Error
+func ADMIN_GET_TRASH(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if validPerm, permErr := HasPermission(res, req, AdminPermissions); !validPerm {
+		// User Must be at least Admin.
+		http.Error(res, permErr.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	bins, getErr := GetTrashBins(NewContext(req))
+	if getErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: getErr.Error(), Code: 500}, nil)
+		return
+	}
+	ServeJsonOfStruct(res, JsonOptions{Status: "Success"}, bins)
+}
+
+// Internal Function
+// Description:
+// Finds the trash bin named by Option:ID for the trash handlers.
+// Failures are written to res.
+//
+// Returns:
+//      bin(*TrashBin) - The bin, nil on failure.
+func trashBinFromRequest(res http.ResponseWriter, req *http.Request) *TrashBin {
+	binID, parseErr := strconv.ParseInt(req.FormValue("ID"), 10, 64)
+	if parseErr != nil || binID == 0 {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: "Invalid ID", Code: 400}, nil)
+		return nil
+	}
+	bin, getErr := GetTrashBin(NewContext(req), binID)
+	if getErr == ErrNoSuchTrash {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: getErr.Error(), Code: 404}, nil)
+		return nil
+	} else if getErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: getErr.Error(), Code: 500}, nil)
+		return nil
+	}
+	return bin
+}
+
+// Call: /admin/trash/restore
+// Description:
+// This call puts a deleted structure back with all of its children and images.
+// If any part cannot be restored nothing is, and Results lists what was rolled back.
+//
+// Method: POST
+// Results: JSON
+// Mandatory Options: ID
+// Optional Options:
+// Codes:
+//      0 - Success, All actions completed
+//    400 - Failure, Invalid ID
+//    404 - Failure, No such trash entry
+//    409 - Failure, The parent structure is gone
+//    500 - Failure, Internal Services Error
+func ADMIN_POST_RESTORETRASH(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if validPerm, permErr := HasPermission(res, req, AdminPermissions); !validPerm {
+		// User Must be at least Admin.
+		http.Error(res, permErr.Error(), http.StatusUnauthorized)
+		return
+	}
+	bin := trashBinFromRequest(res, req)
+	if bin == nil {
+		return
+	}
+
+	restoreErr := RestoreFromTrash(NewContext(req), bin)
+	if restoreErr == ErrTrashParentMissing {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: restoreErr.Error(), Code: 409}, nil)
+		return
+	} else if rb, rolledBack := restoreErr.(*Rollback); rolledBack {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: rb.Error(), Code: 500}, rb)
+		return
+	} else if restoreErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: restoreErr.Error(), Code: 500}, nil)
+		return
+	}
+	RecordAuditCascade(res, req, AuditRestore, bin.RootKind, bin.RootID, nil, nil, bin.Records-1)
+	ServeJsonOfStruct(res, JsonOptions{Status: "Success"}, nil)
+}
+
+// Call: /admin/trash/purge
+// Description:
+// This call removes a deleted structure for good. It cannot be undone.
+//
+// Method: POST
+// Results: JSON
+// Mandatory Options: ID
+// Optional Options:
+// Codes:
+//      0 - Success, All actions completed
+//    400 - Failure, Invalid ID
+//    404 - Failure, No such trash entry
+//    500 - Failure, Internal Services Error
+func ADMIN_POST_PURGETRASH(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if validPerm, permErr := HasPermission(res, req, AdminPermissions); !validPerm {
+		// User Must be at least Admin.
+		http.Error(res, permErr.Error(), http.StatusUnauthorized)
+		return
+	}
+	bin := trashBinFromRequest(res, req)
+	if bin == nil {
+		return
+	}
+
+	if purgeErr := PurgeTrash(NewContext(req), bin); purgeErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: purgeErr.Error(), Code: 500}, nil)
+		return
+	}
+	RecordAuditCascade(res, req, AuditPurge, bin.RootKind, bin.RootID, nil, nil, bin.Records-1)
+	ServeJsonOfStruct(res, JsonOptions{Status: "Success"}, nil)
+}
+
+// Call: /admin/trash/purgeExpired
+// Description:
+// This call purges the trash older than Trash.Retention. It is run by
+// App Engine cron, see cron.yaml, and may be run by an Administrator.
+//
+// Method: GET
+// Results: JSON
+// Mandatory Options:
+// Optional Options:
+// Codes:
+//      0 - Success, Results holds the number of entries purged
+//    500 - Failure, Internal Services Error
+func ADMIN_GET_PURGEEXPIREDTRASH(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	fromCron := cronHeaderTrusted && req.Header.Get("X-Appengine-Cron") == "true"
+	if !fromCron {
+		if validPerm, permErr := HasPermission(res, req, AdminPermissions); !validPerm {
+			// User Must be at least Admin.
+			http.Error(res, permErr.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	purged, purgeErr := PurgeExpiredTrash(NewContext(req), time.Now())
+	if purgeErr != nil {
+		ServeJsonOfStruct(res, JsonOptions{Status: "Failure", Reason: purgeErr.Error(), Code: 500}, purged)
+		return
+	}
+	ServeJsonOfStruct(res, JsonOptions{Status: "Success"}, purged)
+}
@@ -0,0 +1,530 @@
+package main
+
+/*
+USER_Grants.go by Allen J. Mills
+    mm.d.yy
+
+    Access control lists for catalogs and books.
+    A grant gives one user a role on one Catalog or Book:
+        Reader -> Read, Editor -> Edit, Writer -> Write, Owner -> Admin
+    The role applies to the target and everything below it. A user's
+    permission on any structure is the highest of their global
+    User.Permission and the grants found walking up its Parent chain
+    (Exercise -> Objective -> Section -> Chapter -> Book -> Catalog).
+    Requests made with an API token never exceed the token's scope.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/net/context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnknownRole       = errors.New("Grant: Unknown role. Use Reader, Editor, Writer, or Owner.") // ErrUnknownRole is returned when parsing a role name fails.
+	ErrInvalidGrantScope = errors.New("Grant: Grants can only target a Catalog or a Book.")         // ErrInvalidGrantScope is returned for grants on any other kind.
+	ErrUnknownKind       = errors.New("Grant: Unknown structure kind.")                             // ErrUnknownKind is returned when resolving a kind that is not part of the structure tree.
+)
+
+const (
+	GrantsTable = "Grants"
+
+	// Roles.
+	// Refer to these by name; RoleLevel gives the permission level each one holds.
+	RoleReader = "Reader"
+	RoleEditor = "Editor"
+	RoleWriter = "Writer"
+	RoleOwner  = "Owner"
+)
+
+// Internal Function
+// Description:
+// Parses a role by name, case does not matter.
+//
+// Returns:
+//      role(string) - Role as one of the Role constants.
+//      level(int) - Permission level the role holds within its target.
+//      failure?(error) - ErrUnknownRole if name is not a role.
+func RoleLevel(name string) (string, int, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "reader":
+		return RoleReader, ReadPermissions, nil
+	case "editor":
+		return RoleEditor, EditPermissions, nil
+	case "writer":
+		return RoleWriter, WritePermissions, nil
+	case "owner":
+		return RoleOwner, AdminPermissions, nil
+	}
+	return "", ReadPermissions, ErrUnknownRole
+}
+
+// Type: Grant
+// Role given to user UID on the Catalog or Book at TargetKind/TargetID.
+// Stored under the key from grantKey, so a user holds at most one role per target.
+type Grant struct {
+	UID        int64
+	Email      string
+	TargetKind string // Catalog or Book
+	TargetID   int64
+	Role       string
+	Granted    time.Time
+	GrantedBy  string
+}
+
+// Method: Kind
+// Implements Entity interface
+func (g *Grant) Kind() string {
+	return GrantsTable
+}
+
+// Internal Function
+// Description:
+// The storage key of user uid's grant on kind/id.
+func grantKey(uid int64, kind string, id int64) EntityKey {
+	return NewEntityKey(GrantsTable, fmt.Sprint(uid, ":", kind, ":", id))
+}
+
+//// --------------------------
+// Scopes
+// A Scope names one structure a request acts on.
+////
+
+// Type: Scope
+// A single structure: Catalog, Book, Chapter, Section, Objective, or Exercise.
+// The zero Scope stands for "nothing in particular" and is checked against
+// the global permission only.
+type Scope struct {
+	Kind string
+	ID   int64
+}
+
+// Internal Function
+// Description:
+// Makes a Scope from a form or url value. Missing or malformed ids
+// give the zero Scope.
+func ScopeOf(kind, id string) Scope {
+	i, parseErr := strconv.ParseInt(id, 10, 64)
+	if parseErr != nil || i == 0 {
+		return Scope{}
+	}
+	return Scope{kind, i}
+}
+
+// Internal Function
+// Description:
+// Walks up the Parent chain from s, the same way API_GetParent does,
+// to find the catalog and book that contain it.
+//
+// Returns:
+//      catalogID(int64) - Containing catalog
+//      bookID(int64) - Containing book, zero for a catalog
+//      failure?(error) - Unknown kind or a missing structure along the way.
+func ResolveScope(ctx context.Context, s Scope) (int64, int64, error) {
+	var objectiveID, sectionID, chapterID, bookID, catalogID int64
+
+	switch s.Kind {
+	default:
+		return 0, 0, ErrUnknownKind
+	case "Exercise":
+		ex, err := GetExerciseFromDatastore(ctx, s.ID)
+		if err != nil {
+			return 0, 0, err
+		}
+		objectiveID = ex.Parent
+	case "Objective":
+		objectiveID = s.ID
+	case "Section":
+		sectionID = s.ID
+	case "Chapter":
+		chapterID = s.ID
+	case "Book":
+		bookID = s.ID
+	case "Catalog":
+		catalogID = s.ID
+	}
+
+	if objectiveID != 0 {
+		ob, err := GetObjectiveFromDatastore(ctx, objectiveID)
+		if err != nil {
+			return 0, 0, err
+		}
+		sectionID = ob.Parent
+	}
+
+	if sectionID != 0 {
+		sc, err := GetSectionFromDatastore(ctx, sectionID)
+		if err != nil {
+			return 0, 0, err
+		}
+		chapterID = sc.Parent
+	}
+
+	if chapterID != 0 {
+		ch, err := GetChapterFromDatastore(ctx, chapterID)
+		if err != nil {
+			return 0, 0, err
+		}
+		bookID = ch.Parent
+	}
+
+	if bookID != 0 {
+		bk, err := GetBookFromDatastore(ctx, bookID)
+		if err != nil {
+			return 0, 0, err
+		}
+		catalogID = bk.Parent
+	}
+
+	return catalogID, bookID, nil
+}
+
+//// --------------------------
+// Permission Resolution
+////
+
+// Internal Function
+// Description:
+// The permission level u holds on s, from their global level and any
+// grants on the containing book and catalog.
+//
+// Returns:
+//      level(int) - Effective permission level
+//      failure?(error) - If s cannot be resolved.
+func EffectivePermission(ctx context.Context, u *User, s Scope) (int, error) {
+	level := u.Permission
+	if s.ID == 0 || level >= AdminPermissions {
+		return level, nil
+	}
+
+	catalogID, bookID, resolveErr := ResolveScope(ctx, s)
+	if resolveErr != nil {
+		return level, resolveErr
+	}
+
+	if grantLevel, found, grantErr := GrantLevel(ctx, u.ID, catalogID, bookID); grantErr != nil {
+		return level, grantErr
+	} else if found && grantLevel > level {
+		level = grantLevel
+	}
+
+	if u.Token != nil && level > u.Token.Scope {
+		level = u.Token.Scope
+	}
+	return level, nil
+}
+
+// Internal Function
+// Description:
+// The highest role user uid holds on the book or catalog.
+//
+// Returns:
+//      level(int) - Permission level of the highest role found
+//      found(bool) - Whether any grant exists
+//      failure?(error) - Storage errors.
+func GrantLevel(ctx context.Context, uid, catalogID, bookID int64) (int, bool, error) {
+	level, found := ReadPermissions, false
+	for _, target := range []Scope{{"Book", bookID}, {"Catalog", catalogID}} {
+		if target.ID == 0 || uid == 0 {
+			continue
+		}
+		g := &Grant{}
+		if getErr := Stores.Entities.Get(ctx, grantKey(uid, target.Kind, target.ID), g); getErr != nil {
+			if getErr == ErrNoSuchEntity {
+				continue
+			}
+			return level, found, getErr
+		}
+		if _, roleLevel, roleErr := RoleLevel(g.Role); roleErr == nil {
+			if !found || roleLevel > level {
+				level = roleLevel
+			}
+			found = true
+		}
+	}
+	return level, found, nil
+}
+
+//// --------------------------
+// Storage
+////
+
+// Internal Function
+// Description:
+// Gives user u the role on the Catalog or Book at target, replacing any role they held there.
+//
+// Returns:
+//      grant(*Grant) - Stored grant
+//      failure?(error) - ErrUnknownRole, ErrInvalidGrantScope, or storage errors.
+func SetGrant(ctx context.Context, u *User, target Scope, role, grantedBy string) (*Grant, error) {
+	roleName, _, roleErr := RoleLevel(role)
+	if roleErr != nil {
+		return nil, roleErr
+	}
+	if (target.Kind != "Catalog" && target.Kind != "Book") || target.ID == 0 {
+		return nil, ErrInvalidGrantScope
+	}
+
+	var structure Entity = &Book{}
+	if target.Kind == "Catalog" {
+		structure = &Catalog{}
+	}
+	if getErr := GetFromDatastore(ctx, target.ID, structure); getErr != nil {
+		return nil, getErr
+	}
+
+	g := &Grant{
+		UID:        u.ID,
+		Email:      u.Email,
+		TargetKind: target.Kind,
+		TargetID:   target.ID,
+		Role:       roleName,
+		Granted:    time.Now(),
+		GrantedBy:  grantedBy,
+	}
+	_, putErr := Stores.Entities.Put(ctx, grantKey(u.ID, target.Kind, target.ID), g)
+	return g, putErr
+}
+
+// Internal Function
+// Description:
+// Gets the grant user uid holds on target.
+//
+// Returns:
+//      grant(*Grant) - The stored grant, nil when there is none.
+//      failure?(error) - Any storage error other than a missing grant.
+func GetGrant(ctx context.Context, uid int64, target Scope) (*Grant, error) {
+	g := &Grant{}
+	getErr := Stores.Entities.Get(ctx, grantKey(uid, target.Kind, target.ID), g)
+	if getErr == ErrNoSuchEntity {
+		return nil, nil
+	}
+	if getErr != nil {
+		return nil, getErr
+	}
+	return g, nil
+}
+
+// Internal Function
+// Description:
+// Removes user uid's grant on target. Missing grants are not an error.
+func DeleteGrant(ctx context.Context, uid int64, target Scope) error {
+	return Stores.Entities.Delete(ctx, []EntityKey{grantKey(uid, target.Kind, target.ID)})
+}
+
+// Internal Function
+// Description:
+// Gets every grant held by user uid.
+func GetGrantsForUser(ctx context.Context, uid int64) ([]Grant, error) {
+	grants := make([]Grant, 0)
+	_, getErr := Stores.Entities.GetAll(ctx, NewEntityQuery(GrantsTable).Filter("UID =", uid), &grants)
+	sortGrants(grants)
+	return grants, getErr
+}
+
+// Internal Function
+// Description:
+// Gets every grant on the Catalog or Book at target.
+func GetGrantsForTarget(ctx context.Context, target Scope) ([]Grant, error) {
+	grants := make([]Grant, 0)
+	q := NewEntityQuery(GrantsTable).Filter("TargetKind =", target.Kind).Filter("TargetID =", target.ID)
+	_, getErr := Stores.Entities.GetAll(ctx, q, &grants)
+	sortGrants(grants)
+	return grants, getErr
+}
+
+func sortGrants(grants []Grant) {
+	sort.Slice(grants, func(i, j int) bool {
+		if grants[i].TargetKind != grants[j].TargetKind {
+			return grants[i].TargetKind > grants[j].TargetKind // Catalogs first
+		}
+		if grants[i].TargetID != grants[j].TargetID {
+			return grants[i].TargetID < grants[j].TargetID
+		}
+		return grants[i].Email < grants[j].Email
+	})
+}
+
+// Internal Function
+// Description:
+// Removes every grant held by user uid. Used when a user is deleted.
+func DeleteGrantsForUser(ctx context.Context, uid int64) error {
+	keys, getErr := Stores.Entities.GetAll(ctx, NewEntityQuery(GrantsTable).Filter("UID =", uid), nil)
+	if getErr != nil || len(keys) == 0 {
+		return getErr
+	}
+	return Stores.Entities.Delete(ctx, keys)
+}
+
+// Internal Function
+// Description:
+// Collects the keys of every grant on the given targets, so they can be
+// deleted together with the structures.
+func GetGrantKeysForTargets(ctx context.Context, targets ...Scope) []EntityKey {
+	keys := make([]EntityKey, 0)
+	for _, t := range targets {
+		q := NewEntityQuery(GrantsTable).Filter("TargetKind =", t.Kind).Filter("TargetID =", t.ID)
+		if k, getErr := Stores.Entities.GetAll(ctx, q, nil); getErr == nil {
+			keys = append(keys, k...)
+		}
+	}
+	return keys
+}
+
+// ------------------------------------
+// Handlers
+/////
+
+// Call: /admin/getGrants
+// Description:
+// This call lists grants, either those held by Option:UEmail
+// or those on the structure at Option:Kind and Option:ID.
+//
+// Method: GET
+// Results: JSON
+// Mandatory Options: UEmail OR {Kind, ID}
+// Optional Options:
+// Codes:
+//      0 - Success, All actions completed
+//    400 - Failure, Invalid Parameter
+//    500 - Failure, Internal Services Error
+func ADMIN_GET_GRANTS(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if validPerm, permErr := HasPermission(res, req, AdminPermissions); !validPerm {
+		// User Must be at least Admin.
+		http.Error(res, permErr.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ctx := NewContext(req)
+	var grants []Grant
+	var getErr error
+
+	if uEmail := strings.ToLower(req.FormValue("UEmail")); uEmail != "" {
+		uid, loginErr := GetUIDFromLogin(ctx, uEmail)
+		if loginErr != nil {
+			fmt.Fprint(res, `{"Status":"Failure","Reason":"Email not found: `+loginErr.Error()+`","Code":500}`)
+			return
+		}
+		grants, getErr = GetGrantsForUser(ctx, uid)
+	} else if target := ScopeOf(req.FormValue("Kind"), req.FormValue("ID")); target.ID != 0 {
+		grants, getErr = GetGrantsForTarget(ctx, target)
+	} else {
+		fmt.Fprint(res, `{"Status":"Failure","Reason":"Missing UEmail or Kind and ID.","Code":400}`)
+		return
+	}
+
+	if getErr != nil {
+		fmt.Fprint(res, `{"Status":"Failure","Reason":"`, getErr.Error(), `","Code":500}`)
+		return
+	}
+	ServeJsonOfStruct(res, JsonOptions{
+		Status: "Success",
+		Reason: "",
+		Code:   0,
+	}, grants)
+}
+
+// Call: /admin/setGrant
+// Description:
+// This call gives a user a role on one catalog or book.
+// Mandatory:Kind is Catalog or Book, Mandatory:Role is Reader, Editor, Writer, or Owner.
+// A user holds one role per target; setting a new role replaces the old one.
+//
+// Method: POST
+// Results: JSON
+// Mandatory Options: UEmail, Kind, ID, Role
+// Optional Options:
+// Codes:
+//      0 - Success, All actions completed
+//    400 - Failure, Invalid Parameter
+//    500 - Failure, Internal Services Error
+func ADMIN_POST_SETGRANT(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if validPerm, permErr := HasPermission(res, req, AdminPermissions); !validPerm {
+		// User Must be at least Admin.
+		http.Error(res, permErr.Error(), http.StatusUnauthorized)
+		return
+	}
+	admin, _ := GetUserFromRequest(res, req)
+
+	ctx := NewContext(req)
+
+	uid, loginErr := GetUIDFromLogin(ctx, strings.ToLower(req.FormValue("UEmail")))
+	if loginErr != nil {
+		fmt.Fprint(res, `{"Status":"Failure","Reason":"Email not found: `+loginErr.Error()+`","Code":500}`)
+		return
+	}
+	u, getErr := GetUserFromDatastore(ctx, uid)
+	if getErr != nil {
+		fmt.Fprint(res, `{"Status":"Failure","Reason":"User cannot be retrived: `+getErr.Error()+`","Code":500}`)
+		return
+	}
+
+	target := ScopeOf(req.FormValue("Kind"), req.FormValue("ID"))
+	prior, _ := GetGrant(ctx, uid, target)
+
+	g, grantErr := SetGrant(ctx, u, target, req.FormValue("Role"), admin.Email)
+	if grantErr == ErrUnknownRole || grantErr == ErrInvalidGrantScope {
+		fmt.Fprint(res, `{"Status":"Failure","Reason":"`, grantErr.Error(), `","Code":400}`)
+		return
+	} else if grantErr != nil {
+		fmt.Fprint(res, `{"Status":"Failure","Reason":"Grant cannot be stored: `, grantErr.Error(), `","Code":500}`)
+		return
+	}
+	RecordAudit(res, req, AuditGrant, target.Kind, target.ID, prior, g)
+
+	ServeJsonOfStruct(res, JsonOptions{
+		Status: "Success",
+		Reason: "",
+		Code:   0,
+	}, g)
+}
+
+// Call: /admin/deleteGrant
+// Description:
+// This call removes a user's role on one catalog or book.
+//
+// Method: POST
+// Results: JSON
+// Mandatory Options: UEmail, Kind, ID
+// Optional Options:
+// Codes:
+//      0 - Success, All actions completed
+//    400 - Failure, Invalid Parameter
+//    500 - Failure, Internal Services Error
+func ADMIN_POST_DELETEGRANT(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if validPerm, permErr := HasPermission(res, req, AdminPermissions); !validPerm {
+		// User Must be at least Admin.
+		http.Error(res, permErr.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	target := ScopeOf(req.FormValue("Kind"), req.FormValue("ID"))
+	if (target.Kind != "Catalog" && target.Kind != "Book") || target.ID == 0 {
+		fmt.Fprint(res, `{"Status":"Failure","Reason":"`, ErrInvalidGrantScope.Error(), `","Code":400}`)
+		return
+	}
+
+	ctx := NewContext(req)
+
+	uid, loginErr := GetUIDFromLogin(ctx, strings.ToLower(req.FormValue("UEmail")))
+	if loginErr != nil {
+		fmt.Fprint(res, `{"Status":"Failure","Reason":"Email not found: `+loginErr.Error()+`","Code":500}`)
+		return
+	}
+
+	prior, _ := GetGrant(ctx, uid, target)
+	if delErr := DeleteGrant(ctx, uid, target); delErr != nil {
+		fmt.Fprint(res, `{"Status":"Failure","Reason":"`, delErr.Error(), `","Code":500}`)
+		return
+	}
+	if prior != nil {
+		RecordAudit(res, req, AuditRevoke, target.Kind, target.ID, prior, nil)
+	}
+	fmt.Fprint(res, `{"Status":"Success","Reason":"","Code":0}`)
+}
@@ -9,7 +9,9 @@ filename.go by Allen J. Mills
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 )
 
 var (
@@ -35,22 +37,80 @@ const (
 	AdminPermissions = iota
 )
 
+// Internal Function
+// Description:
+// Parses a permission level by name: Read, Edit, Write, or Admin.
+// Case does not matter.
+//
+// Returns:
+//      level(int) - Matching permission level
+//      failure?(error) - If name is not a permission level.
+func PermissionFromString(name string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "read":
+		return ReadPermissions, nil
+	case "edit":
+		return EditPermissions, nil
+	case "write":
+		return WritePermissions, nil
+	case "admin":
+		return AdminPermissions, nil
+	}
+	return ReadPermissions, fmt.Errorf("Permission Error: Unknown permission level %q.", name)
+}
+
+// Internal Function
+// Description:
+// The name of a permission level, as accepted by PermissionFromString.
+func PermissionName(level int) string {
+	switch level {
+	case ReadPermissions:
+		return "Read"
+	case EditPermissions:
+		return "Edit"
+	case WritePermissions:
+		return "Write"
+	case AdminPermissions:
+		return "Admin"
+	}
+	return fmt.Sprint(level)
+}
+
 // Internal Function
 // Description:
 // Given a response, request, and minimum permission level.
 // This function will return a boolean if the current user
 // does or does not meet the requirement.
+// When scopes are given the user must meet the requirement on each
+// non-zero one, either globally or through a grant on its book or
+// catalog, see USER_Grants.go.
 //
 // Returns:
 //      valid?(bool) - True/False if user meets requirement
 //      failure?(error) - Any errors are stored here if exists.
-func HasPermission(res http.ResponseWriter, req *http.Request, minimumRequiredPermission int) (bool, error) {
-	u, sessErr := GetUserFromSession(res, req)
-	if sessErr != nil {
-		return false, sessErr
+func HasPermission(res http.ResponseWriter, req *http.Request, minimumRequiredPermission PermissionLevel, scopes ...Scope) (bool, error) {
+	u, authErr := GetUserFromRequest(res, req)
+	if authErr != nil {
+		return false, authErr
+	}
+
+	ctx := NewContext(req)
+	scoped := false
+	for _, s := range scopes {
+		if s.ID == 0 {
+			continue
+		}
+		scoped = true
+		level, levelErr := EffectivePermission(ctx, u, s)
+		if levelErr != nil {
+			return false, levelErr
+		}
+		if level < int(minimumRequiredPermission) {
+			return false, ErrInvalidPermission
+		}
 	}
 
-	if u.Permission >= minimumRequiredPermission {
+	if scoped || u.Permission >= int(minimumRequiredPermission) {
 		return true, nil
 	}
 	return false, ErrInvalidPermission
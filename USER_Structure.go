@@ -10,7 +10,6 @@ filename.go by Allen J. Mills
 import (
 	"encoding/json"
 	"golang.org/x/net/context"
-	"google.golang.org/appengine/datastore"
 	"strings"
 )
 
@@ -30,17 +29,15 @@ type User struct {
 	Name       string
 	Email      string
 	Permission int
-	ID         int64 `datastore:"-"`
+	ID         int64     `datastore:"-"`
+	CSRFToken  string    `datastore:"-" json:"-"` // Set for the session's own user, for templates to embed.
+	Token      *APIToken `datastore:"-" json:"-"` // Set when authenticated by API token, whose scope caps every permission.
 }
 
-// Method: Key
-// Implements Retrivable interface
-func (u *User) Key(ctx context.Context, id interface{}) *datastore.Key {
-	return datastore.NewKey(ctx, UsersTable, "", id.(int64), nil)
-}
-
-func (u *User) StoreKey(k *datastore.Key) {
-	u.ID = k.IntID()
+// Method: Kind
+// Implements Entity interface
+func (u *User) Kind() string {
+	return UsersTable
 }
 
 // ToString
@@ -63,3 +60,34 @@ func MakeUser(name, email string) User {
 		Email: strings.ToLower(email),
 	}
 }
+
+// Internal Function
+// Description:
+// Retrieves the user stored at uid.
+//
+// Returns:
+//      user(*User) - Stored user with ID set.
+//      failure?(error) - If any errors occur they exist here.
+func GetUserFromDatastore(ctx context.Context, uid int64) (*User, error) {
+	u := &User{}
+	if getErr := GetFromDatastore(ctx, uid, u); getErr != nil {
+		return &User{}, getErr
+	}
+	u.ID = uid
+	return u, nil
+}
+
+// Internal Function
+// Description:
+// Stores u, allocating an id for new users. u.ID is updated.
+//
+// Returns:
+//      failure?(error) - If any errors occur they exist here.
+func PlaceUserInDatastore(ctx context.Context, u *User) error {
+	uid, putErr := PlaceInDatastore(ctx, u.ID, u)
+	if putErr != nil {
+		return putErr
+	}
+	u.ID = uid
+	return nil
+}
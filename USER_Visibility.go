@@ -0,0 +1,166 @@
+package main
+
+/*
+USER_Visibility.go by Allen J. Mills
+    mm.d.yy
+
+    Who may read a book.
+        public   - anyone, listed in /api/books.json
+        unlisted - anyone with a link, not listed
+        private  - only staff, users with a grant, and share links
+    Staff are users whose own level is Edit or above. A grant of any
+    role on the book or its catalog also counts, see USER_Grants.go.
+    Share links, see AUTH_share.go, open a single private book to
+    anyone holding the link until it expires.
+
+    Everything below a book (chapters, sections, objectives, exercises,
+    and their images) has the visibility of the book. Catalogs are
+    always readable.
+*/
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrUnknownVisibility = errors.New("Visibility: Unknown visibility. Use public, unlisted, or private.") // ErrUnknownVisibility is returned when parsing a visibility fails.
+	ErrNotVisible        = errors.New("Visibility: Not found.")                                            // ErrNotVisible is returned for structures the reader may not see. It does not reveal that they exist.
+)
+
+const (
+	// Book visibilities.
+	VisibilityPublic   = "public"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPrivate  = "private"
+)
+
+// Internal Function
+// Description:
+// Parses a visibility by name, case does not matter.
+//
+// Returns:
+//      visibility(string) - One of the Visibility constants.
+//      failure?(error) - ErrUnknownVisibility
+func ParseVisibility(name string) (string, error) {
+	switch v := strings.ToLower(strings.TrimSpace(name)); v {
+	case VisibilityPublic, VisibilityUnlisted, VisibilityPrivate:
+		return v, nil
+	}
+	return "", ErrUnknownVisibility
+}
+
+// Method: GetVisibility
+// The book's visibility, treating books saved before visibility existed as public.
+func (b Book) GetVisibility() string {
+	if v, err := ParseVisibility(b.Visibility); err == nil {
+		return v
+	}
+	return VisibilityPublic
+}
+
+// Type: ReadChecker
+// Answers visibility questions for one request. Decisions are cached,
+// so checking every item of a list only looks up each parent once.
+type ReadChecker struct {
+	ctx    context.Context
+	res    http.ResponseWriter
+	req    *http.Request
+	user   *User // nil when not logged in, found on first use
+	looked bool
+	scopes map[Scope]bool
+	books  map[int64]bool
+}
+
+// Internal Function
+// Description:
+// Makes a ReadChecker for the request. The user, if any, is only
+// looked up once a non-public book is met.
+func NewReadChecker(res http.ResponseWriter, req *http.Request) *ReadChecker {
+	return &ReadChecker{
+		ctx:    NewContext(req),
+		res:    res,
+		req:    req,
+		scopes: make(map[Scope]bool),
+		books:  make(map[int64]bool),
+	}
+}
+
+// Method: CanRead
+// Reports whether the structure at s may be read. The zero Scope and
+// structures outside any book are always readable.
+func (rc *ReadChecker) CanRead(s Scope) bool {
+	if s.ID == 0 {
+		return true
+	}
+	if ok, seen := rc.scopes[s]; seen {
+		return ok
+	}
+
+	ok := false
+	if catalogID, bookID, resolveErr := ResolveScope(rc.ctx, s); resolveErr == nil {
+		ok = bookID == 0 || rc.canReadBook(catalogID, bookID)
+	}
+	rc.scopes[s] = ok
+	return ok
+}
+
+// Method: Listed
+// Reports whether b belongs in a listing of books. Unlisted and private
+// books are only listed for readers who could read them if private.
+func (rc *ReadChecker) Listed(b Book) bool {
+	if b.GetVisibility() == VisibilityPublic {
+		return true
+	}
+	return rc.canReadHidden(b.Parent, b.ID)
+}
+
+func (rc *ReadChecker) canReadBook(catalogID, bookID int64) bool {
+	if ok, seen := rc.books[bookID]; seen {
+		return ok
+	}
+
+	b := &Book{}
+	ok := false
+	if getErr := GetFromDatastore(rc.ctx, bookID, b); getErr == nil {
+		ok = b.GetVisibility() != VisibilityPrivate || rc.canReadHidden(catalogID, bookID)
+	}
+	rc.books[bookID] = ok
+	return ok
+}
+
+// Method: canReadHidden
+// Staff, users granted a role, and holders of a share link may read
+// books that are not public.
+func (rc *ReadChecker) canReadHidden(catalogID, bookID int64) bool {
+	if !rc.looked {
+		if u, authErr := GetUserFromRequest(rc.res, rc.req); authErr == nil {
+			rc.user = u
+		}
+		rc.looked = true
+	}
+	if rc.user != nil {
+		if rc.user.Permission >= EditPermissions {
+			return true
+		}
+		if _, found, _ := GrantLevel(rc.ctx, rc.user.ID, catalogID, bookID); found {
+			return true
+		}
+	}
+	return HasShareAccess(rc.ctx, rc.req, bookID)
+}
+
+// Internal Function
+// Description:
+// Shorthand for checking one structure at the top of a reader handler.
+//
+// Returns:
+//      failure?(error) - ErrNotVisible when s may not be read.
+func CheckReadable(res http.ResponseWriter, req *http.Request, s Scope) error {
+	if !NewReadChecker(res, req).CanRead(s) {
+		return ErrNotVisible
+	}
+	return nil
+}
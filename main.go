@@ -11,9 +11,15 @@ import (
 // These templates should be called using ServeTemplateWithParams()
 var pages *template.Template
 
-func init() {
+// Internal Function
+// Description:
+// Builds the full site handler: every url route, the public file server,
+// and our templates. Both the App Engine and standalone entrypoints serve this.
+//
+// Returns:
+//      handler(http.Handler) - Root handler for the site.
+func NewHandler() http.Handler {
 	r := httprouter.New()
-	http.Handle("/", r)
 	r.PanicHandler = HandlePanic
 
 	//// ---------------------------------------------------------- //
@@ -53,6 +59,22 @@ func init() {
 	r.POST("/register", AUTH_Register_POST)               // <user><auth> Post to make the new user
 	r.GET("/user", AUTH_UserInfo)                         // <user><auth><DEBUG> DEBUG user info
 
+	// Module: API Tokens
+	// Files: AUTH_tokens.go
+	/****************************************************/
+	r.GET("/user/tokens", AUTH_TokensPage)       // <user><auth> Manage personal API tokens
+	r.GET("/api/tokens.json", API_GetTokens)     // <api><auth> list caller's API tokens
+	r.POST("/api/create/token", API_MakeToken)   // <api><auth> create API token, session only
+	r.POST("/api/revoke/token", API_RevokeToken) // <api><auth> revoke API token
+
+	// Module: Share Links
+	// Files: AUTH_share.go
+	/****************************************************/
+	r.GET("/share/:TOKEN", AUTH_OpenShareLink)       // <user> open a share link to a private book
+	r.GET("/api/shares.json", API_GetShareLinks)     // <api><auth> list share links of a book
+	r.POST("/api/create/share", API_MakeShareLink)   // <api><auth> create share link for a book
+	r.POST("/api/revoke/share", API_RevokeShareLink) // <api><auth> revoke share link
+
 	// Module: Structure Readers
 	// Files: main.go, STRUCT_Handlers.go
 	/*****************************************************/
@@ -71,11 +93,19 @@ func init() {
 	r.GET("/edit/objective/:ID", getSimpleObjectiveEditor) // <user><auth> edit objective given id
 
 	// Module: Structure Parser
-	// Files: PARSE_BookParser.go
-	/************************************************/
-	r.GET("/export/:ID", exportBookToScreen)        // <user><DEBUG>
-	r.GET("/import/book", PARSE_GET_FileUploader)   // <DEBUG>
-	r.POST("/import/book", PARSE_POST_FileUploader) // <DEBUG
+	// Files: PARSE_BookParser.go, PARSE_BookMerge.go, PARSE_BookBundle.go, PARSE_BookEpub.go,
+	//        PARSE_BookCartridge.go, PARSE_ExercisesQTI.go, PARSE_ExercisesMoodle.go,
+	//        PARSE_BookMarkdown.go, PARSE_Markdown.go, PARSE_BookDocx.go
+	/********************************************************/
+	r.GET("/export/:ID", exportBookToScreen)                 // <user> book as HTML, or with format=epub/imscc/docx/markdown/moodle/gift
+	r.GET("/bundle/:ID", exportBookBundle)                   // <user> book and its images as a zip
+	r.GET("/import/book", PARSE_GET_FileUploader)            // <DEBUG>
+	r.POST("/import/book", PARSE_POST_FileUploader)          // <DEBUG
+	r.POST("/import/book/validate", PARSE_POST_ValidateBook) // <api><auth> check a book file, store nothing
+	r.POST("/import/book/merge", PARSE_POST_MergeBook)       // <api><auth> merge a book file into a book, previewed first
+	r.GET("/api/exercises.zip", exportExercisesQTI)          // <api> exercises as a QTI 2.1 package, filtered like exercises.json
+	r.GET("/api/exercises.xml", exportExercisesMoodleXML)    // <api> exercises as Moodle XML, filtered like exercises.zip
+	r.GET("/api/exercises.gift", exportExercisesGIFT)        // <api> exercises as GIFT, filtered like exercises.zip
 
 	// Module: Images
 	// Files: Images.go
@@ -120,6 +150,14 @@ func init() {
 	r.POST("/api/create/objective", API_MakeObjective) // <api><auth> create datastore, objective
 	r.POST("/api/create/exercise", API_MakeExercise)   // <api><auth> create datastore, exercise
 
+	// Module: Revision History
+	// Files: STRUCT_revisions.go
+	/************************************************/
+	r.GET("/api/revisions.json", API_GetRevisions)       // <api><auth> list revisions of a structure
+	r.GET("/api/revision.json", API_GetRevision)         // <api><auth> one revision with its fields
+	r.GET("/api/revision/diff.json", API_DiffRevisions)  // <api><auth> changed fields between two revisions
+	r.POST("/api/restore/revision", API_RestoreRevision) // <api><auth> put an old revision back
+
 	// Module: API-Deleters
 	// Files: API_Deleters.go
 	/****************************************************/
@@ -129,6 +167,16 @@ func init() {
 	r.POST("/api/delete/section", API_DeleteSection)     // <api><auth> delete datastore, section
 	r.POST("/api/delete/objective", API_DeleteObjective) // <api><auth> delete datastore, objective
 	r.POST("/api/delete/exercise", API_DeleteExercise)   // <api><auth> delete datastore, exercise
+	r.GET("/api/delete/preview.json", API_DeletePreview) // <api><auth> what a delete would remove, and its Confirm token
+
+	// Module: Trash
+	// Files: STRUCT_trash.go
+	/************************************************************/
+	r.GET("/admin/trash", ADMIN_TrashPage)                          // <user><auth> Admin: Trash page
+	r.GET("/admin/trash.json", ADMIN_GET_TRASH)                     // <api><auth> Admin: List deleted structures
+	r.POST("/admin/trash/restore", ADMIN_POST_RESTORETRASH)         // <api><auth> Admin: Put a deleted structure back
+	r.POST("/admin/trash/purge", ADMIN_POST_PURGETRASH)             // <api><auth> Admin: Remove a deleted structure for good
+	r.GET("/admin/trash/purgeExpired", ADMIN_GET_PURGEEXPIREDTRASH) // <api><auth><cron> Purge trash past Trash.Retention
 
 	// Module: Administration, Console and Commands
 	// Files: ADMIN_administration.go
@@ -140,11 +188,28 @@ func init() {
 	r.POST("/admin/getUsrEmails", ADMIN_POST_RetriveUserEmails) //
 	r.POST("/admin/createInviteUUID", ADMIN_POST_INVITEUUID)    //
 
+	// Module: Access Control, Catalog and Book grants
+	// Files: USER_Grants.go
+	/************************************************************/
+	r.GET("/admin/getGrants", ADMIN_GET_GRANTS)          // <api><auth> Admin: List grants of a user or on a catalog/book
+	r.POST("/admin/setGrant", ADMIN_POST_SETGRANT)       // <api><auth> Admin: Give a user a role on a catalog/book
+	r.POST("/admin/deleteGrant", ADMIN_POST_DELETEGRANT) // <api><auth> Admin: Remove a user's role on a catalog/book
+
+	// Module: Audit Log
+	// Files: ADMIN_audit.go
+	/************************************************************/
+	r.GET("/admin/audit", ADMIN_AuditPage)      // <user><auth> Admin: Audit log page
+	r.GET("/admin/audit.json", ADMIN_GET_AUDIT) // <api><auth> Admin: Audit entries filtered by user, entity and date
+
+	mux := http.NewServeMux()
+	mux.Handle("/", r)
+
 	// Public file handling.
-	http.Handle("/public/", http.StripPrefix("/public", http.FileServer(http.Dir("public/"))))
+	mux.Handle("/public/", http.StripPrefix("/public", http.FileServer(http.Dir("public/"))))
 
 	// Prepare templates.
-	pages = template.Must(pages.ParseGlob("templates/*.*"))
+	pages = template.Must(template.New("pages").Funcs(exportFuncs).ParseGlob("templates/*.*"))
+	return mux
 }
 
 // ------------------------------------
@@ -197,23 +262,34 @@ func getKeytakeawaysPage(res http.ResponseWriter, req *http.Request, params http
 //
 // Mandatory:ID has no requirements on this level. Sub levels will
 // require that objective ID exists and is a well-formatted integer.
+// Private books are only shown to readers allowed to see them.
+// Permission is the user's level on this book, including grants.
 //
 // Method: GET
 // Results: HTML
 // Mandatory Options: ID
 // Optional Options:
 func getSimpleTOC(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	pu, _ := GetUserFromSession(res, req)
+	if ErrorPage(res, "Book Not Found", CheckReadable(res, req, ScopeOf("Book", params.ByName("ID")))) {
+		return
+	}
+
+	pu, sessErr := GetUserFromSession(res, req)
+	if sessErr == nil {
+		pu.Permission, _ = EffectivePermission(NewContext(req), pu, ScopeOf("Book", params.ByName("ID")))
+	}
 
 	screenOutput := struct {
 		Name       string
 		Email      string
 		Permission int
+		CSRFToken  string
 		ID         string
 	}{
 		pu.Name,
 		pu.Email,
 		pu.Permission,
+		pu.CSRFToken,
 		params.ByName("ID"),
 	}
 
@@ -0,0 +1,32 @@
+//go:build appengine
+// +build appengine
+
+package main
+
+/*
+main_appengine.go by Allen J. Mills
+    mm.d.yy
+
+    Entrypoint for the App Engine go1 runtime. The runtime owns the
+    http server, so we only load settings and register our handler with it.
+*/
+
+import (
+	"log"
+	"net/http"
+)
+
+// Defaults for DefaultSettings when built for App Engine.
+const (
+	defaultBackend  = "appengine"
+	defaultIdentity = "appengine"
+
+	cronHeaderTrusted = true // App Engine strips X-Appengine-Cron from outside requests.
+)
+
+func init() {
+	if err := LoadSettings(""); err != nil {
+		log.Fatal(err)
+	}
+	http.Handle("/", NewHandler())
+}
@@ -0,0 +1,112 @@
+//go:build !appengine
+// +build !appengine
+
+package main
+
+/*
+main_standalone.go by Allen J. Mills
+    mm.d.yy
+
+    Entrypoint for running outside of App Engine, on our own
+    machines or in a container. Run from the project directory
+    so templates/ and public/ can be found.
+
+    Settings come from config.json and the environment (see
+    CONFIG_settings.go); a few can also be given as flags.
+
+    Example:
+        go build -o textbook . && ./textbook -addr :8080 -backend file -data ./data
+*/
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Defaults for DefaultSettings when running standalone.
+const (
+	defaultBackend  = "file"
+	defaultIdentity = "header"
+
+	cronHeaderTrusted = false // Anyone can send X-Appengine-Cron here.
+)
+
+func main() {
+	configPath := flag.String("config", "", "Settings file. Defaults to $TEXTBOOK_CONFIG, then config.json if present.")
+	addr := flag.String("addr", "", "Address to listen on, overrides Server.Addr.")
+	backend := flag.String("backend", "", "Storage backend, overrides Storage.Backend: memory, file, or appengine.")
+	dataDir := flag.String("data", "", "Data directory for the file backend, overrides Storage.DataDir.")
+	flag.Parse()
+
+	cfg, cfgErr := ReadSettings(*configPath)
+	if cfgErr != nil {
+		log.Fatal(cfgErr)
+	}
+	// Command line flags win over the file and environment.
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			cfg.Server.Addr = *addr
+		case "backend":
+			cfg.Storage.Backend = *backend
+		case "data":
+			cfg.Storage.DataDir = *dataDir
+		}
+	})
+	if err := cfg.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if err := ApplySettings(cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	srv := &http.Server{
+		Addr:    Settings.Server.Addr,
+		Handler: NewHandler(),
+	}
+
+	// Purge old trash, which App Engine does from cron.yaml.
+	go func() {
+		for now := range time.Tick(Settings.Trash.PurgeInterval.Duration) {
+			if purged, err := PurgeExpiredTrash(context.Background(), now); err != nil {
+				log.Printf("trash purge: %v", err)
+			} else if purged > 0 {
+				log.Printf("trash purge: removed %d deleted structures", purged)
+			}
+		}
+	}()
+
+	// Stop accepting connections on SIGINT/SIGTERM and let active requests finish.
+	idle := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		timeout := Settings.Server.ShutdownTimeout.Duration
+		log.Printf("shutting down, waiting up to %v for active requests", timeout)
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+		close(idle)
+	}()
+
+	log.Printf("serving on %s with %s storage and %s identity", srv.Addr, Stores.Name, Settings.Identity.Provider)
+	if Settings.Identity.Provider == "header" {
+		log.Printf("WARNING: anyone connecting from %s can log in as any user by sending %s; only the authenticating proxy may connect from there",
+			strings.Join(Settings.Identity.TrustedProxies, ", "), Settings.Identity.Header)
+	}
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-idle
+}
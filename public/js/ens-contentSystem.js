@@ -2,6 +2,18 @@
        return window.setTimeout( callback, seconds * 1000 );
     }
 
+// csrf token for state changing requests, placed on the page by the Nav template
+function csrfToken(){
+    return $('meta[name="csrf-token"]').attr('content') || '';
+}
+
+// every ajax request carries the token, the server ignores it on GETs
+$.ajaxSetup({
+    beforeSend: function(xhr){
+        xhr.setRequestHeader('X-CSRF-Token', csrfToken());
+    }
+});
+
 // no images ckeditor config
 var noImagesConfig = {
   	extraPlugins: 'mathjax',
@@ -15,9 +27,9 @@ var noImagesConfig = {
             extraPlugins: 'mathjax',
             mathJaxLib: 'https://cdn.mathjax.org/mathjax/2.6-latest/MathJax.js?config=TeX-AMS_HTML',
             filebrowserImageBrowseUrl: '/image/browser?action=browseImageURL&oid='+argID,
-            filebrowserImageUploadUrl: '/api/ckeditor/create?action=uploadImageURL&oid='+argID,
+            filebrowserImageUploadUrl: '/api/ckeditor/create?action=uploadImageURL&oid='+argID+'&csrf_token='+encodeURIComponent(csrfToken()),
             filebrowserBrowseUrl: '/image/browser?action=browseURL&oid='+argID,
-            filebrowserUploadUrl: '/api/ckeditor/create?action=uploadURL&oid='+argID,
+            filebrowserUploadUrl: '/api/ckeditor/create?action=uploadURL&oid='+argID+'&csrf_token='+encodeURIComponent(csrfToken()),
             removePlugins: 'forms',
             skin: 'icy_orange,/public/icy_orange/'
     };
@@ -51,4 +63,24 @@ function ensBreadcrumb(entity,id){
   });
   return promise;
 
-}
\ No newline at end of file
+}
+
+// asks the server what deleting kind/id would remove and lists it in target.
+// the delete call must send back the Confirm token, kept on target as data('confirm').
+function ensDeletePreview(kind,id,target){
+  $(target).removeData('confirm').text('Checking what will be deleted...');
+  $.get('/api/delete/preview.json',{Kind:kind,ID:id},function(data){
+      var p = $.parseJSON(data);
+      if (p.Status != "Success"){ $(target).text(p.Reason); return; }
+      var list = $('<ul/>');
+      $.each(p.Results.Counts,function(k,n){
+          list.append($('<li/>').text(n+' '+k));
+      });
+      var files = $('<ul/>');
+      $.each(p.Results.Files,function(i,f){
+          files.append($('<li/>').text(f));
+      });
+      list.append($('<li/>').text(p.Results.Files.length+' Images').append(files));
+      $(target).html('<p><strong>This will delete:</strong></p>').append(list).data('confirm',p.Results.Token);
+  });
+}